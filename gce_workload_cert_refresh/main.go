@@ -27,6 +27,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
@@ -158,6 +160,10 @@ func main() {
 	}
 
 	opts.Writers = []io.Writer{os.Stderr}
+	// The configuration is only used for the log format, falling back to text.
+	if err := cfg.Load(nil); err == nil {
+		opts.FormatFunction = logfields.FormatFunction(cfg.Get().Logging.Format, programName, opts.FormatFunction)
+	}
 
 	if err := logger.Init(ctx, opts); err != nil {
 		fmt.Printf("Error initializing logger: %v", err)
@@ -27,6 +27,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -35,6 +37,8 @@ import (
 var (
 	client      metadata.MDSClientInterface
 	programName = path.Base(os.Args[0])
+	// keyPolicy is the policy the metadata SSH keys must comply with.
+	keyPolicy utils.KeyPolicy
 )
 
 func init() {
@@ -70,6 +74,14 @@ func parseSSHKeys(username string, keys []string) []string {
 		}
 
 		if user == username {
+			if err := keyPolicy.Check(keyVal); err != nil {
+				fingerprint, fpErr := utils.KeyFingerprint(keyVal)
+				if fpErr != nil {
+					fingerprint = "(invalid key)"
+				}
+				logger.Warningf("SSH key %s of user %s rejected by policy: %v", fingerprint, username, err)
+				continue
+			}
 			keyList = append(keyList, keyVal)
 		}
 	}
@@ -154,7 +166,25 @@ func main() {
 	} else {
 		opts.Writers = []io.Writer{os.Stderr}
 	}
+	// With a broken configuration the key policy and the protected users are
+	// unknown, every key is refused rather than the ones the policy would reject
+	// accepted. Logging falls back to text.
+	loadErr := cfg.Load(nil)
+	if loadErr == nil {
+		opts.FormatFunction = logfields.FormatFunction(cfg.Get().Logging.Format, programName, opts.FormatFunction)
+	}
 	logger.Init(ctx, opts)
+	if loadErr != nil {
+		logger.Errorf("Refusing the metadata SSH keys of user %s, failed to load the configuration: %v", username, loadErr)
+		os.Exit(1)
+	}
+
+	config := cfg.Get().Accounts
+	keyPolicy = utils.NewKeyPolicy(config.KeyTypes, config.KeyMinRSABits, config.KeyRequireSecurityKey, config.KeyForbiddenOptions)
+	if reason := utils.ProtectedUser(username, strings.Split(config.ProtectedUsers, ","), config.ProtectedUIDThreshold); reason != "" {
+		logger.Warningf("Refusing the metadata SSH keys of user %s, %s.", username, reason)
+		return
+	}
 
 	instanceAttributes, err := getMetadataAttributes(ctx, "instance/attributes/")
 	if err != nil {
@@ -173,5 +203,11 @@ func main() {
 	}
 
 	userKeyList := getUserKeys(username, instanceAttributes, projectAttributes)
+	if utils.ExpiryTimeEnabled(ctx, config.ExpiryTimeOption) {
+		// Let sshd enforce the keys' expiration itself.
+		for i, key := range userKeyList {
+			userKeyList[i] = utils.AddExpiryTimeOption(key, time.Local)
+		}
+	}
 	fmt.Print(strings.Join(userKeyList, "\n"))
 }
@@ -75,6 +75,27 @@ func TestParseSSHKeys(t *testing.T) {
 
 }
 
+func TestParseSSHKeysPolicy(t *testing.T) {
+	oldPolicy := keyPolicy
+	t.Cleanup(func() { keyPolicy = oldPolicy })
+	keyPolicy = utils.KeyPolicy{MinRSABits: 256, ForbiddenOptions: []string{"command"}}
+
+	pubKey := utils.MakeRandRSAPubKey(t)
+	keys := []string{
+		fmt.Sprintf("usera:ssh-rsa %s", pubKey),
+		fmt.Sprintf(`usera:command="/bin/true" ssh-rsa %s`, pubKey),
+	}
+	want := []string{fmt.Sprintf("ssh-rsa %s", pubKey)}
+	if got := parseSSHKeys("usera", keys); !stringSliceEqual(got, want) {
+		t.Errorf("parseSSHKeys(usera, %v) = %v, want: %v", keys, got, want)
+	}
+
+	keyPolicy.MinRSABits = 2048
+	if got := parseSSHKeys("usera", keys); len(got) != 0 {
+		t.Errorf("parseSSHKeys(usera, %v) with 2048 bits RSA keys = %v, want: none", keys, got)
+	}
+}
+
 func TestCheckWinSSHEnabled(t *testing.T) {
 	tests := []struct {
 		instanceEnable *bool
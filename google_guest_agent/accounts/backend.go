@@ -0,0 +1,142 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accounts implements the backends managing the local user accounts and
+// groups: one running the configured useradd-style commands and a native one
+// editing the passwd, shadow, group and gshadow files itself.
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+const (
+	// BackendCommand is the name of the CommandBackend.
+	BackendCommand = "command"
+	// BackendNative is the name of the NativeBackend.
+	BackendNative = "native"
+)
+
+// ErrGroupExists is returned by CreateGroup if the group already exists.
+var ErrGroupExists = errors.New("group already exists")
+
+// Backend manages the local user accounts and groups.
+type Backend interface {
+	// CreateUser creates the user and its home directory, uid is the user's UID
+	// or empty to allocate one.
+	CreateUser(ctx context.Context, user, uid string) error
+	// DeleteUser removes the user and its home directory.
+	DeleteUser(ctx context.Context, user string) error
+	// CreateGroup creates the group, it returns ErrGroupExists if it already
+	// exists.
+	CreateGroup(ctx context.Context, group string) error
+	// AddUserToGroup adds the user to the group's members.
+	AddUserToGroup(ctx context.Context, user, group string) error
+	// RemoveUserFromGroup removes the user from the group's members.
+	RemoveUserFromGroup(ctx context.Context, user, group string) error
+	// LockUser locks the user's password and disables its login shell.
+	LockUser(ctx context.Context, user string) error
+	// UnlockUser unlocks the user's password and restores its login shell.
+	UnlockUser(ctx context.Context, user, shell string) error
+}
+
+// CommandBackend runs commands built from templates where {user} and {group}
+// are replaced by the user and group names, i.e. useradd -m {user}.
+type CommandBackend struct {
+	// UserAdd creates a user, "-u uid" is appended to set its UID.
+	UserAdd string
+	// UserDel removes a user and its home directory.
+	UserDel string
+	// GroupAdd creates a group, it must exit with code 9 if the group exists.
+	GroupAdd string
+	// GPasswdAdd adds a user to a group.
+	GPasswdAdd string
+	// GPasswdRemove removes a user from a group.
+	GPasswdRemove string
+	// Lock locks a user's password and disables its login shell.
+	Lock string
+	// Unlock unlocks a user's password and sets its login shell to {shell}.
+	Unlock string
+}
+
+// Command replaces {user} and {group} in the command template cmd and returns
+// the command's name and arguments. It supports the legacy python-era user
+// command overrides.
+func Command(cmd, user, group string) (string, []string) {
+	cmd = strings.Replace(cmd, "{user}", user, 1)
+	cmd = strings.Replace(cmd, "{group}", group, 1)
+
+	// We don't run the command here because we might need the exit codes.
+	tokens := strings.Fields(cmd)
+	return tokens[0], tokens[1:]
+}
+
+// CreateUser runs the UserAdd command.
+func (b *CommandBackend) CreateUser(ctx context.Context, user, uid string) error {
+	useradd := b.UserAdd
+	if uid != "" {
+		useradd = fmt.Sprintf("%s -u %s", useradd, uid)
+	}
+	name, args := Command(useradd, user, "")
+	return run.Quiet(ctx, name, args...)
+}
+
+// DeleteUser runs the UserDel command.
+func (b *CommandBackend) DeleteUser(ctx context.Context, user string) error {
+	name, args := Command(b.UserDel, user, "")
+	return run.Quiet(ctx, name, args...)
+}
+
+// CreateGroup runs the GroupAdd command.
+func (b *CommandBackend) CreateGroup(ctx context.Context, group string) error {
+	name, args := Command(b.GroupAdd, "", group)
+	ret := run.WithOutput(ctx, name, args...)
+	if ret.ExitCode == 9 {
+		// 9 means group already exists.
+		return ErrGroupExists
+	}
+	if ret.ExitCode != 0 {
+		return error(ret)
+	}
+	return nil
+}
+
+// AddUserToGroup runs the GPasswdAdd command.
+func (b *CommandBackend) AddUserToGroup(ctx context.Context, user, group string) error {
+	name, args := Command(b.GPasswdAdd, user, group)
+	return run.Quiet(ctx, name, args...)
+}
+
+// RemoveUserFromGroup runs the GPasswdRemove command.
+func (b *CommandBackend) RemoveUserFromGroup(ctx context.Context, user, group string) error {
+	name, args := Command(b.GPasswdRemove, user, group)
+	return run.Quiet(ctx, name, args...)
+}
+
+// LockUser runs the Lock command.
+func (b *CommandBackend) LockUser(ctx context.Context, user string) error {
+	name, args := Command(b.Lock, user, "")
+	return run.Quiet(ctx, name, args...)
+}
+
+// UnlockUser runs the Unlock command.
+func (b *CommandBackend) UnlockUser(ctx context.Context, user, shell string) error {
+	name, args := Command(strings.Replace(b.Unlock, "{shell}", shell, 1), user, "")
+	return run.Quiet(ctx, name, args...)
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// ParseIDRange parses a MIN-MAX range of UIDs or GIDs, both included.
+func ParseIDRange(value string) (int, int, error) {
+	minValue, maxValue, found := strings.Cut(strings.TrimSpace(value), "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid ID range %q, want MIN-MAX", value)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(minValue))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ID range %q, want MIN-MAX", value)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxValue))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ID range %q, want MIN-MAX", value)
+	}
+	if min <= 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid ID range %q, want 0 < MIN <= MAX", value)
+	}
+	return min, max, nil
+}
+
+// HashID returns a stable ID between min and max, both included, derived from
+// a hash of name, so that a user gets the same UID on every instance. If used
+// reports the ID as taken, the next ones are tried in turn, wrapping around
+// the range.
+func HashID(name string, min, max int, used func(int) bool) (int, error) {
+	if min <= 0 || max < min {
+		return 0, fmt.Errorf("invalid ID range %d-%d", min, max)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	size := uint64(max - min + 1)
+	start := uint64(h.Sum32()) % size
+
+	for i := uint64(0); i < size; i++ {
+		id := min + int((start+i)%size)
+		if !used(id) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ID between %d and %d", min, max)
+}
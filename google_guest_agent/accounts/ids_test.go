@@ -0,0 +1,66 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"testing"
+)
+
+func TestParseIDRange(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max int
+		wantErr  bool
+	}{
+		{value: "200000-299999", min: 200000, max: 299999},
+		{value: " 1000 - 1000 ", min: 1000, max: 1000},
+		{value: "1000", wantErr: true},
+		{value: "0-1000", wantErr: true},
+		{value: "2000-1000", wantErr: true},
+		{value: "a-b", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		min, max, err := ParseIDRange(tc.value)
+		if (err != nil) != tc.wantErr || min != tc.min || max != tc.max {
+			t.Errorf("ParseIDRange(%q) = %d, %d, %v, want: %d, %d, error: %t", tc.value, min, max, err, tc.min, tc.max, tc.wantErr)
+		}
+	}
+}
+
+func TestHashID(t *testing.T) {
+	none := func(int) bool { return false }
+	id, err := HashID("alice", 2000, 2009, none)
+	if err != nil {
+		t.Fatalf("HashID(alice) = %v, want: nil", err)
+	}
+	if id < 2000 || id > 2009 {
+		t.Errorf("HashID(alice) = %d, want: between 2000 and 2009", id)
+	}
+	if again, _ := HashID("alice", 2000, 2009, none); again != id {
+		t.Errorf("HashID(alice) = %d then %d, want: stable", id, again)
+	}
+
+	// Collisions are resolved with the next free ID, wrapping around the range.
+	taken := map[int]bool{id: true, 2000 + (id-2000+1)%10: true}
+	want := 2000 + (id-2000+2)%10
+	if got, err := HashID("alice", 2000, 2009, func(id int) bool { return taken[id] }); err != nil || got != want {
+		t.Errorf("HashID(alice) with %v taken = %d, %v, want: %d, nil", taken, got, err, want)
+	}
+
+	if _, err := HashID("alice", 2000, 2009, func(int) bool { return true }); err == nil {
+		t.Errorf("HashID(alice) with every ID taken = nil, want: error")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package accounts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// databaseMu serializes the agent's own updates, fcntl locks don't exclude
+// other file descriptors of the same process.
+var databaseMu sync.Mutex
+
+// lockDatabase takes the write lock on path like lckpwdf(3) does, so that the
+// shadow utilities and other lckpwdf users don't edit the database concurrently.
+// It gives up after timeout. The returned function releases the lock.
+func lockDatabase(ctx context.Context, path string, timeout time.Duration) (func(), error) {
+	databaseMu.Lock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		databaseMu.Unlock()
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	deadline := time.Now().Add(timeout)
+	for err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock); err != nil; err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock) {
+		if err != syscall.EAGAIN && err != syscall.EACCES && err != syscall.EINTR {
+			break
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("timed out after %s", timeout)
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		databaseMu.Unlock()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	return func() {
+		// Closing the file releases the lock.
+		file.Close()
+		databaseMu.Unlock()
+	}, nil
+}
+
+// chownLike sets the owner of file to the one of info.
+func chownLike(file *os.File, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return file.Chown(int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package accounts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// lockDatabase is not supported on windows, which has no account database files.
+func lockDatabase(ctx context.Context, path string, timeout time.Duration) (func(), error) {
+	return nil, errors.New("the native accounts backend is not supported on windows")
+}
+
+// chownLike is a no-op on windows.
+func chownLike(file *os.File, info os.FileInfo) error {
+	return nil
+}
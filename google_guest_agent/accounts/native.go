@@ -0,0 +1,686 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NativeBackend edits the passwd, shadow, group and gshadow files itself, it's
+// meant for the minimal images lacking the shadow utilities. The files are
+// locked like lckpwdf(3) does and atomically replaced, the previous version is
+// kept with a "-" suffix like the shadow utilities do.
+type NativeBackend struct {
+	// Passwd, Shadow, Group and GShadow are the paths of the account database
+	// files. Shadow and GShadow are only updated if they exist.
+	Passwd, Shadow, Group, GShadow string
+	// LockFile is the file locked while the database files are edited.
+	LockFile string
+	// LockTimeout is how long to wait for the lock.
+	LockTimeout time.Duration
+	// LoginDefs is the path of login.defs(5), the UID and GID ranges and the home
+	// directories' mode are read from it.
+	LoginDefs string
+	// Skel is the directory copied to the new users' home directory.
+	Skel string
+	// HomeBase is the directory the home directories are created in.
+	HomeBase string
+	// Shell is the new users' login shell.
+	Shell string
+	// NoLoginShell is the login shell of locked users.
+	NoLoginShell string
+	// HashIDMin and HashIDMax, if set, are the range the UID of the users created
+	// without an explicit one is derived from, see HashID, rather than the next
+	// free one.
+	HashIDMin, HashIDMax int
+}
+
+// NewNativeBackend returns a NativeBackend editing the system's files and
+// creating users like "useradd -m -s /bin/bash -p *" does.
+func NewNativeBackend() *NativeBackend {
+	return &NativeBackend{
+		Passwd:       "/etc/passwd",
+		Shadow:       "/etc/shadow",
+		Group:        "/etc/group",
+		GShadow:      "/etc/gshadow",
+		LockFile:     "/etc/.pwd.lock",
+		LockTimeout:  15 * time.Second,
+		LoginDefs:    "/etc/login.defs",
+		Skel:         "/etc/skel",
+		HomeBase:     "/home",
+		Shell:        "/bin/bash",
+		NoLoginShell: "/sbin/nologin",
+	}
+}
+
+// dbFile is an account database file, its records are lines of colon separated
+// fields whose first field is the record's name.
+type dbFile struct {
+	path string
+	// exists is false if the file doesn't exist, it's then never written.
+	exists bool
+	// data is the file's original content.
+	data  []byte
+	lines []string
+	info  os.FileInfo
+	dirty bool
+}
+
+// readDBFile reads the database file path, which may not exist if optional.
+func readDBFile(path string, optional bool) (*dbFile, error) {
+	f := &dbFile{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	if f.info, err = os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	f.exists = true
+	f.data = data
+	f.lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		f.lines = nil
+	}
+	return f, nil
+}
+
+// find returns the index and fields of the record named name, -1 if there's
+// none. Comments and blank lines are skipped.
+func (f *dbFile) find(name string) (int, []string) {
+	for i, line := range f.lines {
+		fields := recordFields(line)
+		if fields != nil && fields[0] == name {
+			return i, fields
+		}
+	}
+	return -1, nil
+}
+
+// records returns the fields of all the records.
+func (f *dbFile) records() [][]string {
+	var res [][]string
+	for _, line := range f.lines {
+		if fields := recordFields(line); fields != nil {
+			res = append(res, fields)
+		}
+	}
+	return res
+}
+
+// set replaces the record at index i, or appends it if i is -1.
+func (f *dbFile) set(i int, fields []string) {
+	if !f.exists {
+		return
+	}
+	if i < 0 {
+		f.lines = append(f.lines, strings.Join(fields, ":"))
+	} else {
+		f.lines[i] = strings.Join(fields, ":")
+	}
+	f.dirty = true
+}
+
+// remove removes the record at index i.
+func (f *dbFile) remove(i int) {
+	f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	f.dirty = true
+}
+
+// write atomically replaces the file if it was modified, keeping its previous
+// version with a "-" suffix.
+func (f *dbFile) write() error {
+	if !f.exists || !f.dirty {
+		return nil
+	}
+
+	if err := writeFileAtomic(f.path+"-", f.data, f.info); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", f.path, err)
+	}
+	content := strings.Join(f.lines, "\n")
+	if len(f.lines) > 0 {
+		content += "\n"
+	}
+	return writeFileAtomic(f.path, []byte(content), f.info)
+}
+
+// recordFields returns the colon separated fields of line, nil for comments and
+// blank lines.
+func recordFields(line string) []string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil
+	}
+	return strings.Split(line, ":")
+}
+
+// writeFileAtomic writes data to a temporary file with the mode and owner of
+// info, syncs it and renames it to path.
+func writeFileAtomic(path string, data []byte, info os.FileInfo) error {
+	tmp := path + "+"
+	os.Remove(tmp)
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	// The umask may have restricted the mode.
+	if err := file.Chmod(info.Mode().Perm()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := chownLike(file, info); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// database is the account database, read and written under the lock.
+type database struct {
+	passwd, shadow, group, gshadow *dbFile
+}
+
+// update locks the database, calls fn on it and writes the files fn modified.
+func (b *NativeBackend) update(ctx context.Context, fn func(db *database) error) error {
+	unlock, err := lockDatabase(ctx, b.LockFile, b.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db := &database{}
+	if db.passwd, err = readDBFile(b.Passwd, false); err != nil {
+		return err
+	}
+	if db.shadow, err = readDBFile(b.Shadow, true); err != nil {
+		return err
+	}
+	if db.group, err = readDBFile(b.Group, false); err != nil {
+		return err
+	}
+	if db.gshadow, err = readDBFile(b.GShadow, true); err != nil {
+		return err
+	}
+
+	if err := fn(db); err != nil {
+		return err
+	}
+
+	// Groups are written first so that new users' primary group exists once the
+	// user does.
+	for _, f := range []*dbFile{db.gshadow, db.group, db.shadow, db.passwd} {
+		if err := f.write(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// loginDefs returns the integer value of key in login.defs, or def if it's not
+// set. base is the base of the value, 0 to infer it from its prefix.
+func (b *NativeBackend) loginDefs(key string, def int64, base int) int64 {
+	file, err := os.Open(b.LoginDefs)
+	if err != nil {
+		return def
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != key {
+			continue
+		}
+		if value, err := strconv.ParseInt(fields[1], base, 64); err == nil {
+			return value
+		}
+	}
+	return def
+}
+
+// freeID returns the lowest ID between key_MIN and key_MAX of login.defs the
+// records don't use in their field idx, preferring one that's unused by other
+// too, i.e. to have matching UID and GID.
+func (b *NativeBackend) freeID(key string, records [][]string, idx int, other [][]string, otherIdx int) (int, error) {
+	used := func(records [][]string, idx int) map[int]bool {
+		res := make(map[int]bool)
+		for _, fields := range records {
+			if len(fields) > idx {
+				if id, err := strconv.Atoi(fields[idx]); err == nil {
+					res[id] = true
+				}
+			}
+		}
+		return res
+	}
+	ids, otherIDs := used(records, idx), used(other, otherIdx)
+	min, max := int(b.loginDefs(key+"_MIN", 1000, 10)), int(b.loginDefs(key+"_MAX", 60000, 10))
+
+	for _, avoidOther := range []bool{true, false} {
+		for id := min; id <= max; id++ {
+			if !ids[id] && (!avoidOther || !otherIDs[id]) {
+				return id, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no free %s between %d and %d", key, min, max)
+}
+
+// idNames returns the names of the records by their ID in field idx.
+func idNames(records [][]string, idx int) map[int]string {
+	res := make(map[int]string)
+	for _, fields := range records {
+		if len(fields) > idx {
+			if id, err := strconv.Atoi(fields[idx]); err == nil {
+				res[id] = fields[0]
+			}
+		}
+	}
+	return res
+}
+
+// validName returns an error if name can't be a user or group name.
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, "-") ||
+		strings.ContainsAny(name, ":,/\n\t ") {
+		return fmt.Errorf("invalid user or group name %q", name)
+	}
+	return nil
+}
+
+// shadowDays returns the number of days since the epoch, the shadow files' date
+// format.
+func shadowDays() string {
+	return strconv.FormatInt(time.Now().Unix()/(24*60*60), 10)
+}
+
+// members returns the comma separated members list as a slice.
+func members(list string) []string {
+	var res []string
+	for _, member := range strings.Split(list, ",") {
+		if member != "" {
+			res = append(res, member)
+		}
+	}
+	return res
+}
+
+// withoutMember returns the members list without user and whether it was listed.
+func withoutMember(list, user string) (string, bool) {
+	var res []string
+	var found bool
+	for _, member := range members(list) {
+		if member == user {
+			found = true
+			continue
+		}
+		res = append(res, member)
+	}
+	return strings.Join(res, ","), found
+}
+
+// CreateUser adds the user and its own group to the database, with a locked
+// password, and creates its home directory from Skel if it doesn't exist.
+func (b *NativeBackend) CreateUser(ctx context.Context, user, uid string) error {
+	if err := validName(user); err != nil {
+		return err
+	}
+
+	var userID, groupID int
+	home := filepath.Join(b.HomeBase, user)
+	err := b.update(ctx, func(db *database) error {
+		if i, _ := db.passwd.find(user); i >= 0 {
+			return fmt.Errorf("user %s already exists", user)
+		}
+
+		var err error
+		uidUsers := idNames(db.passwd.records(), 2)
+		switch {
+		case uid != "":
+			if userID, err = strconv.Atoi(uid); err != nil || userID < 0 {
+				return fmt.Errorf("invalid uid %q", uid)
+			}
+			if name, found := uidUsers[userID]; found {
+				return fmt.Errorf("uid %d is already used by %s", userID, name)
+			}
+		case b.HashIDMax > 0:
+			// The GID is matched too, unless the user's own group exists.
+			gidGroups := idNames(db.group.records(), 2)
+			used := func(id int) bool {
+				_, uidFound := uidUsers[id]
+				name, gidFound := gidGroups[id]
+				return uidFound || (gidFound && name != user)
+			}
+			if userID, err = HashID(user, b.HashIDMin, b.HashIDMax, used); err != nil {
+				return err
+			}
+		default:
+			if userID, err = b.freeID("UID", db.passwd.records(), 2, db.group.records(), 2); err != nil {
+				return err
+			}
+		}
+
+		// The user's own group is reused if it exists.
+		if _, fields := db.group.find(user); fields != nil && len(fields) > 2 {
+			if groupID, err = strconv.Atoi(fields[2]); err != nil {
+				return fmt.Errorf("invalid group entry for %s", user)
+			}
+		} else {
+			groupID = userID
+			for _, fields := range db.group.records() {
+				if len(fields) > 2 && fields[2] == strconv.Itoa(userID) {
+					if groupID, err = b.freeID("GID", db.group.records(), 2, nil, 0); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			db.group.set(-1, []string{user, "x", strconv.Itoa(groupID), ""})
+			if i, _ := db.gshadow.find(user); i < 0 {
+				db.gshadow.set(-1, []string{user, "!", "", ""})
+			}
+		}
+
+		db.passwd.set(-1, []string{user, "x", strconv.Itoa(userID), strconv.Itoa(groupID), "", home, b.Shell})
+		if i, _ := db.shadow.find(user); i >= 0 {
+			db.shadow.remove(i)
+		}
+		db.shadow.set(-1, []string{user, "*", shadowDays(), "0", "99999", "7", "", "", ""})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.createHome(home, userID, groupID)
+}
+
+// createHome creates the home directory with the content of Skel, unless it
+// already exists.
+func (b *NativeBackend) createHome(home string, uid, gid int) error {
+	if _, err := os.Lstat(home); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(home), 0755); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(b.loginDefs("HOME_MODE", 0, 8))
+	if mode == 0 {
+		mode = 0777 &^ os.FileMode(b.loginDefs("UMASK", 022, 8))
+	}
+	if err := os.Mkdir(home, mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Chmod(home, mode.Perm()); err != nil {
+		return err
+	}
+	if err := os.Lchown(home, uid, gid); err != nil {
+		return err
+	}
+
+	err := filepath.WalkDir(b.Skel, func(src string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if src == b.Skel && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(b.Skel, src)
+		if err != nil || rel == "." {
+			return err
+		}
+		dst := filepath.Join(home, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			err = os.Mkdir(dst, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(src); err == nil {
+				err = os.Symlink(target, dst)
+			}
+		case info.Mode().IsRegular():
+			err = copyFile(src, dst, info.Mode().Perm())
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.Lchown(dst, uid, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", b.Skel, home, err)
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst, created with mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DeleteUser removes the user from the database and from the groups' members,
+// as well as its own group if no one else is a member of it, and removes its
+// home directory.
+func (b *NativeBackend) DeleteUser(ctx context.Context, user string) error {
+	var home string
+	err := b.update(ctx, func(db *database) error {
+		i, fields := db.passwd.find(user)
+		if i < 0 {
+			return fmt.Errorf("user %s not found", user)
+		}
+		if len(fields) > 5 {
+			home = fields[5]
+		}
+		db.passwd.remove(i)
+		if i, _ := db.shadow.find(user); i >= 0 {
+			db.shadow.remove(i)
+		}
+
+		for _, f := range []*dbFile{db.group, db.gshadow} {
+			for i, line := range f.lines {
+				fields := recordFields(line)
+				if len(fields) < 4 {
+					continue
+				}
+				var found, foundAdmin bool
+				fields[3], found = withoutMember(fields[3], user)
+				if f == db.gshadow {
+					fields[2], foundAdmin = withoutMember(fields[2], user)
+				}
+				if found || foundAdmin {
+					f.set(i, fields)
+				}
+			}
+		}
+
+		primaryGID := ""
+		if len(fields) > 3 {
+			primaryGID = fields[3]
+		}
+		if i, group := db.group.find(user); i >= 0 && len(group) > 3 && group[2] == primaryGID && len(members(group[3])) == 0 {
+			db.group.remove(i)
+			if i, _ := db.gshadow.find(user); i >= 0 {
+				db.gshadow.remove(i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if home == "" || !filepath.IsAbs(home) || filepath.Clean(home) == "/" {
+		return nil
+	}
+	return os.RemoveAll(home)
+}
+
+// CreateGroup adds the group to the database.
+func (b *NativeBackend) CreateGroup(ctx context.Context, group string) error {
+	if err := validName(group); err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(db *database) error {
+		if i, _ := db.group.find(group); i >= 0 {
+			return ErrGroupExists
+		}
+		gid, err := b.freeID("GID", db.group.records(), 2, nil, 0)
+		if err != nil {
+			return err
+		}
+		db.group.set(-1, []string{group, "x", strconv.Itoa(gid), ""})
+		if i, _ := db.gshadow.find(group); i < 0 {
+			db.gshadow.set(-1, []string{group, "!", "", ""})
+		}
+		return nil
+	})
+}
+
+// AddUserToGroup adds the user to the group's members, if it isn't already.
+func (b *NativeBackend) AddUserToGroup(ctx context.Context, user, group string) error {
+	return b.update(ctx, func(db *database) error {
+		if i, _ := db.passwd.find(user); i < 0 {
+			return fmt.Errorf("user %s not found", user)
+		}
+		i, fields := db.group.find(group)
+		if i < 0 || len(fields) < 4 {
+			return fmt.Errorf("group %s not found", group)
+		}
+
+		if list, found := withoutMember(fields[3], user); !found {
+			fields[3] = strings.Join(append(members(list), user), ",")
+			db.group.set(i, fields)
+		}
+		if i, fields := db.gshadow.find(group); i >= 0 && len(fields) >= 4 {
+			if list, found := withoutMember(fields[3], user); !found {
+				fields[3] = strings.Join(append(members(list), user), ",")
+				db.gshadow.set(i, fields)
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveUserFromGroup removes the user from the group's members, if it is one.
+func (b *NativeBackend) RemoveUserFromGroup(ctx context.Context, user, group string) error {
+	return b.update(ctx, func(db *database) error {
+		i, fields := db.group.find(group)
+		if i < 0 || len(fields) < 4 {
+			return fmt.Errorf("group %s not found", group)
+		}
+
+		var found bool
+		if fields[3], found = withoutMember(fields[3], user); found {
+			db.group.set(i, fields)
+		}
+		if i, fields := db.gshadow.find(group); i >= 0 && len(fields) >= 4 {
+			if fields[3], found = withoutMember(fields[3], user); found {
+				db.gshadow.set(i, fields)
+			}
+		}
+		return nil
+	})
+}
+
+// LockUser prefixes the user's password hash with "!", like "usermod -L" does,
+// and sets its login shell to NoLoginShell.
+func (b *NativeBackend) LockUser(ctx context.Context, user string) error {
+	return b.update(ctx, func(db *database) error {
+		i, fields := db.passwd.find(user)
+		if i < 0 || len(fields) < 7 {
+			return fmt.Errorf("user %s not found", user)
+		}
+		fields[6] = b.NoLoginShell
+		db.passwd.set(i, fields)
+
+		if i, fields := db.shadow.find(user); i >= 0 && len(fields) > 1 && !strings.HasPrefix(fields[1], "!") {
+			fields[1] = "!" + fields[1]
+			db.shadow.set(i, fields)
+		}
+		return nil
+	})
+}
+
+// UnlockUser removes the "!" prefix of the user's password hash, like
+// "usermod -U" does, and sets its login shell to shell.
+func (b *NativeBackend) UnlockUser(ctx context.Context, user, shell string) error {
+	return b.update(ctx, func(db *database) error {
+		i, fields := db.passwd.find(user)
+		if i < 0 || len(fields) < 7 {
+			return fmt.Errorf("user %s not found", user)
+		}
+		fields[6] = shell
+		db.passwd.set(i, fields)
+
+		if i, fields := db.shadow.find(user); i >= 0 && len(fields) > 1 && strings.HasPrefix(fields[1], "!") {
+			// Like usermod, don't leave a password-less account.
+			if fields[1] == "!" {
+				return fmt.Errorf("unlocking user %s would leave it without password", user)
+			}
+			fields[1] = strings.TrimPrefix(fields[1], "!")
+			db.shadow.set(i, fields)
+		}
+		return nil
+	})
+}
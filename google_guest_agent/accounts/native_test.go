@@ -0,0 +1,345 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNativeBackend returns a NativeBackend editing files in a temporary
+// directory, with the given initial content.
+func testNativeBackend(t *testing.T, passwd, shadow, group, gshadow string) *NativeBackend {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the native backend is not supported on windows")
+	}
+
+	dir := t.TempDir()
+	b := &NativeBackend{
+		Passwd:       filepath.Join(dir, "passwd"),
+		Shadow:       filepath.Join(dir, "shadow"),
+		Group:        filepath.Join(dir, "group"),
+		GShadow:      filepath.Join(dir, "gshadow"),
+		LockFile:     filepath.Join(dir, ".pwd.lock"),
+		LockTimeout:  time.Second,
+		LoginDefs:    filepath.Join(dir, "login.defs"),
+		Skel:         filepath.Join(dir, "skel"),
+		HomeBase:     filepath.Join(dir, "home"),
+		Shell:        "/bin/bash",
+		NoLoginShell: "/sbin/nologin",
+	}
+
+	files := map[string]string{
+		b.Passwd:    passwd,
+		b.Shadow:    shadow,
+		b.Group:     group,
+		b.GShadow:   gshadow,
+		b.LoginDefs: "# comment\nUID_MIN 1000\nUID_MAX 60000\nGID_MIN 1000\nGID_MAX 60000\nUMASK 022\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	return b
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %+v", path, err)
+	}
+	return string(data)
+}
+
+func TestNativeCreateUser(t *testing.T) {
+	b := testNativeBackend(t,
+		"root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000::/home/alice:/bin/bash\n",
+		"root:*:19000:0:99999:7:::\nalice:*:19000:0:99999:7:::\n",
+		"root:x:0:\nalice:x:1000:\nbob-group:x:1001:\n",
+		"root:*::\nalice:!::\nbob-group:!::\n")
+	// The home directory can only be given to another user by root.
+	isRoot := os.Geteuid() == 0
+
+	if err := os.MkdirAll(filepath.Join(b.Skel, ".config"), 0755); err != nil {
+		t.Fatalf("Failed to create skel: %+v", err)
+	}
+	if err := os.WriteFile(filepath.Join(b.Skel, ".bashrc"), []byte("# bashrc\n"), 0644); err != nil {
+		t.Fatalf("Failed to create skel: %+v", err)
+	}
+	if err := os.Symlink(".bashrc", filepath.Join(b.Skel, ".profile")); err != nil {
+		t.Fatalf("Failed to create skel: %+v", err)
+	}
+
+	ctx := context.Background()
+	if err := b.CreateUser(ctx, "bob", ""); err != nil && isRoot {
+		t.Fatalf("CreateUser(bob) = %+v, want: nil", err)
+	}
+	if err := b.CreateUser(ctx, "bob", ""); err == nil {
+		t.Errorf("CreateUser(bob) for an existing user = nil, want: error")
+	}
+	if err := b.CreateUser(ctx, "bad:name", ""); err == nil {
+		t.Errorf("CreateUser(bad:name) = nil, want: error")
+	}
+
+	home := filepath.Join(b.HomeBase, "bob")
+	// 1001 is used by a group, bob gets the next UID free of both.
+	wantPasswd := "root:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000::/home/alice:/bin/bash\nbob:x:1002:1002::" + home + ":/bin/bash\n"
+	if got := readFile(t, b.Passwd); got != wantPasswd {
+		t.Errorf("passwd = %q, want: %q", got, wantPasswd)
+	}
+	if got := readFile(t, b.Passwd+"-"); !strings.HasPrefix(wantPasswd, got) || got == wantPasswd {
+		t.Errorf("passwd- = %q, want the previous passwd", got)
+	}
+	wantShadow := "bob:*:" + shadowDays() + ":0:99999:7:::\n"
+	if got := readFile(t, b.Shadow); !strings.HasSuffix(got, wantShadow) {
+		t.Errorf("shadow = %q, want suffix: %q", got, wantShadow)
+	}
+	if got, want := readFile(t, b.Group), "root:x:0:\nalice:x:1000:\nbob-group:x:1001:\nbob:x:1002:\n"; got != want {
+		t.Errorf("group = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.GShadow), "root:*::\nalice:!::\nbob-group:!::\nbob:!::\n"; got != want {
+		t.Errorf("gshadow = %q, want: %q", got, want)
+	}
+	info, err := os.Stat(b.Passwd)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %+v", b.Passwd, err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("passwd mode = %o, want: 640", info.Mode().Perm())
+	}
+
+	if !isRoot {
+		return
+	}
+	if got := readFile(t, filepath.Join(home, ".bashrc")); got != "# bashrc\n" {
+		t.Errorf("%s/.bashrc = %q, want: %q", home, got, "# bashrc\n")
+	}
+	if target, err := os.Readlink(filepath.Join(home, ".profile")); err != nil || target != ".bashrc" {
+		t.Errorf("Readlink(%s/.profile) = %q, %v, want: .bashrc, nil", home, target, err)
+	}
+	if info, err := os.Stat(filepath.Join(home, ".config")); err != nil || !info.IsDir() {
+		t.Errorf("%s/.config is not a directory: %v", home, err)
+	}
+	if info, err := os.Stat(home); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Stat(%s) = %v, %v, want mode 755", home, info, err)
+	}
+}
+
+func TestNativeUIDAndExistingGroup(t *testing.T) {
+	b := testNativeBackend(t, "", "", "carol:x:2000:\nother:x:3000:\n", "")
+
+	// Home directory creation fails unless run as root, the user is created
+	// anyway.
+	b.CreateUser(context.Background(), "carol", "3000")
+	if got, want := readFile(t, b.Passwd), "carol:x:3000:2000::"+filepath.Join(b.HomeBase, "carol")+":/bin/bash\n"; got != want {
+		t.Errorf("passwd = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.Group), "carol:x:2000:\nother:x:3000:\n"; got != want {
+		t.Errorf("group = %q, want: %q", got, want)
+	}
+	// An explicit uid is checked for collisions whatever the uid policy.
+	if err := b.CreateUser(context.Background(), "erin", "3000"); err == nil || !strings.Contains(err.Error(), "already used by carol") {
+		t.Errorf("CreateUser(erin, 3000) = %v, want: uid 3000 is already used by carol", err)
+	}
+	if got := readFile(t, b.Passwd); strings.Contains(got, "erin") {
+		t.Errorf("passwd = %q, want no erin", got)
+	}
+}
+
+func TestNativeHashUID(t *testing.T) {
+	id, err := HashID("dave", 2000, 2009, func(int) bool { return false })
+	if err != nil {
+		t.Fatalf("HashID(dave) = %v, want: nil", err)
+	}
+	next := 2000 + (id-2000+1)%10
+	b := testNativeBackend(t, fmt.Sprintf("alice:x:%d:%d::/home/alice:/bin/bash\n", id, id), "", fmt.Sprintf("alice:x:%d:\n", id), "")
+	b.HashIDMin, b.HashIDMax = 2000, 2009
+	ctx := context.Background()
+
+	if err := b.CreateUser(ctx, "bob", strconv.Itoa(id)); err == nil {
+		t.Errorf("CreateUser(bob, %d) with the uid of alice = nil, want: error", id)
+	}
+
+	// Home directory creation fails unless run as root, the user is created
+	// anyway.
+	b.CreateUser(ctx, "dave", "")
+	want := fmt.Sprintf("alice:x:%d:%d::/home/alice:/bin/bash\ndave:x:%d:%d::%s:/bin/bash\n", id, id, next, next, filepath.Join(b.HomeBase, "dave"))
+	if got := readFile(t, b.Passwd); got != want {
+		t.Errorf("passwd = %q, want: %q", got, want)
+	}
+}
+
+func TestNativeGroups(t *testing.T) {
+	b := testNativeBackend(t,
+		"alice:x:1000:1000::/home/alice:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n",
+		"alice:*:19000:0:99999:7:::\nbob:*:19000:0:99999:7:::\n",
+		"alice:x:1000:\nbob:x:1001:\n",
+		"alice:!::\nbob:!::\n")
+	ctx := context.Background()
+
+	if err := b.CreateGroup(ctx, "google-sudoers"); err != nil {
+		t.Fatalf("CreateGroup(google-sudoers) = %+v, want: nil", err)
+	}
+	if err := b.CreateGroup(ctx, "google-sudoers"); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("CreateGroup(google-sudoers) for an existing group = %v, want: %v", err, ErrGroupExists)
+	}
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		if err := b.AddUserToGroup(ctx, user, "google-sudoers"); err != nil {
+			t.Fatalf("AddUserToGroup(%s, google-sudoers) = %+v, want: nil", user, err)
+		}
+	}
+	if err := b.AddUserToGroup(ctx, "carol", "google-sudoers"); err == nil {
+		t.Errorf("AddUserToGroup(carol, google-sudoers) for a missing user = nil, want: error")
+	}
+	if err := b.AddUserToGroup(ctx, "alice", "missing"); err == nil {
+		t.Errorf("AddUserToGroup(alice, missing) for a missing group = nil, want: error")
+	}
+	if got, want := readFile(t, b.Group), "alice:x:1000:\nbob:x:1001:\ngoogle-sudoers:x:1002:alice,bob\n"; got != want {
+		t.Errorf("group = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.GShadow), "alice:!::\nbob:!::\ngoogle-sudoers:!::alice,bob\n"; got != want {
+		t.Errorf("gshadow = %q, want: %q", got, want)
+	}
+
+	if err := b.RemoveUserFromGroup(ctx, "alice", "google-sudoers"); err != nil {
+		t.Fatalf("RemoveUserFromGroup(alice, google-sudoers) = %+v, want: nil", err)
+	}
+	if err := b.RemoveUserFromGroup(ctx, "alice", "google-sudoers"); err != nil {
+		t.Errorf("RemoveUserFromGroup(alice, google-sudoers) for a non member = %+v, want: nil", err)
+	}
+	if got, want := readFile(t, b.Group), "alice:x:1000:\nbob:x:1001:\ngoogle-sudoers:x:1002:bob\n"; got != want {
+		t.Errorf("group = %q, want: %q", got, want)
+	}
+
+	home := filepath.Join(t.TempDir(), "bob")
+	if err := os.Mkdir(home, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %+v", home, err)
+	}
+	if err := os.WriteFile(b.Passwd, []byte("alice:x:1000:1000::/home/alice:/bin/bash\nbob:x:1001:1001::"+home+":/bin/bash\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %+v", b.Passwd, err)
+	}
+	if err := b.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatalf("DeleteUser(bob) = %+v, want: nil", err)
+	}
+	if err := b.DeleteUser(ctx, "bob"); err == nil {
+		t.Errorf("DeleteUser(bob) for a missing user = nil, want: error")
+	}
+	if got, want := readFile(t, b.Passwd), "alice:x:1000:1000::/home/alice:/bin/bash\n"; got != want {
+		t.Errorf("passwd = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.Shadow), "alice:*:19000:0:99999:7:::\n"; got != want {
+		t.Errorf("shadow = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.Group), "alice:x:1000:\ngoogle-sudoers:x:1002:\n"; got != want {
+		t.Errorf("group = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.GShadow), "alice:!::\ngoogle-sudoers:!::\n"; got != want {
+		t.Errorf("gshadow = %q, want: %q", got, want)
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("Stat(%s) = %v, want: not exist", home, err)
+	}
+}
+
+func TestNativeLockUser(t *testing.T) {
+	b := testNativeBackend(t,
+		"alice:x:1000:1000::/home/alice:/bin/bash\nbob:x:1001:1001::/home/bob:/bin/bash\n",
+		"alice:*:19000:0:99999:7:::\nbob:!:19000:0:99999:7:::\n",
+		"alice:x:1000:\nbob:x:1001:\n",
+		"alice:!::\nbob:!::\n")
+	ctx := context.Background()
+
+	for _, user := range []string{"alice", "alice", "bob"} {
+		if err := b.LockUser(ctx, user); err != nil {
+			t.Fatalf("LockUser(%s) = %+v, want: nil", user, err)
+		}
+	}
+	if got, want := readFile(t, b.Passwd), "alice:x:1000:1000::/home/alice:/sbin/nologin\nbob:x:1001:1001::/home/bob:/sbin/nologin\n"; got != want {
+		t.Errorf("passwd = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.Shadow), "alice:!*:19000:0:99999:7:::\nbob:!:19000:0:99999:7:::\n"; got != want {
+		t.Errorf("shadow = %q, want: %q", got, want)
+	}
+
+	if err := b.UnlockUser(ctx, "alice", "/bin/zsh"); err != nil {
+		t.Fatalf("UnlockUser(alice) = %+v, want: nil", err)
+	}
+	if err := b.UnlockUser(ctx, "bob", "/bin/bash"); err == nil {
+		t.Errorf("UnlockUser(bob) without password = nil, want: error")
+	}
+	if err := b.LockUser(ctx, "carol"); err == nil {
+		t.Errorf("LockUser(carol) for a missing user = nil, want: error")
+	}
+	if got, want := readFile(t, b.Passwd), "alice:x:1000:1000::/home/alice:/bin/zsh\nbob:x:1001:1001::/home/bob:/sbin/nologin\n"; got != want {
+		t.Errorf("passwd = %q, want: %q", got, want)
+	}
+	if got, want := readFile(t, b.Shadow), "alice:*:19000:0:99999:7:::\nbob:!:19000:0:99999:7:::\n"; got != want {
+		t.Errorf("shadow = %q, want: %q", got, want)
+	}
+}
+
+func TestNativeLock(t *testing.T) {
+	b := testNativeBackend(t, "", "", "", "")
+	b.LockTimeout = 200 * time.Millisecond
+
+	unlock, err := lockDatabase(context.Background(), b.LockFile, b.LockTimeout)
+	if err != nil {
+		t.Fatalf("lockDatabase(%s) = %+v, want: nil", b.LockFile, err)
+	}
+
+	errs := make(chan error)
+	go func() { errs <- b.CreateGroup(context.Background(), "group") }()
+	select {
+	case err := <-errs:
+		t.Fatalf("CreateGroup() = %v while the database is locked, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	if err := <-errs; err != nil {
+		t.Errorf("CreateGroup() = %+v after unlock, want: nil", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		cmd, user, group string
+		wantName         string
+		wantArgs         []string
+	}{
+		{"useradd -m -s /bin/bash -p * {user}", "alice", "", "useradd", []string{"-m", "-s", "/bin/bash", "-p", "*", "alice"}},
+		{"gpasswd -a {user} {group}", "alice", "google-sudoers", "gpasswd", []string{"-a", "alice", "google-sudoers"}},
+		{"groupadd {group}", "", "google-sudoers", "groupadd", []string{"google-sudoers"}},
+	}
+
+	for _, tc := range tests {
+		name, args := Command(tc.cmd, tc.user, tc.group)
+		if name != tc.wantName || strings.Join(args, " ") != strings.Join(tc.wantArgs, " ") {
+			t.Errorf("Command(%q, %q, %q) = %q, %q, want: %q, %q", tc.cmd, tc.user, tc.group, name, args, tc.wantName, tc.wantArgs)
+		}
+	}
+}
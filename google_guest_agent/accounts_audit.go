@@ -0,0 +1,333 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+// The events of the accounts audit log.
+const (
+	auditUserCreated  = "user_created"
+	auditUserRemoved  = "user_removed"
+	auditUserLocked   = "user_locked"
+	auditUserUnlocked = "user_unlocked"
+	auditGroupAdded   = "group_added"
+	auditGroupRemoved = "group_removed"
+	auditKeyAdded     = "key_added"
+	auditKeyRemoved   = "key_removed"
+)
+
+// The metadata sources of the audited changes.
+const (
+	auditSourceInstance = "instance"
+	auditSourceProject  = "project"
+)
+
+// auditRecord is a record of the accounts audit log, written as a JSON line.
+type auditRecord struct {
+	// Time is when the change was applied, in RFC3339 format.
+	Time string `json:"time"`
+	// Event is one of the audit* events.
+	Event string `json:"event"`
+	User  string `json:"user"`
+	// Group is the group of the group_added and group_removed events.
+	Group string `json:"group,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of the key of the key_added and
+	// key_removed events.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Source is the metadata the change comes from, instance or project. It's
+	// omitted if the change doesn't come from metadata, e.g. the default role's
+	// groups.
+	Source string `json:"source,omitempty"`
+	// Reason is why the change was applied if not obvious, e.g. expired keys.
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditSummary is the summary of the records of a run published to the
+// guest-agent/accounts-audit guest attribute.
+type auditSummary struct {
+	// Time is when the records were written, in RFC3339 format.
+	Time string `json:"time"`
+	// Events is the number of records of each event.
+	Events map[string]int `json:"events"`
+}
+
+// accountsAudit collects the audit records of a run of the accounts manager
+// and writes them once it's done.
+type accountsAudit struct {
+	config  *cfg.Accounts
+	now     func() time.Time
+	records []auditRecord
+
+	// keySources are the metadata sources of each user's keys, from the current
+	// then the previous metadata, so that removed keys are attributed too.
+	keySources []map[string]map[string]string
+	// roleSources are the metadata sources of the users' roles.
+	roleSources map[string]string
+}
+
+// newAccountsAudit returns the audit of a run of the accounts manager applying
+// md, prev is the previously applied metadata.
+func newAccountsAudit(config *cfg.Accounts, md, prev *metadata.Descriptor) *accountsAudit {
+	a := &accountsAudit{config: config, now: time.Now, roleSources: make(map[string]string)}
+	for _, desc := range []*metadata.Descriptor{md, prev} {
+		if desc != nil {
+			a.keySources = append(a.keySources, auditKeySources(desc, keyPolicy(config)))
+		}
+	}
+
+	if !md.Instance.Attributes.BlockProjectKeys {
+		roles := make(map[string]userRole)
+		parseUserRoles(md.Project.Attributes.UserRoles, roles)
+		for user := range roles {
+			a.roleSources[user] = auditSourceProject
+		}
+	}
+	roles := make(map[string]userRole)
+	parseUserRoles(md.Instance.Attributes.UserRoles, roles)
+	for user := range roles {
+		a.roleSources[user] = auditSourceInstance
+	}
+	return a
+}
+
+// auditKeySources returns the metadata source of each key policy accepts of
+// each user of md, the instance's keys take precedence.
+func auditKeySources(md *metadata.Descriptor, policy utils.KeyPolicy) map[string]map[string]string {
+	sources := make(map[string]map[string]string)
+	add := func(keys []string, source string) {
+		for user, userKeys := range getUserKeys(keys, policy) {
+			if sources[user] == nil {
+				sources[user] = make(map[string]string)
+			}
+			for _, key := range userKeys {
+				if _, found := sources[user][key]; !found {
+					sources[user][key] = source
+				}
+			}
+		}
+	}
+	add(md.Instance.Attributes.SSHKeys, auditSourceInstance)
+	if !md.Instance.Attributes.BlockProjectKeys {
+		add(md.Project.Attributes.SSHKeys, auditSourceProject)
+	}
+	return sources
+}
+
+// keySource returns the metadata source of key of user, key may have been
+// written with an expiry-time option.
+func (a *accountsAudit) keySource(user, key string) string {
+	fingerprint, err := utils.KeyFingerprint(key)
+	if err != nil {
+		return ""
+	}
+	for _, sources := range a.keySources {
+		for mdKey, source := range sources[user] {
+			if fp, err := utils.KeyFingerprint(mdKey); err == nil && fp == fingerprint {
+				return source
+			}
+		}
+	}
+	return ""
+}
+
+// userSource returns the metadata source of user, instance if any of its keys
+// comes from the instance's metadata.
+func (a *accountsAudit) userSource(user string) string {
+	var res string
+	for _, sources := range a.keySources {
+		for _, source := range sources[user] {
+			if source == auditSourceInstance {
+				return source
+			}
+			res = source
+		}
+		if res != "" {
+			return res
+		}
+	}
+	return res
+}
+
+// add appends record, stamped with the current time.
+func (a *accountsAudit) add(record auditRecord) {
+	record.Time = a.now().UTC().Format(time.RFC3339)
+	a.records = append(a.records, record)
+}
+
+// userEvent records event for user, i.e. its creation or removal. Like the
+// other events, it's not recorded by a nil audit, i.e. by the deprovision
+// command.
+func (a *accountsAudit) userEvent(event, user string) {
+	if a == nil {
+		return
+	}
+	a.add(auditRecord{Event: event, User: user, Source: a.userSource(user)})
+}
+
+// groupEvent records user being added to or removed from group.
+func (a *accountsAudit) groupEvent(user, group string, added bool) {
+	if a == nil {
+		return
+	}
+	event := auditGroupRemoved
+	if added {
+		event = auditGroupAdded
+	}
+	a.add(auditRecord{Event: event, User: user, Group: group, Source: a.roleSources[user]})
+}
+
+// keyChanges records the keys added to and removed from the authorized keys
+// file of user, installed are the keys it had and keys the ones it now has.
+// Keys are compared by fingerprint, adding or removing an option isn't audited.
+func (a *accountsAudit) keyChanges(user string, installed, keys []string) {
+	if a == nil {
+		return
+	}
+	fingerprints := func(keys []string) map[string]string {
+		res := make(map[string]string)
+		for _, key := range keys {
+			if fp, err := utils.KeyFingerprint(key); err == nil {
+				res[fp] = key
+			}
+		}
+		return res
+	}
+	before, after := fingerprints(installed), fingerprints(keys)
+
+	for _, key := range keys {
+		fp, err := utils.KeyFingerprint(key)
+		if err != nil {
+			continue
+		}
+		if _, found := before[fp]; !found {
+			before[fp] = key
+			a.add(auditRecord{Event: auditKeyAdded, User: user, Fingerprint: fp, Source: a.keySource(user, key)})
+		}
+	}
+	for _, key := range installed {
+		fp, err := utils.KeyFingerprint(key)
+		if err != nil {
+			continue
+		}
+		if _, found := after[fp]; found {
+			continue
+		}
+		after[fp] = key
+		record := auditRecord{Event: auditKeyRemoved, User: user, Fingerprint: fp, Source: a.keySource(user, key)}
+		if utils.CheckExpiredKey(key) != nil {
+			record.Reason = "expired"
+		}
+		a.add(record)
+	}
+}
+
+// flush appends the records to the [Accounts] audit_log file, rotating it as
+// needed, and publishes their summary if audit_guest_attribute is set. Nothing
+// is written if audit_log isn't set.
+func (a *accountsAudit) flush(ctx context.Context) error {
+	if a.config.AuditLog == "" || len(a.records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	summary := auditSummary{Time: a.now().UTC().Format(time.RFC3339), Events: make(map[string]int)}
+	for _, record := range a.records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+		summary.Events[record.Event]++
+	}
+	a.records = nil
+
+	if err := appendAuditLog(a.config.AuditLog, buf.Bytes(), int64(a.config.AuditLogMaxSize), a.config.AuditLogBackups); err != nil {
+		return fmt.Errorf("failed to write audit log %s: %w", a.config.AuditLog, err)
+	}
+
+	if !a.config.AuditGuestAttribute || mdsClient == nil {
+		return nil
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	// Guest attributes may be disabled for the instance, it's not worth more than
+	// a debug message.
+	if err := mdsClient.WriteGuestAttributes(ctx, guestAttributesNamespace+"accounts-audit", string(data)); err != nil {
+		accountsLog.Debugf("Failed to publish the accounts audit summary: %+v", err)
+	}
+	return nil
+}
+
+// appendAuditLog appends data to the audit log file path. If it would grow past
+// maxSize bytes the file is first rotated to path.1, path.1 to path.2 and so on,
+// keeping up to backups, at least 1, rotated files. A maxSize of 0 disables
+// rotation.
+func appendAuditLog(path string, data []byte, maxSize int64, backups int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && maxSize > 0 && info.Size() > 0 && info.Size()+int64(len(data)) > maxSize {
+		if err := rotateAuditLog(path, backups); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotateAuditLog shifts path.N to path.N+1, dropping the ones past backups,
+// and path to path.1. The records just rotated are never dropped, at least 1
+// backup is kept.
+func rotateAuditLog(path string, backups int) error {
+	if backups < 1 {
+		backups = 1
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
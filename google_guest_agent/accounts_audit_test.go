@@ -0,0 +1,196 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+func TestAccountsAuditRecords(t *testing.T) {
+	instanceKey := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " alice"
+	projectKey := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " alice"
+	removedKey := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " alice"
+	expiredKey := fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"alice@example.com","expireOn":"2020-01-01T00:00:00+0000"}`, utils.MakeRandRSAPubKey(t))
+
+	md := &metadata.Descriptor{}
+	md.Instance.Attributes.SSHKeys = []string{"alice:" + instanceKey}
+	md.Instance.Attributes.UserRoles = "alice:user:docker"
+	md.Project.Attributes.SSHKeys = []string{"alice:" + projectKey, "bob:" + projectKey}
+	prev := &metadata.Descriptor{}
+	prev.Project.Attributes.SSHKeys = []string{"alice:" + removedKey}
+
+	audit := newAccountsAudit(&cfg.Accounts{}, md, prev)
+	audit.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	audit.userEvent(auditUserCreated, "alice")
+	audit.userEvent(auditUserCreated, "bob")
+	audit.groupEvent("alice", "docker", true)
+	audit.groupEvent("bob", "google-sudoers", true)
+	audit.keyChanges("alice", []string{instanceKey, removedKey, expiredKey}, []string{`expiry-time="209501010000" ` + instanceKey, projectKey})
+
+	fingerprint := func(key string) string {
+		fp, err := utils.KeyFingerprint(key)
+		if err != nil {
+			t.Fatalf("utils.KeyFingerprint(%q) = %v, want: nil", key, err)
+		}
+		return fp
+	}
+	when := "2023-11-14T22:13:20Z"
+	want := []auditRecord{
+		{Time: when, Event: auditUserCreated, User: "alice", Source: auditSourceInstance},
+		{Time: when, Event: auditUserCreated, User: "bob", Source: auditSourceProject},
+		{Time: when, Event: auditGroupAdded, User: "alice", Group: "docker", Source: auditSourceInstance},
+		{Time: when, Event: auditGroupAdded, User: "bob", Group: "google-sudoers"},
+		{Time: when, Event: auditKeyAdded, User: "alice", Fingerprint: fingerprint(projectKey), Source: auditSourceProject},
+		{Time: when, Event: auditKeyRemoved, User: "alice", Fingerprint: fingerprint(removedKey), Source: auditSourceProject},
+		{Time: when, Event: auditKeyRemoved, User: "alice", Fingerprint: fingerprint(expiredKey), Reason: "expired"},
+	}
+	if !reflect.DeepEqual(audit.records, want) {
+		t.Errorf("accountsAudit.records = %+v, want: %+v", audit.records, want)
+	}
+}
+
+func TestAccountsAuditRevoked(t *testing.T) {
+	key := "ssh-rsa " + utils.MakeRandRSAPubKey(t) + " alice"
+	prev := &metadata.Descriptor{}
+	prev.Instance.Attributes.SSHKeys = []string{"alice:" + key}
+
+	audit := newAccountsAudit(&cfg.Accounts{}, &metadata.Descriptor{}, prev)
+	audit.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	// A locked or removed user's keys are all revoked, they're audited as
+	// removed from the previous metadata.
+	audit.keyChanges("alice", []string{key}, nil)
+	audit.groupEvent("alice", "google-sudoers", false)
+
+	fp, err := utils.KeyFingerprint(key)
+	if err != nil {
+		t.Fatalf("utils.KeyFingerprint(%q) = %v, want: nil", key, err)
+	}
+	when := "2023-11-14T22:13:20Z"
+	want := []auditRecord{
+		{Time: when, Event: auditKeyRemoved, User: "alice", Fingerprint: fp, Source: auditSourceInstance},
+		{Time: when, Event: auditGroupRemoved, User: "alice", Group: "google-sudoers"},
+	}
+	if !reflect.DeepEqual(audit.records, want) {
+		t.Errorf("accountsAudit.records = %+v, want: %+v", audit.records, want)
+	}
+
+	// The deprovision command doesn't audit.
+	var none *accountsAudit
+	none.userEvent(auditUserRemoved, "alice")
+	none.groupEvent("alice", "google-sudoers", false)
+	none.keyChanges("alice", []string{key}, nil)
+}
+
+func TestAccountsAuditFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "accounts.log")
+	audit := newAccountsAudit(&cfg.Accounts{AuditLog: path, AuditLogMaxSize: 1 << 20, AuditLogBackups: 1}, &metadata.Descriptor{}, nil)
+	audit.userEvent(auditUserCreated, "alice")
+	audit.userEvent(auditUserRemoved, "bob")
+
+	if err := audit.flush(context.Background()); err != nil {
+		t.Fatalf("accountsAudit.flush() = %v, want: nil", err)
+	}
+	if len(audit.records) != 0 {
+		t.Errorf("accountsAudit.flush() kept %d records, want: 0", len(audit.records))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	var users []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("json.Unmarshal(%q) = %v, want: nil", scanner.Text(), err)
+		}
+		users = append(users, record.Event+":"+record.User)
+	}
+	if want := []string{"user_created:alice", "user_removed:bob"}; !reflect.DeepEqual(users, want) {
+		t.Errorf("audit log records = %v, want: %v", users, want)
+	}
+}
+
+func TestAppendAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line := []byte(strings.Repeat("x", 9) + "\n")
+
+	// Each line fills the file up, the 4 appends rotate it 3 times and only 2
+	// backups are kept.
+	for i := 0; i < 4; i++ {
+		if err := appendAuditLog(path, line, 15, 2); err != nil {
+			t.Fatalf("appendAuditLog() = %v, want: nil", err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if string(data) != string(line) {
+			t.Errorf("%s = %q, want: %q", name, data, line)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%s.3) = %v, want: not exist", path, err)
+	}
+
+	// With no backups configured, 1 is still kept rather than dropping the
+	// records.
+	noBackups := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 3; i++ {
+		if err := appendAuditLog(noBackups, line, 15, 0); err != nil {
+			t.Fatalf("appendAuditLog() = %v, want: nil", err)
+		}
+	}
+	for _, name := range []string{noBackups, noBackups + ".1"} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != string(line) {
+			t.Errorf("%s = %q, %v, want: %q, nil", name, data, err, line)
+		}
+	}
+	if _, err := os.Stat(noBackups + ".2"); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%s.2) = %v, want: not exist", noBackups, err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%s) = %v, want: nil", path, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("audit log mode = %v, want: %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+const (
+	// userRemovalJobID reconciles the accounts once the removal grace period of
+	// a locked user expires.
+	userRemovalJobID = "accounts-user-removal"
+	// keyExpiryJobID reconciles the accounts once an installed SSH key expires.
+	keyExpiryJobID = "accounts-key-expiry"
+
+	// accountsReconcileRetry is the interval the accounts are reconciled at while a
+	// past expiry is still pending, i.e. a user removal keeps failing.
+	accountsReconcileRetry = time.Minute
+)
+
+// accountsReconcileSchedule is when an accountsReconcileJob is scheduled.
+type accountsReconcileSchedule struct {
+	// next is the time the job is scheduled for.
+	next time.Time
+	// retry is set if next had already passed, the job then runs every
+	// accountsReconcileRetry.
+	retry bool
+}
+
+var (
+	// accountsReconcileAt are the schedules of the accountsReconcileJobs, by job
+	// id.
+	accountsReconcileAt = make(map[string]accountsReconcileSchedule)
+
+	// accountsReconcileAtMu protects accountsReconcileAt.
+	accountsReconcileAtMu sync.Mutex
+)
+
+// jobIntervalUntil returns the scheduler interval for a job to run at next, 0 if
+// next is zero.
+func jobIntervalUntil(next, now time.Time) time.Duration {
+	if next.IsZero() {
+		return 0
+	}
+	// The scheduler's resolution is a second, give it one more to be late rather
+	// than early.
+	if interval := next.Sub(now).Truncate(time.Second) + time.Second; interval > time.Second {
+		return interval
+	}
+	return time.Second
+}
+
+// nextKeyExpiry returns when the first of the users' keys which haven't expired
+// yet at now expires, the zero time if none of them expires.
+func nextKeyExpiry(keys map[string][]string, now time.Time) time.Time {
+	var next time.Time
+	for _, userKeys := range keys {
+		for _, key := range userKeys {
+			expireOn, expiring, err := utils.KeyExpiration(key)
+			if err != nil || !expiring || !expireOn.After(now) {
+				continue
+			}
+			if next.IsZero() || expireOn.Before(next) {
+				next = expireOn
+			}
+		}
+	}
+	return next
+}
+
+// accountsReconcileJob reconciles the accounts manager after interval, i.e. at
+// a time the desired accounts state changes without any metadata change.
+type accountsReconcileJob struct {
+	id       string
+	interval time.Duration
+}
+
+// ID returns the job id.
+func (j *accountsReconcileJob) ID() string {
+	return j.id
+}
+
+// Interval returns the time left until the reconciliation.
+func (j *accountsReconcileJob) Interval() (time.Duration, bool) {
+	return j.interval, false
+}
+
+// ShouldEnable returns true if the interval is set.
+func (j *accountsReconcileJob) ShouldEnable(ctx context.Context) bool {
+	return j.interval > 0
+}
+
+// Run reconciles the accounts manager, which reschedules the job, see
+// scheduleAccountsReconcile. It's kept scheduled for the manager to replace it.
+func (j *accountsReconcileJob) Run(ctx context.Context) (bool, error) {
+	return true, reconcileNow(ctx, []string{"accounts"})
+}
+
+// scheduleAccountsReconcile schedules the accountsReconcileJob id to run at
+// next, or unschedules it if next is zero. It's retried every
+// accountsReconcileRetry if next isn't after now, i.e. a user removal failed.
+// The job is left as is if its schedule is unchanged.
+func scheduleAccountsReconcile(ctx context.Context, id string, next, now time.Time) {
+	accountsReconcileAtMu.Lock()
+	defer accountsReconcileAtMu.Unlock()
+
+	schedule := accountsReconcileSchedule{next: next, retry: !next.After(now)}
+	curr, found := accountsReconcileAt[id]
+	if (found && curr.next.Equal(next) && curr.retry == schedule.retry) || (!found && next.IsZero()) {
+		return
+	}
+
+	sched := scheduler.Get()
+	if found {
+		sched.UnscheduleJob(id)
+		delete(accountsReconcileAt, id)
+	}
+	if next.IsZero() {
+		return
+	}
+
+	interval := jobIntervalUntil(next, now)
+	if schedule.retry {
+		interval = accountsReconcileRetry
+	}
+	if err := sched.ScheduleJob(ctx, &accountsReconcileJob{id: id, interval: interval}, false); err != nil {
+		accountsLog.Errorf("Failed to schedule job %s: %v.", id, err)
+		return
+	}
+	accountsReconcileAt[id] = schedule
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+func TestNextKeyExpiry(t *testing.T) {
+	pubKey := utils.MakeRandRSAPubKey(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiring := func(expireOn time.Time) string {
+		return fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"%s"}`, pubKey, expireOn.Format(time.RFC3339))
+	}
+
+	tests := []struct {
+		desc string
+		keys map[string][]string
+		want time.Time
+	}{
+		{desc: "none"},
+		{
+			desc: "non expiring",
+			keys: map[string][]string{"alice": {fmt.Sprintf("ssh-rsa %s alice", pubKey)}},
+		},
+		{
+			desc: "earliest",
+			keys: map[string][]string{
+				"alice": {fmt.Sprintf("ssh-rsa %s alice", pubKey), expiring(now.Add(2 * time.Hour))},
+				"bob":   {expiring(now.Add(-time.Hour)), expiring(now.Add(90 * time.Second))},
+			},
+			want: now.Add(90 * time.Second),
+		},
+	}
+
+	for _, tc := range tests {
+		if got := nextKeyExpiry(tc.keys, now); !got.Equal(tc.want) {
+			t.Errorf("nextKeyExpiry(%s) = %s, want: %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestJobIntervalUntil(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		next time.Time
+		want time.Duration
+	}{
+		{time.Time{}, 0},
+		{now.Add(-time.Minute), time.Second},
+		{now.Add(1500 * time.Millisecond), 2 * time.Second},
+		{now.Add(time.Hour), time.Hour + time.Second},
+	}
+
+	for _, tc := range tests {
+		if got := jobIntervalUntil(tc.next, now); got != tc.want {
+			t.Errorf("jobIntervalUntil(%s) = %s, want: %s", tc.next, got, tc.want)
+		}
+	}
+}
+
+func TestScheduleAccountsReconcile(t *testing.T) {
+	ctx := context.Background()
+	id := "test-accounts-reconcile"
+	now := time.Now()
+	t.Cleanup(func() { scheduleAccountsReconcile(ctx, id, time.Time{}, now) })
+
+	next := func() time.Time {
+		for _, job := range scheduler.Get().Jobs() {
+			if job.ID == id {
+				return job.Next
+			}
+		}
+		return time.Time{}
+	}
+
+	scheduleAccountsReconcile(ctx, id, now.Add(time.Hour), now)
+	// The scheduler computes the next run asynchronously.
+	var first time.Time
+	for i := 0; i < 50 && first.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		first = next()
+	}
+	if first.IsZero() {
+		t.Fatalf("job %s isn't scheduled", id)
+	}
+
+	// Unchanged, the job is left as is, i.e. its next run doesn't move.
+	time.Sleep(1100 * time.Millisecond)
+	scheduleAccountsReconcile(ctx, id, now.Add(time.Hour), time.Now())
+	if got := next(); !got.Equal(first) {
+		t.Errorf("job %s next run = %s after an unchanged schedule, want: %s", id, got, first)
+	}
+
+	// The removal at that time failed, the same expiry is now past and retried
+	// every accountsReconcileRetry rather than after another hour.
+	scheduleAccountsReconcile(ctx, id, now.Add(time.Hour), now.Add(time.Hour+time.Second))
+	if got := accountsReconcileAt[id]; !got.retry || !got.next.Equal(now.Add(time.Hour)) {
+		t.Errorf("job %s schedule = %+v after a failed removal, want a retry of %s", id, got, now.Add(time.Hour))
+	}
+	var retry time.Time
+	for i := 0; i < 50 && (retry.IsZero() || retry.Equal(first)); i++ {
+		time.Sleep(10 * time.Millisecond)
+		retry = next()
+	}
+	if limit := time.Now().Add(accountsReconcileRetry + time.Second); retry.IsZero() || retry.After(limit) {
+		t.Errorf("job %s next run = %s after a failed removal, want it before %s", id, retry, limit)
+	}
+
+	// Still failing, the retry is left as is.
+	scheduleAccountsReconcile(ctx, id, now.Add(time.Hour), now.Add(time.Hour+time.Minute))
+	if got := next(); !got.Equal(retry) {
+		t.Errorf("job %s next run = %s after another failed removal, want: %s", id, got, retry)
+	}
+
+	// A past expiry is retried.
+	scheduleAccountsReconcile(ctx, id, now.Add(-time.Minute), now)
+	if got := accountsReconcileAt[id]; !got.retry || !got.next.Equal(now.Add(-time.Minute)) {
+		t.Errorf("job %s schedule = %+v, want a retry of %s", id, got, now.Add(-time.Minute))
+	}
+
+	scheduleAccountsReconcile(ctx, id, time.Time{}, now)
+	if _, found := accountsReconcileAt[id]; found {
+		t.Errorf("job %s is still scheduled, want: unscheduled", id)
+	}
+	for _, job := range scheduler.Get().Jobs() {
+		if job.ID == id {
+			t.Errorf("job %s is still scheduled, want: unscheduled", id)
+		}
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"syscall"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
-	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 )
 
 func getUID(path string) string {
@@ -37,20 +36,11 @@ func getUID(path string) string {
 }
 
 func createUser(ctx context.Context, username, uid string) error {
-	config := cfg.Get()
-	useradd := config.Accounts.UserAddCmd
-	if uid != "" {
-		useradd = fmt.Sprintf("%s -u %s", useradd, uid)
-	}
-	cmd, args := createUserGroupCmd(useradd, username, "")
-	return run.Quiet(ctx, cmd, args...)
+	return accountsBackend(cfg.Get().Accounts).CreateUser(ctx, username, uid)
 }
 
 func addUserToGroup(ctx context.Context, user, group string) error {
-	config := cfg.Get()
-	gpasswdadd := config.Accounts.GPasswdAddCmd
-	cmd, args := createUserGroupCmd(gpasswdadd, user, group)
-	return run.Quiet(ctx, cmd, args...)
+	return accountsBackend(cfg.Get().Accounts).AddUserToGroup(ctx, user, group)
 }
 
 func userExists(name string) (bool, error) {
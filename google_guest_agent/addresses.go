@@ -27,12 +27,15 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 var (
+	// networkLog logs the entries of the network component.
+	networkLog = logfields.Component(logfields.ComponentNetwork)
+
 	addressKey        = regKeyBase + `\ForwardedIps`
 	oldWSFCAddresses  string
 	oldWSFCEnable     bool
@@ -40,7 +43,17 @@ var (
 	interfaces        []net.Interface
 )
 
-type addressMgr struct{}
+func init() {
+	registerManager(&managerSpec{
+		name: "address",
+		new:  func() manager { return &addressMgr{} },
+	})
+}
+
+type addressMgr struct {
+	// applied counts the routes, or addresses on windows, added or removed by Set().
+	applied int
+}
 
 func (a *addressMgr) parseWSFCAddresses(config *cfg.Sections) string {
 	if config.WSFC != nil && config.WSFC.Addresses != "" {
@@ -104,12 +117,17 @@ func compareRoutes(configuredRoutes, desiredRoutes []string) (toAdd, toRm []stri
 var badMAC []string
 
 func getInterfaceByMAC(mac string) (net.Interface, error) {
+	return findInterfaceByMAC(interfaces, mac)
+}
+
+// findInterfaceByMAC returns the interface of ifaces with the hardware address mac.
+func findInterfaceByMAC(ifaces []net.Interface, mac string) (net.Interface, error) {
 	hwaddr, err := net.ParseMAC(mac)
 	if err != nil {
 		return net.Interface{}, err
 	}
 
-	for _, iface := range interfaces {
+	for _, iface := range ifaces {
 		if iface.HardwareAddr.String() == hwaddr.String() {
 			return iface, nil
 		}
@@ -200,6 +218,12 @@ func removeLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname stri
 // If WSFCAddresses is set (with or without EnableWSFC), only ips in the list will be filtered out.
 // TODO return a filtered list rather than modifying the metadata object. liamh@15-11-19
 func (a *addressMgr) applyWSFCFilter(config *cfg.Sections) {
+	newMetadata.Instance.NetworkInterfaces = a.wsfcFilteredInterfaces(config, newMetadata.Instance.NetworkInterfaces)
+}
+
+// wsfcFilteredInterfaces returns a copy of nics with the forwarded ips filtered out
+// as described in applyWSFCFilter, nics is left unchanged.
+func (a *addressMgr) wsfcFilteredInterfaces(config *cfg.Sections, nics []metadata.NetworkInterfaces) []metadata.NetworkInterfaces {
 	wsfcAddresses := a.parseWSFCAddresses(config)
 
 	var wsfcAddrs []string
@@ -209,15 +233,15 @@ func (a *addressMgr) applyWSFCFilter(config *cfg.Sections) {
 		}
 
 		if net.ParseIP(wsfcAddr) == nil {
-			logger.Errorf("Address for WSFC is not in valid form %s", wsfcAddr)
+			networkLog.Errorf("Address for WSFC is not in valid form %s", wsfcAddr)
 			continue
 		}
 
 		wsfcAddrs = append(wsfcAddrs, wsfcAddr)
 	}
 
+	interfaces := append([]metadata.NetworkInterfaces(nil), nics...)
 	if len(wsfcAddrs) != 0 {
-		interfaces := newMetadata.Instance.NetworkInterfaces
 		for idx := range interfaces {
 			var filteredForwardedIps []string
 			for _, ip := range interfaces[idx].ForwardedIps {
@@ -238,12 +262,13 @@ func (a *addressMgr) applyWSFCFilter(config *cfg.Sections) {
 	} else {
 		wsfcEnable := a.parseWSFCEnable(config)
 		if wsfcEnable {
-			for idx := range newMetadata.Instance.NetworkInterfaces {
-				newMetadata.Instance.NetworkInterfaces[idx].ForwardedIps = nil
-				newMetadata.Instance.NetworkInterfaces[idx].TargetInstanceIps = nil
+			for idx := range interfaces {
+				interfaces[idx].ForwardedIps = nil
+				interfaces[idx].TargetInstanceIps = nil
 			}
 		}
 	}
+	return interfaces
 }
 
 func (a *addressMgr) Diff(ctx context.Context) (bool, error) {
@@ -298,15 +323,15 @@ func (a *addressMgr) Set(ctx context.Context) error {
 
 	if config.NetworkInterfaces.Setup {
 		if runtime.GOOS != "windows" {
-			logger.Debugf("Configure IPv6")
+			networkLog.Debugf("Configure IPv6")
 			if err := configureIPv6(ctx); err != nil {
 				// Continue through IPv6 configuration errors.
-				logger.Errorf("Error configuring IPv6: %v", err)
+				networkLog.Errorf("Error configuring IPv6: %v", err)
 			}
 		}
 
 		if runtime.GOOS != "windows" && !interfacesEnabled {
-			logger.Debugf("Enable network interfaces")
+			networkLog.Debugf("Enable network interfaces")
 			if err := enableNetworkInterfaces(ctx, config); err != nil {
 				return err
 			}
@@ -318,66 +343,23 @@ func (a *addressMgr) Set(ctx context.Context) error {
 		return nil
 	}
 
-	logger.Debugf("Add routes for aliases, forwarded IP and target-instance IPs")
+	networkLog.Debugf("Add routes for aliases, forwarded IP and target-instance IPs")
 	// Add routes for IP aliases, forwarded and target-instance IPs.
 	for _, ni := range newMetadata.Instance.NetworkInterfaces {
 		iface, err := getInterfaceByMAC(ni.Mac)
 		if err != nil {
 			if !utils.ContainsString(ni.Mac, badMAC) {
-				logger.Errorf("Error getting interface: %s", err)
+				networkLog.Errorf("Error getting interface: %s", err)
 				badMAC = append(badMAC, ni.Mac)
 			}
 			continue
 		}
-		wantIPs := ni.ForwardedIps
-		wantIPs = append(wantIPs, ni.ForwardedIpv6s...)
-		if config.IPForwarding.TargetInstanceIPs {
-			wantIPs = append(wantIPs, ni.TargetInstanceIps...)
-		}
-		// IP Aliases are not supported on windows.
-		if runtime.GOOS != "windows" && config.IPForwarding.IPAliases {
-			wantIPs = append(wantIPs, ni.IPAliases...)
-		}
-
-		var forwardedIPs []string
-		var configuredIPs []string
-		if runtime.GOOS == "windows" {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				logger.Errorf("Error getting addresses for interface %s: %s", iface.Name, err)
-			}
-			for _, addr := range addrs {
-				configuredIPs = append(configuredIPs, strings.TrimSuffix(addr.String(), "/32"))
-			}
-			regFwdIPs, err := getForwardsFromRegistry(ni.Mac)
-			if err != nil {
-				logger.Errorf("Error getting forwards from registry: %s", err)
-				continue
-			}
-			for _, ip := range configuredIPs {
-				// Only add to `forwardedIPs` if it is recorded in the registry.
-				if utils.ContainsString(ip, regFwdIPs) {
-					forwardedIPs = append(forwardedIPs, ip)
-				}
-			}
-		} else {
-			forwardedIPs, err = getLocalRoutes(ctx, config, iface.Name)
-			if err != nil {
-				logger.Errorf("Error getting routes: %v", err)
-				continue
-			}
-		}
-
-		// Trims any '/32' suffix for consistency.
-		trimSuffix := func(entries []string) []string {
-			var res []string
-			for _, entry := range entries {
-				res = append(res, strings.TrimSuffix(entry, "/32"))
-			}
-			return res
+		wantIPs, forwardedIPs, configuredIPs, err := interfaceIPs(ctx, config, ni, iface)
+		if err != nil {
+			networkLog.With(logfields.KeyInterface, iface.Name).WithError(err).Errorf("Error getting IPs of interface.")
+			continue
 		}
-		forwardedIPs = trimSuffix(forwardedIPs)
-		wantIPs = trimSuffix(wantIPs)
+		fields := networkLog.With(logfields.KeyInterface, iface.Name)
 
 		toAdd, toRm := compareRoutes(forwardedIPs, wantIPs)
 
@@ -393,7 +375,7 @@ func (a *addressMgr) Set(ctx context.Context) error {
 				}
 				msg += fmt.Sprintf(" removing %q", toRm)
 			}
-			logger.Infof(msg)
+			fields.Infof("%s", msg)
 		}
 
 		var registryEntries []string
@@ -414,8 +396,10 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			}
 			if err == nil {
 				registryEntries = append(registryEntries, ip)
+				routesAdded.Inc()
+				a.applied++
 			} else {
-				logger.Errorf("error adding route: %v", err)
+				fields.WithError(err).Errorf("Error adding route %s.", ip)
 			}
 		}
 
@@ -430,15 +414,18 @@ func (a *addressMgr) Set(ctx context.Context) error {
 				err = removeLocalRoute(ctx, config, ip, iface.Name)
 			}
 			if err != nil {
-				logger.Errorf("error removing route: %v", err)
+				fields.WithError(err).Errorf("Error removing route %s.", ip)
 				// Add IPs we fail to remove to registry to maintain accurate record.
 				registryEntries = append(registryEntries, ip)
+			} else {
+				routesRemoved.Inc()
+				a.applied++
 			}
 		}
 
 		if runtime.GOOS == "windows" {
 			if err := writeRegMultiString(addressKey, ni.Mac, registryEntries); err != nil {
-				logger.Errorf("error writing registry: %s", err)
+				networkLog.Errorf("error writing registry: %s", err)
 			}
 		}
 	}
@@ -446,6 +433,126 @@ func (a *addressMgr) Set(ctx context.Context) error {
 	return nil
 }
 
+// Applied returns the number of routes, or addresses on windows, added or removed
+// by Set().
+func (a *addressMgr) Applied() int {
+	return a.applied
+}
+
+// Plan returns the network interfaces the manager would enable and the routes, or
+// addresses on windows, it would add or remove.
+func (a *addressMgr) Plan(ctx context.Context) ([]string, error) {
+	config := cfg.Get()
+
+	// Plan must not change what the next Set() does, it works on copies of
+	// the interfaces and of the metadata network interfaces.
+	nics := newMetadata.Instance.NetworkInterfaces
+	if runtime.GOOS == "windows" {
+		nics = a.wsfcFilteredInterfaces(config, nics)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error populating interfaces: %v", err)
+	}
+
+	var res []string
+	if config.NetworkInterfaces.Setup && runtime.GOOS != "windows" && !interfacesEnabled && len(nics) > 1 {
+		res = append(res, fmt.Sprintf("enable %d secondary network interface(s)", len(nics)-1))
+	}
+
+	if !config.NetworkInterfaces.IPForwarding {
+		return res, nil
+	}
+
+	kind := "route"
+	if runtime.GOOS == "windows" {
+		kind = "address"
+	}
+
+	for _, ni := range nics {
+		iface, err := findInterfaceByMAC(ifaces, ni.Mac)
+		if err != nil {
+			res = append(res, fmt.Sprintf("skip interface %s: %v", ni.Mac, err))
+			continue
+		}
+		wantIPs, forwardedIPs, configuredIPs, err := interfaceIPs(ctx, config, ni, iface)
+		if err != nil {
+			res = append(res, fmt.Sprintf("skip interface %s: %v", iface.Name, err))
+			continue
+		}
+
+		toAdd, toRm := compareRoutes(forwardedIPs, wantIPs)
+		for _, ip := range toAdd {
+			if runtime.GOOS == "windows" && utils.ContainsString(ip, configuredIPs) {
+				continue
+			}
+			res = append(res, fmt.Sprintf("add %s %s on %s", kind, ip, iface.Name))
+		}
+		for _, ip := range toRm {
+			if runtime.GOOS == "windows" && !utils.ContainsString(ip, configuredIPs) {
+				continue
+			}
+			res = append(res, fmt.Sprintf("remove %s %s from %s", kind, ip, iface.Name))
+		}
+	}
+
+	return res, nil
+}
+
+// interfaceIPs returns the IPs metadata wants forwarded to the interface ni, the
+// IPs currently forwarded to it and, on windows, the addresses configured on it.
+// The '/32' suffix is trimmed from the forwarded and wanted IPs for consistency.
+func interfaceIPs(ctx context.Context, config *cfg.Sections, ni metadata.NetworkInterfaces, iface net.Interface) ([]string, []string, []string, error) {
+	wantIPs := ni.ForwardedIps
+	wantIPs = append(wantIPs, ni.ForwardedIpv6s...)
+	if config.IPForwarding.TargetInstanceIPs {
+		wantIPs = append(wantIPs, ni.TargetInstanceIps...)
+	}
+	// IP Aliases are not supported on windows.
+	if runtime.GOOS != "windows" && config.IPForwarding.IPAliases {
+		wantIPs = append(wantIPs, ni.IPAliases...)
+	}
+
+	var forwardedIPs []string
+	var configuredIPs []string
+	if runtime.GOOS == "windows" {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			networkLog.Errorf("Error getting addresses for interface %s: %s", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			configuredIPs = append(configuredIPs, strings.TrimSuffix(addr.String(), "/32"))
+		}
+		regFwdIPs, err := getForwardsFromRegistry(ni.Mac)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error getting forwards from registry: %s", err)
+		}
+		for _, ip := range configuredIPs {
+			// Only add to `forwardedIPs` if it is recorded in the registry.
+			if utils.ContainsString(ip, regFwdIPs) {
+				forwardedIPs = append(forwardedIPs, ip)
+			}
+		}
+	} else {
+		var err error
+		forwardedIPs, err = getLocalRoutes(ctx, config, iface.Name)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error getting routes: %v", err)
+		}
+	}
+
+	// Trims any '/32' suffix for consistency.
+	trimSuffix := func(entries []string) []string {
+		var res []string
+		for _, entry := range entries {
+			res = append(res, strings.TrimSuffix(entry, "/32"))
+		}
+		return res
+	}
+	return trimSuffix(wantIPs), trimSuffix(forwardedIPs), configuredIPs, nil
+}
+
 // Enables or disables IPv6 on network interfaces.
 func configureIPv6(ctx context.Context) error {
 	var newNi, oldNi metadata.NetworkInterfaces
@@ -516,7 +623,7 @@ func enableNetworkInterfaces(ctx context.Context, config *cfg.Sections) error {
 		iface, err := getInterfaceByMAC(ni.Mac)
 		if err != nil {
 			if !utils.ContainsString(ni.Mac, badMAC) {
-				logger.Errorf("Error getting interface: %s", err)
+				networkLog.Errorf("Error getting interface: %s", err)
 				badMAC = append(badMAC, ni.Mac)
 			}
 			continue
@@ -532,7 +639,7 @@ func enableNetworkInterfaces(ctx context.Context, config *cfg.Sections) error {
 		iface, err := getInterfaceByMAC(ni.Mac)
 		if err != nil {
 			if !utils.ContainsString(ni.Mac, badMAC) {
-				logger.Errorf("Error getting interface: %s", err)
+				networkLog.Errorf("Error getting interface: %s", err)
 				badMAC = append(badMAC, ni.Mac)
 			}
 			continue
@@ -586,7 +693,7 @@ func enableSLESInterfaces(ctx context.Context, interfaces []string) error {
 	var err error
 	var priority = 10100
 	for _, iface := range interfaces {
-		logger.Debugf("write enabling ifcfg-%s config", iface)
+		networkLog.Debugf("write enabling ifcfg-%s config", iface)
 
 		var ifcfg *os.File
 		ifcfg, err = os.Create("/etc/sysconfig/network/ifcfg-" + iface)
@@ -613,7 +720,7 @@ func enableSLESInterfaces(ctx context.Context, interfaces []string) error {
 
 // disableNM writes an ifcfg file with DHCP and NetworkManager disabled.
 func disableNM(iface string) error {
-	logger.Debugf("write disabling ifcfg-%s config", iface)
+	networkLog.Debugf("write disabling ifcfg-%s config", iface)
 	filename := "/etc/sysconfig/network-scripts/ifcfg-" + iface
 	ifcfg, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err == nil {
@@ -215,3 +215,25 @@ func TestWsfcFlagTriggerAddressDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestWSFCFilteredInterfacesCopy(t *testing.T) {
+	reloadConfig(t, nil)
+
+	var md metadata.Descriptor
+	mdJSON := `{"instance":{"attributes":{"enable-wsfc":"true"}, "networkInterfaces":[{"forwardedIps":["192.168.0.0"],"targetInstanceIps":["192.168.0.1"]}]}}`
+	if err := json.Unmarshal([]byte(mdJSON), &md); err != nil {
+		t.Fatalf("failed to unmarshal test JSON: %v", err)
+	}
+	newMetadata = &md
+
+	testAddress := addressMgr{}
+	got := testAddress.wsfcFilteredInterfaces(cfg.Get(), md.Instance.NetworkInterfaces)
+	if len(got) != 1 || got[0].ForwardedIps != nil || got[0].TargetInstanceIps != nil {
+		t.Errorf("wsfcFilteredInterfaces() = %+v, want the forwarded and target instance ips filtered out", got)
+	}
+
+	ni := md.Instance.NetworkInterfaces[0]
+	if !reflect.DeepEqual(ni.ForwardedIps, []string{"192.168.0.0"}) || !reflect.DeepEqual(ni.TargetInstanceIps, []string{"192.168.0.1"}) {
+		t.Errorf("wsfcFilteredInterfaces() modified the metadata network interfaces: %+v", ni)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"github.com/GoogleCloudPlatform/guest-agent/metrics"
+)
+
+const metricsPath = "/metrics"
+
+var (
+	managerSetDuration = metrics.NewHistogram("guest_agent_manager_set_duration_seconds",
+		"Duration of the managers' Set() calls by manager.", metrics.LongBuckets, "manager")
+	managerFailures = metrics.NewCounter("guest_agent_manager_failures_total",
+		"Number of failed manager runs, including timeouts and panics, by manager.", "manager")
+	usersCreated = metrics.NewCounter("guest_agent_users_created_total",
+		"Number of user accounts created.")
+	usersRemoved = metrics.NewCounter("guest_agent_users_removed_total",
+		"Number of Google user accounts removed or deprovisioned.")
+	routesAdded = metrics.NewCounter("guest_agent_routes_added_total",
+		"Number of forwarded IP routes, or addresses on windows, added.")
+	routesRemoved = metrics.NewCounter("guest_agent_routes_removed_total",
+		"Number of forwarded IP routes, or addresses on windows, removed.")
+	snapshotHookDuration = metrics.NewHistogram("guest_agent_snapshot_hook_duration_seconds",
+		"Duration of the snapshot hook scripts by hook (pre or post) and result (success or error).",
+		metrics.LongBuckets, "hook", "result")
+)
+
+// listenMetrics returns a listener on the configured socket path, or address
+// which must be a loopback one.
+func listenMetrics(config *cfg.Metrics) (net.Listener, error) {
+	if config.SocketPath != "" {
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("metrics socket_path is not supported on windows")
+		}
+		return listenPrivateSocket(config.SocketPath)
+	}
+
+	host, _, err := net.SplitHostPort(config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address %q: %v", config.Address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("metrics address %q is not a loopback address", config.Address)
+	}
+
+	return net.Listen("tcp", config.Address)
+}
+
+// startMetricsServer serves the metrics in the Prometheus text format until ctx
+// is cancelled, if enabled.
+func startMetricsServer(ctx context.Context, config *cfg.Metrics) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	listener, err := listenMetrics(config)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metrics.Handler())
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			logfields.Errorf("Failed to close metrics server: %+v", err)
+		}
+	}()
+
+	go func() {
+		logfields.Infof("Serving metrics on %s%s", listener.Addr(), metricsPath)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logfields.Errorf("Metrics server failed: %+v", err)
+		}
+	}()
+
+	return nil
+}
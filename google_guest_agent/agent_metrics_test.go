@@ -0,0 +1,100 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestListenMetrics(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "127.0.0.1:0"},
+		{address: "localhost:0"},
+		{address: "[::1]:0"},
+		{address: "0.0.0.0:0", wantErr: true},
+		{address: "10.128.0.2:9952", wantErr: true},
+		{address: "9952", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.address, func(t *testing.T) {
+			listener, err := listenMetrics(&cfg.Metrics{Address: tc.address})
+			if tc.wantErr {
+				if err == nil {
+					listener.Close()
+					t.Fatalf("listenMetrics(%s) succeeded, want error", tc.address)
+				}
+				return
+			}
+			if err != nil {
+				// IPv6 may not be available in the test environment.
+				if strings.HasPrefix(tc.address, "[") {
+					t.Skipf("listenMetrics(%s) failed: %+v", tc.address, err)
+				}
+				t.Fatalf("listenMetrics(%s) failed: %+v", tc.address, err)
+			}
+			listener.Close()
+		})
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := listenMetrics(&cfg.Metrics{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("listenMetrics() failed: %+v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if err := startMetricsServer(ctx, &cfg.Metrics{Enabled: true, Address: address}); err != nil {
+		t.Fatalf("startMetricsServer() failed: %+v", err)
+	}
+
+	managerFailures.Inc("test-metrics")
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", address, metricsPath))
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %+v", err)
+	}
+
+	for _, want := range []string{
+		`guest_agent_manager_failures_total{manager="test-metrics"} 1`,
+		"# TYPE guest_agent_metadata_requests_total counter",
+		"# TYPE guest_agent_scheduler_job_runs_total counter",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("GET %s returned:\n%s\nwant it to contain %q", metricsPath, body, want)
+		}
+	}
+}
@@ -22,8 +22,8 @@ import (
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/uefi"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"github.com/google/go-tpm-tools/client"
 	"github.com/google/go-tpm-tools/proto/tpm"
 	"github.com/google/go-tpm/legacy/tpm2"
@@ -73,7 +73,7 @@ func (j *CredsJob) readRootCACert(name uefi.VariableName) (*uefi.Variable, error
 		return nil, fmt.Errorf("unable to verify Root CA cert: %w", err)
 	}
 
-	logger.Infof("Successfully read root CA Cert from %+v", name)
+	logfields.Infof("Successfully read root CA Cert from %+v", name)
 	return rootCACert, nil
 }
 
@@ -160,7 +160,7 @@ func (j *CredsJob) fetchClientCredentials(ctx context.Context, rootCA string) ([
 // $cert = Get-ChildItem Cert:\LocalMachine\My | Where-Object { $_.Issuer -like "*google.internal*" }
 // Invoke-RestMethod -Uri https://169.254.169.254 -Method Get -Headers @{"Metadata-Flavor"="Google"} -Certificate $cert
 func (j *CredsJob) Run(ctx context.Context) (bool, error) {
-	logger.Infof("Fetching Root CA cert...")
+	logfields.Infof("Fetching Root CA cert...")
 
 	v, err := j.readRootCACert(googleRootCACertUEFIVar)
 	if err != nil {
@@ -171,7 +171,7 @@ func (j *CredsJob) Run(ctx context.Context) (bool, error) {
 		return true, fmt.Errorf("failed to store Root CA cert with an error: %w", err)
 	}
 
-	logger.Infof("Fetching client credentials...")
+	logfields.Infof("Fetching client credentials...")
 
 	creds, err := j.fetchClientCredentials(ctx, filepath.Join(defaultCredsDir, rootCACertFileName))
 	if err != nil {
@@ -182,7 +182,7 @@ func (j *CredsJob) Run(ctx context.Context) (bool, error) {
 		return true, fmt.Errorf("failed to store client credentials with an error: %w", err)
 	}
 
-	logger.Infof("Successfully bootstrapped MDS mTLS credentials")
+	logfields.Infof("Successfully bootstrapped MDS mTLS credentials")
 	return true, nil
 }
 
@@ -201,7 +201,7 @@ func (j *CredsJob) Interval() (time.Duration, bool) {
 func (j *CredsJob) ShouldEnable(ctx context.Context) bool {
 	_, err := j.client.GetKey(ctx, clientCertsKey, nil)
 	if err != nil {
-		logger.Warningf("Skipping scheduling credential generation job, failed to reach client credentials endpoint(%s) with error: %v", clientCertsKey, err)
+		logfields.Warningf("Skipping scheduling credential generation job, failed to reach client credentials endpoint(%s) with error: %v", clientCertsKey, err)
 		return false
 	}
 	return true
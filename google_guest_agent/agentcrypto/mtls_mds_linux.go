@@ -22,8 +22,8 @@ import (
 	"path/filepath"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 const (
@@ -61,7 +61,7 @@ func (j *CredsJob) writeRootCACert(ctx context.Context, content []byte, outputFi
 
 	// Best effort to update system store, don't fail.
 	if err := updateSystemStore(ctx, outputFile); err != nil {
-		logger.Errorf("Failed add Root MDS cert to system trust store with error: %v", err)
+		logfields.Errorf("Failed add Root MDS cert to system trust store with error: %v", err)
 	}
 
 	return nil
@@ -130,6 +130,6 @@ func updateSystemStore(ctx context.Context, cert string) error {
 		return fmt.Errorf("command %q failed with error: %s", cmd, res.Error())
 	}
 
-	logger.Infof("Certificate %q added to system store successfully %s", cert, res.StdOut)
+	logfields.Infof("Certificate %q added to system store successfully %s", cert, res.StdOut)
 	return nil
 }
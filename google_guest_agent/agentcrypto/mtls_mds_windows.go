@@ -25,8 +25,8 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"golang.org/x/sys/windows"
 	"software.sslmate.com/src/go-pkcs12"
 )
@@ -62,7 +62,7 @@ func (j *CredsJob) writeRootCACert(_ context.Context, cacert []byte, outputFile
 	// Try to fetch previous certificate's serial number before it gets overwritten.
 	num, err := serialNumber(outputFile)
 	if err != nil {
-		logger.Debugf("No previous MDS root certificate was found, will skip cleanup: %v", err)
+		logfields.Debugf("No previous MDS root certificate was found, will skip cleanup: %v", err)
 	}
 
 	if err := utils.SaferWriteFile(cacert, outputFile, 0644); err != nil {
@@ -100,12 +100,12 @@ func (j *CredsJob) writeRootCACert(_ context.Context, cacert []byte, outputFile
 	// may be about to expire.
 	oldCtx, err := findCert(root, certificateIssuer, num)
 	if err != nil {
-		logger.Warningf("Failed to find previous MDS root certificate with error: %v", err)
+		logfields.Warningf("Failed to find previous MDS root certificate with error: %v", err)
 		return nil
 	}
 
 	if err := deleteCert(oldCtx, root); err != nil {
-		logger.Warningf("Failed to delete previous MDS root certificate(%s) with error: %v", num, err)
+		logfields.Warningf("Failed to delete previous MDS root certificate(%s) with error: %v", num, err)
 		return nil
 	}
 
@@ -114,7 +114,7 @@ func (j *CredsJob) writeRootCACert(_ context.Context, cacert []byte, outputFile
 
 // findCert finds and returns certificate issued by issuer with the serial number in the given the store.
 func findCert(storeName, issuer, certID string) (*windows.CertContext, error) {
-	logger.Infof("Searching for certificate with serial number %s in store %s by issuer %s", certID, storeName, issuer)
+	logfields.Infof("Searching for certificate with serial number %s in store %s by issuer %s", certID, storeName, issuer)
 
 	st, err := windows.CertOpenStore(
 		windows.CERT_STORE_PROV_SYSTEM,
@@ -135,7 +135,7 @@ func findCert(storeName, issuer, certID string) (*windows.CertContext, error) {
 	// maxCertEnumeration would avoid requiring a infinite loop that relies on enumerating
 	// until we get nil crt.
 	for i := 1; i <= maxCertEnumeration; i++ {
-		logger.Debugf("Attempt %d, searching certificate...", i)
+		logfields.Debugf("Attempt %d, searching certificate...", i)
 
 		// https://learn.microsoft.com/en-us/windows/win32/api/wincrypt/nf-wincrypt-certfindcertificateinstore
 		crt, err := windows.CertFindCertificateInStore(
@@ -172,7 +172,7 @@ func findCert(storeName, issuer, certID string) (*windows.CertContext, error) {
 func (j *CredsJob) writeClientCredentials(creds []byte, outputFile string) error {
 	num, err := serialNumber(outputFile)
 	if err != nil {
-		logger.Warningf("Could not get previous serial number, will skip cleanup: %v", err)
+		logfields.Warningf("Could not get previous serial number, will skip cleanup: %v", err)
 	}
 
 	if err := utils.SaferWriteFile(creds, outputFile, 0644); err != nil {
@@ -219,13 +219,13 @@ func (j *CredsJob) writeClientCredentials(creds []byte, outputFile string) error
 	if prevCtx == nil && num != "" {
 		prevCtx, err = findCert(my, certificateIssuer, num)
 		if err != nil {
-			logger.Warningf("Failed to find previous certificate with error: %v", err)
+			logfields.Warningf("Failed to find previous certificate with error: %v", err)
 		}
 	}
 
 	// Remove previous certificate only after successful refresh.
 	if err := deleteCert(prevCtx, my); err != nil {
-		logger.Warningf("Failed to delete previous certificate(%s) with error: %v", num, err)
+		logfields.Warningf("Failed to delete previous certificate(%s) with error: %v", num, err)
 	}
 
 	prevCtx = windows.CertDuplicateCertificateContext(crtCtx)
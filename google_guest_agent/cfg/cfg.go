@@ -16,8 +16,14 @@
 package cfg
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/go-ini/ini"
 )
@@ -27,6 +33,22 @@ var (
 	// should always return it.
 	instance *Sections
 
+	// effective is the effective configuration values and their provenance, it's
+	// loaded along with instance.
+	effective []*Value
+
+	// extraDefaults is the extra defaults provided in the last Load() call, it's kept
+	// so the configuration can be reloaded when the metadata overrides change.
+	extraDefaults []byte
+
+	// metadataFragments is the metadata provided configuration overrides, they take
+	// precedence over all the other data sources but the environment variables.
+	metadataFragments []metadataFragment
+
+	// mutex protects instance, effective, extraDefaults and metadataFragments, the
+	// configuration may be reloaded at runtime.
+	mutex sync.RWMutex
+
 	// configFile is a pointer to a function which takes the current OS name and returns
 	// an appropriate config file name. Replaceable by unit tests.
 	configFile = defaultConfigFile
@@ -34,6 +56,10 @@ var (
 	// dataSource is a pointer to a data source loading/defining function, unit tests will
 	// want to change this pointer to whatever makes sense to its implementation.
 	dataSources = defaultDataSources
+
+	// loginDefsFile is login.defs(5), its UID_MIN is the default
+	// protected_uid_threshold. Replaceable by unit tests.
+	loginDefsFile = "/etc/login.defs"
 )
 
 const (
@@ -42,15 +68,38 @@ const (
 
 	defaultConfig = `
 [Accounts]
+archive_dir =
+audit_guest_attribute = false
+audit_log =
+audit_log_backups = 5
+audit_log_max_size = 10485760
+backend = command
+default_role = admin
 deprovision_remove = false
+expiry_time_option = auto
 gpasswd_add_cmd = gpasswd -a {user} {group}
 gpasswd_remove_cmd = gpasswd -d {user} {group}
 groupadd_cmd = groupadd {group}
 groups = adm,dip,docker,lxd,plugdev,video
+key_forbidden_options =
+key_min_rsa_bits = 0
+key_require_security_key = false
+key_types =
+lock_cmd = usermod -L -s /sbin/nologin {user}
+protected_uid_threshold = 1000
+protected_users = root,nobody
+removal_grace_period = 0
 reuse_homedir = false
+uid_policy = system
+uid_range = 200000-299999
+unlock_cmd = usermod -U -s {shell} {user}
 useradd_cmd = useradd -m -s /bin/bash -p * {user}
 userdel_cmd = userdel -r {user}
 
+[Control]
+enabled = false
+socket_path = /run/google-guest-agent/control.sock
+
 [Daemons]
 accounts_daemon = true
 clock_skew_daemon = true
@@ -83,6 +132,11 @@ startup = true
 startup-windows = true
 sysprep-specialize = true
 
+[Logging]
+format = text
+level = info
+override_ttl = 3600
+
 [NetworkInterfaces]
 dhcp_command =
 ip_forwarding = true
@@ -94,6 +148,24 @@ cert_authentication = true
 [MDS]
 mtls_bootstrapping_enabled = true
 
+[Managers]
+default_timeout = 300
+failure_backoff = 600
+failure_policy = skip
+max_failures = 5
+reconcile_interval = 0
+reconcile_intervals =
+timeouts =
+
+[Metrics]
+address = 127.0.0.1:9952
+enabled = false
+socket_path =
+
+[MetadataOverrides]
+allowed_sections =
+enabled = false
+
 [Snapshots]
 enabled = false
 snapshot_service_ip = 169.254.169.254
@@ -101,6 +173,9 @@ snapshot_service_port = 8081
 timeout_in_seconds = 60
 
 [Unstable]
+
+[Watchdog]
+dispatch_timeout = 1800
 `
 )
 
@@ -121,6 +196,9 @@ type Sections struct {
 	// pointer is nil or not.
 	AddressManager *AddressManager `ini:"addressManager,omitempty"`
 
+	// Control defines the local control API served over a Unix domain socket.
+	Control *Control `ini:"Control,omitempty"`
+
 	// Daemons defines the availability of clock skew, network and account managers.
 	Daemons *Daemons `ini:"Daemons,omitempty"`
 
@@ -140,6 +218,10 @@ type Sections struct {
 	// host keys etc.
 	InstanceSetup *InstanceSetup `ini:"InstanceSetup,omitempty"`
 
+	// Logging defines the log format of the guest agent binaries and the guest
+	// agent's log levels.
+	Logging *Logging `ini:"Logging,omitempty"`
+
 	// MetadataScripts contains the configurations of the metadata-scripts service.
 	MetadataScripts *MetadataScripts `ini:"MetadataScripts,omitempty"`
 
@@ -153,6 +235,18 @@ type Sections struct {
 	// MDS defines the MDS configuration options.
 	MDS *MDS `ini:"MDS,omitempty"`
 
+	// Managers defines the managers' timeouts and the policy applied to managers
+	// failing repeatedly.
+	Managers *Managers `ini:"Managers,omitempty"`
+
+	// Metrics defines if and where the agent's metrics are exposed.
+	Metrics *Metrics `ini:"Metrics,omitempty"`
+
+	// MetadataOverrides defines if and which sections may be overridden by the
+	// guest-agent-config metadata attribute. This section itself can never be
+	// overridden by metadata.
+	MetadataOverrides *MetadataOverrides `ini:"MetadataOverrides,omitempty"`
+
 	// Snpashots defines the snapshot listener configuration and behavior i.e. the server address and port.
 	Snapshots *Snapshots `ini:"Snapshots,omitempty"`
 
@@ -160,6 +254,9 @@ type Sections struct {
 	// guaranteed for any keys under this section. No application, script or utility should rely on it.
 	Unstable *Unstable `ini:"Unstable,omitempty"`
 
+	// Watchdog defines when the agent is considered stuck by the systemd watchdog.
+	Watchdog *Watchdog `ini:"Watchdog,omitempty"`
+
 	// WSFC defines the wsfc configurations. It takes precedence over instance's and project's
 	// metadata configuration. The default configuration doesn't define values to it, if the user
 	// has defined it then we shouldn't even consider metadata values. Users must check if this
@@ -174,14 +271,70 @@ type AccountManager struct {
 
 // Accounts contains the configurations of Accounts section.
 type Accounts struct {
+	// ArchiveDir is where the home directories of the users removed with
+	// deprovision_remove are archived before the removal, if set.
+	ArchiveDir string `ini:"archive_dir,omitempty"`
+	// AuditGuestAttribute publishes the summary of the audit records of each run
+	// to the guest-agent/accounts-audit guest attribute.
+	AuditGuestAttribute bool `ini:"audit_guest_attribute,omitempty"`
+	// AuditLog is the file the account and key changes are audited to as JSON
+	// lines, if set.
+	AuditLog string `ini:"audit_log,omitempty"`
+	// AuditLogBackups is the number of rotated audit log files kept, at least 1
+	// is.
+	AuditLogBackups int `ini:"audit_log_backups,omitempty"`
+	// AuditLogMaxSize is the size, in bytes, past which the audit log is rotated,
+	// 0 disables the rotation.
+	AuditLogMaxSize int `ini:"audit_log_max_size,omitempty"`
+	// Backend is the accounts backend, command runs the *_cmd commands and native
+	// edits the account database files itself.
+	Backend string `ini:"backend,omitempty"`
+	// DefaultRole is the role of the users the guest-agent-user-roles metadata
+	// attribute doesn't assign one, admin users are members of google-sudoers.
+	DefaultRole       string `ini:"default_role,omitempty"`
 	DeprovisionRemove bool   `ini:"deprovision_remove,omitempty"`
-	GPasswdAddCmd     string `ini:"gpasswd_add_cmd,omitempty"`
-	GPasswdRemoveCmd  string `ini:"gpasswd_remove_cmd,omitempty"`
-	GroupAddCmd       string `ini:"groupadd_cmd,omitempty"`
-	Groups            string `ini:"groups,omitempty"`
-	ReuseHomedir      bool   `ini:"reuse_homedir,omitempty"`
-	UserAddCmd        string `ini:"useradd_cmd,omitempty"`
-	UserDelCmd        string `ini:"userdel_cmd,omitempty"`
+	// ExpiryTimeOption adds OpenSSH expiry-time options to the expiring keys,
+	// auto if the installed sshd supports them.
+	ExpiryTimeOption string `ini:"expiry_time_option,omitempty"`
+	GPasswdAddCmd    string `ini:"gpasswd_add_cmd,omitempty"`
+	GPasswdRemoveCmd string `ini:"gpasswd_remove_cmd,omitempty"`
+	GroupAddCmd      string `ini:"groupadd_cmd,omitempty"`
+	Groups           string `ini:"groups,omitempty"`
+	// KeyForbiddenOptions is a comma separated list of the authorized keys
+	// options, i.e. command, the metadata SSH keys are rejected with.
+	KeyForbiddenOptions string `ini:"key_forbidden_options,omitempty"`
+	// KeyMinRSABits is the minimum size of the metadata RSA keys, 0 accepts any.
+	KeyMinRSABits int `ini:"key_min_rsa_bits,omitempty"`
+	// KeyRequireSecurityKey only accepts the metadata sk-* keys, backed by a FIDO
+	// security key.
+	KeyRequireSecurityKey bool `ini:"key_require_security_key,omitempty"`
+	// KeyTypes is a comma separated list of the accepted metadata key types, i.e.
+	// ssh-ed25519, any type is accepted if empty.
+	KeyTypes string `ini:"key_types,omitempty"`
+	LockCmd  string `ini:"lock_cmd,omitempty"`
+	// ProtectedUIDThreshold protects the existing users with a lower UID, i.e.
+	// system users, from metadata SSH keys. 0 disables it. It defaults to the
+	// UID_MIN of login.defs, or 1000 if it's not set.
+	ProtectedUIDThreshold int `ini:"protected_uid_threshold,omitempty"`
+	// ProtectedUsers is a comma separated list of users metadata SSH keys are
+	// refused for.
+	ProtectedUsers string `ini:"protected_users,omitempty"`
+	// RemovalGracePeriod is how long, in seconds, the users removed from
+	// metadata stay locked before deprovision_remove removes them, 0 removes
+	// them right away.
+	RemovalGracePeriod int  `ini:"removal_grace_period,omitempty"`
+	ReuseHomedir       bool `ini:"reuse_homedir,omitempty"`
+	// UIDPolicy is how the UID of the users is chosen: system lets useradd, or the
+	// native backend, allocate the next free one, hash derives it from the
+	// username within UIDRange and metadata reads it from the
+	// guest-agent-user-ids metadata attribute.
+	UIDPolicy string `ini:"uid_policy,omitempty"`
+	// UIDRange is the MIN-MAX range of the UIDs derived from the usernames, and
+	// of the UIDs accepted from metadata.
+	UIDRange   string `ini:"uid_range,omitempty"`
+	UnlockCmd  string `ini:"unlock_cmd,omitempty"`
+	UserAddCmd string `ini:"useradd_cmd,omitempty"`
+	UserDelCmd string `ini:"userdel_cmd,omitempty"`
 }
 
 // AddressManager contains the configuration of addressManager section.
@@ -189,6 +342,14 @@ type AddressManager struct {
 	Disable bool `ini:"disable,omitempty"`
 }
 
+// Control contains the configurations of Control section.
+type Control struct {
+	// Enabled enables/disables the local control API, it's not available on windows.
+	Enabled bool `ini:"enabled,omitempty"`
+	// SocketPath is the path of the Unix domain socket the control API is served on.
+	SocketPath string `ini:"socket_path,omitempty"`
+}
+
 // Daemons contains the configurations of Daemons section.
 type Daemons struct {
 	AccountsDaemon  bool `ini:"accounts_daemon,omitempty"`
@@ -252,6 +413,65 @@ type MDS struct {
 	MTLSBootstrappingEnabled bool `ini:"mtls_bootstrapping_enabled,omitempty"`
 }
 
+// Managers contains the configurations of Managers section.
+type Managers struct {
+	// DefaultTimeout is the maximum number of seconds a manager run may take.
+	DefaultTimeout int `ini:"default_timeout,omitempty"`
+	// FailureBackoff is the number of seconds a manager is skipped for once it has
+	// failed MaxFailures times in a row, if FailurePolicy is skip.
+	FailureBackoff int `ini:"failure_backoff,omitempty"`
+	// FailurePolicy is either skip, the manager is skipped for FailureBackoff seconds,
+	// or disable, the manager is disabled until the agent restarts, once it has failed
+	// MaxFailures times in a row.
+	FailurePolicy string `ini:"failure_policy,omitempty"`
+	// MaxFailures is the number of consecutive failed runs after which FailurePolicy
+	// applies, 0 means never.
+	MaxFailures int `ini:"max_failures,omitempty"`
+	// ReconcileInterval is the number of seconds between two checks for drift of
+	// the actual system state from the state managers have applied, 0 disables it.
+	ReconcileInterval int `ini:"reconcile_interval,omitempty"`
+	// ReconcileIntervals overrides ReconcileInterval for some managers, it's a comma
+	// separated list of name:seconds pairs, i.e. address:60,accounts:300.
+	ReconcileIntervals string `ini:"reconcile_intervals,omitempty"`
+	// Timeouts overrides DefaultTimeout for some managers, it's a comma separated
+	// list of name:seconds pairs, i.e. address:600,accounts:120.
+	Timeouts string `ini:"timeouts,omitempty"`
+}
+
+// Logging contains the configurations of Logging section.
+type Logging struct {
+	// Format is the format of the local log entries, text or json for JSON lines
+	// with structured fields.
+	Format string `ini:"format,omitempty"`
+	// Level is a comma separated list of the default log level and of
+	// component:level pairs, i.e. info,accounts:debug.
+	Level string `ini:"level,omitempty"`
+	// OverrideTTL is the number of seconds after which the levels set by the
+	// guest-agent-log-levels metadata attribute revert, 0 means never.
+	OverrideTTL int `ini:"override_ttl,omitempty"`
+}
+
+// Metrics contains the configurations of Metrics section.
+type Metrics struct {
+	// Address is the loopback host:port the metrics are served on, unless
+	// SocketPath is set.
+	Address string `ini:"address,omitempty"`
+	// Enabled enables/disables serving the metrics in the Prometheus text format.
+	Enabled bool `ini:"enabled,omitempty"`
+	// SocketPath is the path of a Unix domain socket to serve the metrics on
+	// instead of Address, it's not supported on windows.
+	SocketPath string `ini:"socket_path,omitempty"`
+}
+
+// MetadataOverrides contains the configurations of MetadataOverrides section.
+type MetadataOverrides struct {
+	// AllowedSections is a comma separated list of sections the guest-agent-config
+	// metadata attribute is allowed to override.
+	AllowedSections string `ini:"allowed_sections,omitempty"`
+	// Enabled enables/disables the guest-agent-config metadata attribute handling.
+	Enabled bool `ini:"enabled,omitempty"`
+}
+
 // NetworkInterfaces contains the configurations of NetworkInterfaces section.
 type NetworkInterfaces struct {
 	DHCPCommand  string `ini:"dhcp_command,omitempty"`
@@ -273,6 +493,14 @@ type Snapshots struct {
 type Unstable struct {
 }
 
+// Watchdog contains the configurations of Watchdog section.
+type Watchdog struct {
+	// DispatchTimeout is the number of seconds the events dispatcher may spend on
+	// a single event, i.e. a metadata update, before the agent stops pinging the
+	// systemd watchdog, 0 disables the check.
+	DispatchTimeout int `ini:"dispatch_timeout,omitempty"`
+}
+
 // WSFC contains the configurations of WSFC section.
 type WSFC struct {
 	Addresses string `ini:"addresses,omitempty"`
@@ -287,16 +515,74 @@ func defaultConfigFile(osName string) string {
 	return unixConfigPath
 }
 
+// dropInDir returns the drop-in directory of a given config file, i.e. for
+// /etc/default/instance_configs.cfg it returns /etc/default/instance_configs.d.
+func dropInDir(config string) string {
+	return strings.TrimSuffix(config, filepath.Ext(config)) + ".d"
+}
+
+// dropInFiles returns the *.cfg files found in the config file's drop-in directory
+// in lexical order. A missing directory is not an error, it simply has no files.
+func dropInFiles(config string) []interface{} {
+	// Glob only fails on malformed patterns and sorts its results.
+	files, _ := filepath.Glob(filepath.Join(dropInDir(config), "*.cfg"))
+
+	var res []interface{}
+	for _, curr := range files {
+		res = append(res, curr)
+	}
+	return res
+}
+
+// loginDefsDefaults returns the built-in defaults derived from login.defs, the
+// protected_uid_threshold matching its UID_MIN, or nil if it has none.
+func loginDefsDefaults(path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "UID_MIN" {
+			continue
+		}
+		if uidMin, err := strconv.Atoi(fields[1]); err == nil && uidMin > 0 {
+			return []byte(fmt.Sprintf("[Accounts]\nprotected_uid_threshold = %d\n", uidMin))
+		}
+	}
+	return nil
+}
+
+// defaultDataSources returns the configuration data sources in the order they are
+// merged, sources later in the list take precedence over the earlier ones:
+//   - the built-in defaults (defaultConfig);
+//   - the defaults derived from login.defs, if any, but on windows;
+//   - the extraDefaults provided by the caller, if any;
+//   - the main config file (i.e. /etc/default/instance_configs.cfg);
+//   - the drop-in files (i.e. /etc/default/instance_configs.d/*.cfg) in lexical order;
+//   - the distro file (i.e. /etc/default/instance_configs.cfg.distro);
+//   - the template file (i.e. /etc/default/instance_configs.cfg.template).
 func defaultDataSources(extraDefaults []byte) []interface{} {
 	var res = []interface{}{[]byte(defaultConfig)}
 	config := configFile(runtime.GOOS)
 
+	if runtime.GOOS != "windows" {
+		if defaults := loginDefsDefaults(loginDefsFile); defaults != nil {
+			res = append(res, defaults)
+		}
+	}
+
 	if len(extraDefaults) > 0 {
 		res = append(res, extraDefaults)
 	}
 
+	res = append(res, config)
+	res = append(res, dropInFiles(config)...)
+
 	return append(res, []interface{}{
-		config,
 		config + ".distro",
 		config + ".template",
 	}...)
@@ -304,28 +590,92 @@ func defaultDataSources(extraDefaults []byte) []interface{} {
 
 // Load loads default configuration and the configuration from default config files.
 func Load(extraDefaults []byte) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, err := load(extraDefaults, metadataFragments)
+	return err
+}
+
+// Reload reloads the configuration from the data sources with the extra defaults
+// and the metadata overrides of the previous Load() call, i.e. to pick up changes
+// of the configuration files.
+func Reload() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, err := load(extraDefaults, metadataFragments)
+	return err
+}
+
+// load loads the configuration from the data sources followed by the metadata
+// fragments and the environment variables, it must be called with mutex held. The
+// metadata fragments are filtered with the MetadataOverrides section of the other
+// sources only, so that metadata can never allow itself more. It returns the
+// metadata sections and keys dropped.
+func load(extra []byte, fragments []metadataFragment) ([]string, error) {
 	opts := ini.LoadOptions{
 		Loose:       true,
 		Insensitive: true,
 	}
 
-	sources := dataSources(extraDefaults)
-	cfg, err := ini.LoadSources(opts, sources[0], sources[1:]...)
+	fileLayers := classifySources(configFile(runtime.GOOS), dataSources(extra))
+	base, err := loadLayers(opts, append(append([]*layer{}, fileLayers...), envLayers()...))
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %+v", err)
+		return nil, err
+	}
+	baseSections := new(Sections)
+	if err := base.MapTo(baseSections); err != nil {
+		return nil, fmt.Errorf("failed to map configuration to object: %+v", err)
+	}
+
+	metadata, rejected, err := metadataLayers(fragments, allowedSections(baseSections.MetadataOverrides))
+	if err != nil {
+		return nil, err
+	}
+
+	layers := append(fileLayers, metadata...)
+	layers = append(layers, envLayers()...)
+
+	cfg, err := loadLayers(opts, layers)
+	if err != nil {
+		return nil, err
 	}
 
 	sections := new(Sections)
 	if err := cfg.MapTo(sections); err != nil {
-		return fmt.Errorf("failed to map configuration to object: %+v", err)
+		return nil, fmt.Errorf("failed to map configuration to object: %+v", err)
+	}
+
+	values, err := effectiveValues(opts, cfg, layers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine configuration provenance: %+v", err)
 	}
 
 	instance = sections
-	return nil
+	effective = values
+	extraDefaults = extra
+	metadataFragments = fragments
+	return rejected, nil
+}
+
+// loadLayers merges the data of layers, later layers take precedence.
+func loadLayers(opts ini.LoadOptions, layers []*layer) (*ini.File, error) {
+	var sources []interface{}
+	for _, curr := range layers {
+		sources = append(sources, curr.data)
+	}
+
+	cfg, err := ini.LoadSources(opts, sources[0], sources[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %+v", err)
+	}
+	return cfg, nil
 }
 
 // Get returns the configuration's instance previously loaded with Load().
 func Get() *Sections {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
 	if instance == nil {
 		panic("cfg package was not initialized, Load() " +
 			"should be called in the early initialization code path")
@@ -15,6 +15,9 @@
 package cfg
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -56,6 +59,11 @@ key = value
 }
 
 func TestDefaultDataSources(t *testing.T) {
+	loginDefsFile = filepath.Join(t.TempDir(), "login.defs")
+	defer func() {
+		loginDefsFile = "/etc/login.defs"
+	}()
+
 	expectedDataSources := 4
 	sources := defaultDataSources(nil)
 	if len(sources) != expectedDataSources {
@@ -69,6 +77,75 @@ func TestDefaultDataSources(t *testing.T) {
 	}
 }
 
+func TestLoginDefsDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"uid-min", "# UID_MIN 100\nSYS_UID_MIN 201\nUID_MIN\t\t 500\nUID_MAX 60000\n", "[Accounts]\nprotected_uid_threshold = 500\n"},
+		{"no-uid-min", "SYS_UID_MIN 201\n", ""},
+		{"invalid-uid-min", "UID_MIN none\n", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "login.defs")
+			if err := os.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+				t.Fatalf("Failed to write %s: %+v", path, err)
+			}
+			if got := string(loginDefsDefaults(path)); got != tc.want {
+				t.Errorf("loginDefsDefaults(%q) = %q, want: %q", tc.contents, got, tc.want)
+			}
+		})
+	}
+
+	if got := loginDefsDefaults(filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Errorf("loginDefsDefaults(missing) = %q, want: nil", got)
+	}
+}
+
+func TestLoginDefsThreshold(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("login.defs isn't read on windows")
+	}
+	dir := t.TempDir()
+	loginDefsFile = filepath.Join(dir, "login.defs")
+	configFile = func(osName string) string { return filepath.Join(dir, "instance_configs.cfg") }
+	defer func() {
+		configFile = defaultConfigFile
+		loginDefsFile = "/etc/login.defs"
+	}()
+
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if got := Get().Accounts.ProtectedUIDThreshold; got != 1000 {
+		t.Errorf("protected_uid_threshold = %d without login.defs, want: 1000", got)
+	}
+
+	if err := os.WriteFile(loginDefsFile, []byte("UID_MIN 500\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %+v", loginDefsFile, err)
+	}
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if got := Get().Accounts.ProtectedUIDThreshold; got != 500 {
+		t.Errorf("protected_uid_threshold = %d with UID_MIN 500, want: 500", got)
+	}
+
+	// The configuration file takes precedence.
+	if err := os.WriteFile(configFile(runtime.GOOS), []byte("[Accounts]\nprotected_uid_threshold = 2000\n"), 0644); err != nil {
+		t.Fatalf("Failed to write the configuration file: %+v", err)
+	}
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if got := Get().Accounts.ProtectedUIDThreshold; got != 2000 {
+		t.Errorf("protected_uid_threshold = %d with a configured 2000, want: 2000", got)
+	}
+}
+
 func TestDefaultConfigFile(t *testing.T) {
 	windowsConfig := `C:\Program Files\Google\Compute Engine\instance_configs.cfg`
 	unixConfig := `/etc/default/instance_configs.cfg`
@@ -94,3 +171,100 @@ func TestGetTwice(t *testing.T) {
 		t.Errorf("Get() should return always the same pointer, expected: %p, got: %p", firstCfg, secondCfg)
 	}
 }
+
+func TestDropInDir(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{`/etc/default/instance_configs.cfg`, `/etc/default/instance_configs.d`},
+		{`/etc/default/instance_configs`, `/etc/default/instance_configs.d`},
+	}
+
+	for _, tc := range tests {
+		if got := dropInDir(tc.config); got != tc.want {
+			t.Errorf("dropInDir(%s) = %s, want: %s", tc.config, got, tc.want)
+		}
+	}
+}
+
+func TestDropInPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "instance_configs.cfg")
+	dropIn := filepath.Join(dir, "instance_configs.d")
+
+	if err := os.Mkdir(dropIn, 0755); err != nil {
+		t.Fatalf("Failed to create drop-in dir: %+v", err)
+	}
+
+	files := map[string]string{
+		config:                               "[Accounts]\ngroups = main\nuseradd_cmd = main\nuserdel_cmd = main\n",
+		filepath.Join(dropIn, "10-a.cfg"):    "[Accounts]\ngroups = 10-a\nuseradd_cmd = 10-a\n",
+		filepath.Join(dropIn, "20-b.cfg"):    "[Accounts]\ngroups = 20-b\n",
+		filepath.Join(dropIn, "ignored.txt"): "[Accounts]\ngroups = ignored\n",
+		config + ".distro":                   "[Accounts]\nuserdel_cmd = distro\n",
+	}
+
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %+v", name, err)
+		}
+	}
+
+	configFile = func(osName string) string { return config }
+	loginDefsFile = filepath.Join(dir, "login.defs")
+	defer func() {
+		configFile = defaultConfigFile
+		loginDefsFile = "/etc/login.defs"
+	}()
+
+	if got := len(defaultDataSources(nil)); got != 6 {
+		t.Errorf("defaultDataSources() returned wrong number of sources, expected: 6, got: %d", got)
+	}
+
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	accounts := Get().Accounts
+	if accounts.Groups != "20-b" {
+		t.Errorf("Accounts.groups = %q, want: %q", accounts.Groups, "20-b")
+	}
+
+	if accounts.UserAddCmd != "10-a" {
+		t.Errorf("Accounts.useradd_cmd = %q, want: %q", accounts.UserAddCmd, "10-a")
+	}
+
+	if accounts.UserDelCmd != "distro" {
+		t.Errorf("Accounts.userdel_cmd = %q, want: %q", accounts.UserDelCmd, "distro")
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "instance_configs.cfg")
+	configFile = func(osName string) string { return config }
+	defer func() {
+		configFile = defaultConfigFile
+	}()
+
+	if err := Load([]byte("[Accounts]\nuseradd_cmd = extra\n")); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	if err := os.WriteFile(config, []byte("[Accounts]\ngroups = reloaded\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %+v", config, err)
+	}
+
+	if err := Reload(); err != nil {
+		t.Fatalf("Failed to reload configuration: %+v", err)
+	}
+
+	accounts := Get().Accounts
+	if accounts.Groups != "reloaded" {
+		t.Errorf("Accounts.groups = %q, want: %q", accounts.Groups, "reloaded")
+	}
+
+	if accounts.UserAddCmd != "extra" {
+		t.Errorf("Accounts.useradd_cmd = %q, want: %q", accounts.UserAddCmd, "extra")
+	}
+}
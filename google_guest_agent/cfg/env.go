@@ -0,0 +1,108 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding configuration
+// keys, i.e. GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES overrides [InstanceSetup]
+// host_key_types.
+const EnvPrefix = "GCE_AGENT_"
+
+// environ is a pointer to a function returning the process' environment in the
+// form of key=value. Replaceable by unit tests.
+var environ = defaultEnviron
+
+func defaultEnviron() []string {
+	return os.Environ()
+}
+
+// envName returns the environment variable name of a section's key, dashes are
+// replaced by underscores as they are not supported by most shells.
+func envName(section, key string) string {
+	return strings.ToUpper(strings.ReplaceAll(EnvPrefix+section+"_"+key, "-", "_"))
+}
+
+// knownEnvNames maps the environment variable names of the known configuration
+// keys to their section and key.
+func knownEnvNames() map[string][2]string {
+	known := make(map[string][2]string)
+	for section, keys := range schema() {
+		for key := range keys {
+			known[envName(section, key)] = [2]string{section, key}
+		}
+	}
+	return known
+}
+
+// UnknownEnvVars returns the names of the environment variables with the EnvPrefix
+// not matching a known section and key, i.e. misspelled ones, sorted.
+func UnknownEnvVars() []string {
+	known := knownEnvNames()
+	var res []string
+	for _, curr := range environ() {
+		name, _, found := strings.Cut(curr, "=")
+		if !found || !strings.HasPrefix(strings.ToUpper(name), EnvPrefix) {
+			continue
+		}
+		if _, found := known[strings.ToUpper(name)]; !found {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// envLayers returns one layer for each environment variable overriding a known
+// configuration key, sorted by variable name. Variables not matching a known
+// section and key are ignored, see UnknownEnvVars.
+func envLayers() []*layer {
+	known := knownEnvNames()
+
+	env := environ()
+	sort.Strings(env)
+
+	var res []*layer
+	for _, curr := range env {
+		name, value, found := strings.Cut(curr, "=")
+		if !found || !strings.HasPrefix(strings.ToUpper(name), EnvPrefix) {
+			continue
+		}
+
+		target, found := known[strings.ToUpper(name)]
+		if !found {
+			continue
+		}
+
+		file := ini.Empty()
+		file.Section(target[0]).Key(target[1]).SetValue(value)
+
+		var buf bytes.Buffer
+		if _, err := file.WriteTo(&buf); err != nil {
+			continue
+		}
+
+		res = append(res, &layer{source: SourceEnv, file: name, data: buf.Bytes()})
+	}
+
+	return res
+}
@@ -0,0 +1,114 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		section string
+		key     string
+		want    string
+	}{
+		{"InstanceSetup", "host_key_types", "GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES"},
+		{"metadatascripts", "shutdown-windows", "GCE_AGENT_METADATASCRIPTS_SHUTDOWN_WINDOWS"},
+	}
+
+	for _, tc := range tests {
+		if got := envName(tc.section, tc.key); got != tc.want {
+			t.Errorf("envName(%s, %s) = %s, want: %s", tc.section, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	environ = func() []string {
+		return []string{
+			"PATH=/usr/bin",
+			"GCE_AGENT_INSTANCE_INSTANCE_ID_DIR=/run/instance_id",
+			"GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES=ed25519",
+			"GCE_AGENT_SNAPSHOTS_SNAPSHOT_SERVICE_PORT=9090",
+			"GCE_AGENT_IPFORWARDING_IP_ALIASES=false",
+			"GCE_AGENT_UNKNOWN_KEY=foo",
+			"gce_agent_daemons_clock_skew_daemon=false",
+		}
+	}
+	defer func() {
+		environ = defaultEnviron
+	}()
+
+	// Environment variables take precedence over metadata and extra defaults.
+	extra := []byte("[MetadataOverrides]\nenabled = true\nallowed_sections = IpForwarding\n[InstanceSetup]\nhost_key_types = rsa\n")
+	if err := Load(extra); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if _, err := ApplyMetadataOverrides("[IpForwarding]\nip_aliases = true\n", ""); err != nil {
+		t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+	}
+	defer func() {
+		if _, err := ApplyMetadataOverrides("", ""); err != nil {
+			t.Errorf("Failed to revert metadata overrides: %+v", err)
+		}
+	}()
+
+	config := Get()
+	if config.Instance.InstanceIDDir != "/run/instance_id" {
+		t.Errorf("Instance.instance_id_dir = %q, want: %q", config.Instance.InstanceIDDir, "/run/instance_id")
+	}
+	if config.InstanceSetup.HostKeyTypes != "ed25519" {
+		t.Errorf("InstanceSetup.host_key_types = %q, want: %q", config.InstanceSetup.HostKeyTypes, "ed25519")
+	}
+	if config.Snapshots.SnapshotServicePort != 9090 {
+		t.Errorf("Snapshots.snapshot_service_port = %d, want: %d", config.Snapshots.SnapshotServicePort, 9090)
+	}
+	if config.IPForwarding.IPAliases {
+		t.Errorf("IpForwarding.ip_aliases = true, want: false")
+	}
+	if config.Daemons.ClockSkewDaemon {
+		t.Errorf("Daemons.clock_skew_daemon = true, want: false")
+	}
+
+	for _, curr := range Effective() {
+		if curr.Section == "instancesetup" && curr.Key == "host_key_types" {
+			if curr.Source != SourceEnv || curr.File != "GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES" {
+				t.Errorf("Effective() returned source: %q, file: %q, want source: %q, file: %q",
+					curr.Source, curr.File, SourceEnv, "GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES")
+			}
+		}
+	}
+}
+
+func TestUnknownEnvVars(t *testing.T) {
+	environ = func() []string {
+		return []string{
+			"PATH=/usr/bin",
+			"GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPES=ed25519",
+			"GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPE=ed25519",
+			"gce_agent_daemons_clock_skew_deamon=false",
+			"GCE_AGENT_UNKNOWN_KEY=foo",
+		}
+	}
+	defer func() {
+		environ = defaultEnviron
+	}()
+
+	want := []string{"GCE_AGENT_INSTANCESETUP_HOST_KEY_TYPE", "GCE_AGENT_UNKNOWN_KEY", "gce_agent_daemons_clock_skew_deamon"}
+	if got := UnknownEnvVars(); !reflect.DeepEqual(got, want) {
+		t.Errorf("UnknownEnvVars() = %v, want: %v", got, want)
+	}
+}
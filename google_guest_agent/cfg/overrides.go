@@ -0,0 +1,170 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const (
+	// ProjectMetadataKey is the project level metadata key carrying configuration overrides.
+	ProjectMetadataKey = "project/attributes/guest-agent-config"
+	// InstanceMetadataKey is the instance level metadata key carrying configuration overrides.
+	InstanceMetadataKey = "instance/attributes/guest-agent-config"
+
+	// overridesSection is the section controlling the metadata overrides, it's never
+	// allowed to be overridden by metadata.
+	overridesSection = "metadataoverrides"
+)
+
+// metadataFragment is a guest-agent-config ini fragment as read from metadata,
+// before its sections and keys are filtered.
+type metadataFragment struct {
+	key  string
+	data string
+}
+
+// ApplyMetadataOverrides merges the project and instance level ini fragments into the
+// configuration, the instance level fragment takes precedence over the project level one
+// and both take precedence over the configuration files (but not over the environment
+// variables, see EnvPrefix). Only sections listed in
+// MetadataOverrides.allowed_sections are merged and the command templates and the
+// accounts backend are never overridden, see lockedKey. The names of the sections and
+// keys dropped are returned. Calling it with empty fragments reverts previously
+// applied overrides.
+func ApplyMetadataOverrides(projectFragment, instanceFragment string) ([]string, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if instance == nil {
+		return nil, fmt.Errorf("cfg package was not initialized, Load() should be called first")
+	}
+
+	var fragments []metadataFragment
+	for _, curr := range []metadataFragment{
+		{ProjectMetadataKey, projectFragment},
+		{InstanceMetadataKey, instanceFragment},
+	} {
+		if strings.TrimSpace(curr.data) != "" {
+			fragments = append(fragments, curr)
+		}
+	}
+
+	return load(extraDefaults, fragments)
+}
+
+// allowedSections returns the lower cased sections metadata may override according
+// to config, config must not include the metadata overrides themselves.
+func allowedSections(config *MetadataOverrides) map[string]bool {
+	allowed := make(map[string]bool)
+	if !config.Enabled {
+		return allowed
+	}
+	for _, curr := range strings.Split(config.AllowedSections, ",") {
+		if curr = strings.ToLower(strings.TrimSpace(curr)); curr != "" && curr != overridesSection {
+			allowed[curr] = true
+		}
+	}
+	return allowed
+}
+
+// lockedKeys are the lower cased section.key metadata can never override, whatever
+// allowed_sections is: the commands run as root, the accounts backend deciding
+// whether they are run at all, and the paths root writes to, runs from or listens
+// on.
+var lockedKeys = map[string]bool{
+	"accounts.archive_dir":           true,
+	"accounts.audit_log":             true,
+	"accounts.backend":               true,
+	"accounts.gpasswd_add_cmd":       true,
+	"accounts.gpasswd_remove_cmd":    true,
+	"accounts.groupadd_cmd":          true,
+	"accounts.lock_cmd":              true,
+	"accounts.unlock_cmd":            true,
+	"accounts.useradd_cmd":           true,
+	"accounts.userdel_cmd":           true,
+	"control.socket_path":            true,
+	"instance.instance_id_dir":       true,
+	"instancesetup.host_key_dir":     true,
+	"metadatascripts.default_shell":  true,
+	"metadatascripts.run_dir":        true,
+	"metrics.socket_path":            true,
+	"networkinterfaces.dhcp_command": true,
+}
+
+// lockedKey reports whether the lower cased key of section is one of lockedKeys.
+func lockedKey(section, key string) bool {
+	return lockedKeys[section+"."+key]
+}
+
+// metadataLayers filters fragments with the allowed sections and returns them as
+// layers, along with the sections and keys dropped.
+func metadataLayers(fragments []metadataFragment, allowed map[string]bool) ([]*layer, []string, error) {
+	var layers []*layer
+	var rejected []string
+	for _, curr := range fragments {
+		data, notAllowed, err := filterSections(curr.data, allowed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %+v", curr.key, err)
+		}
+		rejected = append(rejected, notAllowed...)
+		layers = append(layers, &layer{source: SourceMetadata, file: curr.key, data: data})
+	}
+	return layers, rejected, nil
+}
+
+// filterSections parses fragment and returns it with only the allowed sections and
+// without the locked keys, as well as the sections and keys dropped, in the form of
+// [section] and [section] key.
+func filterSections(fragment string, allowed map[string]bool) ([]byte, []string, error) {
+	opts := ini.LoadOptions{
+		Insensitive: true,
+	}
+
+	file, err := ini.LoadSources(opts, []byte(fragment))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rejected []string
+	for _, section := range file.Sections() {
+		name := section.Name()
+		if strings.EqualFold(name, ini.DefaultSection) && len(section.Keys()) == 0 {
+			continue
+		}
+		if !allowed[name] {
+			rejected = append(rejected, fmt.Sprintf("[%s]", name))
+			file.DeleteSection(name)
+			continue
+		}
+		for _, key := range section.KeyStrings() {
+			if lockedKey(name, key) {
+				rejected = append(rejected, fmt.Sprintf("[%s] %s", name, key))
+				section.DeleteKey(key)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), rejected, nil
+}
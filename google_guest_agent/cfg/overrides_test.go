@@ -0,0 +1,197 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyMetadataOverrides(t *testing.T) {
+	extra := []byte("[MetadataOverrides]\nenabled = true\nallowed_sections = IpForwarding, InstanceSetup\n")
+	if err := Load(extra); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	// Make sure following tests don't see the overrides.
+	defer func() {
+		if _, err := ApplyMetadataOverrides("", ""); err != nil {
+			t.Errorf("Failed to revert metadata overrides: %+v", err)
+		}
+	}()
+
+	project := "[IpForwarding]\nip_aliases = false\ntarget_instance_ips = false\n[Accounts]\ngroups = foo\n"
+	instance := "[IpForwarding]\ntarget_instance_ips = true\n[MetadataOverrides]\nallowed_sections = Accounts\n" +
+		"[InstanceSetup]\nhost_key_types = ed25519\n"
+
+	rejected, err := ApplyMetadataOverrides(project, instance)
+	if err != nil {
+		t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+	}
+
+	if want := []string{"[accounts]", "[metadataoverrides]"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("ApplyMetadataOverrides() rejected %v, want: %v", rejected, want)
+	}
+
+	config := Get()
+	if config.IPForwarding.IPAliases {
+		t.Errorf("IpForwarding.ip_aliases = true, want: false (project override)")
+	}
+	if !config.IPForwarding.TargetInstanceIPs {
+		t.Errorf("IpForwarding.target_instance_ips = false, want: true (instance override)")
+	}
+	if config.InstanceSetup.HostKeyTypes != "ed25519" {
+		t.Errorf("InstanceSetup.host_key_types = %q, want: %q", config.InstanceSetup.HostKeyTypes, "ed25519")
+	}
+	if config.Accounts.Groups == "foo" {
+		t.Errorf("Accounts.groups was overridden by metadata, Accounts is not an allowed section")
+	}
+	if config.MetadataOverrides.AllowedSections != "IpForwarding, InstanceSetup" {
+		t.Errorf("MetadataOverrides.allowed_sections was overridden by metadata: %q", config.MetadataOverrides.AllowedSections)
+	}
+
+	for _, curr := range Effective() {
+		if curr.Section == "ipforwarding" && curr.Key == "target_instance_ips" {
+			if curr.Source != SourceMetadata || curr.File != InstanceMetadataKey {
+				t.Errorf("Effective() returned source: %q, file: %q, want source: %q, file: %q",
+					curr.Source, curr.File, SourceMetadata, InstanceMetadataKey)
+			}
+		}
+	}
+
+	// Reloading the configuration must keep the overrides.
+	if err := Load(extra); err != nil {
+		t.Fatalf("Failed to reload configuration: %+v", err)
+	}
+	if Get().InstanceSetup.HostKeyTypes != "ed25519" {
+		t.Errorf("Load() dropped the metadata overrides")
+	}
+
+	// Empty fragments revert the overrides.
+	if _, err := ApplyMetadataOverrides("", ""); err != nil {
+		t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+	}
+	if !Get().IPForwarding.IPAliases || Get().InstanceSetup.HostKeyTypes != "ecdsa,ed25519,rsa" {
+		t.Errorf("ApplyMetadataOverrides(\"\", \"\") didn't revert the overrides: %+v, %+v",
+			Get().IPForwarding, Get().InstanceSetup)
+	}
+
+	if _, err := ApplyMetadataOverrides("[IpForwarding", ""); err == nil {
+		t.Errorf("ApplyMetadataOverrides() succeeded with invalid fragment, want error")
+	}
+}
+
+func TestMetadataOverridesLockedKeys(t *testing.T) {
+	extra := []byte("[MetadataOverrides]\nenabled = true\nallowed_sections = Accounts\n")
+	if err := Load(extra); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	defer func() {
+		if _, err := ApplyMetadataOverrides("", ""); err != nil {
+			t.Errorf("Failed to revert metadata overrides: %+v", err)
+		}
+	}()
+
+	instance := "[Accounts]\ngroups = foo\nuseradd_cmd = sh -c 'id' {user}\nBackend = native\nLOCK_CMD = true {user}\n"
+	rejected, err := ApplyMetadataOverrides("", instance)
+	if err != nil {
+		t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+	}
+	if want := []string{"[accounts] useradd_cmd", "[accounts] backend", "[accounts] lock_cmd"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("ApplyMetadataOverrides() rejected %v, want: %v", rejected, want)
+	}
+
+	config := Get().Accounts
+	if config.Groups != "foo" {
+		t.Errorf("Accounts.groups = %q, want: %q", config.Groups, "foo")
+	}
+	if config.UserAddCmd != "useradd -m -s /bin/bash -p * {user}" || config.Backend != "command" || config.LockCmd != "usermod -L -s /sbin/nologin {user}" {
+		t.Errorf("Accounts command templates or backend were overridden by metadata: %+v", config)
+	}
+}
+
+func TestMetadataOverridesLockedPaths(t *testing.T) {
+	tests := []struct {
+		section string
+		key     string
+		value   string
+		get     func(*Sections) string
+	}{
+		{"NetworkInterfaces", "dhcp_command", "sh -c id", func(s *Sections) string { return s.NetworkInterfaces.DHCPCommand }},
+		{"Accounts", "audit_log", "/etc/cron.d/audit", func(s *Sections) string { return s.Accounts.AuditLog }},
+		{"Accounts", "archive_dir", "/etc/cron.d", func(s *Sections) string { return s.Accounts.ArchiveDir }},
+		{"Control", "socket_path", "/tmp/control.sock", func(s *Sections) string { return s.Control.SocketPath }},
+		{"Metrics", "socket_path", "/tmp/metrics.sock", func(s *Sections) string { return s.Metrics.SocketPath }},
+		{"MetadataScripts", "default_shell", "/tmp/sh", func(s *Sections) string { return s.MetadataScripts.DefaultShell }},
+		{"MetadataScripts", "run_dir", "/tmp", func(s *Sections) string { return s.MetadataScripts.RunDir }},
+		{"Instance", "instance_id_dir", "/tmp/id", func(s *Sections) string { return s.Instance.InstanceIDDir }},
+		{"InstanceSetup", "host_key_dir", "/tmp/ssh", func(s *Sections) string { return s.InstanceSetup.HostKeyDir }},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.section+"."+tc.key, func(t *testing.T) {
+			extra := []byte(fmt.Sprintf("[MetadataOverrides]\nenabled = true\nallowed_sections = %s\n", tc.section))
+			if err := Load(extra); err != nil {
+				t.Fatalf("Failed to load configuration: %+v", err)
+			}
+			defer func() {
+				if _, err := ApplyMetadataOverrides("", ""); err != nil {
+					t.Errorf("Failed to revert metadata overrides: %+v", err)
+				}
+			}()
+			want := tc.get(Get())
+
+			rejected, err := ApplyMetadataOverrides("", fmt.Sprintf("[%s]\n%s = %s\n", tc.section, tc.key, tc.value))
+			if err != nil {
+				t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+			}
+			wantRejected := []string{fmt.Sprintf("[%s] %s", strings.ToLower(tc.section), tc.key)}
+			if !reflect.DeepEqual(rejected, wantRejected) {
+				t.Errorf("ApplyMetadataOverrides() rejected %v, want: %v", rejected, wantRejected)
+			}
+			if got := tc.get(Get()); got != want {
+				t.Errorf("%s.%s = %q after the metadata override, want: %q", tc.section, tc.key, got, want)
+			}
+		})
+	}
+}
+
+func TestMetadataOverridesAllowlistReload(t *testing.T) {
+	extra := []byte("[MetadataOverrides]\nenabled = true\nallowed_sections = InstanceSetup\n")
+	if err := Load(extra); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	defer func() {
+		if _, err := ApplyMetadataOverrides("", ""); err != nil {
+			t.Errorf("Failed to revert metadata overrides: %+v", err)
+		}
+	}()
+
+	if _, err := ApplyMetadataOverrides("", "[InstanceSetup]\nhost_key_types = ed25519\n"); err != nil {
+		t.Fatalf("ApplyMetadataOverrides() failed: %+v", err)
+	}
+	if Get().InstanceSetup.HostKeyTypes != "ed25519" {
+		t.Fatalf("InstanceSetup.host_key_types = %q, want: %q", Get().InstanceSetup.HostKeyTypes, "ed25519")
+	}
+
+	// The overrides are filtered again with the allowlist of the reloaded sources.
+	if err := Load([]byte("[MetadataOverrides]\nenabled = true\nallowed_sections = IpForwarding\n")); err != nil {
+		t.Fatalf("Failed to reload configuration: %+v", err)
+	}
+	if Get().InstanceSetup.HostKeyTypes == "ed25519" {
+		t.Errorf("Load() kept the overrides of a section no longer allowed")
+	}
+}
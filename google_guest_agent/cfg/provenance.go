@@ -0,0 +1,186 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// Source identifies the kind of data source a configuration value was set by.
+type Source string
+
+const (
+	// SourceBuiltIn identifies the guest agent's built-in defaults, including the
+	// extra defaults provided to Load().
+	SourceBuiltIn Source = "built-in"
+	// SourceMain identifies the main config file, i.e. /etc/default/instance_configs.cfg.
+	SourceMain Source = "main"
+	// SourceDropIn identifies the drop-in files, i.e. /etc/default/instance_configs.d/*.cfg.
+	SourceDropIn Source = "drop-in"
+	// SourceDistro identifies the distro file, i.e. /etc/default/instance_configs.cfg.distro.
+	SourceDistro Source = "distro"
+	// SourceTemplate identifies the template file, i.e. /etc/default/instance_configs.cfg.template.
+	SourceTemplate Source = "template"
+	// SourceMetadata identifies the guest-agent-config metadata attribute.
+	SourceMetadata Source = "metadata"
+	// SourceEnv identifies the GCE_AGENT_<SECTION>_<KEY> environment variables.
+	SourceEnv Source = "env"
+)
+
+const (
+	// FormatINI formats the effective configuration as an ini file.
+	FormatINI = "ini"
+	// FormatJSON formats the effective configuration as a JSON array.
+	FormatJSON = "json"
+)
+
+// Value is an effective configuration value and the data source that set it.
+type Value struct {
+	// Section is the section name.
+	Section string `json:"section"`
+	// Key is the key name.
+	Key string `json:"key"`
+	// Value is the effective value.
+	Value string `json:"value"`
+	// Source is the kind of data source that set the value.
+	Source Source `json:"source"`
+	// File is the file, metadata key or environment variable that set the value.
+	// It's empty for the built-in defaults.
+	File string `json:"file,omitempty"`
+}
+
+// layer wraps a data source and its provenance.
+type layer struct {
+	source Source
+	file   string
+	data   interface{}
+}
+
+// classifySources wraps sources (as returned by dataSources) into layers, files are
+// classified based on the config file path they are derived from.
+func classifySources(config string, sources []interface{}) []*layer {
+	var res []*layer
+	for _, curr := range sources {
+		file, ok := curr.(string)
+		if !ok {
+			res = append(res, &layer{source: SourceBuiltIn, data: curr})
+			continue
+		}
+
+		source := SourceMain
+		switch {
+		case file == config+".distro":
+			source = SourceDistro
+		case file == config+".template":
+			source = SourceTemplate
+		case filepath.Dir(file) == dropInDir(config):
+			source = SourceDropIn
+		}
+
+		res = append(res, &layer{source: source, file: file, data: file})
+	}
+	return res
+}
+
+// effectiveValues returns every key of the merged configuration along with the
+// layer that has set it, layers later in the slice take precedence.
+func effectiveValues(opts ini.LoadOptions, merged *ini.File, layers []*layer) ([]*Value, error) {
+	origins := make(map[string]*layer)
+	originKey := func(section, key string) string {
+		return strings.ToLower(section) + "." + strings.ToLower(key)
+	}
+
+	for _, curr := range layers {
+		file, err := ini.LoadSources(opts, curr.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s configuration: %+v", curr.source, err)
+		}
+		for _, section := range file.Sections() {
+			for _, key := range section.Keys() {
+				origins[originKey(section.Name(), key.Name())] = curr
+			}
+		}
+	}
+
+	var res []*Value
+	for _, section := range merged.Sections() {
+		for _, key := range section.Keys() {
+			value := &Value{
+				Section: section.Name(),
+				Key:     key.Name(),
+				Value:   key.String(),
+			}
+			if origin, found := origins[originKey(section.Name(), key.Name())]; found {
+				value.Source = origin.source
+				value.File = origin.file
+			}
+			res = append(res, value)
+		}
+	}
+
+	return res, nil
+}
+
+// Effective returns the effective configuration values, previously loaded with
+// Load(), along with the data source that set each of them.
+func Effective() []*Value {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if instance == nil {
+		panic("cfg package was not initialized, Load() " +
+			"should be called in the early initialization code path")
+	}
+	return effective
+}
+
+// WriteEffective writes the effective configuration values to w in the requested
+// format, either FormatINI or FormatJSON.
+func WriteEffective(w io.Writer, format string) error {
+	values := Effective()
+
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(values)
+	case FormatINI:
+		var section string
+		for i, curr := range values {
+			if i == 0 || curr.Section != section {
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				section = curr.Section
+				fmt.Fprintf(w, "[%s]\n", section)
+			}
+
+			origin := string(curr.Source)
+			if curr.File != "" {
+				origin = fmt.Sprintf("%s (%s)", curr.Source, curr.File)
+			}
+			fmt.Fprintf(w, "# %s\n%s = %s\n", origin, curr.Key, curr.Value)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, expected %q or %q", format, FormatINI, FormatJSON)
+	}
+}
@@ -0,0 +1,118 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEffective(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "instance_configs.cfg")
+	dropIn := filepath.Join(dir, "instance_configs.d")
+
+	if err := os.Mkdir(dropIn, 0755); err != nil {
+		t.Fatalf("Failed to create drop-in dir: %+v", err)
+	}
+
+	files := map[string]string{
+		config:                            "[InstanceSetup]\nnetwork_enabled = false\n",
+		filepath.Join(dropIn, "10-a.cfg"): "[Accounts]\ngroups = adm\n",
+		config + ".distro":                "[Daemons]\nclock_skew_daemon = false\n",
+		config + ".template":              "[Daemons]\nnetwork_daemon = false\n",
+	}
+
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %+v", name, err)
+		}
+	}
+
+	configFile = func(osName string) string { return config }
+	defer func() {
+		configFile = defaultConfigFile
+	}()
+
+	if err := Load([]byte("[Unstable]\nfoo = bar\n")); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	tests := []struct {
+		section string
+		key     string
+		value   string
+		source  Source
+		file    string
+	}{
+		{"instancesetup", "network_enabled", "false", SourceMain, config},
+		{"instancesetup", "host_key_dir", "/etc/ssh", SourceBuiltIn, ""},
+		{"accounts", "groups", "adm", SourceDropIn, filepath.Join(dropIn, "10-a.cfg")},
+		{"daemons", "clock_skew_daemon", "false", SourceDistro, config + ".distro"},
+		{"daemons", "network_daemon", "false", SourceTemplate, config + ".template"},
+		{"unstable", "foo", "bar", SourceBuiltIn, ""},
+	}
+
+	values := make(map[string]*Value)
+	for _, curr := range Effective() {
+		values[curr.Section+"."+curr.Key] = curr
+	}
+
+	for _, tc := range tests {
+		got, found := values[tc.section+"."+tc.key]
+		if !found {
+			t.Errorf("Effective() didn't return %s.%s", tc.section, tc.key)
+			continue
+		}
+		if got.Value != tc.value || got.Source != tc.source || got.File != tc.file {
+			t.Errorf("Effective() returned %s.%s = %+v, want value: %q, source: %q, file: %q",
+				tc.section, tc.key, got, tc.value, tc.source, tc.file)
+		}
+	}
+}
+
+func TestWriteEffective(t *testing.T) {
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteEffective(&buf, FormatINI); err != nil {
+		t.Fatalf("WriteEffective(ini) failed: %+v", err)
+	}
+	if !strings.Contains(buf.String(), "[accounts]\n# built-in\narchive_dir = \n") {
+		t.Errorf("WriteEffective(ini) returned unexpected output: %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteEffective(&buf, FormatJSON); err != nil {
+		t.Fatalf("WriteEffective(json) failed: %+v", err)
+	}
+	var values []*Value
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatalf("WriteEffective(json) returned invalid JSON: %+v", err)
+	}
+	if len(values) != len(Effective()) {
+		t.Errorf("WriteEffective(json) returned %d values, want: %d", len(values), len(Effective()))
+	}
+
+	if err := WriteEffective(&buf, "yaml"); err == nil {
+		t.Errorf("WriteEffective(yaml) succeeded, want error")
+	}
+}
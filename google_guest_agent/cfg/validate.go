@@ -0,0 +1,361 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var (
+	// commandTemplates maps the command template keys to the placeholders they must
+	// contain, the keys are in the form of section.key (lower case).
+	commandTemplates = map[string][]string{
+		"accounts.gpasswd_add_cmd":    {"{user}", "{group}"},
+		"accounts.gpasswd_remove_cmd": {"{user}", "{group}"},
+		"accounts.groupadd_cmd":       {"{group}"},
+		"accounts.lock_cmd":           {"{user}"},
+		"accounts.unlock_cmd":         {"{user}", "{shell}"},
+		"accounts.useradd_cmd":        {"{user}"},
+		"accounts.userdel_cmd":        {"{user}"},
+	}
+
+	// enumKeys maps the keys (in the form of section.key, lower case) taking one of
+	// a fixed set of values to those values, they are matched case sensitively as
+	// the guest agent does.
+	enumKeys = map[string][]string{
+		"accounts.backend":            {"command", "native"},
+		"accounts.default_role":       {"admin", "user"},
+		"accounts.expiry_time_option": {"auto", "true", "false"},
+		"accounts.uid_policy":         {"system", "hash", "metadata"},
+		"logging.format":              {"text", "json"},
+		"managers.failure_policy":     {"skip", "disable"},
+	}
+
+	// listEnumKeys maps the keys (in the form of section.key, lower case) taking a
+	// comma separated list of values out of a fixed set to those values, they are
+	// matched case insensitively as the guest agent does.
+	listEnumKeys = map[string][]string{
+		"accounts.key_types": {"ssh-rsa", "ssh-dss", "ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384",
+			"ecdsa-sha2-nistp521", "sk-ssh-ed25519@openssh.com", "sk-ecdsa-sha2-nistp256@openssh.com"},
+		"instancesetup.host_key_types": {"dsa", "ecdsa", "ed25519", "rsa"},
+	}
+
+	// logLevels are the levels accepted by the [Logging] level key.
+	logLevels = []string{"debug", "info", "warning", "error"}
+
+	// pathKeys is the set of keys (in the form of section.key, lower case) whose
+	// values must be absolute paths when set.
+	pathKeys = map[string]bool{
+		"instance.instance_id_dir":      true,
+		"instancesetup.host_key_dir":    true,
+		"metadatascripts.default_shell": true,
+		"metadatascripts.run_dir":       true,
+	}
+
+	// legacyKeys is the set of keys (in the form of section.key, lower case) not used
+	// by the guest agent but still shipped by packages or documented, they are accepted
+	// by Validate() so existing files don't fail validation.
+	legacyKeys = map[string]bool{
+		"accounts.usermod_cmd":               true,
+		"metadatascripts.sysprep-specialize": true,
+		"networkinterfaces.dhclient_script":  true,
+	}
+)
+
+// ValidationError describes a single problem found in a configuration file.
+type ValidationError struct {
+	// File is the configuration file where the problem was found.
+	File string
+	// Line is the line number (starting at 1) where the problem was found.
+	Line int
+	// Section is the section name the offending line belongs to, if any.
+	Section string
+	// Key is the offending key name, if any.
+	Key string
+	// Message describes the problem.
+	Message string
+}
+
+// Error returns the problem in the form file:line: message.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// schema returns the known sections and their keys' kinds. Both section and key
+// names are lower cased since the configuration is loaded case insensitively.
+func schema() map[string]map[string]reflect.Kind {
+	res := make(map[string]map[string]reflect.Kind)
+	sections := reflect.TypeOf(Sections{})
+
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		keys := make(map[string]reflect.Kind)
+		res[iniName(section)] = keys
+
+		fields := section.Type.Elem()
+		for j := 0; j < fields.NumField(); j++ {
+			field := fields.Field(j)
+			keys[iniName(field)] = field.Type.Kind()
+		}
+	}
+
+	return res
+}
+
+// iniName returns the lower cased ini name of a struct field.
+func iniName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("ini"), ",")
+	return strings.ToLower(name)
+}
+
+// ConfigFiles returns the configuration files the guest agent reads its
+// configuration from (see defaultDataSources), whether they exist or not.
+func ConfigFiles() []string {
+	var res []string
+	for _, curr := range defaultDataSources(nil) {
+		if file, ok := curr.(string); ok {
+			res = append(res, file)
+		}
+	}
+	return res
+}
+
+// Validate strictly validates the provided configuration files. Differently from
+// Load() it reports unknown sections and keys, values not matching the key's type,
+// command templates missing required placeholders and invalid paths. Files that
+// don't exist are skipped.
+func Validate(files []string) ([]*ValidationError, error) {
+	var res []*ValidationError
+	for _, file := range files {
+		errs, err := validateFile(file)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, errs...)
+	}
+	return res, nil
+}
+
+func validateFile(file string) ([]*ValidationError, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %+v", file, err)
+	}
+	defer f.Close()
+
+	known := schema()
+	var res []*ValidationError
+	var section string
+	var keys map[string]reflect.Kind
+
+	report := func(line int, key, format string, args ...any) {
+		res = append(res, &ValidationError{
+			File:    file,
+			Line:    line,
+			Section: section,
+			Key:     key,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+
+		if text[0] == '[' {
+			end := strings.IndexByte(text, ']')
+			if end < 0 {
+				section, keys = "", nil
+				report(line, "", "unclosed section: %s", text)
+				continue
+			}
+			section = strings.TrimSpace(text[1:end])
+			if keys = known[strings.ToLower(section)]; keys == nil {
+				report(line, "", "unknown section [%s]", section)
+			}
+			continue
+		}
+
+		idx := strings.IndexAny(text, "=:")
+		if idx < 0 {
+			report(line, "", "key-value delimiter not found: %s", text)
+			continue
+		}
+
+		key := strings.TrimSpace(text[:idx])
+		value := iniValue(text[idx+1:])
+
+		// Unknown sections were already reported, don't report each of its keys.
+		if section != "" && keys == nil {
+			continue
+		}
+
+		if section == "" {
+			report(line, key, "key %q is not in a section", key)
+			continue
+		}
+
+		name := strings.ToLower(section + "." + key)
+		kind, found := keys[strings.ToLower(key)]
+		if !found && legacyKeys[name] {
+			continue
+		}
+
+		if !found {
+			report(line, key, "unknown key %q in section [%s]", key, section)
+			continue
+		}
+
+		if msg := validateValue(name, kind, value); msg != "" {
+			report(line, key, "invalid value for %q in section [%s]: %s", key, section, msg)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %+v", file, err)
+	}
+
+	return res, nil
+}
+
+// iniValue trims the inline comment, spaces and quotes of a raw value the same
+// way the ini loader does.
+func iniValue(value string) string {
+	if idx := strings.IndexAny(value, "#;"); idx >= 0 {
+		value = value[:idx]
+	}
+	value = strings.TrimSpace(value)
+
+	for _, quote := range []string{`"""`, `"`, "`"} {
+		if len(value) >= 2*len(quote) && strings.HasPrefix(value, quote) && strings.HasSuffix(value, quote) {
+			return value[len(quote) : len(value)-len(quote)]
+		}
+	}
+	return value
+}
+
+// validateValue returns a message describing why value is not valid for the key
+// name (in the form of section.key) or an empty string if it's valid.
+func validateValue(name string, kind reflect.Kind, value string) string {
+	switch kind {
+	case reflect.Bool:
+		if _, err := parseBool(value); value != "" && err != nil {
+			return fmt.Sprintf("%q is not a boolean", value)
+		}
+	case reflect.Int:
+		if _, err := strconv.Atoi(value); value != "" && err != nil {
+			return fmt.Sprintf("%q is not an integer", value)
+		}
+	}
+
+	if placeholders, found := commandTemplates[name]; found {
+		if value == "" {
+			return "command must not be empty"
+		}
+		for _, curr := range placeholders {
+			if !strings.Contains(value, curr) {
+				return fmt.Sprintf("command %q is missing the %s placeholder", value, curr)
+			}
+		}
+	}
+
+	if values, found := enumKeys[name]; found && !containsString(values, value) {
+		return fmt.Sprintf("%q is not one of %s", value, strings.Join(values, ", "))
+	}
+
+	if values, found := listEnumKeys[name]; found {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.ToLower(strings.TrimSpace(item))
+			if item != "" && !containsString(values, item) {
+				return fmt.Sprintf("%q is not one of %s", item, strings.Join(values, ", "))
+			}
+		}
+	}
+
+	if name == "logging.level" {
+		if msg := validateLogLevels(value); msg != "" {
+			return msg
+		}
+	}
+
+	if pathKeys[name] && value != "" && !isAbs(value) {
+		return fmt.Sprintf("%q is not an absolute path", value)
+	}
+
+	return ""
+}
+
+// validateLogLevels returns a message describing why value isn't a valid comma
+// separated list of a level and component:level pairs, or an empty string.
+func validateLogLevels(value string) string {
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		component, level, found := strings.Cut(entry, ":")
+		if !found {
+			level = component
+		} else if strings.TrimSpace(component) == "" {
+			return fmt.Sprintf("%q is not in the component:level form", entry)
+		}
+		if !containsString(logLevels, strings.ToLower(strings.TrimSpace(level))) {
+			return fmt.Sprintf("%q is not one of %s", strings.TrimSpace(level), strings.Join(logLevels, ", "))
+		}
+	}
+	return ""
+}
+
+// containsString reports whether values contains value.
+func containsString(values []string, value string) bool {
+	for _, curr := range values {
+		if curr == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isAbs reports whether path is absolute, unix style paths are accepted on
+// windows as the ini loader doesn't care about the running OS.
+func isAbs(path string) bool {
+	if runtime.GOOS == "windows" && strings.HasPrefix(path, "/") {
+		return true
+	}
+	return filepath.IsAbs(path)
+}
+
+// parseBool parses value as a boolean the same way the ini loader does.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value: %s", value)
+}
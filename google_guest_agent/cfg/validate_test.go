@@ -0,0 +1,121 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		// wantLines maps the expected problem's line numbers to a substring of their messages.
+		wantLines map[int]string
+	}{
+		{
+			name:      "default-config",
+			contents:  defaultConfig,
+			wantLines: map[int]string{},
+		},
+		{
+			name:      "unknown-section",
+			contents:  "[Accounts]\ngroups = adm\n[Acounts]\ngroups = adm\nfoo = bar\n",
+			wantLines: map[int]string{3: "unknown section [Acounts]"},
+		},
+		{
+			name:      "unknown-key",
+			contents:  "[Accounts]\nuseradd_comand = useradd {user}\n",
+			wantLines: map[int]string{2: `unknown key "useradd_comand"`},
+		},
+		{
+			name:      "type-errors",
+			contents:  "# comment\n[Snapshots]\nsnapshot_service_port = eighty\nenabled = maybe\ntimeout_in_seconds =\n",
+			wantLines: map[int]string{3: "is not an integer", 4: "is not a boolean"},
+		},
+		{
+			name:      "command-templates",
+			contents:  "[accounts]\nuseradd_cmd = useradd -m\ngpasswd_add_cmd = gpasswd -a {user} # {group}\nuserdel_cmd = \"userdel {user}\"\n",
+			wantLines: map[int]string{2: "missing the {user} placeholder", 3: "missing the {group} placeholder"},
+		},
+		{
+			name:      "lock-templates",
+			contents:  "[Accounts]\nlock_cmd = usermod -L\nunlock_cmd = usermod -U {user}\n",
+			wantLines: map[int]string{2: "missing the {user} placeholder", 3: "missing the {shell} placeholder"},
+		},
+		{
+			name:      "enums",
+			contents:  "[Accounts]\nbackend = Native\ndefault_role = admn\nuid_policy = hash\nexpiry_time_option = auto\n[Logging]\nformat = xml\nlevel = info,accounts:verbose\n",
+			wantLines: map[int]string{2: `"Native" is not one of command, native`, 3: `"admn" is not one of admin, user`, 7: `"xml" is not one of text, json`, 8: `"verbose" is not one of debug`},
+		},
+		{
+			name:      "list-enums",
+			contents:  "[Accounts]\nkey_types = SSH-ED25519, ssh-rsa\n[InstanceSetup]\nhost_key_types = ed25519,rsa1\n[Managers]\nfailure_policy = retry\n",
+			wantLines: map[int]string{4: `"rsa1" is not one of dsa`, 6: `"retry" is not one of skip, disable`},
+		},
+		{
+			name:      "log-levels",
+			contents:  "[Logging]\nlevel = WARNING, network:debug\n[Logging]\nlevel = :debug\n",
+			wantLines: map[int]string{4: "component:level form"},
+		},
+		{
+			name:      "paths",
+			contents:  "[InstanceSetup]\nhost_key_dir = etc/ssh\n[MetadataScripts]\nrun_dir =\ndefault_shell = /bin/sh\n",
+			wantLines: map[int]string{2: "is not an absolute path"},
+		},
+		{
+			name:      "syntax",
+			contents:  "foo = bar\n[Accounts\ngroups\n",
+			wantLines: map[int]string{1: "is not in a section", 2: "unclosed section", 3: "delimiter not found"},
+		},
+		{
+			name:      "legacy-keys",
+			contents:  "[NetworkInterfaces]\ndhclient_script = /sbin/google-dhclient-script\n",
+			wantLines: map[int]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "instance_configs.cfg")
+			if err := os.WriteFile(file, []byte(tc.contents), 0644); err != nil {
+				t.Fatalf("Failed to write %s: %+v", file, err)
+			}
+
+			errs, err := Validate([]string{file, file + ".missing"})
+			if err != nil {
+				t.Fatalf("Validate() failed: %+v", err)
+			}
+
+			if len(errs) != len(tc.wantLines) {
+				t.Errorf("Validate() returned %d problems, want: %d, problems: %v", len(errs), len(tc.wantLines), errs)
+			}
+
+			for _, curr := range errs {
+				want, found := tc.wantLines[curr.Line]
+				if !found {
+					t.Errorf("Validate() returned unexpected problem: %s", curr.Error())
+					continue
+				}
+				if curr.File != file || !strings.Contains(curr.Error(), want) {
+					t.Errorf("Validate() returned %q, want it to contain: %q", curr.Error(), want)
+				}
+			}
+		})
+	}
+}
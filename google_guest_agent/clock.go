@@ -20,11 +20,23 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
+func init() {
+	registerManager(&managerSpec{
+		name:     "clockskew",
+		platform: unixOnly,
+		new:      func() manager { return &clockskewMgr{} },
+	})
+}
+
 type clockskewMgr struct{}
 
+// syncedDriftToken is the virtual clock drift token of the last successful clock
+// sync.
+var syncedDriftToken int
+
 func (a *clockskewMgr) Diff(ctx context.Context) (bool, error) {
 	return oldMetadata.Instance.VirtualClock.DriftToken != newMetadata.Instance.VirtualClock.DriftToken, nil
 }
@@ -39,6 +51,16 @@ func (a *clockskewMgr) Disabled(ctx context.Context) (bool, error) {
 }
 
 func (a *clockskewMgr) Set(ctx context.Context) error {
+	token := newMetadata.Instance.VirtualClock.DriftToken
+	if err := a.syncClock(ctx); err != nil {
+		return err
+	}
+	syncedDriftToken = token
+	return nil
+}
+
+// syncClock syncs the system clock.
+func (a *clockskewMgr) syncClock(ctx context.Context) error {
 	if runtime.GOOS == "freebsd" {
 		err := run.Quiet(ctx, "service", "ntpd", "status")
 		if err == nil {
@@ -47,7 +69,7 @@ func (a *clockskewMgr) Set(ctx context.Context) error {
 			}
 			defer func() {
 				if err := run.Quiet(ctx, "service", "ntpd", "start"); err != nil {
-					logger.Warningf("Error starting 'ntpd' after clock sync: %v.", err)
+					logfields.Warningf("Error starting 'ntpd' after clock sync: %v.", err)
 				}
 			}()
 		}
@@ -61,3 +83,16 @@ func (a *clockskewMgr) Set(ctx context.Context) error {
 	}
 	return nil
 }
+
+// Plan returns the clock sync the manager would run, i.e. if the clock wasn't
+// synced for the current drift token. It's compared with the last successful sync,
+// not with the previous metadata, so that a failed sync is reported as a drift.
+func (a *clockskewMgr) Plan(ctx context.Context) ([]string, error) {
+	if newMetadata.Instance.VirtualClock.DriftToken == syncedDriftToken {
+		return nil, nil
+	}
+	if runtime.GOOS == "freebsd" {
+		return []string{"sync the system clock with ntpdate 169.254.169.254"}, nil
+	}
+	return []string{"sync the system clock from the hardware clock"}, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// configShowMetadataTimeout bounds how long config show waits for the metadata
+// server.
+const configShowMetadataTimeout = 10 * time.Second
+
+func configUsage(w io.Writer) {
+	fmt.Fprintf(w,
+		"Usage:\n"+
+			"  %[1]s config validate [file...]: validate the configuration files, defaults to the files read by the agent\n"+
+			"  %[1]s config show [--format=ini|json] [--metadata=false]: print the effective configuration and where each value comes from\n",
+		filepath.Base(os.Args[0]))
+}
+
+// runConfigCommand handles the config subcommands and returns the process' exit code.
+func runConfigCommand(ctx context.Context, args []string) int {
+	if len(args) < 1 {
+		configUsage(os.Stderr)
+		return 1
+	}
+
+	switch args[0] {
+	case "validate":
+		return validateConfig(os.Stdout, args[1:])
+	case "show":
+		return showConfig(ctx, os.Stdout, args[1:])
+	case "help":
+		configUsage(os.Stdout)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "%q is not a valid config command.\n", args[0])
+		configUsage(os.Stderr)
+		return 1
+	}
+}
+
+// validateConfig validates files, or the files read by the agent if none is provided,
+// writing every problem found to w. It returns 1 if any problem was found, 0 otherwise.
+func validateConfig(w io.Writer, files []string) int {
+	if len(files) == 0 {
+		files = cfg.ConfigFiles()
+	}
+
+	errs, err := cfg.Validate(files)
+	if err != nil {
+		fmt.Fprintf(w, "Failed to validate configuration: %+v\n", err)
+		return 1
+	}
+
+	for _, curr := range errs {
+		fmt.Fprintln(w, curr.Error())
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "Found %d problem(s) in the configuration.\n", len(errs))
+		return 1
+	}
+
+	return 0
+}
+
+// showConfig loads the configuration, with the guest-agent-config metadata
+// overrides unless --metadata=false is provided, and writes the effective values
+// and their provenance to w. It returns 1 if the configuration can't be loaded, 0
+// otherwise.
+func showConfig(ctx context.Context, w io.Writer, args []string) int {
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	format := flags.String("format", cfg.FormatINI, "output format, either ini or json")
+	withMetadata := flags.Bool("metadata", true, "apply the guest-agent-config metadata overrides")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if err := cfg.Load(nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %+v\n", err)
+		return 1
+	}
+
+	if *withMetadata {
+		// Logs go to stderr only, stdout is reserved to the configuration.
+		if err := initCommandLogger(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+			return 1
+		}
+
+		// The metadata layer is left out, and reported, if the metadata server
+		// can't be reached, i.e. when not running on GCE.
+		mdCtx, cancel := context.WithTimeout(ctx, configShowMetadataTimeout)
+		defer cancel()
+		md, err := metadata.New().Get(mdCtx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get metadata, showing the configuration without the metadata overrides: %+v\n", err)
+		} else {
+			applyConfigOverrides(md)
+		}
+	}
+
+	if err := cfg.WriteEffective(w, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write configuration: %+v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+var (
+	// appliedProjectOverrides and appliedInstanceOverrides are the guest-agent-config
+	// fragments last merged into the configuration.
+	appliedProjectOverrides, appliedInstanceOverrides string
+
+	// appliedOverridesMu protects appliedProjectOverrides and appliedInstanceOverrides,
+	// the metadata event handlers and the instance setup may apply the overrides
+	// concurrently.
+	appliedOverridesMu sync.Mutex
+)
+
+// applyConfigOverrides merges the guest-agent-config metadata attributes into the
+// configuration if MetadataOverrides is enabled. The configuration is only reloaded
+// if the attributes have changed since the last call.
+func applyConfigOverrides(md *metadata.Descriptor) {
+	var project, instance string
+	if cfg.Get().MetadataOverrides.Enabled {
+		project = md.Project.Attributes.GuestAgentConfig
+		instance = md.Instance.Attributes.GuestAgentConfig
+	}
+
+	appliedOverridesMu.Lock()
+	defer appliedOverridesMu.Unlock()
+
+	if project == appliedProjectOverrides && instance == appliedInstanceOverrides {
+		return
+	}
+
+	logfields.Infof("Applying guest-agent-config metadata configuration overrides")
+	rejected, err := cfg.ApplyMetadataOverrides(project, instance)
+	if err != nil {
+		logfields.Errorf("Failed to apply guest-agent-config metadata overrides: %+v", err)
+		return
+	}
+
+	for _, curr := range rejected {
+		logfields.Warningf("Ignoring %s of guest-agent-config, it's not allowed to be overridden by metadata, "+
+			"see MetadataOverrides.allowed_sections.", curr)
+	}
+
+	appliedProjectOverrides = project
+	appliedInstanceOverrides = instance
+}
@@ -0,0 +1,334 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+const (
+	// controlStatusPath returns the status of the managers, scheduler jobs and
+	// event watchers.
+	controlStatusPath = "/v1/status"
+	// controlReconcilePath triggers a reconciliation of the managers.
+	controlReconcilePath = "/v1/reconcile"
+	// controlReloadPath reloads the configuration.
+	controlReloadPath = "/v1/reload"
+	// controlEventsPath returns the recent event history.
+	controlEventsPath = "/v1/events"
+)
+
+// controlStatus is the response of controlStatusPath.
+type controlStatus struct {
+	// Managers is the status of every manager that has run so far.
+	Managers []managerStatus `json:"managers"`
+	// Jobs is the status of the scheduled jobs.
+	Jobs []scheduler.JobStatus `json:"jobs"`
+	// Watchers is the status of the registered event watchers.
+	Watchers []events.WatcherStatus `json:"watchers"`
+}
+
+// controlReconcileRequest is the request of controlReconcilePath.
+type controlReconcileRequest struct {
+	// Managers are the names of the managers to reconcile, all of them if empty.
+	Managers []string `json:"managers,omitempty"`
+}
+
+// controlError is the response of a failed request.
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// controlServer implements the control API, its operations are pointers to
+// functions so unit tests can replace them.
+type controlServer struct {
+	// ctx is the agent's context, the operations use it rather than the request's
+	// one so they are not interrupted by a client going away.
+	ctx       context.Context
+	status    func() *controlStatus
+	reconcile func(ctx context.Context, names []string) error
+	reload    func() error
+	history   func() []events.EventRecord
+}
+
+// newControlServer returns a controlServer operating on the agent's state.
+func newControlServer(ctx context.Context) *controlServer {
+	return &controlServer{
+		ctx: ctx,
+		status: func() *controlStatus {
+			return &controlStatus{
+				Managers: getManagerStatuses(),
+				Jobs:     scheduler.Get().Jobs(),
+				Watchers: events.Get().Watchers(),
+			}
+		},
+		reconcile: reconcileNow,
+		reload:    func() error { return reloadConfigFiles(ctx) },
+		history:   events.Get().History,
+	}
+}
+
+// reloadConfigFiles reloads the configuration files, the metadata overrides previously
+// applied are kept, re-applies the configured log levels and reschedules the
+// reconciliation jobs.
+func reloadConfigFiles(ctx context.Context) error {
+	if err := cfg.Reload(); err != nil {
+		return err
+	}
+	logfields.Infof("Configuration reloaded")
+	logLevels.apply(time.Now())
+	scheduleReconciliation(ctx, runtime.GOOS)
+	return nil
+}
+
+// handler returns the control API's HTTP handler.
+func (s *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(controlStatusPath, s.method(http.MethodGet, s.handleStatus))
+	mux.HandleFunc(controlReconcilePath, s.method(http.MethodPost, s.handleReconcile))
+	mux.HandleFunc(controlReloadPath, s.method(http.MethodPost, s.handleReload))
+	mux.HandleFunc(controlEventsPath, s.method(http.MethodGet, s.handleEvents))
+	return mux
+}
+
+// method wraps handler so that requests with a method other than method are
+// rejected.
+func (s *controlServer) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeControlResponse(w, http.StatusOK, s.status())
+}
+
+func (s *controlServer) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	var req controlReconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	logfields.Infof("Reconciliation requested through the control API")
+	if err := s.reconcile(s.ctx, req.Managers); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeControlResponse(w, http.StatusOK, s.status().Managers)
+}
+
+func (s *controlServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	logfields.Infof("Configuration reload requested through the control API")
+	if err := s.reload(); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	history := s.history()
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+			return
+		}
+		if limit < len(history) {
+			history = history[len(history)-limit:]
+		}
+	}
+
+	writeControlResponse(w, http.StatusOK, history)
+}
+
+// writeControlResponse writes data as indented JSON.
+func writeControlResponse(w http.ResponseWriter, code int, data interface{}) {
+	res, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(res, '\n'))
+}
+
+// writeControlError writes err as a controlError.
+func writeControlError(w http.ResponseWriter, code int, err error) {
+	writeControlResponse(w, code, &controlError{Error: err.Error()})
+}
+
+// controlListener is a Unix domain socket listener removing its socket when closed.
+type controlListener struct {
+	net.Listener
+	path string
+}
+
+// Close closes the listener and removes its socket.
+func (l *controlListener) Close() error {
+	err := l.Listener.Close()
+	if rmErr := os.Remove(l.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// listenPrivateSocket listens on the Unix domain socket path, only accessible by
+// the user running the agent, replacing any socket left behind by a previous run.
+func listenPrivateSocket(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %+v", dir, err)
+	}
+
+	// The socket is created in a private directory and moved in place once its
+	// permissions are restricted, so other users can never connect to it.
+	tmpDir, err := os.MkdirTemp(dir, ".control")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmp := filepath.Join(tmpDir, filepath.Base(path))
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %+v", tmp, err)
+	}
+
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to change %s permissions: %+v", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to move %s to %s: %+v", tmp, path, err)
+	}
+
+	return &controlListener{Listener: listener, path: path}, nil
+}
+
+// startControlServer serves the control API on the configured socket until ctx is
+// cancelled, if enabled.
+func startControlServer(ctx context.Context, config *cfg.Control) error {
+	if !config.Enabled || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	listener, err := listenPrivateSocket(config.SocketPath)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: newControlServer(ctx).handler()}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			logfields.Errorf("Failed to close control API server: %+v", err)
+		}
+	}()
+
+	go func() {
+		logfields.Infof("Serving control API on %s", config.SocketPath)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logfields.Errorf("Control API server failed: %+v", err)
+		}
+	}()
+
+	return nil
+}
+
+// controlClient is a client of the control API.
+type controlClient struct {
+	client *http.Client
+}
+
+// newControlClient returns a client of the control API served on socketPath.
+func newControlClient(socketPath string) *controlClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &controlClient{client: &http.Client{Transport: transport}}
+}
+
+// do sends a request with body, if not nil, as JSON and decodes the response into
+// out, if not nil.
+func (c *controlClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	// The host is ignored, the connection is always made to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, reqBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var res controlError
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.Error == "" {
+			return fmt.Errorf("request failed: %s", resp.Status)
+		}
+		return errors.New(res.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
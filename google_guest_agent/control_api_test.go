@@ -0,0 +1,227 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+)
+
+// fakeControlServer returns a controlServer with fake operations, reconciled and
+// reloads record the calls made.
+func fakeControlServer(reconciled *[][]string, reloads *int) *controlServer {
+	return &controlServer{
+		ctx: context.Background(),
+		status: func() *controlStatus {
+			return &controlStatus{
+				Managers: []managerStatus{{Name: "address", Enabled: true}},
+				Jobs:     []scheduler.JobStatus{{ID: "reconcile-address"}},
+				Watchers: []events.WatcherStatus{{ID: "metadata", EventType: "metadata-watcher,longpoll", Running: true}},
+			}
+		},
+		reconcile: func(ctx context.Context, names []string) error {
+			if len(names) > 0 && names[0] == "foo" {
+				return fmt.Errorf("unknown manager %q", names[0])
+			}
+			*reconciled = append(*reconciled, names)
+			return nil
+		},
+		reload: func() error {
+			*reloads++
+			return nil
+		},
+		history: func() []events.EventRecord {
+			return []events.EventRecord{{Type: "first"}, {Type: "second"}, {Type: "third"}}
+		},
+	}
+}
+
+// startTestControlServer serves server on a socket in a temporary directory and
+// returns a client of it.
+func startTestControlServer(t *testing.T, server *controlServer) *controlClient {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the control API is not supported on windows")
+	}
+
+	// Unix domain socket paths are limited to ~100 characters, t.TempDir() may be
+	// too long.
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %+v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "run", "control.sock")
+	listener, err := listenPrivateSocket(path)
+	if err != nil {
+		t.Fatalf("listenPrivateSocket(%s) failed: %+v", path, err)
+	}
+
+	srv := &http.Server{Handler: server.handler()}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return newControlClient(path)
+}
+
+func TestListenPrivateSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control API is not supported on windows")
+	}
+
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "control.sock")
+	// A stale socket file left behind by a previous run must be replaced.
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("Failed to write %s: %+v", path, err)
+	}
+
+	listener, err := listenPrivateSocket(path)
+	if err != nil {
+		t.Fatalf("listenPrivateSocket(%s) failed: %+v", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %+v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("listenPrivateSocket(%s) created %s, want a socket with 0600 permissions", path, info.Mode())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("listenPrivateSocket(%s) left %d entries in %s, want: 1", path, len(entries), dir)
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Errorf("Close() failed: %+v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Close() didn't remove %s", path)
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	var reconciled [][]string
+	var reloads int
+	client := startTestControlServer(t, fakeControlServer(&reconciled, &reloads))
+	ctx := context.Background()
+
+	var status controlStatus
+	if err := client.do(ctx, http.MethodGet, controlStatusPath, nil, &status); err != nil {
+		t.Fatalf("GET %s failed: %+v", controlStatusPath, err)
+	}
+	if len(status.Managers) != 1 || len(status.Jobs) != 1 || len(status.Watchers) != 1 {
+		t.Errorf("GET %s = %+v, want one manager, job and watcher", controlStatusPath, status)
+	}
+
+	var statuses []managerStatus
+	req := &controlReconcileRequest{Managers: []string{"address"}}
+	if err := client.do(ctx, http.MethodPost, controlReconcilePath, req, &statuses); err != nil {
+		t.Fatalf("POST %s failed: %+v", controlReconcilePath, err)
+	}
+	if len(reconciled) != 1 || strings.Join(reconciled[0], ",") != "address" {
+		t.Errorf("POST %s reconciled %v, want: [[address]]", controlReconcilePath, reconciled)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "address" {
+		t.Errorf("POST %s = %+v, want the address manager status", controlReconcilePath, statuses)
+	}
+
+	req = &controlReconcileRequest{Managers: []string{"foo"}}
+	if err := client.do(ctx, http.MethodPost, controlReconcilePath, req, nil); err == nil || err.Error() != `unknown manager "foo"` {
+		t.Errorf("POST %s returned error: %v, want: unknown manager \"foo\"", controlReconcilePath, err)
+	}
+
+	if err := client.do(ctx, http.MethodPost, controlReloadPath, nil, nil); err != nil || reloads != 1 {
+		t.Errorf("POST %s = %v, reloads: %d, want: nil, reloads: 1", controlReloadPath, err, reloads)
+	}
+
+	var history []events.EventRecord
+	if err := client.do(ctx, http.MethodGet, controlEventsPath+"?limit=2", nil, &history); err != nil {
+		t.Fatalf("GET %s failed: %+v", controlEventsPath, err)
+	}
+	if len(history) != 2 || history[0].Type != "second" || history[1].Type != "third" {
+		t.Errorf("GET %s?limit=2 = %+v, want the second and third events", controlEventsPath, history)
+	}
+
+	if err := client.do(ctx, http.MethodGet, controlEventsPath+"?limit=foo", nil, nil); err == nil {
+		t.Errorf("GET %s?limit=foo succeeded, want error", controlEventsPath)
+	}
+
+	if err := client.do(ctx, http.MethodGet, controlReloadPath, nil, nil); err == nil {
+		t.Errorf("GET %s succeeded, want error", controlReloadPath)
+	}
+}
+
+func TestCtl(t *testing.T) {
+	var reconciled [][]string
+	var reloads int
+	client := startTestControlServer(t, fakeControlServer(&reconciled, &reloads))
+
+	tests := []struct {
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{args: []string{"status"}, want: `"id": "reconcile-address"`},
+		{args: []string{"status", "foo"}, wantErr: "the status command takes no arguments"},
+		{args: []string{"reconcile"}, want: `"name": "address"`},
+		{args: []string{"reconcile", "foo"}, wantErr: `failed to reconcile managers: unknown manager "foo"`},
+		{args: []string{"reload"}, want: "Configuration reloaded."},
+		{args: []string{"events", "--limit=1"}, want: `"type": "third"`},
+		{args: []string{"foo"}, wantErr: `"foo" is not a valid ctl command`},
+	}
+
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ctl(context.Background(), client, &buf, tc.args)
+
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("ctl(%v) returned error: %v, want: %s", tc.args, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ctl(%v) failed: %+v", tc.args, err)
+			}
+			if !strings.Contains(buf.String(), tc.want) {
+				t.Errorf("ctl(%v) wrote %q, want it to contain %q", tc.args, buf.String(), tc.want)
+			}
+		})
+	}
+
+	if len(reconciled) != 1 || len(reconciled[0]) != 0 {
+		t.Errorf("ctl(reconcile) reconciled %v, want all managers", reconciled)
+	}
+}
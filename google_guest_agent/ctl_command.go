@@ -0,0 +1,128 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func ctlUsage(w io.Writer) {
+	fmt.Fprintf(w,
+		"Usage:\n"+
+			"  %[1]s ctl status: print the status of the managers, scheduled jobs and event watchers\n"+
+			"  %[1]s ctl reconcile [manager...]: re-apply the managers' state if it has drifted, defaults to all managers\n"+
+			"  %[1]s ctl reload: reload the configuration files\n"+
+			"  %[1]s ctl events [--limit=N]: print the most recent events\n",
+		filepath.Base(os.Args[0]))
+}
+
+// runCtlCommand handles the ctl subcommands, talking to the running agent through
+// the control API. It returns the process' exit code.
+func runCtlCommand(ctx context.Context, args []string) int {
+	if len(args) < 1 {
+		ctlUsage(os.Stderr)
+		return 1
+	}
+
+	if args[0] == "help" {
+		ctlUsage(os.Stdout)
+		return 0
+	}
+
+	if !cfg.Get().Control.Enabled {
+		fmt.Fprintln(os.Stderr, "The control API is disabled, see the [Control] enabled configuration.")
+		return 1
+	}
+
+	client := newControlClient(cfg.Get().Control.SocketPath)
+	if err := ctl(ctx, client, os.Stdout, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if _, ok := err.(*ctlUsageError); ok {
+			ctlUsage(os.Stderr)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// ctlUsageError reports a command line misuse.
+type ctlUsageError struct {
+	msg string
+}
+
+func (e *ctlUsageError) Error() string {
+	return e.msg
+}
+
+// ctl runs the ctl subcommand args[0] with client, writing its output to w.
+func ctl(ctx context.Context, client *controlClient, w io.Writer, args []string) error {
+	var res json.RawMessage
+
+	switch args[0] {
+	case "status":
+		if len(args) > 1 {
+			return &ctlUsageError{"the status command takes no arguments"}
+		}
+		if err := client.do(ctx, http.MethodGet, controlStatusPath, nil, &res); err != nil {
+			return fmt.Errorf("failed to get status: %v", err)
+		}
+	case "reconcile":
+		req := &controlReconcileRequest{Managers: args[1:]}
+		if err := client.do(ctx, http.MethodPost, controlReconcilePath, req, &res); err != nil {
+			return fmt.Errorf("failed to reconcile managers: %v", err)
+		}
+	case "reload":
+		if len(args) > 1 {
+			return &ctlUsageError{"the reload command takes no arguments"}
+		}
+		if err := client.do(ctx, http.MethodPost, controlReloadPath, nil, nil); err != nil {
+			return fmt.Errorf("failed to reload configuration: %v", err)
+		}
+		fmt.Fprintln(w, "Configuration reloaded.")
+		return nil
+	case "events":
+		flags := flag.NewFlagSet("events", flag.ContinueOnError)
+		limit := flags.Int("limit", 0, "number of events to print, 0 prints all the recorded events")
+		if err := flags.Parse(args[1:]); err != nil {
+			return &ctlUsageError{err.Error()}
+		}
+		path := controlEventsPath
+		if *limit > 0 {
+			path = fmt.Sprintf("%s?limit=%d", path, *limit)
+		}
+		if err := client.do(ctx, http.MethodGet, path, nil, &res); err != nil {
+			return fmt.Errorf("failed to get events: %v", err)
+		}
+	default:
+		return &ctlUsageError{fmt.Sprintf("%q is not a valid ctl command", args[0])}
+	}
+
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
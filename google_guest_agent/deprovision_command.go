@@ -0,0 +1,251 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+// deprovisionStep is a change the deprovision command makes to bring the
+// instance back to its first boot state.
+type deprovisionStep struct {
+	desc string
+	run  func(ctx context.Context) error
+}
+
+// runDeprovisionCommand reverts what the agent has set up on the instance,
+// i.e. before capturing an image from it, or only prints it with --dry-run. It
+// returns the process' exit code.
+func runDeprovisionCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("deprovision", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the changes without making them")
+	keepArchives := flags.Bool("keep-archives", false, "keep the home directories archived to the archive_dir")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "The deprovision command takes no arguments.\n")
+		return 1
+	}
+	if runtime.GOOS == "windows" {
+		fmt.Fprintf(os.Stderr, "The deprovision command isn't supported on windows.\n")
+		return 1
+	}
+
+	// Logs go to stderr only, stdout is reserved to the steps.
+	if err := initCommandLogger(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+		return 1
+	}
+
+	// The agent would set up the users and files being removed again.
+	if reason := agentRunning(ctx, cfg.Get().Control.SocketPath); reason != "" {
+		if !*dryRun {
+			fmt.Fprintf(os.Stderr, "The guest agent is running, %s, stop it first.\n", reason)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Warning: the guest agent is running, %s.\n", reason)
+	}
+
+	steps, err := deprovisionSteps(cfg.Get(), *keepArchives)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list the deprovision steps: %+v\n", err)
+		return 1
+	}
+	return runDeprovisionSteps(ctx, os.Stdout, steps, *dryRun)
+}
+
+// runDeprovisionSteps writes the description of each step to w and, unless
+// dryRun is set, runs it. It returns 1 if any step failed, 0 otherwise.
+func runDeprovisionSteps(ctx context.Context, w io.Writer, steps []deprovisionStep, dryRun bool) int {
+	if len(steps) == 0 {
+		fmt.Fprintf(w, "Nothing to deprovision.\n")
+		return 0
+	}
+
+	var res int
+	for _, step := range steps {
+		fmt.Fprintf(w, "%s\n", step.desc)
+		if dryRun {
+			continue
+		}
+		if err := step.run(ctx); err != nil {
+			fmt.Fprintf(w, "  failed: %v\n", err)
+			res = 1
+		}
+	}
+	return res
+}
+
+// agentRunning returns why the guest agent is running, its control API answers
+// on socketPath or its systemd unit is active, or an empty string if it's not.
+func agentRunning(ctx context.Context, socketPath string) string {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if socketPath != "" {
+		if err := newControlClient(socketPath).do(ctx, http.MethodGet, controlStatusPath, nil, nil); err == nil {
+			return fmt.Sprintf("its control API answers on %s", socketPath)
+		}
+	}
+	if err := run.Quiet(ctx, "systemctl", "is-active", "--quiet", "google-guest-agent.service"); err == nil {
+		return "the google-guest-agent service is active"
+	}
+	return ""
+}
+
+// deprovisionSteps returns the steps removing the Google users, the SSH host
+// keys, the instance ID file, boto.cfg, the OS Login configuration, the agent's
+// state and, unless keepArchives is set, the home directories archived to the
+// archive_dir so that the instance is set up again on its next boot, as a new
+// instance.
+func deprovisionSteps(config *cfg.Sections, keepArchives bool) ([]deprovisionStep, error) {
+	var steps []deprovisionStep
+
+	// The users and their home directories are removed, whatever
+	// deprovision_remove is, and not archived into the image.
+	accountsConfig := *config.Accounts
+	accountsConfig.DeprovisionRemove = true
+	accountsConfig.ArchiveDir = ""
+	removeConfig := *config
+	removeConfig.Accounts = &accountsConfig
+
+	gUsers, err := readGoogleUsersFile()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read google_users file: %v", err)
+	}
+	var users []string
+	for user := range gUsers {
+		if protectedUser(config.Accounts, user) == "" {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		user := user
+		steps = append(steps, deprovisionStep{
+			desc: fmt.Sprintf("remove user %s and its home directory", user),
+			run:  func(ctx context.Context) error { return removeGoogleUser(ctx, &removeConfig, user, nil, nil) },
+		})
+	}
+
+	// The OS Login lines are filtered out of the system configuration files.
+	for _, file := range osloginConfigFiles(false, false, false) {
+		contents, err := os.ReadFile(file.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		updated := file.update(string(contents))
+		if updated == string(contents) {
+			continue
+		}
+		path := file.path
+		steps = append(steps, deprovisionStep{
+			desc: fmt.Sprintf("remove the OS Login configuration from %s", path),
+			run:  func(ctx context.Context) error { return writeConfigFile(path, updated) },
+		})
+	}
+
+	var paths []string
+	if config.InstanceSetup.SetHostKeys {
+		// generateSSHKeys creates them again on the first boot.
+		for _, pattern := range []string{"ssh_host_*_key", "ssh_host_*_key.pub"} {
+			matches, err := filepath.Glob(filepath.Join(config.InstanceSetup.HostKeyDir, pattern))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, matches...)
+		}
+	}
+	paths = append(paths, config.Instance.InstanceIDDir)
+	if config.InstanceSetup.SetBotoConfig {
+		paths = append(paths, "/etc/boto.cfg")
+	}
+	paths = append(paths, osloginSudoersFile(), "/etc/oslogin_passwd.cache", "/etc/oslogin_group.cache")
+	paths = append(paths, osloginDirs...)
+	paths = append(paths, "/etc/sudoers.d/google_sudoers", googleUserGroupsFile, googleLockedUsersFile)
+	if config.Accounts.ArchiveDir != "" && !keepArchives {
+		// The previous users' home directories must not end up in the image. The
+		// directory may be shared, only the archives archiveHome wrote are removed.
+		entries, err := os.ReadDir(config.Accounts.ArchiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && archiveNameRegexp.MatchString(entry.Name()) {
+				paths = append(paths, filepath.Join(config.Accounts.ArchiveDir, entry.Name()))
+			}
+		}
+	}
+	if config.Accounts.AuditLog != "" {
+		// Its records name the previous users and their keys' fingerprints.
+		paths = append(paths, config.Accounts.AuditLog)
+		// Only its path.N backups, see rotateAuditLog.
+		backups, err := filepath.Glob(config.Accounts.AuditLog + ".[0-9]*")
+		if err != nil {
+			return nil, err
+		}
+		for _, backup := range backups {
+			if _, err := strconv.Atoi(strings.TrimPrefix(backup, config.Accounts.AuditLog+".")); err == nil {
+				paths = append(paths, backup)
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err != nil {
+			continue
+		}
+		path := path
+		steps = append(steps, deprovisionStep{
+			desc: fmt.Sprintf("remove %s", path),
+			run:  func(ctx context.Context) error { return os.RemoveAll(path) },
+		})
+	}
+
+	if _, err := os.Lstat(googleUsersFile); err == nil {
+		// It's kept until every user is removed, for the next run to retry.
+		steps = append(steps, deprovisionStep{
+			desc: fmt.Sprintf("remove %s", googleUsersFile),
+			run: func(ctx context.Context) error {
+				for _, user := range users {
+					if _, err := getPasswd(user); err == nil {
+						return fmt.Errorf("user %s wasn't removed", user)
+					}
+				}
+				return os.Remove(googleUsersFile)
+			},
+		})
+	}
+
+	return steps, nil
+}
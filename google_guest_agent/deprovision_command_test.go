@@ -0,0 +1,209 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestRunDeprovisionSteps(t *testing.T) {
+	ctx := context.Background()
+
+	var ran []string
+	steps := []deprovisionStep{
+		{desc: "remove foo", run: func(context.Context) error { ran = append(ran, "foo"); return nil }},
+		{desc: "remove bar", run: func(context.Context) error { ran = append(ran, "bar"); return fmt.Errorf("busy") }},
+	}
+
+	var buf bytes.Buffer
+	if res := runDeprovisionSteps(ctx, &buf, steps, true); res != 0 {
+		t.Errorf("runDeprovisionSteps(dry run) = %d, want: 0", res)
+	}
+	if want := "remove foo\nremove bar\n"; buf.String() != want {
+		t.Errorf("runDeprovisionSteps(dry run) printed %q, want: %q", buf.String(), want)
+	}
+	if len(ran) != 0 {
+		t.Errorf("runDeprovisionSteps(dry run) ran %v, want: nothing", ran)
+	}
+
+	buf.Reset()
+	if res := runDeprovisionSteps(ctx, &buf, steps, false); res != 1 {
+		t.Errorf("runDeprovisionSteps() = %d, want: 1", res)
+	}
+	if want := "remove foo\nremove bar\n  failed: busy\n"; buf.String() != want {
+		t.Errorf("runDeprovisionSteps() printed %q, want: %q", buf.String(), want)
+	}
+	if want := []string{"foo", "bar"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("runDeprovisionSteps() ran %v, want: %v", ran, want)
+	}
+
+	buf.Reset()
+	if res := runDeprovisionSteps(ctx, &buf, nil, false); res != 0 {
+		t.Errorf("runDeprovisionSteps(no steps) = %d, want: 0", res)
+	}
+	if want := "Nothing to deprovision.\n"; buf.String() != want {
+		t.Errorf("runDeprovisionSteps(no steps) printed %q, want: %q", buf.String(), want)
+	}
+}
+
+func TestDeprovisionSteps(t *testing.T) {
+	dir := t.TempDir()
+	oldUsersFile, oldGroupsFile, oldLockedFile := googleUsersFile, googleUserGroupsFile, googleLockedUsersFile
+	t.Cleanup(func() {
+		googleUsersFile, googleUserGroupsFile, googleLockedUsersFile = oldUsersFile, oldGroupsFile, oldLockedFile
+	})
+	googleUsersFile = filepath.Join(dir, "google_users")
+	googleUserGroupsFile = filepath.Join(dir, "google_users_groups")
+	googleLockedUsersFile = filepath.Join(dir, "google_users_locked")
+
+	hostKeyDir := filepath.Join(dir, "ssh")
+	archiveDir := filepath.Join(dir, "archives")
+	for _, d := range []string{hostKeyDir, archiveDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("os.Mkdir(%s) = %v, want: nil", d, err)
+		}
+	}
+	files := map[string]string{
+		googleUsersFile:                                          "root\n",
+		googleUserGroupsFile:                                     "",
+		googleLockedUsersFile:                                    "",
+		filepath.Join(dir, "instance_id"):                        "1234",
+		filepath.Join(hostKeyDir, "ssh_host_ed25519_key"):        "private",
+		filepath.Join(hostKeyDir, "ssh_host_ed25519_key.pub"):    "public",
+		filepath.Join(hostKeyDir, "ssh_config"):                  "kept",
+		filepath.Join(archiveDir, "alice-20230101000000.tar.gz"): "archive",
+		filepath.Join(archiveDir, "notes.txt"):                   "unrelated",
+		filepath.Join(archiveDir, "backup.tar.gz"):               "unrelated",
+		filepath.Join(dir, "audit.log"):                          "audit",
+		filepath.Join(dir, "audit.log.1"):                        "audit",
+		filepath.Join(dir, "audit.log.bak"):                      "unrelated",
+	}
+	kept := map[string]bool{
+		filepath.Join(hostKeyDir, "ssh_config"):    true,
+		filepath.Join(archiveDir, "notes.txt"):     true,
+		filepath.Join(archiveDir, "backup.tar.gz"): true,
+		filepath.Join(dir, "audit.log.bak"):        true,
+	}
+	for path, contents := range files {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("os.WriteFile(%s) = %v, want: nil", path, err)
+		}
+	}
+
+	config := &cfg.Sections{
+		// root is protected, it's never removed.
+		Accounts:      &cfg.Accounts{ProtectedUsers: "root", ProtectedUIDThreshold: 1000, ArchiveDir: archiveDir, AuditLog: filepath.Join(dir, "audit.log")},
+		Instance:      &cfg.Instance{InstanceIDDir: filepath.Join(dir, "instance_id")},
+		InstanceSetup: &cfg.InstanceSetup{SetHostKeys: true, HostKeyDir: hostKeyDir},
+	}
+
+	// With --keep-archives the archived home directories are left as is.
+	steps, err := deprovisionSteps(config, true)
+	if err != nil {
+		t.Fatalf("deprovisionSteps(keep archives) = %v, want: nil", err)
+	}
+	for _, step := range steps {
+		if strings.Contains(step.desc, archiveDir) {
+			t.Errorf("deprovisionSteps(keep archives) returned step %q, want the archives kept", step.desc)
+		}
+	}
+
+	steps, err = deprovisionSteps(config, false)
+	if err != nil {
+		t.Fatalf("deprovisionSteps() = %v, want: nil", err)
+	}
+
+	// Only the steps in the temporary directory are run, the others depend on
+	// the test host.
+	var got []string
+	var local []deprovisionStep
+	for _, step := range steps {
+		if strings.HasPrefix(step.desc, "remove user ") || strings.Contains(step.desc, dir) {
+			got = append(got, step.desc)
+			local = append(local, step)
+		}
+	}
+	want := []string{
+		"remove " + filepath.Join(hostKeyDir, "ssh_host_ed25519_key"),
+		"remove " + filepath.Join(hostKeyDir, "ssh_host_ed25519_key.pub"),
+		"remove " + filepath.Join(dir, "instance_id"),
+		"remove " + googleUserGroupsFile,
+		"remove " + googleLockedUsersFile,
+		"remove " + filepath.Join(archiveDir, "alice-20230101000000.tar.gz"),
+		"remove " + filepath.Join(dir, "audit.log"),
+		"remove " + filepath.Join(dir, "audit.log.1"),
+		"remove " + googleUsersFile,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("deprovisionSteps() = %v, want: %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if res := runDeprovisionSteps(context.Background(), &buf, local, false); res != 0 {
+		t.Fatalf("runDeprovisionSteps() = %d, want: 0, output: %s", res, buf.String())
+	}
+	for path := range files {
+		_, err := os.Stat(path)
+		if kept[path] != (err == nil) {
+			t.Errorf("os.Stat(%s) = %v, want kept: %t", path, err, kept[path])
+		}
+	}
+}
+
+func TestAgentRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control API is not supported on windows")
+	}
+	ctx := context.Background()
+
+	// Unix domain socket paths are limited to ~100 characters, t.TempDir() may be
+	// too long.
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %+v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "control.sock")
+
+	// Unless the test host runs the agent, nothing answers.
+	if reason := agentRunning(ctx, path); reason != "" {
+		t.Skipf("agentRunning() = %q, the test host runs the agent", reason)
+	}
+
+	listener, err := listenPrivateSocket(path)
+	if err != nil {
+		t.Fatalf("listenPrivateSocket(%s) failed: %+v", path, err)
+	}
+	var reconciled [][]string
+	var reloads int
+	srv := &http.Server{Handler: fakeControlServer(&reconciled, &reloads).handler()}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	if reason := agentRunning(ctx, path); !strings.Contains(reason, path) {
+		t.Errorf("agentRunning() = %q with the control API answering, want it to mention %s", reason, path)
+	}
+}
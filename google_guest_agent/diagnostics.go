@@ -23,8 +23,8 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 const diagnosticsCmd = `C:\Program Files\Google\Compute Engine\diagnostics\diagnostics.exe`
@@ -43,6 +43,16 @@ type diagnosticsEntry struct {
 	Trace     bool
 }
 
+func init() {
+	// Diagnostics are uploaded to a signed URL, routes must be set up first.
+	registerManager(&managerSpec{
+		name:         "diagnostics",
+		platform:     windowsOnly,
+		new:          func() manager { return &diagnosticsMgr{} },
+		dependencies: []string{"address"},
+	})
+}
+
 type diagnosticsMgr struct {
 	// fakeWindows forces Disabled to run as if it was running in a windows system.
 	// mostly target for unit tests.
@@ -87,7 +97,7 @@ func (d *diagnosticsMgr) Disabled(ctx context.Context) (bool, error) {
 }
 
 func (d *diagnosticsMgr) Set(ctx context.Context) error {
-	logger.Infof("Diagnostics: logs export requested.")
+	logfields.Infof("Diagnostics: logs export requested.")
 	diagnosticsEntries, err := readRegMultiString(regKeyBase, diagnosticsRegKey)
 	if err != nil && err != errRegNotExist {
 		return err
@@ -118,16 +128,16 @@ func (d *diagnosticsMgr) Set(ctx context.Context) error {
 	}
 	// If no existing running job, set it to 1 and block other requests
 	if !atomic.CompareAndSwapInt32(&isDiagnosticsRunning, 0, 1) {
-		logger.Infof("Diagnostics: reject the request, as an existing process is collecting logs from the system")
+		logfields.Infof("Diagnostics: reject the request, as an existing process is collecting logs from the system")
 		return nil
 	}
 
 	go func() {
-		logger.Infof("Diagnostics: collecting logs from the system.")
+		logfields.Infof("Diagnostics: collecting logs from the system.")
 		res := run.WithCombinedOutput(ctx, diagnosticsCmd, args...)
-		logger.Infof(res.Combined)
+		logfields.Infof(res.Combined)
 		if res.ExitCode != 0 {
-			logger.Warningf("Error collecting logs: %v", res.Error())
+			logfields.Warningf("Error collecting logs: %v", res.Error())
 		}
 		// Job is done, unblock the following requests
 		atomic.SwapInt32(&isDiagnosticsRunning, 0)
@@ -135,3 +145,32 @@ func (d *diagnosticsMgr) Set(ctx context.Context) error {
 
 	return writeRegMultiString(regKeyBase, diagnosticsRegKey, diagnosticsEntries)
 }
+
+// Plan returns the diagnostics collection the manager would start. The signed URL
+// is a credential and is not included.
+func (d *diagnosticsMgr) Plan(ctx context.Context) ([]string, error) {
+	strEntry := newMetadata.Instance.Attributes.Diagnostics
+	if strEntry == "" {
+		return nil, nil
+	}
+
+	diagnosticsEntries, err := readRegMultiString(regKeyBase, diagnosticsRegKey)
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	if utils.ContainsString(strEntry, diagnosticsEntries) {
+		return nil, nil
+	}
+
+	var entry diagnosticsEntry
+	if err := json.Unmarshal([]byte(strEntry), &entry); err != nil {
+		return nil, err
+	}
+
+	expired, _ := utils.CheckExpired(entry.ExpireOn)
+	if entry.SignedURL == "" || expired {
+		return nil, nil
+	}
+
+	return []string{"collect diagnostics and upload them to the requested signed URL"}, nil
+}
@@ -19,9 +19,10 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 var (
@@ -29,6 +30,9 @@ var (
 		metadata.New(),
 	}
 	instance *Manager
+
+	// eventsLog logs the entries of the events component.
+	eventsLog = logfields.Component(logfields.ComponentEvents)
 )
 
 // Watcher defines the interface between the events manager and the actual
@@ -78,6 +82,12 @@ type Manager struct {
 	// control go routines to leave(given we don't have any more job left to
 	// process).
 	queue *watcherQueue
+
+	// history holds the most recent events dispatched to subscribers.
+	history *eventHistory
+
+	// dispatch is the event currently dispatched to subscribers, if any.
+	dispatch *dispatchState
 }
 
 // watcherQueue wraps the watchers <-> callbacks communication as well as the
@@ -189,6 +199,8 @@ func newManager() *Manager {
 		watchersMap:           make(map[string]bool),
 		removingWatcherEvents: make(map[string]bool),
 		subscribers:           make(map[string][]*eventSubscriber),
+		history:               &eventHistory{},
+		dispatch:              &dispatchState{},
 		queue: &watcherQueue{
 			watchersMap:           make(map[string]bool),
 			dataBus:               make(chan eventBusData),
@@ -236,7 +248,7 @@ func (mngr *Manager) unsubscribe(evType string, cb *EventCb) {
 	mngr.subscribers[evType] = keepMe
 
 	if len(keepMe) == 0 {
-		logger.Debugf("No more subscribers left for evType: %s", evType)
+		eventsLog.Debugf("No more subscribers left for evType: %s", evType)
 		delete(mngr.subscribers, evType)
 	}
 }
@@ -256,20 +268,20 @@ func (mngr *Manager) RemoveWatcher(ctx context.Context, watcher Watcher) error {
 	defer mngr.watchersMutex.Unlock()
 
 	id := watcher.ID()
-	logger.Debugf("Got a request to remove watcher: %s", id)
+	eventsLog.Debugf("Got a request to remove watcher: %s", id)
 	if _, found := mngr.watchersMap[id]; !found {
 		return fmt.Errorf("unknown Watcher(%s)", id)
 	}
 
 	for _, curr := range mngr.watcherEvents {
 		if _, found := mngr.removingWatcherEvents[curr.evType]; found {
-			logger.Debugf("Watcher(%s) is being removed, skipping removal request: %s", id, curr.evType)
+			eventsLog.Debugf("Watcher(%s) is being removed, skipping removal request: %s", id, curr.evType)
 			continue
 		}
 
 		if curr.watcher.ID() == id {
 			mngr.removingWatcherEvents[curr.evType] = true
-			logger.Debugf("Removing watcher: %s, event type: %s", id, curr.evType)
+			eventsLog.Debugf("Removing watcher: %s, event type: %s", id, curr.evType)
 			curr.removed <- true
 		}
 	}
@@ -311,7 +323,7 @@ func (mngr *Manager) AddWatcher(ctx context.Context, watcher Watcher) error {
 
 	// If we are already running the "run/launch" the watcher.
 	for _, curr := range watcher.Events() {
-		logger.Debugf("Adding watcher for event: %s", curr)
+		eventsLog.Debugf("Adding watcher for event: %s", curr)
 		mngr.queue.add(curr)
 		go func(watcher Watcher, evType string, removed chan bool) {
 			mngr.runWatcher(ctx, watcher, evType, removed)
@@ -328,7 +340,7 @@ func (mngr *Manager) runWatcher(ctx context.Context, watcher Watcher, evType str
 
 	go func() {
 		abort = <-removed
-		logger.Debugf("Got a request to abort watcher(%s) for event: %s", id, evType)
+		eventsLog.Debugf("Got a request to abort watcher(%s) for event: %s", id, evType)
 		cancel()
 	}()
 
@@ -338,10 +350,10 @@ func (mngr *Manager) runWatcher(ctx context.Context, watcher Watcher, evType str
 
 		renew, evData, err = watcher.Run(nCtx, evType)
 
-		logger.Debugf("Watcher(%s) returned event: %q, should renew?: %t", id, evType, renew)
+		eventsLog.Debugf("Watcher(%s) returned event: %q, should renew?: %t", id, evType, renew)
 
 		if abort || mngr.queue.leaving {
-			logger.Debugf("Watcher(%s), either are aborting(%t) or leaving(%t), breaking renew cycle",
+			eventsLog.Debugf("Watcher(%s), either are aborting(%t) or leaving(%t), breaking renew cycle",
 				id, abort, mngr.queue.leaving)
 			break
 		}
@@ -355,7 +367,7 @@ func (mngr *Manager) runWatcher(ctx context.Context, watcher Watcher, evType str
 		}
 	}
 
-	logger.Debugf("watcher finishing: %s", evType)
+	eventsLog.Debugf("watcher finishing: %s", evType)
 	if !abort {
 		removed <- true
 	}
@@ -390,12 +402,12 @@ func (mngr *Manager) Run(ctx context.Context) error {
 		for {
 			select {
 			case <-done:
-				logger.Debugf("Got context's Done() signal, leaving.")
+				eventsLog.Debugf("Got context's Done() signal, leaving.")
 				queue.leaving = true
 				finishCallbackHandler <- true
 				return
 			case <-finishContextHandler:
-				logger.Debugf("Got context handler finish signal, leaving.")
+				eventsLog.Debugf("Got context handler finish signal, leaving.")
 				queue.leaving = true
 				return
 			}
@@ -413,20 +425,30 @@ func (mngr *Manager) Run(ctx context.Context) error {
 			case <-finishCallbackHandler:
 				return
 			case busData := <-bus:
+				mngr.dispatch.set(busData.evType, time.Now())
 				subscribers := mngr.subscribers[busData.evType]
+
+				record := EventRecord{Time: time.Now(), Type: busData.evType, Subscribers: len(subscribers)}
+				if busData.data.Error != nil {
+					record.Error = busData.data.Error.Error()
+				}
+				mngr.history.add(record)
+
+				fields := eventsLog.With(logfields.KeyEventType, busData.evType)
 				if subscribers == nil {
-					logger.Debugf("No subscriber found for event: %s, returning.", busData.evType)
+					fields.Debugf("No subscriber found for event, returning.")
+					mngr.dispatch.set("", time.Time{})
 					continue
 				}
 
 				deleteMe := make([]*eventSubscriber, 0)
 				for _, curr := range subscribers {
-					logger.Debugf("Running registered callback for event: %s", busData.evType)
+					fields.Debugf("Running registered callback for event")
 					renew := (*curr.cb)(ctx, busData.evType, curr.data, busData.data)
 					if !renew {
 						deleteMe = append(deleteMe, curr)
 					}
-					logger.Debugf("Returning from event %q subscribed callback, should renew?: %t", busData.evType, renew)
+					fields.Debugf("Returning from event subscribed callback, should renew?: %t", renew)
 				}
 
 				mngr.subscribersMutex.Lock()
@@ -435,10 +457,11 @@ func (mngr *Manager) Run(ctx context.Context) error {
 				}
 				leave := mngr.subscribers[busData.evType] == nil
 				mngr.subscribersMutex.Unlock()
+				mngr.dispatch.set("", time.Time{})
 
 				// No more subscribers at all, we have nothing more left to do here.
 				if leave {
-					logger.Debugf("No subscribers left, leaving")
+					eventsLog.Debugf("No subscribers left, leaving")
 					break
 				}
 			}
@@ -465,7 +488,7 @@ func (mngr *Manager) Run(ctx context.Context) error {
 			len = queue.del(doneStr)
 			delete(mngr.removingWatcherEvents, doneStr)
 			if !queue.leaving && len == 0 {
-				logger.Debugf("All watchers are finished, signaling to leave.")
+				eventsLog.Debugf("All watchers are finished, signaling to leave.")
 				queue.finishContextHandler <- true
 				queue.finishCallbackHandler <- true
 			}
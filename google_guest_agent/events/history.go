@@ -0,0 +1,124 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// historySize is the number of events kept in the manager's history.
+const historySize = 100
+
+// EventRecord describes an event emitted by a watcher.
+type EventRecord struct {
+	// Time is the time the event was dispatched to its subscribers.
+	Time time.Time `json:"time"`
+	// Type is the event type.
+	Type string `json:"type"`
+	// Error is the error the watcher has reported along with the event, if any.
+	Error string `json:"error,omitempty"`
+	// Subscribers is the number of subscribers the event was dispatched to.
+	Subscribers int `json:"subscribers"`
+}
+
+// WatcherStatus describes a registered watcher's event type.
+type WatcherStatus struct {
+	// ID is the watcher id.
+	ID string `json:"id"`
+	// EventType is the event type the watcher handles.
+	EventType string `json:"eventType"`
+	// Running is true if the watcher is currently running for the event type.
+	Running bool `json:"running"`
+}
+
+// eventHistory is a fixed size ring buffer of the most recent events.
+type eventHistory struct {
+	mu      sync.Mutex
+	records []EventRecord
+	next    int
+}
+
+// add records r, overwriting the oldest record if the history is full.
+func (h *eventHistory) add(r EventRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.records) < historySize {
+		h.records = append(h.records, r)
+		return
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % historySize
+}
+
+// list returns a copy of the recorded events, oldest first.
+func (h *eventHistory) list() []EventRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := append([]EventRecord{}, h.records[h.next:]...)
+	return append(res, h.records[:h.next]...)
+}
+
+// History returns the most recent events dispatched by the manager, oldest first.
+func (mngr *Manager) History() []EventRecord {
+	return mngr.history.list()
+}
+
+// Watchers returns the registered watchers, one entry per event type, in
+// registration order.
+func (mngr *Manager) Watchers() []WatcherStatus {
+	mngr.watchersMutex.Lock()
+	defer mngr.watchersMutex.Unlock()
+
+	mngr.queue.queueMutex.RLock()
+	defer mngr.queue.queueMutex.RUnlock()
+
+	var res []WatcherStatus
+	for _, curr := range mngr.watcherEvents {
+		res = append(res, WatcherStatus{
+			ID:        curr.watcher.ID(),
+			EventType: curr.evType,
+			Running:   mngr.queue.watchersMap[curr.evType],
+		})
+	}
+	return res
+}
+
+// dispatchState is the event the manager is dispatching to its subscribers.
+type dispatchState struct {
+	mu     sync.Mutex
+	evType string
+	since  time.Time
+}
+
+// set records that evType is dispatched since since, an empty evType means the
+// dispatcher is idle.
+func (d *dispatchState) set(evType string, since time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evType = evType
+	d.since = since
+}
+
+// Dispatching returns the event type the manager is dispatching to its subscribers
+// and since when, or an empty type if the dispatcher is idle. A dispatch lasting
+// long means a subscriber's callback is stuck.
+func (mngr *Manager) Dispatching() (string, time.Time) {
+	mngr.dispatch.mu.Lock()
+	defer mngr.dispatch.mu.Unlock()
+	return mngr.dispatch.evType, mngr.dispatch.since
+}
@@ -0,0 +1,109 @@
+//  Copyright 2023 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	maxCount := 5
+	ctx := context.Background()
+	eventManager := newManager()
+
+	if err := eventManager.AddWatcher(ctx, &testWatcher{watcherID: "test-watcher", maxCount: maxCount}); err != nil {
+		t.Fatalf("Failed to add watcher to event manager: %+v", err)
+	}
+
+	watchers := eventManager.Watchers()
+	if len(watchers) != 1 || watchers[0].ID != "test-watcher" || watchers[0].EventType != "test-watcher,test-event" {
+		t.Errorf("Watchers() = %+v, want the test-watcher watcher", watchers)
+	}
+	if len(watchers) > 0 && watchers[0].Running {
+		t.Errorf("Watchers() returned a running watcher before Run()")
+	}
+
+	eventManager.Subscribe("test-watcher,test-event", nil, func(ctx context.Context, evType string, data interface{}, evData *EventData) bool {
+		return true
+	})
+
+	if err := eventManager.Run(ctx); err != nil {
+		t.Fatalf("Failed to run event manager, expected success, got error: %+v", err)
+	}
+
+	history := eventManager.History()
+	if len(history) != maxCount {
+		t.Fatalf("History() returned %d events, want: %d", len(history), maxCount)
+	}
+	for _, curr := range history {
+		if curr.Type != "test-watcher,test-event" || curr.Subscribers != 1 || curr.Error != "" {
+			t.Errorf("History() returned %+v, want a test-watcher,test-event event with 1 subscriber", curr)
+		}
+	}
+}
+
+func TestEventHistoryWraps(t *testing.T) {
+	history := &eventHistory{}
+	for i := 0; i < historySize+10; i++ {
+		history.add(EventRecord{Type: fmt.Sprintf("event-%d", i)})
+	}
+
+	records := history.list()
+	if len(records) != historySize {
+		t.Fatalf("list() returned %d records, want: %d", len(records), historySize)
+	}
+	if records[0].Type != "event-10" {
+		t.Errorf("list() returned %q as the oldest record, want: event-10", records[0].Type)
+	}
+	if last := records[len(records)-1].Type; last != fmt.Sprintf("event-%d", historySize+9) {
+		t.Errorf("list() returned %q as the newest record, want: event-%d", last, historySize+9)
+	}
+}
+
+func TestDispatching(t *testing.T) {
+	ctx := context.Background()
+	eventManager := newManager()
+
+	if err := eventManager.AddWatcher(ctx, &testWatcher{watcherID: "test-watcher", maxCount: 2}); err != nil {
+		t.Fatalf("Failed to add watcher to event manager: %+v", err)
+	}
+
+	if evType, _ := eventManager.Dispatching(); evType != "" {
+		t.Errorf("Dispatching() = %q before Run(), want idle", evType)
+	}
+
+	var dispatching []string
+	eventManager.Subscribe("test-watcher,test-event", nil, func(ctx context.Context, evType string, data interface{}, evData *EventData) bool {
+		current, since := eventManager.Dispatching()
+		if since.IsZero() {
+			t.Errorf("Dispatching() returned a zero start time while dispatching %s", current)
+		}
+		dispatching = append(dispatching, current)
+		return true
+	})
+
+	if err := eventManager.Run(ctx); err != nil {
+		t.Fatalf("Failed to run event manager, expected success, got error: %+v", err)
+	}
+
+	if len(dispatching) != 2 || dispatching[0] != "test-watcher,test-event" {
+		t.Errorf("Dispatching() returned %v from the callback, want test-watcher,test-event twice", dispatching)
+	}
+	if evType, since := eventManager.Dispatching(); evType != "" || !since.IsZero() {
+		t.Errorf("Dispatching() = %q, %s after Run(), want idle", evType, since)
+	}
+}
@@ -20,8 +20,8 @@ import (
 	"net"
 	"net/url"
 
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 const (
@@ -31,6 +31,9 @@ const (
 	LongpollEvent = "metadata-watcher,longpoll"
 )
 
+// metadataLog logs the entries of the metadata component.
+var metadataLog = logfields.Component(logfields.ComponentMetadata)
+
 // Watcher is the metadata event watcher implementation.
 type Watcher struct {
 	client         metadata.MDSClientInterface
@@ -62,10 +65,10 @@ func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, e
 		if !mp.failedPrevious {
 			if urlErr, ok := err.(*url.Error); ok {
 				if _, ok := urlErr.Err.(*net.OpError); ok {
-					logger.Errorf("Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
+					metadataLog.Errorf("Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
 				}
 			}
-			logger.Errorf("Error watching metadata: %s", err)
+			metadataLog.Errorf("Error watching metadata: %s", err)
 			mp.failedPrevious = true
 		}
 	} else {
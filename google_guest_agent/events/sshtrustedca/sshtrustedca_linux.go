@@ -24,7 +24,7 @@ import (
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 // Create a named pipe if it doesn't exist.
@@ -51,7 +51,7 @@ func createNamedPipe(ctx context.Context, pipePath string) error {
 
 	restorecon, err := exec.LookPath("restorecon")
 	if err != nil {
-		logger.Infof("No restorecon available, not restoring SELinux context of: %s", pipePath)
+		logfields.Infof("No restorecon available, not restoring SELinux context of: %s", pipePath)
 		return nil
 	}
 
@@ -100,13 +100,13 @@ func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, e
 			// Open the pipe as O_RDONLY to release the blocking open O_WRONLY.
 			pipeFile, err := os.OpenFile(mp.pipePath, os.O_RDONLY, 0644)
 			if err != nil {
-				logger.Errorf("Failed to open readonly pipe: %+v", err)
+				logfields.Errorf("Failed to open readonly pipe: %+v", err)
 				return
 			}
 
 			defer func() {
 				if err := pipeFile.Close(); err != nil {
-					logger.Errorf("Failed to close readonly pipe: %+v", err)
+					logfields.Errorf("Failed to close readonly pipe: %+v", err)
 				}
 			}()
 		}
@@ -129,7 +129,7 @@ func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, e
 	// the watcher.
 	if canceled {
 		if err := pipeFile.Close(); err != nil {
-			logger.Errorf("Failed to close readonly pipe: %+v", err)
+			logfields.Errorf("Failed to close readonly pipe: %+v", err)
 		}
 		return false, nil, nil
 	}
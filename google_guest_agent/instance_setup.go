@@ -29,7 +29,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/go-ini/ini"
 )
 
@@ -71,7 +71,7 @@ func addMetadataRoute() error {
 		}
 	}
 
-	logger.Infof("Adding route to metadata server on adapter with index %d", defaultRoute.ipForwardIfIndex)
+	logfields.Infof("Adding route to metadata server on adapter with index %d", defaultRoute.ipForwardIfIndex)
 	return addIPForwardEntry(forwardEntry)
 }
 
@@ -97,18 +97,17 @@ func agentInit(ctx context.Context) {
 		// Indefinitely retry to set up required MDS route.
 		for ; ; time.Sleep(1 * time.Second) {
 			if err := addMetadataRoute(); err != nil {
-				logger.Errorf("Could not set default route to metadata: %v", err)
+				logfields.Errorf("Could not set default route to metadata: %v", err)
 			} else {
 				break
 			}
 		}
 	} else {
 		// Linux instance setup.
-		defer run.Quiet(ctx, "systemd-notify", "--ready")
-		defer logger.Debugf("notify systemd")
+		defer notifyReady()
 
 		if config.Snapshots.Enabled {
-			logger.Infof("Snapshot listener enabled")
+			logfields.Infof("Snapshot listener enabled")
 			snapshotServiceIP := config.Snapshots.SnapshotServiceIP
 			snapshotServicePort := config.Snapshots.SnapshotServicePort
 			timeoutInSeconds := config.Snapshots.TimeoutInSeconds
@@ -130,7 +129,7 @@ func agentInit(ctx context.Context) {
 			}
 
 			if err := run.Quiet(ctx, "google_"+curr.script); err != nil {
-				logger.Warningf("Failed to run %q script: %v", "google_"+curr.script, err)
+				logfields.Warningf("Failed to run %q script: %v", "google_"+curr.script, err)
 			}
 		}
 
@@ -139,32 +138,36 @@ func agentInit(ctx context.Context) {
 		// boot. If this changes, we will hook these to an explicit
 		// on-boot signal.
 
-		logger.Debugf("set IO scheduler config")
+		logfields.Debugf("set IO scheduler config")
 		if err := setIOScheduler(); err != nil {
-			logger.Warningf("Failed to set IO scheduler: %v", err)
+			logfields.Warningf("Failed to set IO scheduler: %v", err)
 		}
 
 		// Allow users to opt out of below instance setup actions.
 		if !config.InstanceSetup.NetworkEnabled {
-			logger.Infof("InstanceSetup.network_enabled is false, skipping setup actions that require metadata")
+			logfields.Infof("InstanceSetup.network_enabled is false, skipping setup actions that require metadata")
 			return
 		}
 
 		if newMetadata == nil {
 			var err error
-			logger.Debugf("populate metadata for the first time...")
+			logfields.Debugf("populate metadata for the first time...")
 			newMetadata, err = mdsClient.Get(ctx)
 			if err != nil {
-				logger.Errorf("Failed to reach MDS(all retries exhausted): %+v", err)
+				logfields.Errorf("Failed to reach MDS(all retries exhausted): %+v", err)
 				os.Exit(1)
 			}
 		}
 
+		// Metadata overrides may change the first-boot actions' configuration.
+		applyConfigOverrides(newMetadata)
+		config = cfg.Get()
+
 		// Disable overcommit accounting; e2 instances only.
 		parts := strings.Split(newMetadata.Instance.MachineType, "/")
 		if strings.HasPrefix(parts[len(parts)-1], "e2-") {
 			if err := run.Quiet(ctx, "sysctl", "vm.overcommit_memory=1"); err != nil {
-				logger.Warningf("Failed to run 'sysctl vm.overcommit_memory=1': %v", err)
+				logfields.Warningf("Failed to run 'sysctl vm.overcommit_memory=1': %v", err)
 			}
 		}
 
@@ -174,7 +177,7 @@ func agentInit(ctx context.Context) {
 		instanceIDFile := config.Instance.InstanceIDDir
 		instanceID, err := os.ReadFile(instanceIDFile)
 		if err != nil && !os.IsNotExist(err) {
-			logger.Warningf("Not running first-boot actions, error reading instance ID: %v", err)
+			logfields.Warningf("Not running first-boot actions, error reading instance ID: %v", err)
 		} else {
 			if string(instanceID) == "" {
 				// If the file didn't exist or was empty, try legacy key from instance configs.
@@ -183,26 +186,26 @@ func agentInit(ctx context.Context) {
 				// Write instance ID to file for next time before moving on.
 				towrite := fmt.Sprintf("%s\n", newMetadata.Instance.ID.String())
 				if err := os.WriteFile(instanceIDFile, []byte(towrite), 0644); err != nil {
-					logger.Warningf("Failed to write instance ID file: %v", err)
+					logfields.Warningf("Failed to write instance ID file: %v", err)
 				}
 			}
 			if newMetadata.Instance.ID.String() != strings.TrimSpace(string(instanceID)) {
-				logger.Infof("Instance ID changed, running first-boot actions")
+				logfields.Infof("Instance ID changed, running first-boot actions")
 				if config.InstanceSetup.SetHostKeys {
 					if err := generateSSHKeys(ctx); err != nil {
-						logger.Warningf("Failed to generate SSH keys: %v", err)
+						logfields.Warningf("Failed to generate SSH keys: %v", err)
 					}
 				}
 				if config.InstanceSetup.SetBotoConfig {
 					if err := generateBotoConfig(); err != nil {
-						logger.Warningf("Failed to create boto.cfg: %v", err)
+						logfields.Warningf("Failed to create boto.cfg: %v", err)
 					}
 				}
 
 				// Write instance ID to file.
 				towrite := fmt.Sprintf("%s\n", newMetadata.Instance.ID.String())
 				if err := os.WriteFile(instanceIDFile, []byte(towrite), 0644); err != nil {
-					logger.Warningf("Failed to write instance ID file: %v", err)
+					logfields.Warningf("Failed to write instance ID file: %v", err)
 				}
 			}
 		}
@@ -248,43 +251,45 @@ func generateSSHKeys(ctx context.Context) error {
 	// List keys we should generate, according to the config.
 	configKeys := config.InstanceSetup.HostKeyTypes
 	for _, keytype := range strings.Split(configKeys, ",") {
-		keytypes[keytype] = true
+		if keytype = strings.ToLower(strings.TrimSpace(keytype)); keytype != "" {
+			keytypes[keytype] = true
+		}
 	}
 
 	// Generate new keys and upload to guest attributes.
 	for keytype := range keytypes {
 		keyfile := fmt.Sprintf("%s/ssh_host_%s_key", hostKeyDir, keytype)
 		if err := run.Quiet(ctx, "ssh-keygen", "-t", keytype, "-f", keyfile+".temp", "-N", "", "-q"); err != nil {
-			logger.Warningf("Failed to generate SSH host key %q: %v", keyfile, err)
+			logfields.Warningf("Failed to generate SSH host key %q: %v", keyfile, err)
 			continue
 		}
 		if err := os.Chmod(keyfile+".temp", 0600); err != nil {
-			logger.Errorf("Failed to chmod SSH host key %q: %v", keyfile, err)
+			logfields.Errorf("Failed to chmod SSH host key %q: %v", keyfile, err)
 			continue
 		}
 		if err := os.Chmod(keyfile+".temp.pub", 0644); err != nil {
-			logger.Errorf("Failed to chmod SSH host key %q: %v", keyfile+".pub", err)
+			logfields.Errorf("Failed to chmod SSH host key %q: %v", keyfile+".pub", err)
 			continue
 		}
 		if err := os.Rename(keyfile+".temp", keyfile); err != nil {
-			logger.Errorf("Failed to overwrite %q: %v", keyfile, err)
+			logfields.Errorf("Failed to overwrite %q: %v", keyfile, err)
 			continue
 		}
 		if err := os.Rename(keyfile+".temp.pub", keyfile+".pub"); err != nil {
-			logger.Errorf("Failed to overwrite %q: %v", keyfile+".pub", err)
+			logfields.Errorf("Failed to overwrite %q: %v", keyfile+".pub", err)
 			continue
 		}
 		pubKey, err := os.ReadFile(keyfile + ".pub")
 		if err != nil {
-			logger.Errorf("Can't read %s public key: %v", keytype, err)
+			logfields.Errorf("Can't read %s public key: %v", keytype, err)
 			continue
 		}
 		if vals := strings.Split(string(pubKey), " "); len(vals) >= 2 {
 			if err := mdsClient.WriteGuestAttributes(ctx, "hostkeys/"+vals[0], vals[1]); err != nil {
-				logger.Errorf("Failed to upload %s key to guest attributes: %v", keytype, err)
+				logfields.Errorf("Failed to upload %s key to guest attributes: %v", keytype, err)
 			}
 		} else {
-			logger.Warningf("Generated key is malformed, not uploading")
+			logfields.Warningf("Generated key is malformed, not uploading")
 		}
 	}
 
@@ -0,0 +1,103 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+// logLevelsOverride tracks the guest-agent-log-levels metadata attribute, which
+// overrides the configured log levels until it expires.
+type logLevelsOverride struct {
+	mu sync.Mutex
+	// value is the attribute's last seen value.
+	value string
+	// expiry is when value stops applying, zero if it never does.
+	expiry time.Time
+	// timer reverts the levels at expiry.
+	timer *time.Timer
+}
+
+// logLevels is the agent's log levels override.
+var logLevels = &logLevelsOverride{}
+
+// configuredLogLevels returns the log levels of the configuration, debug is the
+// default level if GUEST_AGENT_DEBUG is set.
+func configuredLogLevels() logfields.Levels {
+	base := logfields.Levels{Default: logfields.LevelInfo}
+	if os.Getenv("GUEST_AGENT_DEBUG") != "" {
+		base.Default = logfields.LevelDebug
+	}
+
+	levels, err := logfields.ParseLevels(base, cfg.Get().Logging.Level)
+	if err != nil {
+		logfields.Errorf("Invalid Logging.level configuration, using %s: %+v", base, err)
+		return base
+	}
+	return levels
+}
+
+// update records value, the guest-agent-log-levels attribute, and applies the log
+// levels, the configuration may have changed too. A new value expires
+// Logging.override_ttl seconds later.
+func (o *logLevelsOverride) update(value string, now time.Time) {
+	o.mu.Lock()
+	if value != o.value {
+		o.value = value
+		o.expiry = time.Time{}
+		if o.timer != nil {
+			o.timer.Stop()
+			o.timer = nil
+		}
+		if ttl := time.Duration(cfg.Get().Logging.OverrideTTL) * time.Second; value != "" && ttl > 0 {
+			o.expiry = now.Add(ttl)
+			o.timer = time.AfterFunc(ttl, func() {
+				logfields.Infof("The guest-agent-log-levels metadata override has expired")
+				o.apply(time.Now())
+			})
+		}
+	}
+	o.mu.Unlock()
+
+	o.apply(now)
+}
+
+// apply sets the configured log levels, overridden by the metadata attribute
+// unless it has expired at now.
+func (o *logLevelsOverride) apply(now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	levels := configuredLogLevels()
+	if o.value != "" && (o.expiry.IsZero() || now.Before(o.expiry)) {
+		overridden, err := logfields.ParseLevels(levels, o.value)
+		if err != nil {
+			logfields.Errorf("Invalid guest-agent-log-levels metadata attribute, ignoring it: %+v", err)
+		} else {
+			levels = overridden
+		}
+	}
+
+	previous := logfields.CurrentLevels()
+	logfields.SetLevels(levels)
+	if levels.String() != previous.String() {
+		logfields.Infof("Log levels set to %s", levels)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+func TestLogLevelsOverride(t *testing.T) {
+	reloadConfig(t, []byte("[Logging]\nlevel = info,network:warning\noverride_ttl = 3600"))
+	defer reloadConfig(t, nil)
+	defer logfields.SetLevels(logfields.Levels{Default: logfields.LevelInfo})
+
+	o := &logLevelsOverride{}
+	now := time.Now()
+
+	o.update("", now)
+	if got := logfields.CurrentLevels().String(); got != "info,network:warning" {
+		t.Errorf("update(\"\") set levels %s, want: info,network:warning", got)
+	}
+
+	o.update("accounts:debug", now)
+	defer o.update("", now)
+	if got := logfields.CurrentLevels().String(); got != "info,accounts:debug,network:warning" {
+		t.Errorf("update(accounts:debug) set levels %s, want: info,accounts:debug,network:warning", got)
+	}
+
+	// The same value doesn't restart the TTL.
+	o.update("accounts:debug", now.Add(30*time.Minute))
+	if !o.expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("update(accounts:debug) again set expiry %s, want: %s", o.expiry, now.Add(time.Hour))
+	}
+
+	// Reloads keep the override until it expires.
+	o.apply(now.Add(59 * time.Minute))
+	if got := logfields.CurrentLevels().String(); got != "info,accounts:debug,network:warning" {
+		t.Errorf("apply() before expiry set levels %s, want: info,accounts:debug,network:warning", got)
+	}
+	o.apply(now.Add(time.Hour))
+	if got := logfields.CurrentLevels().String(); got != "info,network:warning" {
+		t.Errorf("apply() after expiry set levels %s, want: info,network:warning", got)
+	}
+
+	// Invalid values are ignored.
+	o.update("accounts:verbose", now)
+	if got := logfields.CurrentLevels().String(); got != "info,network:warning" {
+		t.Errorf("update(accounts:verbose) set levels %s, want: info,network:warning", got)
+	}
+}
@@ -20,9 +20,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -31,6 +32,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/telemetry"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -58,13 +60,6 @@ const (
 	regKeyBase = `SOFTWARE\Google\ComputeEngine`
 )
 
-type manager interface {
-	Diff(ctx context.Context) (bool, error)
-	Disabled(ctx context.Context) (bool, error)
-	Set(ctx context.Context) error
-	Timeout(ctx context.Context) (bool, error)
-}
-
 func logStatus(name string, disabled bool) {
 	var status string
 	switch disabled {
@@ -73,78 +68,14 @@ func logStatus(name string, disabled bool) {
 	case true:
 		status = "disabled"
 	}
-	logger.Infof("GCE %s manager status: %s", name, status)
+	logfields.Infof("GCE %s manager status: %s", name, status)
 }
 
 func closeFile(c io.Closer) {
 	err := c.Close()
 	if err != nil {
-		logger.Warningf("Error closing file: %v.", err)
-	}
-}
-
-func availableManagers() []manager {
-	managers := []manager{
-		&addressMgr{},
+		logfields.Warningf("Error closing file: %v.", err)
 	}
-
-	if runtime.GOOS == "windows" {
-		return append(managers,
-			newWsfcManager(),
-			&winAccountsMgr{},
-			&diagnosticsMgr{},
-		)
-	}
-
-	return append(managers,
-		&clockskewMgr{},
-		&osloginMgr{},
-		&accountsMgr{},
-	)
-}
-
-func runUpdate(ctx context.Context) {
-	var wg sync.WaitGroup
-	for _, mgr := range availableManagers() {
-		wg.Add(1)
-		go func(mgr manager) {
-			defer wg.Done()
-
-			disabled, err := mgr.Disabled(ctx)
-			if err != nil {
-				logger.Errorf("Failed to run manager's Disabled() call: %+v", err)
-				return
-			}
-
-			if disabled {
-				logger.Debugf("manager %#v disabled, skipping", mgr)
-				return
-			}
-
-			timeout, err := mgr.Timeout(ctx)
-			if err != nil {
-				logger.Errorf("[%#v] Failed to run manager Timeout() call: %+v", mgr, err)
-				return
-			}
-
-			diff, err := mgr.Diff(ctx)
-			if err != nil {
-				logger.Errorf("[%#v] Failed to run manager Diff() call: %+v", mgr, err)
-				return
-			}
-
-			if !timeout && !diff {
-				logger.Debugf("[%#v] Manager reports no diff", mgr)
-				return
-			}
-
-			logger.Debugf("running %#v manager", mgr)
-			if err := mgr.Set(ctx); err != nil {
-				logger.Errorf("[%#v] Failed to run manager Set() call: %s", mgr, err)
-			}
-		}(mgr)
-	}
-	wg.Wait()
 }
 
 func runAgent(ctx context.Context) {
@@ -158,6 +89,7 @@ func runAgent(ctx context.Context) {
 		// Local logging is syslog; we will just use stdout in Linux.
 		opts.DisableLocalLogging = true
 	}
+	opts.FormatFunction = logfields.FormatFunction(cfg.Get().Logging.Format, programName, opts.FormatFunction)
 
 	if os.Getenv("GUEST_AGENT_DEBUG") != "" {
 		opts.Debug = true
@@ -167,8 +99,31 @@ func runAgent(ctx context.Context) {
 		fmt.Printf("Error initializing logger: %v", err)
 		os.Exit(1)
 	}
+	// logger.Init() resets the debug logging, the log levels set it back.
+	logLevels.apply(time.Now())
+
+	notifyStatus("Initializing")
+	startWatchdog(ctx)
+	go func() {
+		<-ctx.Done()
+		notifyStopping()
+	}()
+	// The goroutine above may not get to run before the process exits.
+	defer func() {
+		if ctx.Err() != nil {
+			notifyStopping()
+		}
+	}()
 
-	logger.Infof("GCE Agent Started (version %s)", version)
+	logfields.Infof("GCE Agent Started (version %s)", version)
+
+	for _, name := range cfg.UnknownEnvVars() {
+		logfields.Warningf("Ignoring environment variable %s, it doesn't match any configuration section and key.", name)
+	}
+
+	if err := startMetricsServer(ctx, cfg.Get().Metrics); err != nil {
+		logfields.Errorf("Failed to start metrics server: %+v", err)
+	}
 
 	osInfo = osinfo.Get()
 	mdsClient = metadata.New()
@@ -181,7 +136,7 @@ func runAgent(ctx context.Context) {
 		// Error here doesn't matter, if we cant get metadata, we cant record telemetry.
 		newMetadata, err = mdsClient.Get(ctx)
 		if err != nil {
-			logger.Debugf("Error getting metdata: %v", err)
+			logfields.Debugf("Error getting metdata: %v", err)
 		}
 	}
 
@@ -190,45 +145,56 @@ func runAgent(ctx context.Context) {
 	if newMetadata != nil {
 		opts.ProjectName = newMetadata.Project.ProjectID
 		if err := logger.Init(ctx, opts); err != nil {
-			logger.Errorf("Error initializing logger: %v", err)
+			logfields.Errorf("Error initializing logger: %v", err)
 		}
+		logLevels.apply(time.Now())
 	}
 
 	// knownJobs is list of default jobs that run on a pre-defined schedule.
 	knownJobs := []scheduler.Job{telemetry.New(mdsClient, programName, version)}
 	scheduler.ScheduleJobs(ctx, knownJobs, false)
+	scheduleReconciliation(ctx, runtime.GOOS)
 
 	eventManager := events.Get()
 	if err := eventManager.AddDefaultWatchers(ctx); err != nil {
-		logger.Errorf("Error initializing event manager: %v", err)
+		logfields.Errorf("Error initializing event manager: %v", err)
 		return
 	}
 
 	if err := enableDisableOSLoginCertAuth(ctx); err != nil {
-		logger.Errorf("Failed to enable sshtrustedca watcher: %+v", err)
+		logfields.Errorf("Failed to enable sshtrustedca watcher: %+v", err)
 		return
 	}
 
+	if err := startControlServer(ctx, cfg.Get().Control); err != nil {
+		logfields.Errorf("Failed to start control API server: %+v", err)
+	}
+
 	oldMetadata = &metadata.Descriptor{}
 	eventManager.Subscribe(mdsEvent.LongpollEvent, nil, func(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
-		logger.Debugf("Handling metadata %q event.", evType)
+		fields := logfields.EventType(evType)
+		fields.Debugf("Handling metadata event.")
 
 		// If metadata watcher failed there isn't much we can do, just ignore the event and
 		// allow the water to get it corrected.
 		if evData.Error != nil {
-			logger.Infof("Metadata event watcher failed, ignoring: %+v", evData.Error)
+			fields.WithError(evData.Error).Infof("Metadata event watcher failed, ignoring.")
 			return true
 		}
 
 		if evData.Data == nil {
-			logger.Infof("Metadata event watcher didn't pass in the metadata, ignoring.")
+			logfields.Infof("Metadata event watcher didn't pass in the metadata, ignoring.")
 			return true
 		}
 
 		newMetadata = evData.Data.(*metadata.Descriptor)
+		applyConfigOverrides(newMetadata)
+		logLevels.update(newMetadata.Instance.Attributes.LogLevels, time.Now())
+		// The overrides may have changed the reconciliation intervals.
+		scheduleReconciliation(ctx, runtime.GOOS)
 
 		if err := enableDisableOSLoginCertAuth(ctx); err != nil {
-			logger.Errorf("Failed to enable/disable sshtrustedca watcher: %+v", err)
+			logfields.Errorf("Failed to enable/disable sshtrustedca watcher: %+v", err)
 		}
 
 		runUpdate(ctx)
@@ -241,7 +207,7 @@ func runAgent(ctx context.Context) {
 		logger.Fatalf("Failed to run event manager: %+v", err)
 	}
 
-	logger.Infof("GCE Agent Stopped")
+	logfields.Infof("GCE Agent Stopped")
 }
 
 func logFormatWindows(e logger.LogEntry) string {
@@ -264,18 +230,13 @@ func logFormat(e logger.LogEntry) string {
 func closer(c io.Closer) {
 	err := c.Close()
 	if err != nil {
-		logger.Warningf("Error closing %v: %v.", c, err)
+		logfields.Warningf("Error closing %v: %v.", c, err)
 	}
 }
 
 func main() {
 	ctx := context.Background()
 
-	if err := cfg.Load(nil); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load configuration: %+v", err)
-		os.Exit(1)
-	}
-
 	var action string
 	if len(os.Args) < 2 {
 		action = "run"
@@ -283,8 +244,35 @@ func main() {
 		action = os.Args[1]
 	}
 
+	// The config commands deal with the configuration loading themselves, i.e. they
+	// must be able to report problems with configuration files Load() would fail on.
+	if action == "config" {
+		os.Exit(runConfigCommand(ctx, os.Args[2:]))
+	}
+
+	if err := cfg.Load(nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %+v", err)
+		os.Exit(1)
+	}
+
+	if action == "plan" {
+		os.Exit(runPlanCommand(ctx, os.Args[2:]))
+	}
+
+	if action == "deprovision" {
+		os.Exit(runDeprovisionCommand(ctx, os.Args[2:]))
+	}
+
+	if action == "ctl" {
+		os.Exit(runCtlCommand(ctx, os.Args[2:]))
+	}
+
 	if action == "noservice" {
+		// Without the service manager the signals have to be handled here, the
+		// agent is stopped like by the service's Stop().
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 		runAgent(ctx)
+		stop()
 		os.Exit(0)
 	}
 
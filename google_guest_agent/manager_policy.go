@@ -0,0 +1,167 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+const (
+	// failurePolicySkip skips a failing manager for the configured backoff.
+	failurePolicySkip = "skip"
+	// failurePolicyDisable disables a failing manager until the agent restarts.
+	failurePolicyDisable = "disable"
+)
+
+var (
+	// runningManagers holds the managers with a run in progress, including runs
+	// that have timed out but not returned yet.
+	runningManagers   = make(map[string]bool)
+	runningManagersMu sync.Mutex
+)
+
+// startManagerRun marks the manager name as running, it returns false if it's
+// already running.
+func startManagerRun(name string) bool {
+	runningManagersMu.Lock()
+	defer runningManagersMu.Unlock()
+
+	if runningManagers[name] {
+		return false
+	}
+	runningManagers[name] = true
+	return true
+}
+
+// managerRunning returns true if the manager name has a run in progress.
+func managerRunning(name string) bool {
+	runningManagersMu.Lock()
+	defer runningManagersMu.Unlock()
+	return runningManagers[name]
+}
+
+// finishManagerRun marks the manager name as not running.
+func finishManagerRun(name string) {
+	runningManagersMu.Lock()
+	defer runningManagersMu.Unlock()
+	delete(runningManagers, name)
+}
+
+// managerTimeout returns the maximum duration of a run of the manager name, zero
+// means no timeout.
+func managerTimeout(config *cfg.Managers, name string) time.Duration {
+	return managerDuration(config.DefaultTimeout, config.Timeouts, name)
+}
+
+// managerDuration returns the number of seconds overrides, a comma separated list
+// of name:seconds pairs, sets for the manager name, or defaultSeconds if it sets
+// none, as a time.Duration. Zero or negative values are returned as zero.
+func managerDuration(defaultSeconds int, overrides, name string) time.Duration {
+	seconds := defaultSeconds
+	for _, curr := range strings.Split(overrides, ",") {
+		key, value, found := strings.Cut(curr, ":")
+		if !found || strings.TrimSpace(key) != name {
+			continue
+		}
+		override, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			logfields.Warningf("Invalid value %q for manager %s, using the default value", value, name)
+			continue
+		}
+		seconds = override
+	}
+
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// managerSuspension returns why the manager name is suspended at now after
+// repeated failures, an empty string if it's not.
+func managerSuspension(name string, now time.Time) string {
+	managerStatusesMu.Lock()
+	defer managerStatusesMu.Unlock()
+
+	status, found := managerStatuses[name]
+	switch {
+	case !found:
+		return ""
+	case status.FailureDisabled:
+		return "disabled after repeated failures"
+	case now.Before(status.skippedUntil):
+		return fmt.Sprintf("skipped until %s after repeated failures", status.SkippedUntil)
+	default:
+		return ""
+	}
+}
+
+// recordManagerRun updates and publishes the status of the manager name with the
+// outcome of a run, applying the failure policy if it has failed too many times
+// in a row.
+func recordManagerRun(ctx context.Context, config *cfg.Managers, name string, run *managerRun) {
+	if run.err != nil {
+		managerFailures.Inc(name)
+	}
+
+	updateManagerStatus(ctx, name, func(status *managerStatus) {
+		if run.checked {
+			status.Enabled = !run.disabled
+		}
+		if !run.diffTime.IsZero() {
+			status.LastDiff = statusTime(run.diffTime)
+		}
+		if !run.setTime.IsZero() {
+			status.LastSet = statusTime(run.setTime)
+			status.ItemsApplied = run.applied
+		}
+
+		if run.err == nil {
+			status.LastError = ""
+			status.ConsecutiveFailures = 0
+			status.SkippedUntil = ""
+			status.skippedUntil = time.Time{}
+			return
+		}
+
+		status.LastError = run.err.Error()
+		status.ConsecutiveFailures++
+		if config.MaxFailures <= 0 || status.ConsecutiveFailures < config.MaxFailures {
+			return
+		}
+
+		if config.FailurePolicy == failurePolicyDisable {
+			logfields.Manager(name).WithError(run.err).Errorf("Manager failed %d times in a row, disabling it until the agent restarts", status.ConsecutiveFailures)
+			status.FailureDisabled = true
+			return
+		}
+
+		if config.FailurePolicy != failurePolicySkip {
+			logfields.Warningf("Unknown manager failure policy %q, using %q", config.FailurePolicy, failurePolicySkip)
+		}
+		backoff := time.Duration(config.FailureBackoff) * time.Second
+		status.skippedUntil = time.Now().Add(backoff)
+		status.SkippedUntil = statusTime(status.skippedUntil)
+		logfields.Manager(name).WithError(run.err).Warningf("Manager failed %d times in a row, skipping it for %s", status.ConsecutiveFailures, backoff)
+	})
+}
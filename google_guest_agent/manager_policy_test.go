@@ -0,0 +1,162 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+type fakeHangingMgr struct {
+	fakeMgr
+	release chan struct{}
+}
+
+func (f *fakeHangingMgr) Set(ctx context.Context) error {
+	<-f.release
+	return nil
+}
+
+type fakePanicMgr struct {
+	fakeMgr
+}
+
+func (f *fakePanicMgr) Set(ctx context.Context) error {
+	panic("nil map")
+}
+
+func managerStatusByName(t *testing.T, name string) managerStatus {
+	t.Helper()
+	for _, curr := range getManagerStatuses() {
+		if curr.Name == name {
+			return curr
+		}
+	}
+	t.Fatalf("no status found for manager %s", name)
+	return managerStatus{}
+}
+
+func TestManagerTimeout(t *testing.T) {
+	config := &cfg.Managers{DefaultTimeout: 300, Timeouts: "address:600, accounts : 120,oslogin:foo,clockskew:0"}
+
+	tests := map[string]time.Duration{
+		"address":     600 * time.Second,
+		"accounts":    120 * time.Second,
+		"oslogin":     300 * time.Second,
+		"clockskew":   0,
+		"diagnostics": 300 * time.Second,
+	}
+
+	for name, want := range tests {
+		if got := managerTimeout(config, name); got != want {
+			t.Errorf("managerTimeout(%s) = %s, want: %s", name, got, want)
+		}
+	}
+}
+
+func TestRunManagerTimeout(t *testing.T) {
+	ctx := context.Background()
+	reloadConfig(t, []byte("[Managers]\ntimeouts = test-hanging:1\nmax_failures = 0\n"))
+
+	mgr := &fakeHangingMgr{release: make(chan struct{})}
+	start := time.Now()
+	runManager(ctx, "test-hanging", mgr)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("runManager() returned after %s, want about 1s", elapsed)
+	}
+
+	status := managerStatusByName(t, "test-hanging")
+	if !strings.Contains(status.LastError, "deadline exceeded") {
+		t.Errorf("status.LastError = %q, want deadline exceeded", status.LastError)
+	}
+
+	// The hung run is still in progress, the next run must be skipped.
+	runManager(ctx, "test-hanging", &fakeMgr{})
+	status = managerStatusByName(t, "test-hanging")
+	if status.LastError != "previous run still in progress" || status.ConsecutiveFailures != 2 {
+		t.Errorf("status = %+v, want previous run still in progress and 2 failures", status)
+	}
+
+	close(mgr.release)
+	for i := 0; i < 100 && !startManagerRun("test-hanging"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	finishManagerRun("test-hanging")
+
+	runManager(ctx, "test-hanging", &fakeMgr{})
+	status = managerStatusByName(t, "test-hanging")
+	if status.LastError != "" || status.ConsecutiveFailures != 0 {
+		t.Errorf("status = %+v, want no error and no failures", status)
+	}
+}
+
+func TestRunManagerPanic(t *testing.T) {
+	reloadConfig(t, []byte("[Managers]\nmax_failures = 0\n"))
+
+	runManager(context.Background(), "test-panic", &fakePanicMgr{})
+
+	status := managerStatusByName(t, "test-panic")
+	if status.LastError != "panic: nil map" {
+		t.Errorf("status.LastError = %q, want: %q", status.LastError, "panic: nil map")
+	}
+}
+
+func TestRunManagerFailurePolicy(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		policy       string
+		wantDisabled bool
+	}{
+		{policy: failurePolicySkip},
+		{policy: failurePolicyDisable, wantDisabled: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			name := "test-policy-" + tc.policy
+			reloadConfig(t, []byte(fmt.Sprintf("[Managers]\nmax_failures = 2\nfailure_policy = %s\nfailure_backoff = 3600\n", tc.policy)))
+
+			failing := &fakeStatusMgr{setErr: fmt.Errorf("failure")}
+			runManager(ctx, name, failing)
+			if reason := managerSuspension(name, time.Now()); reason != "" {
+				t.Fatalf("managerSuspension() = %q after 1 failure, want empty", reason)
+			}
+
+			runManager(ctx, name, failing)
+			if reason := managerSuspension(name, time.Now()); reason == "" {
+				t.Fatalf("managerSuspension() is empty after 2 failures, want suspended")
+			}
+
+			// Suspended managers don't run at all.
+			runManager(ctx, name, &fakeMgr{})
+			status := managerStatusByName(t, name)
+			if status.ConsecutiveFailures != 2 || status.FailureDisabled != tc.wantDisabled || (status.SkippedUntil != "") == tc.wantDisabled {
+				t.Errorf("status = %+v, want 2 failures and disabled: %t", status, tc.wantDisabled)
+			}
+
+			if !tc.wantDisabled {
+				if reason := managerSuspension(name, time.Now().Add(2*time.Hour)); reason != "" {
+					t.Errorf("managerSuspension() = %q after the backoff, want empty", reason)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+// guestAttributesNamespace is the guest attributes namespace owned by the agent.
+const guestAttributesNamespace = "guest-agent/"
+
+// appliedCounter is implemented by managers able to report how many items, e.g.
+// users or routes, their last Set() call has applied. A successful Set() call of
+// a manager not implementing it counts as one item.
+type appliedCounter interface {
+	Applied() int
+}
+
+// managerStatus is the status of a manager, it's published as JSON to the
+// guest-agent/manager-<name> guest attribute.
+type managerStatus struct {
+	// Name is the manager's name.
+	Name string `json:"name"`
+	// Enabled is the result of the last Disabled() call, negated.
+	Enabled bool `json:"enabled"`
+	// LastDiff is the time of the last Diff() call, in RFC3339 format.
+	LastDiff string `json:"lastDiff,omitempty"`
+	// LastSet is the time of the last Set() call, in RFC3339 format.
+	LastSet string `json:"lastSet,omitempty"`
+	// LastError is the error of the last run, it's cleared by a run succeeding.
+	LastError string `json:"lastError,omitempty"`
+	// ItemsApplied is the number of items applied by the last Set() call.
+	ItemsApplied int `json:"itemsApplied"`
+	// ConsecutiveFailures is the number of runs in a row that have failed.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// SkippedUntil is the time, in RFC3339 format, until which the manager is
+	// skipped after repeated failures.
+	SkippedUntil string `json:"skippedUntil,omitempty"`
+	// FailureDisabled is true if the manager was disabled after repeated failures.
+	FailureDisabled bool `json:"failureDisabled,omitempty"`
+
+	// skippedUntil is SkippedUntil as a time.Time.
+	skippedUntil time.Time
+}
+
+var (
+	// managerStatuses holds the status of every manager that has run so far.
+	managerStatuses = make(map[string]*managerStatus)
+	// publishedStatuses holds the last status published of each manager, as
+	// returned by publishedStatus().
+	publishedStatuses = make(map[string]string)
+	managerStatusesMu sync.Mutex
+)
+
+// managerStatusKey returns the guest attribute key of a manager's status.
+func managerStatusKey(name string) string {
+	return guestAttributesNamespace + "manager-" + name
+}
+
+// updateManagerStatus applies update to the status of the manager name and
+// publishes it to guest attributes if it has changed, see statusChanged().
+func updateManagerStatus(ctx context.Context, name string, update func(*managerStatus)) {
+	managerStatusesMu.Lock()
+	status, found := managerStatuses[name]
+	if !found {
+		status = &managerStatus{Name: name}
+		managerStatuses[name] = status
+	}
+	update(status)
+	data, err := json.Marshal(status)
+	published, changed := statusChanged(*status, publishedStatuses[name])
+	if changed && mdsClient != nil {
+		publishedStatuses[name] = published
+	}
+	managerStatusesMu.Unlock()
+
+	if err != nil {
+		logfields.Errorf("Failed to marshal %s manager status: %+v", name, err)
+		return
+	}
+
+	if mdsClient == nil || !changed {
+		return
+	}
+
+	// Guest attributes may be disabled for the instance, it's not worth more than
+	// a debug message.
+	if err := mdsClient.WriteGuestAttributes(ctx, managerStatusKey(name), string(data)); err != nil {
+		logfields.Debugf("Failed to publish %s manager status: %+v", name, err)
+	}
+}
+
+// statusChanged returns the form of status compared between runs, i.e. without
+// LastDiff which changes on every run, and whether it differs from the last one
+// published. A disabled manager is only published once it's disabled after having
+// been published enabled.
+func statusChanged(status managerStatus, lastPublished string) (string, bool) {
+	if !status.Enabled && lastPublished == "" {
+		return "", false
+	}
+	status.LastDiff = ""
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", true
+	}
+	return string(data), string(data) != lastPublished
+}
+
+// getManagerStatuses returns a copy of the statuses of every manager that has run
+// so far, sorted by name.
+func getManagerStatuses() []managerStatus {
+	managerStatusesMu.Lock()
+	defer managerStatusesMu.Unlock()
+
+	var res []managerStatus
+	for _, curr := range managerStatuses {
+		res = append(res, *curr)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// statusTime formats t for managerStatus.
+func statusTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type fakeStatusMgr struct {
+	fakeMgr
+	setErr  error
+	applied int
+}
+
+func (f *fakeStatusMgr) Set(ctx context.Context) error { return f.setErr }
+func (f *fakeStatusMgr) Applied() int                  { return f.applied }
+
+func TestRunManagerStatus(t *testing.T) {
+	ctx := context.Background()
+	reloadConfig(t, []byte("[Managers]\nmax_failures = 0\n"))
+
+	tests := []struct {
+		name         string
+		mgr          manager
+		wantEnabled  bool
+		wantSet      bool
+		wantError    string
+		wantApplied  int
+		previousFail bool
+	}{
+		{
+			name: "disabled",
+			mgr:  &fakeMgr{disabled: true},
+		},
+		{
+			name:        "counter",
+			mgr:         &fakeStatusMgr{applied: 3},
+			wantEnabled: true,
+			wantSet:     true,
+			wantApplied: 3,
+		},
+		{
+			name:        "no-counter",
+			mgr:         &fakeMgr{},
+			wantEnabled: true,
+			wantSet:     true,
+			wantApplied: 1,
+		},
+		{
+			name:        "set-error",
+			mgr:         &fakeStatusMgr{setErr: fmt.Errorf("useradd failed")},
+			wantEnabled: true,
+			wantSet:     true,
+			wantError:   "useradd failed",
+		},
+		{
+			name:         "error-cleared",
+			mgr:          &fakeMgr{},
+			wantEnabled:  true,
+			wantSet:      true,
+			wantApplied:  1,
+			previousFail: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			name := "test-" + tc.name
+			if tc.previousFail {
+				runManager(ctx, name, &fakeStatusMgr{setErr: fmt.Errorf("failure")})
+			}
+			runManager(ctx, name, tc.mgr)
+
+			var got *managerStatus
+			statuses := getManagerStatuses()
+			for i := range statuses {
+				if statuses[i].Name == name {
+					got = &statuses[i]
+				}
+			}
+			if got == nil {
+				t.Fatalf("getManagerStatuses() returned no status for %s", name)
+			}
+
+			if got.Enabled != tc.wantEnabled {
+				t.Errorf("status.Enabled = %t, want: %t", got.Enabled, tc.wantEnabled)
+			}
+			if (got.LastSet != "") != tc.wantSet {
+				t.Errorf("status.LastSet = %q, want set: %t", got.LastSet, tc.wantSet)
+			}
+			if tc.wantEnabled && got.LastDiff == "" {
+				t.Errorf("status.LastDiff is empty, want set")
+			}
+			if got.LastError != tc.wantError {
+				t.Errorf("status.LastError = %q, want: %q", got.LastError, tc.wantError)
+			}
+			if got.ItemsApplied != tc.wantApplied {
+				t.Errorf("status.ItemsApplied = %d, want: %d", got.ItemsApplied, tc.wantApplied)
+			}
+		})
+	}
+}
+
+func TestStatusChanged(t *testing.T) {
+	if _, changed := statusChanged(managerStatus{Name: "network"}, ""); changed {
+		t.Errorf("statusChanged(disabled, never published) = true, want: false")
+	}
+
+	enabled := managerStatus{Name: "network", Enabled: true, LastDiff: "2023-01-01T00:00:00Z", LastSet: "2023-01-01T00:00:00Z"}
+	published, changed := statusChanged(enabled, "")
+	if !changed {
+		t.Fatalf("statusChanged(enabled, never published) = false, want: true")
+	}
+
+	// A new Diff() call alone doesn't change the status.
+	enabled.LastDiff = "2023-01-01T00:01:00Z"
+	if _, changed := statusChanged(enabled, published); changed {
+		t.Errorf("statusChanged(new LastDiff) = true, want: false")
+	}
+
+	enabled.LastError = "failed"
+	if _, changed := statusChanged(enabled, published); !changed {
+		t.Errorf("statusChanged(new LastError) = false, want: true")
+	}
+
+	// A manager disabled after being published enabled is published once more.
+	disabled := managerStatus{Name: "network", LastSet: "2023-01-01T00:00:00Z"}
+	if _, changed := statusChanged(disabled, published); !changed {
+		t.Errorf("statusChanged(disabled, published enabled) = false, want: true")
+	}
+}
+
+func TestManagerStatusKey(t *testing.T) {
+	if got := managerStatusKey("accounts"); got != "guest-agent/manager-accounts" {
+		t.Errorf("managerStatusKey(accounts) = %q, want: %q", got, "guest-agent/manager-accounts")
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+type manager interface {
+	Diff(ctx context.Context) (bool, error)
+	Disabled(ctx context.Context) (bool, error)
+	Set(ctx context.Context) error
+	Timeout(ctx context.Context) (bool, error)
+	// Plan returns a human readable description of the changes Set would make,
+	// it must not change the system.
+	Plan(ctx context.Context) ([]string, error)
+}
+
+// platform restricts the operating systems a manager is available on.
+type platform int
+
+const (
+	// allPlatforms makes a manager available on every operating system.
+	allPlatforms platform = iota
+	// windowsOnly makes a manager available on windows only.
+	windowsOnly
+	// unixOnly makes a manager available on every operating system but windows.
+	unixOnly
+)
+
+// supports returns true if the platform includes the operating system goos.
+func (p platform) supports(goos string) bool {
+	switch p {
+	case windowsOnly:
+		return goos == "windows"
+	case unixOnly:
+		return goos != "windows"
+	default:
+		return true
+	}
+}
+
+// managerSpec describes a manager known to the registry.
+type managerSpec struct {
+	// name uniquely identifies the manager.
+	name string
+	// platform restricts the operating systems the manager is available on.
+	platform platform
+	// new creates the manager, it's called once for every update since some managers
+	// derive their state from the metadata and configuration at creation time.
+	new func() manager
+	// dependencies lists the names of the managers that must have run before this
+	// one. It's an ordering constraint only: the manager still runs if a dependency
+	// is disabled, has no diff or has failed. Dependencies not available on the
+	// running platform are ignored.
+	dependencies []string
+	// conflicts lists the names of the managers that must never run concurrently
+	// with this one, the relation is symmetric.
+	conflicts []string
+}
+
+// managerRegistry holds the managers known to the agent.
+type managerRegistry struct {
+	mu    sync.Mutex
+	specs map[string]*managerSpec
+}
+
+// managers is the registry of the agent's managers, managers register themselves
+// in their files' init() functions.
+var managers = &managerRegistry{specs: make(map[string]*managerSpec)}
+
+// registerManager registers spec within the agent's registry.
+func registerManager(spec *managerSpec) {
+	managers.register(spec)
+}
+
+// register adds spec to the registry, it panics if the name is empty or was
+// already registered as it's a programming error.
+func (r *managerRegistry) register(spec *managerSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if spec.name == "" || spec.new == nil {
+		panic("manager registered without a name or constructor")
+	}
+	if _, found := r.specs[spec.name]; found {
+		panic(fmt.Sprintf("manager %q registered twice", spec.name))
+	}
+	r.specs[spec.name] = spec
+}
+
+// resolve returns the managers available on goos sorted in a valid execution
+// order. It fails if a manager refers to an unknown manager or if dependencies
+// form a cycle.
+func (r *managerRegistry) resolve(goos string) ([]*managerSpec, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	available := make(map[string]*managerSpec)
+	for name, spec := range r.specs {
+		for _, curr := range append(append([]string{}, spec.dependencies...), spec.conflicts...) {
+			if _, found := r.specs[curr]; !found {
+				return nil, fmt.Errorf("manager %q refers to unknown manager %q", name, curr)
+			}
+		}
+		if spec.platform.supports(goos) {
+			available[name] = spec
+		}
+	}
+
+	var names []string
+	for name := range available {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Depth first topological sort, visiting names in lexical order keeps the
+	// result stable across runs.
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var res []*managerSpec
+	var visit func(name string, path []string) error
+
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("manager dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		spec := available[name]
+		deps := append([]string{}, spec.dependencies...)
+		sort.Strings(deps)
+
+		for _, dep := range deps {
+			if _, found := available[dep]; !found {
+				continue
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+
+		state[name] = visited
+		res = append(res, spec)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// run executes the managers available on goos as a DAG: a manager is started as
+// soon as all its dependencies have finished and none of its conflicting managers
+// is running, independent managers run concurrently.
+func (r *managerRegistry) run(ctx context.Context, goos string, runFunc func(context.Context, string, manager)) error {
+	specs, err := r.resolve(goos)
+	if err != nil {
+		return err
+	}
+
+	conflicts := make(map[string]map[string]bool)
+	for _, spec := range specs {
+		for _, curr := range spec.conflicts {
+			for _, pair := range [][2]string{{spec.name, curr}, {curr, spec.name}} {
+				if conflicts[pair[0]] == nil {
+					conflicts[pair[0]] = make(map[string]bool)
+				}
+				conflicts[pair[0]][pair[1]] = true
+			}
+		}
+	}
+
+	available := make(map[string]bool)
+	for _, spec := range specs {
+		available[spec.name] = true
+	}
+
+	done := make(map[string]bool)
+	running := make(map[string]bool)
+	skipped := make(map[string]bool)
+	finished := make(chan string)
+	pending := specs
+
+	ready := func(spec *managerSpec) bool {
+		for _, dep := range spec.dependencies {
+			if available[dep] && !done[dep] {
+				return false
+			}
+		}
+		for name := range running {
+			if conflicts[spec.name][name] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for len(pending) > 0 || len(running) > 0 {
+		var blocked []*managerSpec
+		for _, spec := range pending {
+			if !ready(spec) {
+				blocked = append(blocked, spec)
+				continue
+			}
+
+			// A manager whose run has timed out may still be changing the system,
+			// its dependents and the managers it conflicts with are skipped until it
+			// returns.
+			if reason := runBlocker(spec, conflicts[spec.name], skipped); reason != "" {
+				skipped[spec.name] = true
+				done[spec.name] = true
+				skipManagerRun(ctx, spec.name, reason)
+				continue
+			}
+
+			running[spec.name] = true
+			go func(spec *managerSpec) {
+				runFunc(ctx, spec.name, spec.new())
+				finished <- spec.name
+			}(spec)
+		}
+		pending = blocked
+
+		// Skipping managers may have made others ready.
+		if len(running) == 0 {
+			continue
+		}
+
+		name := <-finished
+		delete(running, name)
+		done[name] = true
+	}
+
+	return nil
+}
+
+// runBlocker returns why the manager of spec can't run now, an empty string if it
+// can: one of its dependencies was skipped, or one of its dependencies or of the
+// managers it conflicts with has a run in progress, i.e. one that has timed out.
+func runBlocker(spec *managerSpec, conflicts map[string]bool, skipped map[string]bool) string {
+	for _, dep := range spec.dependencies {
+		if skipped[dep] {
+			return fmt.Sprintf("dependency %s was skipped", dep)
+		}
+		if managerRunning(dep) {
+			return fmt.Sprintf("dependency %s is still running", dep)
+		}
+	}
+
+	var names []string
+	for name := range conflicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if managerRunning(name) {
+			return fmt.Sprintf("conflicting manager %s is still running", name)
+		}
+	}
+	return ""
+}
+
+// skipManagerRun reports that the manager name was skipped for reason, it's not
+// counted as a failure of the manager.
+func skipManagerRun(ctx context.Context, name, reason string) {
+	logfields.Manager(name).Warningf("Skipping manager, %s", reason)
+	updateManagerStatus(ctx, name, func(status *managerStatus) {
+		status.LastError = "skipped: " + reason
+	})
+}
+
+// managerPlan is the outcome of a manager's Plan() call.
+type managerPlan struct {
+	// name is the manager's name.
+	name string
+	// disabled is true if the manager is disabled, Plan() is not called then.
+	disabled bool
+	// changes are the changes returned by Plan().
+	changes []string
+	// err is the error returned by Disabled() or Plan().
+	err error
+}
+
+// plan calls Plan() of every manager available on goos in execution order, the
+// managers run sequentially since plans don't change the system.
+func (r *managerRegistry) plan(ctx context.Context, goos string) ([]*managerPlan, error) {
+	specs, err := r.resolve(goos)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*managerPlan
+	for _, spec := range specs {
+		mgr := spec.new()
+		plan := &managerPlan{name: spec.name}
+		res = append(res, plan)
+
+		plan.disabled, plan.err = mgr.Disabled(ctx)
+		if plan.err != nil || plan.disabled {
+			continue
+		}
+		plan.changes, plan.err = mgr.Plan(ctx)
+	}
+
+	return res, nil
+}
+
+// managerRun is the outcome of a manager run.
+type managerRun struct {
+	// checked is true once Disabled() has returned.
+	checked bool
+	// disabled is the result of Disabled().
+	disabled bool
+	// diffTime is the time Diff() has returned, zero if it wasn't called.
+	diffTime time.Time
+	// setTime is the time Set() has returned, zero if it wasn't called.
+	setTime time.Time
+	// applied is the number of items applied by Set().
+	applied int
+	// err is the error that has ended the run, if any.
+	err error
+}
+
+// runManager runs a single manager with the configured timeout, recovering from
+// its panics, unless it's suspended after repeated failures. The manager's status
+// is then updated and published.
+func runManager(ctx context.Context, name string, mgr manager) {
+	if reason := managerSuspension(name, time.Now()); reason != "" {
+		logfields.Manager(name).Debugf("Manager %s, skipping", reason)
+		return
+	}
+
+	config := cfg.Get().Managers
+	if !startManagerRun(name) {
+		logfields.Manager(name).Warningf("Previous manager run is still in progress, skipping")
+		recordManagerRun(ctx, config, name, &managerRun{err: fmt.Errorf("previous run still in progress")})
+		return
+	}
+
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	timeout := managerTimeout(config, name)
+	if timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	done := make(chan *managerRun, 1)
+	go func() {
+		run := &managerRun{}
+		defer func() {
+			if r := recover(); r != nil {
+				logfields.Manager(name).Errorf("Manager panicked: %v\n%s", r, debug.Stack())
+				run.err = fmt.Errorf("panic: %v", r)
+			}
+			// The run is over before it's reported, the dependents check it.
+			finishManagerRun(name)
+			done <- run
+		}()
+		runManagerSteps(runCtx, name, mgr, run)
+	}()
+
+	var run *managerRun
+	select {
+	case run = <-done:
+	case <-runCtx.Done():
+		// The manager's goroutine is left behind, run.* commands are killed by the
+		// context cancellation and further runs, as well as the runs of its
+		// dependents, are skipped until it returns.
+		logfields.Manager(name).WithError(runCtx.Err()).Errorf("Manager run was cancelled")
+		run = &managerRun{err: fmt.Errorf("run cancelled: %v", runCtx.Err())}
+	}
+
+	recordManagerRun(ctx, config, name, run)
+}
+
+// runManagerSteps runs a single manager's Set() if it's enabled and reports a diff
+// or a timeout, run is updated along the way.
+func runManagerSteps(ctx context.Context, name string, mgr manager, run *managerRun) {
+	var err error
+	run.disabled, err = mgr.Disabled(ctx)
+	if err != nil {
+		logfields.Manager(name).WithError(err).Errorf("Failed to run manager's Disabled() call")
+		run.err = err
+		return
+	}
+	run.checked = true
+
+	if run.disabled {
+		logfields.Manager(name).Debugf("Manager disabled, skipping")
+		return
+	}
+
+	timeout, err := mgr.Timeout(ctx)
+	if err != nil {
+		logfields.Manager(name).WithError(err).Errorf("Failed to run manager Timeout() call")
+		run.err = err
+		return
+	}
+
+	diff, err := mgr.Diff(ctx)
+	run.diffTime = time.Now()
+	if err != nil {
+		logfields.Manager(name).WithError(err).Errorf("Failed to run manager Diff() call")
+		run.err = err
+		return
+	}
+
+	if !timeout && !diff {
+		logfields.Manager(name).Debugf("Manager reports no diff")
+		return
+	}
+
+	logfields.Manager(name).Debugf("Running manager")
+	start := time.Now()
+	run.err = mgr.Set(ctx)
+	run.setTime = time.Now()
+	managerSetDuration.Observe(run.setTime.Sub(start).Seconds(), name)
+	if run.err != nil {
+		logfields.Manager(name).WithError(run.err).Errorf("Failed to run manager Set() call")
+	}
+
+	if counter, ok := mgr.(appliedCounter); ok {
+		run.applied = counter.Applied()
+	} else if run.err == nil {
+		run.applied = 1
+	}
+}
+
+// runUpdate runs all the registered managers available on the running platform.
+func runUpdate(ctx context.Context) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	runFunc := func(ctx context.Context, name string, mgr manager) {
+		notifyStatus("Applying metadata update: running manager %s", name)
+		runManager(ctx, name, mgr)
+	}
+	if err := managers.run(ctx, runtime.GOOS, runFunc); err != nil {
+		logfields.Errorf("Failed to run managers: %+v", err)
+	}
+	notifyStatus("Waiting for metadata changes, last update applied at %s", time.Now().Format(time.RFC3339))
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMgr struct {
+	disabled bool
+	changes  []string
+	setCalls int
+}
+
+func (f *fakeMgr) Diff(ctx context.Context) (bool, error)     { return true, nil }
+func (f *fakeMgr) Disabled(ctx context.Context) (bool, error) { return f.disabled, nil }
+func (f *fakeMgr) Timeout(ctx context.Context) (bool, error)  { return false, nil }
+func (f *fakeMgr) Plan(ctx context.Context) ([]string, error) { return f.changes, nil }
+
+func (f *fakeMgr) Set(ctx context.Context) error {
+	f.setCalls++
+	return nil
+}
+
+func newTestRegistry(specs ...*managerSpec) *managerRegistry {
+	reg := &managerRegistry{specs: make(map[string]*managerSpec)}
+	for _, curr := range specs {
+		if curr.new == nil {
+			curr.new = func() manager { return &fakeMgr{} }
+		}
+		reg.register(curr)
+	}
+	return reg
+}
+
+func TestResolveManagers(t *testing.T) {
+	tests := []struct {
+		name    string
+		goos    string
+		specs   []*managerSpec
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "dependencies",
+			goos: "linux",
+			specs: []*managerSpec{
+				{name: "accounts", dependencies: []string{"oslogin"}},
+				{name: "oslogin", dependencies: []string{"address"}},
+				{name: "address"},
+				{name: "clockskew"},
+			},
+			want: []string{"address", "oslogin", "accounts", "clockskew"},
+		},
+		{
+			name: "platform",
+			goos: "windows",
+			specs: []*managerSpec{
+				{name: "accounts", platform: unixOnly, dependencies: []string{"address"}},
+				{name: "diagnostics", platform: windowsOnly, dependencies: []string{"oslogin"}},
+				{name: "oslogin", platform: unixOnly},
+				{name: "address"},
+			},
+			want: []string{"address", "diagnostics"},
+		},
+		{
+			name: "cycle",
+			goos: "linux",
+			specs: []*managerSpec{
+				{name: "a", dependencies: []string{"b"}},
+				{name: "b", dependencies: []string{"c"}},
+				{name: "c", dependencies: []string{"a"}},
+			},
+			wantErr: "manager dependency cycle: a -> b -> c -> a",
+		},
+		{
+			name: "unknown",
+			goos: "linux",
+			specs: []*managerSpec{
+				{name: "a", conflicts: []string{"b"}},
+			},
+			wantErr: `manager "a" refers to unknown manager "b"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			specs, err := newTestRegistry(tc.specs...).resolve(tc.goos)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("resolve(%s) returned error: %v, want: %s", tc.goos, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve(%s) failed: %+v", tc.goos, err)
+			}
+
+			var got []string
+			for _, curr := range specs {
+				got = append(got, curr.name)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("resolve(%s) = %v, want: %v", tc.goos, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunManagers(t *testing.T) {
+	reg := newTestRegistry(
+		&managerSpec{name: "address"},
+		&managerSpec{name: "oslogin", dependencies: []string{"address"}},
+		&managerSpec{name: "accounts", dependencies: []string{"oslogin"}},
+		&managerSpec{name: "clockskew", conflicts: []string{"accounts", "oslogin"}},
+	)
+
+	conflicting := map[string]bool{"clockskew/accounts": true, "clockskew/oslogin": true}
+
+	var mu sync.Mutex
+	var running []string
+	finished := make(map[string]time.Time)
+	started := make(map[string]time.Time)
+
+	runFunc := func(ctx context.Context, name string, mgr manager) {
+		mu.Lock()
+		for _, curr := range running {
+			if conflicting[name+"/"+curr] || conflicting[curr+"/"+name] {
+				t.Errorf("manager %q ran concurrently with conflicting manager %q", name, curr)
+			}
+		}
+		running = append(running, name)
+		started[name] = time.Now()
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		for i, curr := range running {
+			if curr == name {
+				running = append(running[:i], running[i+1:]...)
+				break
+			}
+		}
+		finished[name] = time.Now()
+		mu.Unlock()
+	}
+
+	if err := reg.run(context.Background(), runtime.GOOS, runFunc); err != nil {
+		t.Fatalf("run() failed: %+v", err)
+	}
+
+	if len(finished) != 4 {
+		t.Fatalf("run() ran %d managers, want: 4", len(finished))
+	}
+
+	for _, curr := range [][2]string{{"address", "oslogin"}, {"oslogin", "accounts"}} {
+		if started[curr[1]].Before(finished[curr[0]]) {
+			t.Errorf("manager %q started before its dependency %q finished", curr[1], curr[0])
+		}
+	}
+}
+
+func TestRunManagersSkipsDependentsOfRunningManager(t *testing.T) {
+	reg := newTestRegistry(
+		&managerSpec{name: "address"},
+		&managerSpec{name: "oslogin", dependencies: []string{"address"}},
+		&managerSpec{name: "accounts", dependencies: []string{"oslogin"}},
+		&managerSpec{name: "clockskew", conflicts: []string{"address"}},
+		&managerSpec{name: "diagnostics"},
+	)
+
+	// address has a timed out run still in progress.
+	if !startManagerRun("address") {
+		t.Fatalf("startManagerRun(address) = false, want: true")
+	}
+	defer finishManagerRun("address")
+
+	var mu sync.Mutex
+	var ran []string
+	runFunc := func(ctx context.Context, name string, mgr manager) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, name)
+	}
+
+	if err := reg.run(context.Background(), runtime.GOOS, runFunc); err != nil {
+		t.Fatalf("run() failed: %+v", err)
+	}
+
+	sort.Strings(ran)
+	if want := []string{"address", "diagnostics"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("run() ran %v, want: %v", ran, want)
+	}
+
+	for _, curr := range getManagerStatuses() {
+		if curr.Name == "accounts" && curr.LastError != "skipped: dependency oslogin was skipped" {
+			t.Errorf("accounts status.LastError = %q, want: %q", curr.LastError, "skipped: dependency oslogin was skipped")
+		}
+	}
+}
+
+func TestPlanManagers(t *testing.T) {
+	accounts := &fakeMgr{changes: []string{"create user foo"}}
+	reg := newTestRegistry(
+		&managerSpec{name: "accounts", new: func() manager { return accounts }, dependencies: []string{"oslogin"}},
+		&managerSpec{name: "oslogin", new: func() manager { return &fakeMgr{disabled: true} }},
+	)
+
+	plans, err := reg.plan(context.Background(), runtime.GOOS)
+	if err != nil {
+		t.Fatalf("plan() failed: %+v", err)
+	}
+
+	if len(plans) != 2 || plans[0].name != "oslogin" || plans[1].name != "accounts" {
+		t.Fatalf("plan() returned %+v, want oslogin and accounts plans", plans)
+	}
+	if !plans[0].disabled {
+		t.Errorf("plan() returned oslogin enabled, want disabled")
+	}
+	if strings.Join(plans[1].changes, ",") != "create user foo" {
+		t.Errorf("plan() returned accounts changes %v, want: [create user foo]", plans[1].changes)
+	}
+	if accounts.setCalls != 0 {
+		t.Errorf("plan() called Set() %d times, want: 0", accounts.setCalls)
+	}
+}
+
+func TestRegisteredManagers(t *testing.T) {
+	for _, goos := range []string{"linux", "windows"} {
+		if _, err := managers.resolve(goos); err != nil {
+			t.Errorf("resolve(%s) failed: %+v", goos, err)
+		}
+	}
+}
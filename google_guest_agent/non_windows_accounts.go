@@ -18,22 +18,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/accounts"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 var (
+	// accountsLog logs the entries of the accounts component.
+	accountsLog = logfields.Component(logfields.ComponentAccounts)
+
 	// sshKeys is a cache of what we have added to each managed users' authorized
 	// keys file. Avoids necessity of re-reading all files on every change.
 	sshKeys         map[string][]string
@@ -69,7 +76,23 @@ func removeExpiredKeys(keys []string) []string {
 	return validKeys
 }
 
-type accountsMgr struct{}
+func init() {
+	// The oslogin manager must run first, enabling OS Login clears the metadata
+	// SSH keys so the accounts manager removes the users it has created.
+	registerManager(&managerSpec{
+		name:         "accounts",
+		platform:     unixOnly,
+		new:          func() manager { return &accountsMgr{} },
+		dependencies: []string{"oslogin"},
+	})
+}
+
+type accountsMgr struct {
+	// applied counts the users created, updated or removed by Set().
+	applied int
+	// audit collects the changes applied by Set().
+	audit *accountsAudit
+}
 
 func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	// If any keys have changed.
@@ -82,6 +105,11 @@ func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	if newMetadata.Instance.Attributes.BlockProjectKeys != oldMetadata.Instance.Attributes.BlockProjectKeys {
 		return true, nil
 	}
+	// If any user's role has changed.
+	if newMetadata.Instance.Attributes.UserRoles != oldMetadata.Instance.Attributes.UserRoles ||
+		newMetadata.Project.Attributes.UserRoles != oldMetadata.Project.Attributes.UserRoles {
+		return true, nil
+	}
 
 	// If any on-disk keys have expired.
 	for _, keys := range sshKeys {
@@ -89,10 +117,10 @@ func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 			return true, nil
 		}
 	}
-	// If we've just disabled OS Login.
+	// If we've just enabled or disabled OS Login.
 	oldOslogin, _, _ := getOSLoginEnabled(oldMetadata)
 	newOslogin, _, _ := getOSLoginEnabled(newMetadata)
-	if oldOslogin && !newOslogin {
+	if oldOslogin != newOslogin {
 		return true, nil
 	}
 
@@ -105,25 +133,32 @@ func (a *accountsMgr) Timeout(ctx context.Context) (bool, error) {
 
 func (a *accountsMgr) Disabled(ctx context.Context) (bool, error) {
 	config := cfg.Get()
+	oldOslogin, _, _ := getOSLoginEnabled(oldMetadata)
 	oslogin, _, _ := getOSLoginEnabled(newMetadata)
+	// When OS Login has just been enabled run one last time, the oslogin manager
+	// has cleared the metadata SSH keys so the Google users get removed.
+	if oslogin && !oldOslogin {
+		oslogin = false
+	}
 	return false || runtime.GOOS == "windows" || oslogin || !config.Daemons.AccountsDaemon, nil
 }
 
 func (a *accountsMgr) Set(ctx context.Context) error {
 	config := cfg.Get()
+	a.audit = newAccountsAudit(config.Accounts, newMetadata, oldMetadata)
 
 	if sshKeys == nil {
-		logger.Debugf("initialize sshKeys map")
+		accountsLog.Debugf("initialize sshKeys map")
 		sshKeys = make(map[string][]string)
 	}
 
-	logger.Debugf("create sudoers file if needed")
+	accountsLog.Debugf("create sudoers file if needed")
 	if err := createSudoersFile(); err != nil {
-		logger.Errorf("Error creating google-sudoers file: %v.", err)
+		accountsLog.Errorf("Error creating google-sudoers file: %v.", err)
 	}
-	logger.Debugf("create sudoers group if needed")
+	accountsLog.Debugf("create sudoers group if needed")
 	if err := createSudoersGroup(ctx, config); err != nil {
-		logger.Errorf("Error creating google-sudoers group: %v.", err)
+		accountsLog.Errorf("Error creating google-sudoers group: %v.", err)
 	}
 
 	mdkeys := newMetadata.Instance.Attributes.SSHKeys
@@ -131,57 +166,183 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 		mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
 	}
 
-	mdKeyMap := getUserKeys(mdkeys)
+	mdKeyMap := getUserKeys(mdkeys, keyPolicy(config.Accounts))
+	for user, reason := range refuseProtectedUsers(config.Accounts, mdKeyMap) {
+		accountsLog.With(logfields.KeyUser, user).Warningf("Refusing the metadata SSH keys of user, %s.", reason)
+	}
 
-	logger.Debugf("read google users file")
+	accountsLog.Debugf("read google users file")
 	gUsers, err := readGoogleUsersFile()
 	if err != nil {
 		// TODO: is this OK to continue past?
-		logger.Errorf("Couldn't read google_users file: %v.", err)
+		accountsLog.Errorf("Couldn't read google_users file: %v.", err)
+	}
+	// Unlike google_users, the locked users' state can't be rebuilt, i.e. the
+	// shells to restore would be lost.
+	lockedUsers, err := readLockedUsersFile()
+	if err != nil {
+		return fmt.Errorf("couldn't read google_users_locked file: %v", err)
+	}
+
+	roles, errs := getUserRoles(newMetadata)
+	for _, err := range errs {
+		accountsLog.WithError(err).Errorf("Ignoring invalid guest-agent-user-roles entry.")
+	}
+	granted, err := readGoogleUserGroupsFile()
+	if err != nil {
+		accountsLog.Errorf("Couldn't read google_users_groups file: %v.", err)
+		granted = make(map[string][]string)
+	}
+	uids, errs := getUserIDs(newMetadata)
+	if config.Accounts.UIDPolicy == uidPolicyMetadata {
+		for _, err := range errs {
+			accountsLog.WithError(err).Errorf("Ignoring invalid guest-agent-user-ids entry.")
+		}
+	}
+
+	now := time.Now()
+	grace := time.Duration(config.Accounts.RemovalGracePeriod) * time.Second
+	locked := make(map[string]lockedUser)
+	expiryTime := utils.ExpiryTimeEnabled(ctx, config.Accounts.ExpiryTimeOption)
+	// The group database is read once, and kept up to date with the changes made
+	// below. The users' groups are left as is if it can't be read.
+	members, err := readGroupMembers()
+	if err != nil {
+		accountsLog.WithError(err).Errorf("Error reading group members, not syncing the users' groups.")
 	}
 
 	// Update SSH keys, creating Google users as needed.
 	for user, userKeys := range mdKeyMap {
-		if _, err := getPasswd(user); err != nil {
-			logger.Infof("Creating user %s.", user)
-			if err := createGoogleUser(ctx, config, user); err != nil {
-				logger.Errorf("Error creating user: %s.", err)
+		fields := accountsLog.With(logfields.KeyUser, user)
+		if state, ok := lockedUsers[user]; ok {
+			fields.Infof("Restoring locked user.")
+			if err := unlockGoogleUser(ctx, config, user, state); err != nil {
+				fields.WithError(err).Errorf("Error restoring user.")
+				locked[user] = state
 				continue
 			}
 			gUsers[user] = ""
+			a.audit.userEvent(auditUserUnlocked, user)
+			a.applied++
 		}
-		if _, ok := gUsers[user]; !ok {
-			logger.Infof("Adding existing user %s to google-sudoers group.", user)
-			if err := addUserToGroup(ctx, user, "google-sudoers"); err != nil {
-				logger.Errorf("%v.", err)
+		if _, err := getPasswd(user); err != nil {
+			fields.Infof("Creating user.")
+			if err := createGoogleUser(ctx, config, user, uids, members, a.audit); err != nil {
+				fields.WithError(err).Errorf("Error creating user.")
+				continue
 			}
+			gUsers[user] = ""
+			usersCreated.Inc()
+			a.applied++
 		}
-		if !compareStringSlice(userKeys, sshKeys[user]) {
-			logger.Infof("Updating keys for user %s.", user)
-			if err := updateAuthorizedKeysFile(ctx, user, userKeys); err != nil {
-				logger.Errorf("Error updating SSH keys for %s: %v.", user, err)
+		if members != nil && a.syncUserGroups(ctx, user, roleOf(roles, user, config.Accounts.DefaultRole), members, granted) {
+			a.applied++
+		}
+		authorizedKeys := withExpiryTimeOptions(userKeys, expiryTime)
+		if !compareStringSlice(userKeys, sshKeys[user]) || googleKeysDrifted(user, authorizedKeys) {
+			fields.Infof("Updating keys for user.")
+			installed, _ := readGoogleAuthorizedKeys(user)
+			logExpiredKeys(user, installed, authorizedKeys)
+			if err := updateAuthorizedKeysFile(ctx, user, authorizedKeys); err != nil {
+				fields.WithError(err).Errorf("Error updating SSH keys.")
 				continue
 			}
+			a.audit.keyChanges(user, installed, authorizedKeys)
 			sshKeys[user] = userKeys
+			a.applied++
 		}
 	}
 
-	// Remove Google users not found in metadata.
+	// Remove Google users not found in metadata. With deprovision_remove and a
+	// grace period they're first locked, and removed once it expires.
 	for user := range gUsers {
-		if _, ok := mdKeyMap[user]; !ok && user != "" {
-			logger.Infof("Removing user %s.", user)
-			err = removeGoogleUser(ctx, config, user)
+		if _, ok := mdKeyMap[user]; ok || user == "" {
+			continue
+		}
+		fields := accountsLog.With(logfields.KeyUser, user)
+		if reason := protectedUser(config.Accounts, user); reason != "" {
+			// It's no longer managed, it's kept but loses what the agent granted it.
+			fields.Warningf("Not removing user, %s, revoking its Google keys and groups.", reason)
+			if err := revokeGoogleUser(ctx, config, user, members, a.audit); err != nil {
+				fields.WithError(err).Errorf("Error revoking the keys and sudo access of user.")
+				// Keep it in the google_users file, it's retried on the next run.
+				if _, ok := sshKeys[user]; !ok {
+					sshKeys[user] = nil
+				}
+				continue
+			}
+			a.removeRoleGroups(ctx, user, granted)
+			a.applied++
+			delete(sshKeys, user)
+			continue
+		}
+		lockedState, isLocked := lockedUsers[user]
+
+		if config.Accounts.DeprovisionRemove && grace > 0 && !isLocked {
+			fields.Infof("Locking user, it will be removed in %s.", grace)
+			l, err := lockGoogleUser(ctx, config, user, members, a.audit, now)
 			if err != nil {
-				logger.Errorf("Error removing user: %v.", err)
+				fields.WithError(err).Errorf("Error locking user.")
+				// Keep it in the google_users file, it's retried on the next run.
+				if _, ok := sshKeys[user]; !ok {
+					sshKeys[user] = nil
+				}
+				continue
 			}
+			locked[user] = l
+			a.audit.userEvent(auditUserLocked, user)
+			a.applied++
+			a.removeRoleGroups(ctx, user, granted)
 			delete(sshKeys, user)
+			continue
+		}
+		if config.Accounts.DeprovisionRemove && isLocked && now.Before(lockedState.since.Add(grace)) {
+			locked[user] = lockedState
+			continue
+		}
+
+		if isLocked && !config.Accounts.DeprovisionRemove {
+			// deprovision_remove was disabled since the user was locked, it's kept.
+			if err := unlockGoogleUser(ctx, config, user, lockedState); err != nil {
+				fields.WithError(err).Errorf("Error restoring user.")
+			}
+		}
+		fields.Infof("Removing user.")
+		err = removeGoogleUser(ctx, config, user, members, a.audit)
+		if err != nil {
+			fields.WithError(err).Errorf("Error removing user.")
+			if isLocked {
+				// Retried on the next run.
+				locked[user] = lockedState
+			}
+		} else {
+			a.audit.userEvent(auditUserRemoved, user)
+			usersRemoved.Inc()
+			a.applied++
 		}
+		if !config.Accounts.DeprovisionRemove {
+			a.removeRoleGroups(ctx, user, granted)
+		}
+		delete(granted, user)
+		delete(sshKeys, user)
 	}
+	scheduleAccountsReconcile(ctx, userRemovalJobID, nextUserRemoval(locked, grace), now)
+	// Expired keys are removed on the next run after their expireOn time.
+	scheduleAccountsReconcile(ctx, keyExpiryJobID, nextKeyExpiry(sshKeys, now), now)
 
 	// Update the google_users file if we've added or removed any users.
-	logger.Debugf("write google_users file")
-	if err := writeGoogleUsersFile(); err != nil {
-		logger.Errorf("Error writing google_users file: %v.", err)
+	accountsLog.Debugf("write google_users file")
+	if err := writeGoogleUsersFile(locked); err != nil {
+		accountsLog.Errorf("Error writing google_users file: %v.", err)
+	}
+	if err := writeLockedUsersFile(locked); err != nil {
+		accountsLog.Errorf("Error writing google_users_locked file: %v.", err)
+	}
+	if err := writeGoogleUserGroupsFile(granted); err != nil {
+		accountsLog.Errorf("Error writing google_users_groups file: %v.", err)
+	}
+	if err := a.audit.flush(ctx); err != nil {
+		accountsLog.Errorf("Error writing accounts audit log: %v.", err)
 	}
 
 	// Start SSHD if not started. We do this in agent instead of adding a
@@ -195,15 +356,249 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 	return nil
 }
 
+// logExpiredKeys logs the removal of the keys of user which are installed but
+// no longer in keys because they have expired.
+func logExpiredKeys(user string, installed, keys []string) {
+	fields := accountsLog.With(logfields.KeyUser, user)
+	for _, key := range installed {
+		if utils.ContainsString(key, keys) || utils.CheckExpiredKey(key) == nil {
+			continue
+		}
+		fingerprint, err := utils.KeyFingerprint(key)
+		if err != nil {
+			fingerprint = "(invalid key)"
+		}
+		fields.Infof("Removing expired SSH key %s.", fingerprint)
+	}
+}
+
+// keyPolicy returns the policy the metadata SSH keys must comply with.
+func keyPolicy(config *cfg.Accounts) utils.KeyPolicy {
+	return utils.NewKeyPolicy(config.KeyTypes, config.KeyMinRSABits, config.KeyRequireSecurityKey, config.KeyForbiddenOptions)
+}
+
+// protectedUser returns why the accounts manager must not manage user, see
+// utils.ProtectedUser, or an empty string if it can.
+func protectedUser(config *cfg.Accounts, user string) string {
+	return utils.ProtectedUser(user, strings.Split(config.ProtectedUsers, ","), config.ProtectedUIDThreshold)
+}
+
+// refuseProtectedUsers removes the protected users from mdKeyMap and returns
+// why each of them was refused.
+func refuseProtectedUsers(config *cfg.Accounts, mdKeyMap map[string][]string) map[string]string {
+	refused := make(map[string]string)
+	for user := range mdKeyMap {
+		if reason := protectedUser(config, user); reason != "" {
+			refused[user] = reason
+			delete(mdKeyMap, user)
+		}
+	}
+	return refused
+}
+
+// withExpiryTimeOptions returns keys as written to the authorized keys file,
+// with an expiry-time option for the expiring keys if expiryTime is set.
+func withExpiryTimeOptions(keys []string, expiryTime bool) []string {
+	if !expiryTime {
+		return keys
+	}
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, utils.AddExpiryTimeOption(key, time.Local))
+	}
+	return res
+}
+
+// removeRoleGroups removes user from the role groups it was added to.
+func (a *accountsMgr) removeRoleGroups(ctx context.Context, user string, granted map[string][]string) {
+	fields := accountsLog.With(logfields.KeyUser, user)
+	for _, group := range granted[user] {
+		if err := accountsBackend(cfg.Get().Accounts).RemoveUserFromGroup(ctx, user, group); err != nil {
+			fields.WithError(err).Errorf("Error removing user from group %s.", group)
+			continue
+		}
+		a.audit.groupEvent(user, group, false)
+	}
+	delete(granted, user)
+}
+
+// syncUserGroups adds user to or removes it from google-sudoers and the role's
+// groups so that its memberships match role. members are the groups' members, as
+// returned by readGroupMembers(), and granted the role groups each user was added
+// to, both are updated for user. It returns true if any membership was changed.
+func (a *accountsMgr) syncUserGroups(ctx context.Context, user string, role userRole, members map[string]map[string]bool, granted map[string][]string) bool {
+	fields := accountsLog.With(logfields.KeyUser, user)
+
+	var changed bool
+	var err error
+	changes, newGranted := userGroupChanges(user, role, members, granted[user])
+	backend := accountsBackend(cfg.Get().Accounts)
+	for _, change := range changes {
+		if change.add {
+			fields.Infof("Adding user to group %s.", change.group)
+			err = backend.AddUserToGroup(ctx, user, change.group)
+		} else {
+			fields.Infof("Removing user from group %s.", change.group)
+			err = backend.RemoveUserFromGroup(ctx, user, change.group)
+		}
+		if err != nil {
+			fields.WithError(err).Errorf("Error changing groups of user.")
+			// Only record the role groups the user is actually a member of, so
+			// that the change is retried on the next run.
+			if change.add {
+				newGranted = removeString(newGranted, change.group)
+			} else if change.group != "google-sudoers" {
+				newGranted = append(newGranted, change.group)
+			}
+			continue
+		}
+		a.audit.groupEvent(user, change.group, change.add)
+		setGroupMember(members, change.group, user, change.add)
+		changed = true
+	}
+
+	granted[user] = newGranted
+	return changed
+}
+
+// Plan returns the users the manager would create or remove and the users whose
+// group membership or authorized keys it would change.
+func (a *accountsMgr) Plan(ctx context.Context) ([]string, error) {
+	config := cfg.Get()
+
+	var res []string
+	if _, err := os.Stat("/etc/sudoers.d/google_sudoers"); os.IsNotExist(err) {
+		res = append(res, "create /etc/sudoers.d/google_sudoers")
+	}
+	if _, err := user.LookupGroup("google-sudoers"); err != nil {
+		res = append(res, "create group google-sudoers")
+	}
+
+	// Enabling OS Login clears the metadata SSH keys, see osloginMgr.
+	var mdkeys []string
+	if oslogin, _, _ := getOSLoginEnabled(newMetadata); !oslogin {
+		mdkeys = newMetadata.Instance.Attributes.SSHKeys
+		if !newMetadata.Instance.Attributes.BlockProjectKeys {
+			mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
+		}
+	}
+	mdKeyMap := getUserKeys(mdkeys, keyPolicy(config.Accounts))
+	refused := refuseProtectedUsers(config.Accounts, mdKeyMap)
+
+	gUsers, err := readGoogleUsersFile()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read google_users file: %v", err)
+	}
+	lockedUsers, err := readLockedUsersFile()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read google_users_locked file: %v", err)
+	}
+
+	roles, _ := getUserRoles(newMetadata)
+	granted, err := readGoogleUserGroupsFile()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read google_users_groups file: %v", err)
+	}
+	members, err := readGroupMembers()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read group members: %v", err)
+	}
+
+	expiryTime := utils.ExpiryTimeEnabled(ctx, config.Accounts.ExpiryTimeOption)
+
+	var users []string
+	for name := range refused {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	for _, name := range users {
+		res = append(res, fmt.Sprintf("refuse SSH keys of user %s, %s", name, refused[name]))
+	}
+
+	users = nil
+	for name := range mdKeyMap {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+
+	for _, name := range users {
+		userKeys := mdKeyMap[name]
+		if _, ok := lockedUsers[name]; ok {
+			res = append(res, fmt.Sprintf("unlock user %s", name))
+		}
+		_, err := getPasswd(name)
+		if err != nil {
+			res = append(res, fmt.Sprintf("create user %s with %d SSH key(s)", name, len(userKeys)))
+		}
+		changes, _ := userGroupChanges(name, roleOf(roles, name, config.Accounts.DefaultRole), members, granted[name])
+		for _, change := range changes {
+			if change.add {
+				res = append(res, fmt.Sprintf("add user %s to group %s", name, change.group))
+			} else {
+				res = append(res, fmt.Sprintf("remove user %s from group %s", name, change.group))
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if googleKeysDrifted(name, withExpiryTimeOptions(userKeys, expiryTime)) {
+			keys, _ := readGoogleAuthorizedKeys(name)
+			res = append(res, fmt.Sprintf("update SSH keys of user %s from %d to %d key(s)", name, len(keys), len(userKeys)))
+		}
+	}
+
+	users = nil
+	var protected []string
+	for name := range gUsers {
+		if _, ok := mdKeyMap[name]; ok || name == "" {
+			continue
+		}
+		if protectedUser(config.Accounts, name) != "" {
+			protected = append(protected, name)
+		} else {
+			users = append(users, name)
+		}
+	}
+	sort.Strings(users)
+	sort.Strings(protected)
+	for _, name := range protected {
+		res = append(res, fmt.Sprintf("remove SSH keys and groups of protected user %s", name))
+	}
+
+	now := time.Now()
+	grace := time.Duration(config.Accounts.RemovalGracePeriod) * time.Second
+	for _, name := range users {
+		l, isLocked := lockedUsers[name]
+		switch {
+		case config.Accounts.DeprovisionRemove && grace > 0 && !isLocked:
+			res = append(res, fmt.Sprintf("lock user %s and remove it in %s", name, grace))
+		case config.Accounts.DeprovisionRemove && isLocked && now.Before(l.since.Add(grace)):
+			// Still in its grace period.
+		case config.Accounts.DeprovisionRemove:
+			res = append(res, fmt.Sprintf("remove user %s", name))
+		default:
+			res = append(res, fmt.Sprintf("remove SSH keys and sudo permissions of user %s", name))
+		}
+	}
+
+	return res, nil
+}
+
+// Applied returns the number of users created, updated or removed by Set().
+func (a *accountsMgr) Applied() int {
+	return a.applied
+}
+
 var badSSHKeys []string
 
-// getUserKeys returns the keys which are not expired and non-expiring key.
+// getUserKeys returns the keys which are not expired and non-expiring key, and
+// that policy accepts. Rejected keys are logged once.
 // valid formats are:
 // user:ssh-rsa [KEY_VALUE] [USERNAME]
 // user:ssh-rsa [KEY_VALUE]
 // user:ssh-rsa [KEY_VALUE] google-ssh {"userName":"[USERNAME]","expireOn":"[EXPIRE_TIME]"}
 // user:[KEY_OPTIONS] ssh-rsa [KEY_VALUE]
-func getUserKeys(mdkeys []string) map[string][]string {
+func getUserKeys(mdkeys []string, policy utils.KeyPolicy) map[string][]string {
 	mdKeyMap := make(map[string][]string)
 	for i := 0; i < len(mdkeys); i++ {
 		trimmedKey := strings.Trim(mdkeys[i], " ")
@@ -212,10 +607,24 @@ func getUserKeys(mdkeys []string) map[string][]string {
 			if err == nil {
 				err = utils.ValidateUserKey(user, keyVal)
 			}
+			if err == nil {
+				if err = policy.Check(keyVal); err != nil {
+					// Only the fingerprint of a valid key is logged.
+					if !utils.ContainsString(trimmedKey, badSSHKeys) {
+						fingerprint, fpErr := utils.KeyFingerprint(keyVal)
+						if fpErr != nil {
+							fingerprint = "(invalid key)"
+						}
+						accountsLog.With(logfields.KeyUser, user).Errorf("SSH key %s rejected by policy: %v", fingerprint, err)
+						badSSHKeys = append(badSSHKeys, trimmedKey)
+					}
+					continue
+				}
+			}
 
 			if err != nil {
 				if !utils.ContainsString(trimmedKey, badSSHKeys) {
-					logger.Errorf("%s: %s", err.Error(), trimmedKey)
+					accountsLog.Errorf("%s: %s", err.Error(), trimmedKey)
 					badSSHKeys = append(badSSHKeys, trimmedKey)
 				}
 				continue
@@ -297,7 +706,10 @@ func getPasswd(user string) (*passwdEntry, error) {
 	return nil, fmt.Errorf("user not found")
 }
 
-func writeGoogleUsersFile() error {
+// writeGoogleUsersFile records the Google users, i.e. the users with keys and
+// the locked ones, one username per line. The locked users' state is recorded by
+// writeLockedUsersFile().
+func writeGoogleUsersFile(locked map[string]lockedUser) error {
 	dir := path.Dir(googleUsersFile)
 	if _, err := os.Stat(dir); err != nil {
 		if err = os.Mkdir(dir, 0755); err != nil {
@@ -311,6 +723,9 @@ func writeGoogleUsersFile() error {
 		for user := range sshKeys {
 			fmt.Fprintf(gfile, "%s\n", user)
 		}
+		for user := range locked {
+			fmt.Fprintf(gfile, "%s\n", user)
+		}
 	}
 	return err
 }
@@ -329,51 +744,123 @@ func readGoogleUsersFile() (map[string]string, error) {
 	return res, nil
 }
 
-// Replaces {user} or {group} in command string. Supports legacy python-era
-// user command overrides.
-func createUserGroupCmd(cmd, user, group string) (string, []string) {
-	cmd = strings.Replace(cmd, "{user}", user, 1)
-	cmd = strings.Replace(cmd, "{group}", group, 1)
-
-	// We don't run the command here because we might need the exit codes.
-	tokens := strings.Fields(cmd)
-	return tokens[0], tokens[1:]
+// accountsBackend returns the accounts backend selected by the Accounts
+// section, the command one unless native is set.
+func accountsBackend(config *cfg.Accounts) accounts.Backend {
+	if config.Backend == accounts.BackendNative {
+		backend := accounts.NewNativeBackend()
+		if config.UIDPolicy == uidPolicyHash {
+			// An invalid range is reported by googleUserUID.
+			backend.HashIDMin, backend.HashIDMax, _ = accounts.ParseIDRange(config.UIDRange)
+		}
+		return backend
+	}
+	return &accounts.CommandBackend{
+		UserAdd:       config.UserAddCmd,
+		UserDel:       config.UserDelCmd,
+		GroupAdd:      config.GroupAddCmd,
+		GPasswdAdd:    config.GPasswdAddCmd,
+		GPasswdRemove: config.GPasswdRemoveCmd,
+		Lock:          config.LockCmd,
+		Unlock:        config.UnlockCmd,
+	}
 }
 
 // createGoogleUser creates a Google managed user account if needed and adds it
-// to the configured groups.
-func createGoogleUser(ctx context.Context, config *cfg.Sections, user string) error {
+// to the configured groups. Its google-sudoers membership depends on its role,
+// see syncUserGroups. Its UID is the owner's of its home directory with
+// reuse_homedir, otherwise it follows the uid_policy, ids are the UIDs assigned
+// by metadata. The groups it's added to are updated in members, nil if unknown,
+// and its creation and memberships are recorded to audit.
+func createGoogleUser(ctx context.Context, config *cfg.Sections, user string, ids map[string]int, members map[string]map[string]bool, audit *accountsAudit) error {
 	var uid string
 	if config.Accounts.ReuseHomedir {
 		uid = getUID(fmt.Sprintf("/home/%s", user))
 	}
+	if uid == "" {
+		var err error
+		if uid, err = googleUserUID(config.Accounts, user, ids); err != nil {
+			return err
+		}
+	}
 
 	if err := createUser(ctx, user, uid); err != nil {
 		return err
 	}
+	audit.userEvent(auditUserCreated, user)
 	groups := config.Accounts.Groups
 	for _, group := range strings.Split(groups, ",") {
-		addUserToGroup(ctx, user, group)
+		if err := addUserToGroup(ctx, user, group); err != nil {
+			accountsLog.With(logfields.KeyUser, user).WithError(err).Warningf("Error adding user to group %s.", group)
+			continue
+		}
+		audit.groupEvent(user, group, true)
+		if members != nil {
+			setGroupMember(members, group, user, true)
+		}
 	}
-	return addUserToGroup(ctx, user, "google-sudoers")
+	return nil
 }
 
 // removeGoogleUser removes Google managed users. If deprovision_remove is true, the
-// user and its home directory are removed. Otherwise, SSH keys and sudoer
+// user and its home directory are removed, after archiving the latter if
+// archive_dir is set. Otherwise, SSH keys and sudoer
 // permissions are removed but the user remains on the system. Group membership
-// is not changed.
-func removeGoogleUser(ctx context.Context, config *cfg.Sections, user string) error {
+// is not changed. members are the groups' members, as returned by
+// readGroupMembers(), nil if unknown, and the revoked keys and memberships are
+// recorded to audit.
+func removeGoogleUser(ctx context.Context, config *cfg.Sections, user string, members map[string]map[string]bool, audit *accountsAudit) error {
 	if config.Accounts.DeprovisionRemove {
-		userdel := config.Accounts.UserDelCmd
-		name, args := createUserGroupCmd(userdel, user, "")
-		return run.Quiet(ctx, name, args...)
+		installed, _ := readGoogleAuthorizedKeys(user)
+		if config.Accounts.ArchiveDir != "" {
+			path, err := archiveHome(user, config.Accounts.ArchiveDir, time.Now())
+			if err != nil {
+				return err
+			}
+			accountsLog.With(logfields.KeyUser, user).Infof("Archived the home directory of user to %s.", path)
+		}
+		if err := accountsBackend(config.Accounts).DeleteUser(ctx, user); err != nil {
+			return err
+		}
+		audit.keyChanges(user, installed, nil)
+		// The user's memberships are gone with it.
+		var groups []string
+		for group, groupMembers := range members {
+			if groupMembers[user] {
+				groups = append(groups, group)
+			}
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			audit.groupEvent(user, group, false)
+			setGroupMember(members, group, user, false)
+		}
+		return nil
 	}
+	return revokeGoogleUser(ctx, config, user, members, audit)
+}
+
+// revokeGoogleUser removes the keys the agent has added to the authorized keys
+// file of user and removes it from google-sudoers, it's otherwise left as is.
+// members are the groups' members, as returned by readGroupMembers(), nil if
+// unknown, and the revoked keys and membership are recorded to audit.
+func revokeGoogleUser(ctx context.Context, config *cfg.Sections, user string, members map[string]map[string]bool, audit *accountsAudit) error {
+	installed, _ := readGoogleAuthorizedKeys(user)
 	if err := updateAuthorizedKeysFile(ctx, user, []string{}); err != nil {
 		return err
 	}
-	gpasswddel := config.Accounts.GPasswdRemoveCmd
-	name, args := createUserGroupCmd(gpasswddel, user, "google-sudoers")
-	return run.Quiet(ctx, name, args...)
+	audit.keyChanges(user, installed, nil)
+	if members != nil && !members["google-sudoers"][user] {
+		return nil
+	}
+	if err := accountsBackend(config.Accounts).RemoveUserFromGroup(ctx, user, "google-sudoers"); err != nil {
+		return err
+	}
+	audit.groupEvent(user, "google-sudoers", false)
+	if members != nil {
+		setGroupMember(members, "google-sudoers", user, false)
+	}
+	return nil
 }
 
 // createSudoersFile creates the google_sudoers configuration file if it does
@@ -394,27 +881,112 @@ func createSudoersFile() error {
 
 // createSudoersGroup creates the google-sudoers group if it does not exist.
 func createSudoersGroup(ctx context.Context, config *cfg.Sections) error {
-	groupadd := config.Accounts.GroupAddCmd
-	name, args := createUserGroupCmd(groupadd, "", "google-sudoers")
-	ret := run.WithOutput(ctx, name, args...)
-	if ret.ExitCode == 9 {
-		// 9 means group already exists.
+	err := accountsBackend(config.Accounts).CreateGroup(ctx, "google-sudoers")
+	if errors.Is(err, accounts.ErrGroupExists) {
 		return nil
 	}
-	if ret.ExitCode != 0 {
-		return error(ret)
+	if err != nil {
+		return err
 	}
-	logger.Infof("Created google sudoers file")
+	accountsLog.Infof("Created google sudoers file")
 	return nil
 }
 
+// googleKeyComment precedes every key the agent adds to an authorized keys file.
+const googleKeyComment = "# Added by Google"
+
+// readGoogleAuthorizedKeys returns the keys the agent has added to the user's
+// authorized keys file.
+func readGoogleAuthorizedKeys(user string) ([]string, error) {
+	passwd, err := getPasswd(user)
+	if err != nil {
+		return nil, err
+	}
+
+	akcontents, err := os.ReadFile(path.Join(passwd.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var isgoogle bool
+	var keys []string
+	for _, key := range strings.Split(string(akcontents), "\n") {
+		if key == "" {
+			continue
+		}
+		if isgoogle {
+			isgoogle = false
+			keys = append(keys, key)
+			continue
+		}
+		isgoogle = key == googleKeyComment
+	}
+	return keys, nil
+}
+
+// googleKeysDrifted returns true if the keys the agent has added to the user's
+// authorized keys file differ from keys. Users updateAuthorizedKeysFile skips, and
+// users whose file can't be read, are reported as not drifted.
+func googleKeysDrifted(user string, keys []string) bool {
+	passwd, err := getPasswd(user)
+	if err != nil || passwd.HomeDir == "" || passwd.Shell == "/sbin/nologin" {
+		return false
+	}
+	current, err := readGoogleAuthorizedKeys(user)
+	if err != nil {
+		return false
+	}
+	return !compareStringSlice(keys, current)
+}
+
 // updateAuthorizedKeysFile adds provided keys to the user's SSH
 // AuthorizedKeys file. The file and containing directory are created if it
 // does not exist. Uses a temporary file to avoid partial updates in case of
 // errors. If no keys are provided, the authorized keys file is removed.
 func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) error {
-	gcomment := "# Added by Google"
+	return writeAuthorizedKeysFile(ctx, user, keys, false)
+}
+
+// stripGoogleAuthorizedKeys removes the keys the agent has added to the user's
+// authorized keys file and keeps the user's own keys, the file is only removed
+// if none is left.
+func stripGoogleAuthorizedKeys(ctx context.Context, user string) error {
+	return writeAuthorizedKeysFile(ctx, user, nil, true)
+}
+
+// authorizedKeysLines returns the lines of the authorized keys file contents
+// with the keys the agent has added replaced by keys, the other lines, i.e. the
+// user's own keys, are kept.
+func authorizedKeysLines(contents []byte, keys []string) []string {
+	var isgoogle bool
+	var lines []string
+	for _, key := range strings.Split(string(contents), "\n") {
+		if key == "" {
+			continue
+		}
+		if isgoogle {
+			isgoogle = false
+			continue
+		}
+		if key == googleKeyComment {
+			isgoogle = true
+			continue
+		}
+		lines = append(lines, key)
+	}
+	for _, key := range keys {
+		lines = append(lines, googleKeyComment, key)
+	}
+	return lines
+}
 
+// writeAuthorizedKeysFile replaces the keys the agent has added to the user's
+// authorized keys file with keys. With no keys the whole file is removed, unless
+// keepUserKeys is set.
+func writeAuthorizedKeysFile(ctx context.Context, user string, keys []string, keepUserKeys bool) error {
 	passwd, err := getPasswd(user)
 	if err != nil {
 		return err
@@ -442,7 +1014,7 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 	}
 	akpath := path.Join(sshpath, "authorized_keys")
 	// Remove empty file.
-	if len(keys) == 0 {
+	if len(keys) == 0 && !keepUserKeys {
 		os.Remove(akpath)
 		return nil
 	}
@@ -453,21 +1025,10 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 		return err
 	}
 
-	var isgoogle bool
-	var userKeys []string
-	for _, key := range strings.Split(string(akcontents), "\n") {
-		if key == "" {
-			continue
-		}
-		if isgoogle {
-			isgoogle = false
-			continue
-		}
-		if key == gcomment {
-			isgoogle = true
-			continue
-		}
-		userKeys = append(userKeys, key)
+	lines := authorizedKeysLines(akcontents, keys)
+	if len(lines) == 0 {
+		os.Remove(akpath)
+		return nil
 	}
 
 	newfile, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE, 0600)
@@ -476,11 +1037,8 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 	}
 	defer newfile.Close()
 
-	for _, key := range userKeys {
-		fmt.Fprintf(newfile, "%s\n", key)
-	}
-	for _, key := range keys {
-		fmt.Fprintf(newfile, "%s\n%s\n", gcomment, key)
+	for _, line := range lines {
+		fmt.Fprintf(newfile, "%s\n", line)
 	}
 	err = os.Chown(tempPath, passwd.UID, passwd.GID)
 	if err != nil {
@@ -24,8 +24,9 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"golang.org/x/sys/unix"
+
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 var (
@@ -127,12 +128,12 @@ func Get() OSInfo {
 	osInfo, err := parseRelease()
 	if err != nil {
 		// This is a non critical error, we can still return a partially populated OSInfo.
-		logger.Warningf("Error parsing release info: %v", err)
+		logfields.Warningf("Error parsing release info: %v", err)
 	}
 
 	var uts unix.Utsname
 	if err := unix.Uname(&uts); err != nil {
-		logger.Warningf("unix.Uname error: %v", err)
+		logfields.Warningf("unix.Uname error: %v", err)
 		return osInfo
 	}
 	osInfo.KernelVersion = string(bytes.TrimRight(uts.Version[:], "\x00"))
@@ -23,9 +23,10 @@ import (
 	"syscall"
 	"unsafe"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
+
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 var (
@@ -146,7 +147,7 @@ func Get() OSInfo {
 
 	kVersion, kRelease, err := getKernelInfo()
 	if err != nil {
-		logger.Warningf("getKernelInfo() error: %v", err)
+		logfields.Warningf("getKernelInfo() error: %v", err)
 		return osInfo
 	}
 	osInfo.KernelVersion = kVersion
@@ -160,14 +161,14 @@ func Get() OSInfo {
 
 	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, registry.QUERY_VALUE)
 	if err != nil {
-		logger.Warningf("registry.OpenKey error: %v", err)
+		logfields.Warningf("registry.OpenKey error: %v", err)
 		return osInfo
 	}
 	defer k.Close()
 
 	productName, _, err := k.GetStringValue("ProductName")
 	if err != nil {
-		logger.Warningf("GetStringValue('ProductName') error: %v", err)
+		logfields.Warningf("GetStringValue('ProductName') error: %v", err)
 		return osInfo
 	}
 	osInfo.PrettyName = productName
@@ -28,8 +28,8 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/sshtrustedca"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/sshca"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 var (
@@ -39,6 +39,14 @@ var (
 	trustedCAWatcher events.Watcher
 )
 
+func init() {
+	registerManager(&managerSpec{
+		name:     "oslogin",
+		platform: unixOnly,
+		new:      func() manager { return &osloginMgr{} },
+	})
+}
+
 type osloginMgr struct{}
 
 // We also read project keys first, letting instance-level keys take
@@ -117,65 +125,67 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 	enable, twofactor, skey := getOSLoginEnabled(newMetadata)
 
 	if enable && !oldEnable {
-		logger.Infof("Enabling OS Login")
+		logfields.Infof("Enabling OS Login")
 		newMetadata.Instance.Attributes.SSHKeys = nil
+		// The accounts manager depends on this one, it runs next and removes
+		// the users provisioned for the metadata SSH keys.
 		newMetadata.Project.Attributes.SSHKeys = nil
-		(&accountsMgr{}).Set(ctx)
 	}
 
 	if !enable && oldEnable {
-		logger.Infof("Disabling OS Login")
+		logfields.Infof("Disabling OS Login")
 	}
 
-	if err := writeSSHConfig(enable, twofactor, skey); err != nil {
-		logger.Errorf("Error updating SSH config: %v.", err)
-	}
+	// The services are only restarted if the OS Login settings or the
+	// configuration files have changed, i.e. not when a reconciliation only
+	// recreates the OS Login directories.
+	restart, _ := o.Diff(ctx)
 
-	if err := writeNSSwitchConfig(enable); err != nil {
-		logger.Errorf("Error updating NSS config: %v.", err)
+	changed, err := writeSSHConfig(enable, twofactor, skey)
+	if err != nil {
+		logfields.Errorf("Error updating SSH config: %v.", err)
 	}
+	restart = restart || changed
 
-	if err := writePAMConfig(enable, twofactor); err != nil {
-		logger.Errorf("Error updating PAM config: %v.", err)
+	changed, err = writeNSSwitchConfig(enable)
+	if err != nil {
+		logfields.Errorf("Error updating NSS config: %v.", err)
 	}
+	restart = restart || changed
 
-	if err := writeGroupConf(enable); err != nil {
-		logger.Errorf("Error updating group.conf: %v.", err)
+	changed, err = writePAMConfig(enable, twofactor)
+	if err != nil {
+		logfields.Errorf("Error updating PAM config: %v.", err)
 	}
+	restart = restart || changed
 
-	for _, svc := range []string{"nscd", "unscd", "systemd-logind", "cron", "crond"} {
-		// These services should be restarted if running
-		logger.Debugf("systemctl try-restart %s, if it exists", svc)
-		if err := systemctlTryRestart(ctx, svc); err != nil {
-			logger.Errorf("Error restarting service: %v.", err)
-		}
+	changed, err = writeGroupConf(enable)
+	if err != nil {
+		logfields.Errorf("Error updating group.conf: %v.", err)
 	}
+	restart = restart || changed
 
-	// SSH should be started if not running, reloaded otherwise.
-	for _, svc := range []string{"ssh", "sshd"} {
-		logger.Debugf("systemctl reload-or-restart %s, if it exists", svc)
-		if err := systemctlReloadOrRestart(ctx, svc); err != nil {
-			logger.Errorf("Error reloading service: %v.", err)
-		}
+	if restart {
+		restartOSLoginServices(ctx)
 	}
 
 	now := fmt.Sprintf("%d", time.Now().Unix())
 	mdsClient.WriteGuestAttributes(ctx, "guest-agent/sshable", now)
 
 	if enable {
-		logger.Debugf("Create OS Login dirs, if needed")
+		logfields.Debugf("Create OS Login dirs, if needed")
 		if err := createOSLoginDirs(ctx); err != nil {
-			logger.Errorf("Error creating OS Login directory: %v.", err)
+			logfields.Errorf("Error creating OS Login directory: %v.", err)
 		}
 
-		logger.Debugf("create OS Login sudoers config, if needed")
+		logfields.Debugf("create OS Login sudoers config, if needed")
 		if err := createOSLoginSudoersFile(); err != nil {
-			logger.Errorf("Error creating OS Login sudoers file: %v.", err)
+			logfields.Errorf("Error creating OS Login sudoers file: %v.", err)
 		}
 
-		logger.Debugf("starting OS Login nss cache fill")
+		logfields.Debugf("starting OS Login nss cache fill")
 		if err := run.Quiet(ctx, "google_oslogin_nss_cache"); err != nil {
-			logger.Errorf("Error updating NSS cache: %v.", err)
+			logfields.Errorf("Error updating NSS cache: %v.", err)
 		}
 
 	}
@@ -183,6 +193,82 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 	return nil
 }
 
+// restartOSLoginServices restarts the services caching users and groups, and
+// reloads sshd, so that they pick up the OS Login configuration.
+func restartOSLoginServices(ctx context.Context) {
+	for _, svc := range []string{"nscd", "unscd", "systemd-logind", "cron", "crond"} {
+		// These services should be restarted if running
+		logfields.Debugf("systemctl try-restart %s, if it exists", svc)
+		if err := systemctlTryRestart(ctx, svc); err != nil {
+			logfields.Errorf("Error restarting service: %v.", err)
+		}
+	}
+
+	// SSH should be started if not running, reloaded otherwise.
+	for _, svc := range []string{"ssh", "sshd"} {
+		logfields.Debugf("systemctl reload-or-restart %s, if it exists", svc)
+		if err := systemctlReloadOrRestart(ctx, svc); err != nil {
+			logfields.Errorf("Error reloading service: %v.", err)
+		}
+	}
+}
+
+// osloginConfigFile is a system configuration file the manager rewrites.
+type osloginConfigFile struct {
+	path string
+	// update returns the file's updated contents.
+	update func(string) string
+}
+
+// osloginConfigFiles returns the sshd, nsswitch, PAM and group configuration
+// files the manager rewrites for the given OS Login settings.
+func osloginConfigFiles(enable, twofactor, skey bool) []osloginConfigFile {
+	return []osloginConfigFile{
+		{"/etc/ssh/sshd_config", func(c string) string { return updateSSHConfig(c, enable, twofactor, skey) }},
+		{"/etc/nsswitch.conf", func(c string) string { return updateNSSwitchConfig(c, enable) }},
+		{"/etc/pam.d/sshd", func(c string) string { return updatePAMsshdPamless(c, enable, twofactor) }},
+		{"/etc/security/group.conf", func(c string) string { return updateGroupConf(c, enable) }},
+	}
+}
+
+// osloginSudoersFile returns the path of the OS Login sudoers configuration.
+func osloginSudoersFile() string {
+	if runtime.GOOS == "freebsd" {
+		return "/usr/local/etc/sudoers.d/google-oslogin"
+	}
+	return "/etc/sudoers.d/google-oslogin"
+}
+
+// Plan returns the lines the manager would rewrite in the sshd, nsswitch, PAM and
+// group configuration files and the OS Login files it would create.
+func (o *osloginMgr) Plan(ctx context.Context) ([]string, error) {
+	enable, twofactor, skey := getOSLoginEnabled(newMetadata)
+
+	var res []string
+	for _, curr := range osloginConfigFiles(enable, twofactor, skey) {
+		contents, err := os.ReadFile(curr.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		res = append(res, planFileChanges(curr.path, string(contents), curr.update(string(contents)))...)
+	}
+
+	if !enable {
+		return res, nil
+	}
+
+	for _, curr := range append(osloginDirs, osloginSudoersFile()) {
+		if _, err := os.Stat(curr); os.IsNotExist(err) {
+			res = append(res, fmt.Sprintf("create %s", curr))
+		}
+	}
+
+	return res, nil
+}
+
 func filterGoogleLines(contents string) []string {
 	var isgoogle, isgoogleblock bool
 	var filtered []string
@@ -205,7 +291,7 @@ func filterGoogleLines(contents string) []string {
 }
 
 func writeConfigFile(path, contents string) error {
-	logger.Debugf("writing %s", path)
+	logfields.Debugf("writing %s", path)
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0777)
 	if err != nil {
 		return err
@@ -267,16 +353,17 @@ func updateSSHConfig(sshConfig string, enable, twofactor, skey bool) string {
 	return strings.Join(filtered, "\n")
 }
 
-func writeSSHConfig(enable, twofactor, skey bool) error {
+// writeSSHConfig updates the sshd configuration, it returns true if it has changed.
+func writeSSHConfig(enable, twofactor, skey bool) (bool, error) {
 	sshConfig, err := os.ReadFile("/etc/ssh/sshd_config")
 	if err != nil {
-		return err
+		return false, err
 	}
 	proposed := updateSSHConfig(string(sshConfig), enable, twofactor, skey)
 	if proposed == string(sshConfig) {
-		return nil
+		return false, nil
 	}
-	return writeConfigFile("/etc/ssh/sshd_config", proposed)
+	return true, writeConfigFile("/etc/ssh/sshd_config", proposed)
 }
 
 func updateNSSwitchConfig(nsswitch string, enable bool) string {
@@ -301,16 +388,18 @@ func updateNSSwitchConfig(nsswitch string, enable bool) string {
 	return strings.Join(filtered, "\n")
 }
 
-func writeNSSwitchConfig(enable bool) error {
+// writeNSSwitchConfig updates the NSS configuration, it returns true if it has
+// changed.
+func writeNSSwitchConfig(enable bool) (bool, error) {
 	nsswitch, err := os.ReadFile("/etc/nsswitch.conf")
 	if err != nil {
-		return err
+		return false, err
 	}
 	proposed := updateNSSwitchConfig(string(nsswitch), enable)
 	if proposed == string(nsswitch) {
-		return nil
+		return false, nil
 	}
-	return writeConfigFile("/etc/nsswitch.conf", proposed)
+	return true, writeConfigFile("/etc/nsswitch.conf", proposed)
 }
 
 func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
@@ -338,20 +427,19 @@ func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
 	return strings.Join(filtered, "\n")
 }
 
-func writePAMConfig(enable, twofactor bool) error {
+// writePAMConfig updates the sshd PAM configuration, it returns true if it has
+// changed.
+func writePAMConfig(enable, twofactor bool) (bool, error) {
 	pamsshd, err := os.ReadFile("/etc/pam.d/sshd")
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	proposed := updatePAMsshdPamless(string(pamsshd), enable, twofactor)
-	if proposed != string(pamsshd) {
-		if err := writeConfigFile("/etc/pam.d/sshd", proposed); err != nil {
-			return err
-		}
+	if proposed == string(pamsshd) {
+		return false, nil
 	}
-
-	return nil
+	return true, writeConfigFile("/etc/pam.d/sshd", proposed)
 }
 
 func updateGroupConf(groupconf string, enable bool) string {
@@ -365,25 +453,29 @@ func updateGroupConf(groupconf string, enable bool) string {
 	return strings.Join(filtered, "\n")
 }
 
-func writeGroupConf(enable bool) error {
+// writeGroupConf updates the pam_group configuration, it returns true if it has
+// changed.
+func writeGroupConf(enable bool) (bool, error) {
 	groupconf, err := os.ReadFile("/etc/security/group.conf")
 	if err != nil {
-		return err
+		return false, err
 	}
 	proposed := updateGroupConf(string(groupconf), enable)
-	if proposed != string(groupconf) {
-		if err := writeConfigFile("/etc/security/group.conf", proposed); err != nil {
-			return err
-		}
+	if proposed == string(groupconf) {
+		return false, nil
 	}
-	return nil
+	return true, writeConfigFile("/etc/security/group.conf", proposed)
 }
 
+// osloginDirs are the directories OS Login caches its users' and sudoers'
+// configuration in.
+var osloginDirs = []string{"/var/google-sudoers.d", "/var/google-users.d"}
+
 // Creates necessary OS Login directories if they don't exist.
 func createOSLoginDirs(ctx context.Context) error {
 	restorecon, restoreconerr := exec.LookPath("restorecon")
 
-	for _, dir := range []string{"/var/google-sudoers.d", "/var/google-users.d"} {
+	for _, dir := range osloginDirs {
 		err := os.Mkdir(dir, 0750)
 		if err != nil && !os.IsExist(err) {
 			return err
@@ -396,11 +488,7 @@ func createOSLoginDirs(ctx context.Context) error {
 }
 
 func createOSLoginSudoersFile() error {
-	osloginSudoers := "/etc/sudoers.d/google-oslogin"
-	if runtime.GOOS == "freebsd" {
-		osloginSudoers = "/usr/local" + osloginSudoers
-	}
-	sudoFile, err := os.OpenFile(osloginSudoers, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0440)
+	sudoFile, err := os.OpenFile(osloginSudoersFile(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0440)
 	if err != nil {
 		if os.IsExist(err) {
 			return nil
@@ -0,0 +1,136 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// runPlanCommand fetches metadata once and prints the changes every enabled manager
+// would make, as if the agent was starting now. It returns the process' exit code.
+func runPlanCommand(ctx context.Context, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "The plan command takes no arguments.\n")
+		return 1
+	}
+
+	// Logs go to stderr only, stdout is reserved to the plan.
+	if err := initCommandLogger(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing logger: %v\n", err)
+		return 1
+	}
+
+	osInfo = osinfo.Get()
+	mdsClient = metadata.New()
+
+	var err error
+	newMetadata, err = mdsClient.Get(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get metadata: %+v\n", err)
+		return 1
+	}
+	oldMetadata = &metadata.Descriptor{}
+	applyConfigOverrides(newMetadata)
+
+	plans, err := managers.plan(ctx, runtime.GOOS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to plan managers: %+v\n", err)
+		return 1
+	}
+
+	return writePlans(os.Stdout, plans)
+}
+
+// initCommandLogger initializes the logger of the commands printing their output
+// to stdout, the logs only go to stderr.
+func initCommandLogger(ctx context.Context) error {
+	opts := logger.LogOpts{
+		LoggerName:          programName,
+		FormatFunction:      logfields.FormatFunction(cfg.Get().Logging.Format, programName, logFormat),
+		Writers:             []io.Writer{os.Stderr},
+		DisableLocalLogging: true,
+		DisableCloudLogging: true,
+		Debug:               os.Getenv("GUEST_AGENT_DEBUG") != "",
+	}
+	return logger.Init(ctx, opts)
+}
+
+// writePlans writes plans to w, it returns 1 if any manager failed to plan, 0
+// otherwise.
+func writePlans(w io.Writer, plans []*managerPlan) int {
+	var res int
+	for _, curr := range plans {
+		fmt.Fprintf(w, "[%s]\n", curr.name)
+		switch {
+		case curr.err != nil:
+			fmt.Fprintf(w, "  failed to plan: %v\n", curr.err)
+			res = 1
+		case curr.disabled:
+			fmt.Fprintf(w, "  disabled\n")
+		case len(curr.changes) == 0:
+			fmt.Fprintf(w, "  no changes\n")
+		default:
+			for _, change := range curr.changes {
+				fmt.Fprintf(w, "  %s\n", change)
+			}
+		}
+	}
+	return res
+}
+
+// planFileChanges returns the lines that would be added to or removed from the file
+// at path if its current contents were replaced by proposed. Blank lines are
+// ignored.
+func planFileChanges(path, current, proposed string) []string {
+	count := make(map[string]int)
+	for _, line := range strings.Split(current, "\n") {
+		count[line]++
+	}
+
+	var added []string
+	for _, line := range strings.Split(proposed, "\n") {
+		if count[line] > 0 {
+			count[line]--
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			added = append(added, line)
+		}
+	}
+
+	var res []string
+	for _, line := range strings.Split(current, "\n") {
+		if count[line] > 0 && strings.TrimSpace(line) != "" {
+			count[line]--
+			res = append(res, fmt.Sprintf("%s: remove line %q", path, line))
+		}
+	}
+	for _, line := range added {
+		res = append(res, fmt.Sprintf("%s: add line %q", path, line))
+	}
+
+	return res
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPlanFileChanges(t *testing.T) {
+	current := "Port 22\n\nPermitRootLogin no\nAllowUsers a\nAllowUsers a\n"
+	proposed := "#### Google OS Login control. Do not edit this section. ####\nPort 22\n\nAllowUsers a\nPasswordAuthentication no\n"
+
+	want := []string{
+		`sshd_config: remove line "PermitRootLogin no"`,
+		`sshd_config: remove line "AllowUsers a"`,
+		`sshd_config: add line "#### Google OS Login control. Do not edit this section. ####"`,
+		`sshd_config: add line "PasswordAuthentication no"`,
+	}
+
+	got := planFileChanges("sshd_config", current, proposed)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("planFileChanges() = %q, want: %q", got, want)
+	}
+
+	if got := planFileChanges("sshd_config", current, current); len(got) != 0 {
+		t.Errorf("planFileChanges() with identical contents = %q, want: empty", got)
+	}
+}
+
+func TestWritePlans(t *testing.T) {
+	plans := []*managerPlan{
+		{name: "address", changes: []string{"add route 10.0.0.2 on eth0"}},
+		{name: "clockskew", disabled: true},
+		{name: "oslogin"},
+		{name: "accounts", err: fmt.Errorf("boom")},
+	}
+
+	want := "[address]\n  add route 10.0.0.2 on eth0\n" +
+		"[clockskew]\n  disabled\n" +
+		"[oslogin]\n  no changes\n" +
+		"[accounts]\n  failed to plan: boom\n"
+
+	var buf bytes.Buffer
+	if got := writePlans(&buf, plans); got != 1 {
+		t.Errorf("writePlans() = %d, want: 1", got)
+	}
+	if buf.String() != want {
+		t.Errorf("writePlans() wrote %q, want: %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+// updateMu serializes runUpdate() and the changes made by the reconciliation runs.
+// The reconciliation jobs only hold it, shared while computing the drift and
+// exclusively while re-applying the state, and skip the run if an update is in
+// progress.
+var updateMu sync.RWMutex
+
+var (
+	// reconcileIntervals are the intervals of the scheduled reconciliation jobs, by
+	// job id.
+	reconcileIntervals = make(map[string]time.Duration)
+
+	// reconcileIntervalsMu protects reconcileIntervals.
+	reconcileIntervalsMu sync.Mutex
+)
+
+// driftManager wraps a manager so that Diff() is ignored and Timeout() reports the
+// drift of the actual system state from the desired one, as computed by Plan().
+type driftManager struct {
+	manager
+	name string
+	// mu, if set, is try-locked, shared by Timeout() and exclusively by Set(), the
+	// calls are skipped if it's not available.
+	mu *sync.RWMutex
+}
+
+// Diff ignores metadata changes, they are handled by runUpdate().
+func (d *driftManager) Diff(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// Timeout returns true if the wrapped manager's Plan() returns changes, i.e. the
+// actual system state has drifted.
+func (d *driftManager) Timeout(ctx context.Context) (bool, error) {
+	if d.mu != nil {
+		if !d.mu.TryRLock() {
+			logfields.Manager(d.name).Debugf("Update in progress, skipping reconciliation")
+			return false, nil
+		}
+		defer d.mu.RUnlock()
+	}
+
+	changes, err := d.Plan(ctx)
+	if err != nil {
+		return false, err
+	}
+	if len(changes) > 0 {
+		logfields.Manager(d.name).Infof("Drift detected, re-applying: %s", strings.Join(changes, "; "))
+	}
+	return len(changes) > 0, nil
+}
+
+// Set re-applies the wrapped manager's state.
+func (d *driftManager) Set(ctx context.Context) error {
+	if d.mu != nil {
+		if !d.mu.TryLock() {
+			logfields.Manager(d.name).Debugf("Update in progress, skipping reconciliation")
+			return nil
+		}
+		defer d.mu.Unlock()
+	}
+	return d.manager.Set(ctx)
+}
+
+// Applied returns the wrapped manager's Applied(), or one if it doesn't implement
+// appliedCounter.
+func (d *driftManager) Applied() int {
+	if counter, ok := d.manager.(appliedCounter); ok {
+		return counter.Applied()
+	}
+	return 1
+}
+
+// reconcileJob is a scheduler job periodically re-applying a manager's state if
+// the actual system state has drifted from it.
+type reconcileJob struct {
+	spec     *managerSpec
+	interval time.Duration
+}
+
+// ID returns the job id.
+func (j *reconcileJob) ID() string {
+	return "reconcile-" + j.spec.name
+}
+
+// Interval returns the reconciliation interval, the first run happens after it.
+func (j *reconcileJob) Interval() (time.Duration, bool) {
+	return j.interval, false
+}
+
+// ShouldEnable returns true if the reconciliation interval is set.
+func (j *reconcileJob) ShouldEnable(ctx context.Context) bool {
+	return j.interval > 0
+}
+
+// Run runs the manager wrapped by a driftManager, unless a previous run of the
+// manager is in progress. It always asks to be rescheduled.
+func (j *reconcileJob) Run(ctx context.Context) (bool, error) {
+	if newMetadata == nil || managerRunning(j.spec.name) {
+		return true, nil
+	}
+
+	runManager(ctx, j.spec.name, &driftManager{manager: j.spec.new(), name: j.spec.name, mu: &updateMu})
+	return true, nil
+}
+
+// reconcileJobs returns a reconciliation job for every manager available on goos
+// with a reconciliation interval set.
+func (r *managerRegistry) reconcileJobs(goos string, config *cfg.Managers) ([]scheduler.Job, error) {
+	specs, err := r.resolve(goos)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []scheduler.Job
+	for _, spec := range specs {
+		interval := managerDuration(config.ReconcileInterval, config.ReconcileIntervals, spec.name)
+		if interval > 0 {
+			res = append(res, &reconcileJob{spec: spec, interval: interval})
+		}
+	}
+	return res, nil
+}
+
+// scheduleReconciliation schedules the reconciliation jobs of the managers
+// available on the running platform. It's called again when the configuration
+// changes, only the jobs whose interval changed are rescheduled and the ones no
+// longer configured are unscheduled.
+func scheduleReconciliation(ctx context.Context, goos string) {
+	jobs, err := managers.reconcileJobs(goos, cfg.Get().Managers)
+	if err != nil {
+		logfields.Errorf("Failed to schedule managers reconciliation: %+v", err)
+		return
+	}
+
+	reconcileIntervalsMu.Lock()
+	defer reconcileIntervalsMu.Unlock()
+
+	sched := scheduler.Get()
+	configured := make(map[string]bool)
+	for _, job := range jobs {
+		configured[job.ID()] = true
+		interval, _ := job.Interval()
+		if curr, found := reconcileIntervals[job.ID()]; found {
+			if curr == interval {
+				continue
+			}
+			sched.UnscheduleJob(job.ID())
+		}
+		if err := sched.ScheduleJob(ctx, job, false); err != nil {
+			logfields.Errorf("Failed to schedule job %s: %+v", job.ID(), err)
+			delete(reconcileIntervals, job.ID())
+			continue
+		}
+		reconcileIntervals[job.ID()] = interval
+	}
+
+	for id := range reconcileIntervals {
+		if !configured[id] {
+			sched.UnscheduleJob(id)
+			delete(reconcileIntervals, id)
+		}
+	}
+}
+
+// reconcile runs, through runFunc, the managers available on goos named in names,
+// or all of them if names is empty, wrapped by a driftManager. Dependencies and
+// conflicts are honored among the selected managers. It fails on unknown names.
+func (r *managerRegistry) reconcile(ctx context.Context, goos string, names []string, runFunc func(context.Context, string, manager)) error {
+	specs, err := r.resolve(goos)
+	if err != nil {
+		return err
+	}
+
+	available := make(map[string]bool)
+	for _, spec := range specs {
+		available[spec.name] = true
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		if !available[name] {
+			return fmt.Errorf("unknown manager %q", name)
+		}
+		selected[name] = true
+	}
+
+	return r.run(ctx, goos, func(ctx context.Context, name string, mgr manager) {
+		if len(selected) > 0 && !selected[name] {
+			return
+		}
+		runFunc(ctx, name, &driftManager{manager: mgr, name: name})
+	})
+}
+
+// reconcileNow immediately reconciles the managers named in names, or all the
+// managers if empty, waiting for any update in progress.
+func reconcileNow(ctx context.Context, names []string) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	if newMetadata == nil {
+		return fmt.Errorf("metadata is not available yet")
+	}
+	return managers.reconcile(ctx, runtime.GOOS, names, runManager)
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestReconcileJobs(t *testing.T) {
+	reg := newTestRegistry(
+		&managerSpec{name: "address"},
+		&managerSpec{name: "accounts"},
+		&managerSpec{name: "clockskew"},
+	)
+	config := &cfg.Managers{ReconcileInterval: 300, ReconcileIntervals: "address:60,clockskew:0"}
+
+	jobs, err := reg.reconcileJobs("linux", config)
+	if err != nil {
+		t.Fatalf("reconcileJobs() failed: %+v", err)
+	}
+
+	want := map[string]time.Duration{
+		"reconcile-accounts": 300 * time.Second,
+		"reconcile-address":  60 * time.Second,
+	}
+	if len(jobs) != len(want) {
+		t.Fatalf("reconcileJobs() returned %d jobs, want: %d", len(jobs), len(want))
+	}
+	for _, job := range jobs {
+		interval, startNow := job.Interval()
+		if interval != want[job.ID()] || startNow {
+			t.Errorf("job %s interval = %s (start now: %t), want: %s", job.ID(), interval, startNow, want[job.ID()])
+		}
+		if !job.ShouldEnable(context.Background()) {
+			t.Errorf("job %s ShouldEnable() = false, want: true", job.ID())
+		}
+	}
+}
+
+func TestReconcileJobRun(t *testing.T) {
+	ctx := context.Background()
+	reloadConfig(t, []byte("[Managers]\nmax_failures = 0\n"))
+
+	if newMetadata == nil {
+		newMetadata = &metadata.Descriptor{}
+		defer func() { newMetadata = nil }()
+	}
+
+	tests := []struct {
+		name      string
+		changes   []string
+		locked    bool
+		wantCalls int
+	}{
+		{name: "drift", changes: []string{"add route 10.0.0.2 on eth0"}, wantCalls: 1},
+		{name: "no-drift", wantCalls: 0},
+		{name: "update-in-progress", changes: []string{"create user foo"}, locked: true, wantCalls: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := &fakeMgr{changes: tc.changes}
+			job := &reconcileJob{
+				spec:     &managerSpec{name: "test-reconcile-" + tc.name, new: func() manager { return mgr }},
+				interval: time.Minute,
+			}
+
+			if tc.locked {
+				updateMu.Lock()
+				defer updateMu.Unlock()
+			}
+
+			reschedule, err := job.Run(ctx)
+			if err != nil || !reschedule {
+				t.Errorf("Run() = (%t, %v), want: (true, nil)", reschedule, err)
+			}
+			if mgr.setCalls != tc.wantCalls {
+				t.Errorf("Run() called Set() %d times, want: %d", mgr.setCalls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconcileManagers(t *testing.T) {
+	reg := newTestRegistry(
+		&managerSpec{name: "address"},
+		&managerSpec{name: "accounts", dependencies: []string{"address"}},
+		&managerSpec{name: "clockskew"},
+	)
+
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr string
+	}{
+		{name: "all", want: []string{"accounts", "address", "clockskew"}},
+		{name: "selected", names: []string{"accounts"}, want: []string{"accounts"}},
+		{name: "unknown", names: []string{"accounts", "foo"}, wantErr: `unknown manager "foo"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []string
+
+			err := reg.reconcile(context.Background(), "linux", tc.names, func(ctx context.Context, name string, mgr manager) {
+				if _, ok := mgr.(*driftManager); !ok {
+					t.Errorf("reconcile() ran %s as %T, want a *driftManager", name, mgr)
+				}
+				mu.Lock()
+				got = append(got, name)
+				mu.Unlock()
+			})
+
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("reconcile(%v) returned error: %v, want: %s", tc.names, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reconcile(%v) failed: %+v", tc.names, err)
+			}
+
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("reconcile(%v) ran %v, want: %v", tc.names, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDriftManagerLock(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.RWMutex
+	mgr := &fakeMgr{changes: []string{"add route 10.0.0.2 on eth0"}}
+	drift := &driftManager{manager: mgr, name: "test-drift-lock", mu: &mu}
+
+	// A concurrent reader doesn't prevent the drift detection, but the state isn't
+	// re-applied until it's done.
+	mu.RLock()
+	if timeout, err := drift.Timeout(ctx); err != nil || !timeout {
+		t.Errorf("Timeout() = (%t, %v), want: (true, nil)", timeout, err)
+	}
+	if err := drift.Set(ctx); err != nil || mgr.setCalls != 0 {
+		t.Errorf("Set() = %v, called Set() %d times, want: nil, 0 times", err, mgr.setCalls)
+	}
+	mu.RUnlock()
+
+	if err := drift.Set(ctx); err != nil || mgr.setCalls != 1 {
+		t.Errorf("Set() = %v, called Set() %d times, want: nil, once", err, mgr.setCalls)
+	}
+
+	// The lock is only held during the calls.
+	if !mu.TryLock() {
+		t.Fatalf("driftManager didn't release its lock")
+	}
+	mu.Unlock()
+}
+
+func TestClockskewPlan(t *testing.T) {
+	oldNew, oldOld, oldSynced := newMetadata, oldMetadata, syncedDriftToken
+	t.Cleanup(func() { newMetadata, oldMetadata, syncedDriftToken = oldNew, oldOld, oldSynced })
+
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.VirtualClock.DriftToken = 2
+	// The metadata change was already handled, but the clock sync failed.
+	oldMetadata = newMetadata
+	syncedDriftToken = 1
+
+	mgr := &clockskewMgr{}
+	changes, err := mgr.Plan(context.Background())
+	if err != nil || len(changes) == 0 {
+		t.Errorf("Plan() = (%v, %v), want: the clock sync", changes, err)
+	}
+
+	syncedDriftToken = 2
+	if changes, err := mgr.Plan(context.Background()); err != nil || len(changes) != 0 {
+		t.Errorf("Plan() = (%v, %v), want: no changes", changes, err)
+	}
+}
+
+func TestScheduleReconciliation(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(func() {
+		reloadConfig(t, []byte("[Managers]\nreconcile_interval = 0\n"))
+		scheduleReconciliation(ctx, "linux")
+	})
+
+	reloadConfig(t, []byte("[Managers]\nreconcile_interval = 3600\n"))
+	scheduleReconciliation(ctx, "linux")
+	if got := reconcileIntervals["reconcile-clockskew"]; got != time.Hour {
+		t.Fatalf("reconcile-clockskew interval = %s, want: %s", got, time.Hour)
+	}
+
+	reloadConfig(t, []byte("[Managers]\nreconcile_interval = 3600\nreconcile_intervals = clockskew:0,address:7200\n"))
+	scheduleReconciliation(ctx, "linux")
+	if _, found := reconcileIntervals["reconcile-clockskew"]; found {
+		t.Errorf("reconcile-clockskew is still scheduled, want: unscheduled")
+	}
+	if got := reconcileIntervals["reconcile-address"]; got != 2*time.Hour {
+		t.Errorf("reconcile-address interval = %s, want: %s", got, 2*time.Hour)
+	}
+
+	scheduled := make(map[string]bool)
+	for _, job := range scheduler.Get().Jobs() {
+		scheduled[job.ID] = true
+	}
+	for id := range reconcileIntervals {
+		if !scheduled[id] {
+			t.Errorf("job %s isn't scheduled", id)
+		}
+	}
+	if scheduled["reconcile-clockskew"] {
+		t.Errorf("job reconcile-clockskew is scheduled, want: unscheduled")
+	}
+}
@@ -23,7 +23,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 // Result wraps a command execution result.
@@ -94,7 +94,7 @@ func WithCombinedOutput(ctx context.Context, name string, args ...string) *Resul
 func execCommand(cmd *exec.Cmd) *Result {
 	var stdout, stderr bytes.Buffer
 
-	logger.Debugf("exec: %v", cmd)
+	logfields.Debugf("exec: %v", cmd)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
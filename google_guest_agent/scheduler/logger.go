@@ -15,15 +15,15 @@
 package scheduler
 
 import (
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 type cronLogger struct{}
 
 func (cl *cronLogger) Info(msg string, keysAndValues ...any) {
-	logger.Infof("Scheduler - %s: %+v", msg, keysAndValues)
+	logfields.Infof("Scheduler - %s: %+v", msg, keysAndValues)
 }
 
 func (cl *cronLogger) Error(err error, msg string, keysAndValues ...any) {
-	logger.Infof("Scheduler - %s: %+v", msg, keysAndValues)
+	logfields.Infof("Scheduler - %s: %+v", msg, keysAndValues)
 }
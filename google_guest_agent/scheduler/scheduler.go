@@ -18,13 +18,18 @@ package scheduler
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"github.com/GoogleCloudPlatform/guest-agent/metrics"
 	"github.com/robfig/cron/v3"
 )
 
+var jobRuns = metrics.NewCounter("guest_agent_scheduler_job_runs_total",
+	"Number of scheduled job runs by job and result (success or error).", "job", "result")
+
 // Job defines the interface between the schedule manager and the actual job.
 type Job interface {
 	// ID returns the job id.
@@ -69,13 +74,16 @@ func Get() *Scheduler {
 // getFunc generates a wrapper function for cron scheduler.
 func (s *Scheduler) getFunc(ctx context.Context, job Job) func() {
 	f := func() {
-		logger.Infof("Invoking job %q", job.ID())
+		logfields.Infof("Invoking job %q", job.ID())
 		schedule, err := job.Run(ctx)
 		if !schedule {
 			s.UnscheduleJob(job.ID())
 		}
 		if err != nil {
-			logger.Errorf("Failed to execute job %s: %v", job.ID(), err)
+			jobRuns.Inc(job.ID(), "error")
+			logfields.Errorf("Failed to execute job %s: %v", job.ID(), err)
+		} else {
+			jobRuns.Inc(job.ID(), "success")
 		}
 	}
 	return f
@@ -87,7 +95,7 @@ func (s *Scheduler) ScheduleJob(ctx context.Context, job Job, synchronous bool)
 		return fmt.Errorf("ShouldEnable() returned false, cannot schedule job %s", job.ID())
 	}
 
-	logger.Infof("Scheduling job: %s", job.ID())
+	logfields.Infof("Scheduling job: %s", job.ID())
 
 	interval, startNow := job.Interval()
 	if err := s.jobInit(job.ID(), interval, s.getFunc(ctx, job), startNow, synchronous); err != nil {
@@ -97,32 +105,32 @@ func (s *Scheduler) ScheduleJob(ctx context.Context, job Job, synchronous bool)
 	return nil
 }
 
-func (s *Scheduler) setEntryID(jobID string, entryID cron.EntryID) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.jobs[jobID] = entryID
-}
-
 // jobInit adds job to the schedule to run at specified interval.
 // Setting startImmediately to true executes first run immediately, otherwise
 // first run will be after interval (at now+interval).
 // If startImmediately and synchronous both are true, init method will block
 // until job is completed.
 func (s *Scheduler) jobInit(jobID string, interval time.Duration, job func(), startImmediately, synchronous bool) error {
-	logger.Infof("Scheduling job %q to run at %f hr interval", jobID, interval.Hours())
+	logfields.Infof("Scheduling job %q to run at %f hr interval", jobID, interval.Hours())
 
+	// The lookup and the addition are atomic, concurrent calls don't schedule the
+	// job twice.
+	s.mu.Lock()
 	_, found := s.jobs[jobID]
 	// If found, job is already running, return.
 	if found {
-		logger.Infof("Skipping, job %q is already scheduled", jobID)
+		s.mu.Unlock()
+		logfields.Infof("Skipping, job %q is already scheduled", jobID)
 		return nil
 	}
 
 	entry, err := s.cron.AddFunc(fmt.Sprintf("@every %ds", int(interval.Seconds())), job)
 	if err != nil {
+		s.mu.Unlock()
 		return fmt.Errorf("unable to schedule %q: %w", jobID, err)
 	}
-	s.setEntryID(jobID, entry)
+	s.jobs[jobID] = entry
+	s.mu.Unlock()
 
 	if startImmediately {
 		if synchronous {
@@ -138,27 +146,68 @@ func (s *Scheduler) jobInit(jobID string, interval time.Duration, job func(), st
 
 // UnscheduleJob removes the job from schedule.
 func (s *Scheduler) UnscheduleJob(jobID string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	logger.Infof("Unscheduling job %q", jobID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	entry, found := s.jobs[jobID]
 	if found {
+		logfields.Debugf("Unscheduling job %q", jobID)
 		s.cron.Remove(entry)
 		delete(s.jobs, jobID)
 	}
 }
 
+// JobStatus describes a scheduled job.
+type JobStatus struct {
+	// ID is the job id.
+	ID string `json:"id"`
+	// Next is the time the job will run next.
+	Next time.Time `json:"next"`
+	// Prev is the last time the job ran, zero if it hasn't run yet.
+	Prev time.Time `json:"prev"`
+}
+
+// Jobs returns the status of the scheduled jobs sorted by id.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var res []JobStatus
+	for id, entryID := range s.jobs {
+		entry := s.cron.Entry(entryID)
+		res = append(res, JobStatus{ID: id, Next: entry.Next, Prev: entry.Prev})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Ping returns an error if the scheduler's run loop doesn't respond before ctx is
+// done, i.e. it is stuck and jobs aren't run anymore.
+func (s *Scheduler) Ping(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		// Entries() is answered by the run loop while the scheduler is running.
+		s.cron.Entries()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("scheduler is not responding: %w", ctx.Err())
+	}
+}
+
 // start begins executing each job at defined interval.
 func (s *Scheduler) start() {
-	logger.Infof("Starting the scheduler to run jobs")
+	logfields.Infof("Starting the scheduler to run jobs")
 	s.cron.Start()
 }
 
 // Stop stops executing new jobs.
 func (s *Scheduler) Stop() {
-	logger.Infof("Stopping the scheduler")
+	logfields.Infof("Stopping the scheduler")
 	s.cron.Stop()
 }
 
@@ -174,15 +223,15 @@ func ScheduleJobs(ctx context.Context, jobs []Job, synchronous bool) {
 		go func(job Job) {
 			defer wg.Done()
 			if err := sched.ScheduleJob(ctx, job, synchronous); err != nil {
-				logger.Errorf("Failed to schedule job %s with error: %v", job.ID(), err)
+				logfields.Errorf("Failed to schedule job %s with error: %v", job.ID(), err)
 			} else {
-				logger.Infof("Successfully scheduled job %s", job.ID())
+				logfields.Infof("Successfully scheduled job %s", job.ID())
 			}
 		}(job)
 	}
 
 	if synchronous {
-		logger.Debugf("Waiting for %v to finish...", ids)
+		logfields.Debugf("Waiting for %v to finish...", ids)
 		wg.Wait()
 	}
 }
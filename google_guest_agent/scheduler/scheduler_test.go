@@ -150,6 +150,10 @@ func TestStopSchedule(t *testing.T) {
 	if job.ctr > 3 {
 		t.Errorf("Scheduler failed to stop the job, counter value found %d, should have stopped after max 3", job.ctr)
 	}
+
+	if got := jobRuns.Value(job.ID(), "success"); got < 2 {
+		t.Errorf("jobRuns(%s, success) = %v, want at least 2", job.ID(), got)
+	}
 }
 
 func TestScheduleJobError(t *testing.T) {
@@ -209,3 +213,40 @@ func TestScheduleJobsNoWait(t *testing.T) {
 		t.Errorf("ScheduleJobs(ctx, job1, true) returned after %f seconds, expected no wait", got.Seconds())
 	}
 }
+
+func TestJobs(t *testing.T) {
+	job := &testJob{
+		interval:     time.Minute,
+		id:           "test_jobs_listing",
+		shouldEnable: true,
+	}
+	s := Get()
+	defer s.UnscheduleJob(job.ID())
+
+	if err := s.ScheduleJob(context.Background(), job, false); err != nil {
+		t.Fatalf("ScheduleJob(ctx, %s) failed unexpectedly with error: %v", job.ID(), err)
+	}
+
+	for _, curr := range s.Jobs() {
+		if curr.ID != job.ID() {
+			continue
+		}
+		if curr.Next.IsZero() {
+			t.Errorf("Jobs() returned %s with no next run time", job.ID())
+		}
+		if !curr.Prev.IsZero() {
+			t.Errorf("Jobs() returned %s with previous run at %v, want none", job.ID(), curr.Prev)
+		}
+		return
+	}
+	t.Errorf("Jobs() didn't return scheduled job %s", job.ID())
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := Get().Ping(ctx); err != nil {
+		t.Errorf("Ping() failed unexpectedly with error: %v", err)
+	}
+}
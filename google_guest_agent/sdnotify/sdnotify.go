@@ -0,0 +1,87 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sdnotify implements the systemd service manager notification protocol,
+// see sd_notify(3).
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Ready tells the service manager the service startup is finished.
+	Ready = "READY=1"
+	// Stopping tells the service manager the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the service manager's watchdog from restarting the service.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state describing the service's status as status, it's a
+// single human readable line.
+func Status(status string) string {
+	return "STATUS=" + strings.ReplaceAll(status, "\n", " ")
+}
+
+// Notify sends the states to the service manager over the NOTIFY_SOCKET
+// datagram socket. It returns false if NOTIFY_SOCKET is not set, i.e. the
+// process isn't run by systemd or the service isn't a notify one.
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// Names starting with @ are abstract sockets.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, fmt.Errorf("failed to write to notify socket: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval at which Watchdog must be sent, half of
+// the service's WatchdogSec, or 0 if the service manager's watchdog is not
+// enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(value) * time.Microsecond / 2, nil
+}
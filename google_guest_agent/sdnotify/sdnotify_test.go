@@ -0,0 +1,91 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets are not supported on windows")
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Errorf("Notify() without NOTIFY_SOCKET = %t, %v, want: false, nil", sent, err)
+	}
+
+	// Unix domain socket paths are limited to ~100 characters, t.TempDir() may be
+	// too long.
+	dir, err := os.MkdirTemp("", "sdnotify")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %+v", path, err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if sent, err := Notify(Ready, Status("Running\nmanagers")); !sent || err != nil {
+		t.Fatalf("Notify() = %t, %v, want: true, nil", sent, err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read from %s: %+v", path, err)
+	}
+	if got, want := string(buf[:n]), "READY=1\nSTATUS=Running managers"; got != want {
+		t.Errorf("Notify() sent %q, want: %q", got, want)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{usec: "", want: 0},
+		{usec: "60000000", want: 30 * time.Second},
+		{usec: "60000000", pid: strconv.Itoa(os.Getpid()), want: 30 * time.Second},
+		{usec: "60000000", pid: "1", want: 0},
+		{usec: "foo", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+
+		got, err := WatchdogInterval()
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("WatchdogInterval() with WATCHDOG_USEC=%q WATCHDOG_PID=%q = %s, %v, want: %s, error: %t",
+				tc.usec, tc.pid, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
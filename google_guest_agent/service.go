@@ -40,7 +40,10 @@ func (p *program) Start(s service.Service) error {
 	return nil
 }
 
+// Stop tells systemd the agent is stopping, before the process may exit, and
+// waits for run to return.
 func (p *program) Stop(s service.Service) error {
+	notifyStopping()
 	p.cancel()
 	select {
 	case <-p.done:
@@ -56,7 +59,11 @@ func usage(name string) {
 			"  %[1]s install: install the %[2]s service\n"+
 			"  %[1]s remove: remove the %[2]s service\n"+
 			"  %[1]s start: start the %[2]s service\n"+
-			"  %[1]s stop: stop the %[2]s service\n", filepath.Base(os.Args[0]), name)
+			"  %[1]s stop: stop the %[2]s service\n"+
+			"  %[1]s config validate [file...]: validate the configuration files\n"+
+			"  %[1]s config show [--format=ini|json]: print the effective configuration\n"+
+			"  %[1]s plan: print the changes the managers would make without applying them\n"+
+			"  %[1]s ctl status|reconcile|reload|events: control the running agent\n", filepath.Base(os.Args[0]), name)
 }
 
 func register(ctx context.Context, name, displayName, desc string, run func(context.Context), action string) error {
@@ -0,0 +1,133 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/sdnotify"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+)
+
+var (
+	// serviceStatus is the agent's current phase, reported to systemd as STATUS.
+	serviceStatus   string
+	serviceStatusMu sync.Mutex
+
+	// stoppingOnce makes sure STOPPING is only sent once, the stop paths may race.
+	stoppingOnce sync.Once
+)
+
+// notify sends states to systemd, if the agent is run as a notify service.
+func notify(states ...string) {
+	if _, err := sdnotify.Notify(states...); err != nil {
+		logfields.Warningf("Failed to notify systemd: %v", err)
+	}
+}
+
+// notifyStatus records status, a human readable description of the agent's
+// current phase, and reports it to systemd.
+func notifyStatus(format string, v ...interface{}) {
+	status := fmt.Sprintf(format, v...)
+
+	serviceStatusMu.Lock()
+	serviceStatus = status
+	serviceStatusMu.Unlock()
+
+	notify(sdnotify.Status(status))
+}
+
+// notifyReady tells systemd the agent has finished its startup.
+func notifyReady() {
+	logfields.Debugf("notify systemd")
+	notifyStatus("Waiting for metadata changes")
+	notify(sdnotify.Ready)
+}
+
+// notifyStopping tells systemd the agent is shutting down, only the first call
+// notifies.
+func notifyStopping() {
+	stoppingOnce.Do(func() {
+		notifyStatus("Stopping")
+		notify(sdnotify.Stopping)
+	})
+}
+
+// checkLiveness returns an error if the events dispatcher has been dispatching
+// the same event for longer than dispatchTimeout at now, i.e. a subscriber's
+// callback is stuck, or if the scheduler doesn't respond to ping.
+func checkLiveness(ctx context.Context, now time.Time, dispatchTimeout time.Duration,
+	dispatching func() (string, time.Time), ping func(context.Context) error) error {
+
+	if evType, since := dispatching(); evType != "" && dispatchTimeout > 0 && now.Sub(since) > dispatchTimeout {
+		return fmt.Errorf("events dispatcher stuck on a %s event for %s", evType, now.Sub(since).Round(time.Second))
+	}
+	if err := ping(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startWatchdog pings the systemd watchdog, if it's enabled for the agent, as
+// long as the events dispatcher and the scheduler are alive. systemd restarts
+// the agent once the pings stop.
+func startWatchdog(ctx context.Context) {
+	interval, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		logfields.Errorf("Failed to get the systemd watchdog interval: %v", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	logfields.Infof("Pinging the systemd watchdog every %s", interval)
+	eventManager, sched := events.Get(), scheduler.Get()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			dispatchTimeout := time.Duration(cfg.Get().Watchdog.DispatchTimeout) * time.Second
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			err := checkLiveness(pingCtx, time.Now(), dispatchTimeout, eventManager.Dispatching, sched.Ping)
+			cancel()
+
+			if err != nil {
+				logfields.Errorf("Agent is unhealthy, not pinging the systemd watchdog: %v", err)
+				notify(sdnotify.Status(fmt.Sprintf("Unhealthy: %v", err)))
+				continue
+			}
+
+			serviceStatusMu.Lock()
+			status := serviceStatus
+			serviceStatusMu.Unlock()
+			// The status is sent again as it may have been replaced by an unhealthy one.
+			notify(sdnotify.Watchdog, sdnotify.Status(status))
+		}
+	}()
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckLiveness(t *testing.T) {
+	now := time.Now()
+	alive := func(context.Context) error { return nil }
+	stuck := func(context.Context) error { return fmt.Errorf("scheduler is not responding") }
+
+	tests := []struct {
+		name    string
+		evType  string
+		since   time.Time
+		timeout time.Duration
+		ping    func(context.Context) error
+		wantErr string
+	}{
+		{name: "idle", ping: alive},
+		{name: "dispatching", evType: "metadata", since: now.Add(-time.Minute), timeout: time.Hour, ping: alive},
+		{name: "dispatch-stuck", evType: "metadata", since: now.Add(-2 * time.Hour), timeout: time.Hour, ping: alive,
+			wantErr: "events dispatcher stuck on a metadata event for 2h0m0s"},
+		{name: "dispatch-timeout-disabled", evType: "metadata", since: now.Add(-2 * time.Hour), ping: alive},
+		{name: "scheduler-stuck", ping: stuck, wantErr: "scheduler is not responding"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dispatching := func() (string, time.Time) { return tc.evType, tc.since }
+			err := checkLiveness(context.Background(), now, tc.timeout, dispatching, tc.ping)
+
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("checkLiveness() failed unexpectedly with error: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("checkLiveness() returned error: %v, want: %s", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestProgramStopNotifiesStopping(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unixgram sockets are not supported on windows")
+	}
+
+	// Unix domain socket paths are limited to ~100 characters, t.TempDir() may be
+	// too long.
+	dir, err := os.MkdirTemp("", "notify")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %+v", path, err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	stoppingOnce = sync.Once{}
+	t.Cleanup(func() { stoppingOnce = sync.Once{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prg := &program{
+		run:     func(ctx context.Context) { <-ctx.Done() },
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		timeout: 5 * time.Second,
+	}
+	if err := prg.Start(nil); err != nil {
+		t.Fatalf("Start() = %v, want: nil", err)
+	}
+	if err := prg.Stop(nil); err != nil {
+		t.Fatalf("Stop() = %v, want: nil", err)
+	}
+	// Only the first call notifies.
+	notifyStopping()
+
+	var got []string
+	buf := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+
+	want := []string{"STATUS=Stopping", "STOPPING=1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Stop() notified %q, want: %q", got, want)
+	}
+}
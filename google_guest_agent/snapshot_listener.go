@@ -23,7 +23,7 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	sspb "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/snapshot_service"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/golang/groupcache/lru"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -47,7 +47,7 @@ func getSnapshotConfig(timeoutInSeconds int) (snapshotConfig, error) {
 }
 
 func runScript(ctx context.Context, path, disks string, config snapshotConfig) (int, sspb.AgentErrorCode) {
-	logger.Infof("Running guest consistent snapshot script at: %s.", path)
+	logfields.Infof("Running guest consistent snapshot script at: %s.", path)
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return -1, sspb.AgentErrorCode_SCRIPT_NOT_FOUND
@@ -68,10 +68,10 @@ func runScript(ctx context.Context, path, disks string, config snapshotConfig) (
 func listenForSnapshotRequests(ctx context.Context, address string, requestChan chan<- *sspb.GuestMessage) {
 	for leaving := false; !leaving; {
 		// Start hanging connection on server that feeds to channel
-		logger.Infof("Attempting to connect to snapshot service at %s.", address)
+		logfields.Infof("Attempting to connect to snapshot service at %s.", address)
 		conn, err := grpc.Dial(address, grpc.WithInsecure())
 		if err != nil {
-			logger.Errorf("Failed to connect to snapshot service: %v.", err)
+			logfields.Errorf("Failed to connect to snapshot service: %v.", err)
 			return
 		}
 
@@ -82,7 +82,7 @@ func listenForSnapshotRequests(ctx context.Context, address string, requestChan
 		}
 		r, err := c.CreateConnection(ctx, &guestReady)
 		if err != nil {
-			logger.Errorf("Error creating connection: %v.", err)
+			logfields.Errorf("Error creating connection: %v.", err)
 			leaving = errors.Is(err, context.Canceled)
 			cancel()
 			continue
@@ -90,11 +90,11 @@ func listenForSnapshotRequests(ctx context.Context, address string, requestChan
 		for {
 			request, err := r.Recv()
 			if err != nil {
-				logger.Errorf("Error reading snapshot request: %v.", err)
+				logfields.Errorf("Error reading snapshot request: %v.", err)
 				cancel()
 				break
 			}
-			logger.Infof("Received snapshot request.")
+			logfields.Infof("Received snapshot request.")
 			requestChan <- request
 		}
 	}
@@ -116,32 +116,40 @@ func getSnapshotResponse(ctx context.Context, timeoutInSeconds int, guestMessage
 
 		}
 
-		var url string
+		var url, hook string
 		switch request.GetType() {
 		case sspb.OperationType_PRE_SNAPSHOT:
-			logger.Infof("Handling pre snapshot request for operation id %d.", request.GetOperationId())
+			logfields.Infof("Handling pre snapshot request for operation id %d.", request.GetOperationId())
 			_, found := seenPreSnapshotOperationIds.Get(request.GetOperationId())
 			if found {
-				logger.Infof("Duplicate pre snapshot request operation id %d.", request.GetOperationId())
+				logfields.Infof("Duplicate pre snapshot request operation id %d.", request.GetOperationId())
 				return nil
 			}
 			seenPreSnapshotOperationIds.Add(request.GetOperationId(), request.GetOperationId())
 			url = scriptsDir + "pre.sh"
+			hook = "pre"
 		case sspb.OperationType_POST_SNAPSHOT:
-			logger.Infof("Handling post snapshot request for operation id %d.", request.GetOperationId())
+			logfields.Infof("Handling post snapshot request for operation id %d.", request.GetOperationId())
 			_, found := seenPostSnapshotOperationIds.Get(request.GetOperationId())
 			if found {
-				logger.Infof("Duplicate post snapshot request operation id %d.", request.GetOperationId())
+				logfields.Infof("Duplicate post snapshot request operation id %d.", request.GetOperationId())
 				return nil
 			}
 			seenPostSnapshotOperationIds.Add(request.GetOperationId(), request.GetOperationId())
 			url = scriptsDir + "post.sh"
+			hook = "post"
 		default:
-			logger.Errorf("Unhandled operation type %d.", request.GetType())
+			logfields.Errorf("Unhandled operation type %d.", request.GetType())
 			return nil
 		}
 
+		start := time.Now()
 		scriptsReturnCode, agentErrorCode := runScript(ctx, url, request.GetDiskList(), config)
+		result := "success"
+		if agentErrorCode != sspb.AgentErrorCode_NO_ERROR {
+			result = "error"
+		}
+		snapshotHookDuration.Observe(time.Since(start).Seconds(), hook, result)
 		response.ScriptsReturnCode = int32(scriptsReturnCode)
 		response.AgentReturnCode = agentErrorCode
 
@@ -155,7 +163,7 @@ func handleSnapshotRequests(ctx context.Context, timeoutInSeconds int, address s
 	for {
 		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 		if err != nil {
-			logger.Errorf("Failed to connect to snapshot service: %v.", err)
+			logfields.Errorf("Failed to connect to snapshot service: %v.", err)
 			return
 		}
 		for {
@@ -170,7 +178,7 @@ func handleSnapshotRequests(ctx context.Context, timeoutInSeconds int, address s
 			}
 
 			for i := 0; i < maxRequestHandleAttempts; i++ {
-				logger.Infof("Attempt %d/%d of handling snapshot request.", i+1, maxRequestHandleAttempts)
+				logfields.Infof("Attempt %d/%d of handling snapshot request.", i+1, maxRequestHandleAttempts)
 
 				c := sspb.NewSnapshotServiceClient(conn)
 				ctx, cancel := context.WithCancel(ctx)
@@ -178,12 +186,12 @@ func handleSnapshotRequests(ctx context.Context, timeoutInSeconds int, address s
 
 				_, err = c.HandleResponsesFromGuest(ctx, response)
 				if err != nil {
-					logger.Errorf("Error sending response: %v.", err)
+					logfields.Errorf("Error sending response: %v.", err)
 					time.Sleep(1 * time.Second) // Avoid idle looping
 					continue
 				}
 
-				logger.Debugf("Successfully handled snapshot request.")
+				logfields.Debugf("Successfully handled snapshot request.")
 				break
 			}
 		}
@@ -22,8 +22,8 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/sshtrustedca"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 // Certificates wrapps a list of certificate authorities.
@@ -58,7 +58,7 @@ func Close() {
 func writeFile(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
 	// There was some error on the pipe watcher, just ignore it.
 	if evData.Error != nil {
-		logger.Debugf("Not handling ssh trusted ca cert event, we got an error: %+v", evData.Error)
+		logfields.Debugf("Not handling ssh trusted ca cert event, we got an error: %+v", evData.Error)
 		return true
 	}
 
@@ -66,14 +66,14 @@ func writeFile(ctx context.Context, evType string, data interface{}, evData *eve
 	pipeData := evData.Data.(*sshtrustedca.PipeData)
 	defer func() {
 		if err := pipeData.File.Close(); err != nil {
-			logger.Errorf("Failed to close pipe: %+v", err)
+			logfields.Errorf("Failed to close pipe: %+v", err)
 		}
 		pipeData.Finished()
 	}()
 
 	certificate, err := mdsClient.GetKey(ctx, "oslogin/certificates", nil)
 	if err != nil {
-		logger.Errorf("Failed to get certificate from metadata server: %+v", err)
+		logfields.Errorf("Failed to get certificate from metadata server: %+v", err)
 		return true
 	}
 
@@ -82,7 +82,7 @@ func writeFile(ctx context.Context, evType string, data interface{}, evData *eve
 	var outData []string
 
 	if err := json.Unmarshal([]byte(certificate), &certs); err != nil {
-		logger.Errorf("Failed to unmarshal certificate json: %+v", err)
+		logfields.Errorf("Failed to unmarshal certificate json: %+v", err)
 		return true
 	}
 
@@ -93,12 +93,12 @@ func writeFile(ctx context.Context, evType string, data interface{}, evData *eve
 	outStr := strings.Join(outData, "\n")
 	n, err := pipeData.File.WriteString(outStr)
 	if err != nil {
-		logger.Errorf("Failed to write certificate to the write end of the pipe: %+v", err)
+		logfields.Errorf("Failed to write certificate to the write end of the pipe: %+v", err)
 		return true
 	}
 
 	if n != len(outStr) {
-		logger.Errorf("Wrote the wrong ammout of data, wrote %d bytes instead of %d bytes", n, len(certificate))
+		logfields.Errorf("Wrote the wrong ammout of data, wrote %d bytes instead of %d bytes", n, len(certificate))
 	}
 
 	return true
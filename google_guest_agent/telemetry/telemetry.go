@@ -20,8 +20,8 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
@@ -63,7 +63,7 @@ func formatGuestAgent(d Data) string {
 		Architecture: &d.AgentArch,
 	})
 	if err != nil {
-		logger.Warningf("Error marshalling AgentInfo: %v", err)
+		logfields.Warningf("Error marshalling AgentInfo: %v", err)
 	}
 	return base64.StdEncoding.EncodeToString(data)
 }
@@ -78,7 +78,7 @@ func formatGuestOS(d Data) string {
 		KernelRelease: &d.KernelRelease,
 	})
 	if err != nil {
-		logger.Warningf("Error marshalling AgentInfo: %v", err)
+		logfields.Warningf("Error marshalling AgentInfo: %v", err)
 	}
 	return base64.StdEncoding.EncodeToString(data)
 }
@@ -132,7 +132,7 @@ func (j *Job) Run(ctx context.Context) (bool, error) {
 	}
 	if err := Record(ctx, j.client, d); err != nil {
 		// Log this here in Debug mode as telemetry is best effort.
-		logger.Debugf("Error recording telemetry: %v", err)
+		logfields.Debugf("Error recording telemetry: %v", err)
 	}
 
 	return j.ShouldEnable(ctx), nil
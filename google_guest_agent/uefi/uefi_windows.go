@@ -22,7 +22,7 @@ import (
 
 	"golang.org/x/sys/windows"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 var (
@@ -87,7 +87,7 @@ type TOKEN_PRIVILEGES struct {
 // ReadVariable reads UEFI variable and returns as byte array.
 // Throws an error if variable is invalid or empty.
 func ReadVariable(v VariableName) (*Variable, error) {
-	logger.Debugf("Enabling required %s priviliges for agent process", SE_SYSTEM_ENVIRONMENT_NAME)
+	logfields.Debugf("Enabling required %s priviliges for agent process", SE_SYSTEM_ENVIRONMENT_NAME)
 	if err := enablePrivilege(SE_SYSTEM_ENVIRONMENT_NAME); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,120 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/accounts"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+const (
+	// uidPolicySystem lets the accounts backend allocate the next free UID.
+	uidPolicySystem = "system"
+	// uidPolicyHash derives the UID from a hash of the username.
+	uidPolicyHash = "hash"
+	// uidPolicyMetadata reads the UID from the guest-agent-user-ids attribute.
+	uidPolicyMetadata = "metadata"
+)
+
+// parseUserIDs parses the guest-agent-user-ids metadata attribute, a newline
+// separated list of USER:UID entries. Invalid entries are returned as errors,
+// the valid ones are applied anyway.
+func parseUserIDs(value string, ids map[string]int) []error {
+	var errs []error
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, uid, found := strings.Cut(line, ":")
+		id, err := strconv.Atoi(strings.TrimSpace(uid))
+		if !found || name == "" || err != nil || id <= 0 {
+			errs = append(errs, fmt.Errorf("invalid user ID entry %q, want USER:UID", line))
+			continue
+		}
+		ids[name] = id
+	}
+	return errs
+}
+
+// getUserIDs returns the UIDs assigned by the instance's or, unless project
+// keys are blocked, the project's guest-agent-user-ids attribute. The
+// instance's UIDs take precedence.
+func getUserIDs(md *metadata.Descriptor) (map[string]int, []error) {
+	ids := make(map[string]int)
+	var errs []error
+	if !md.Instance.Attributes.BlockProjectKeys {
+		errs = append(errs, parseUserIDs(md.Project.Attributes.UserIDs, ids)...)
+	}
+	errs = append(errs, parseUserIDs(md.Instance.Attributes.UserIDs, ids)...)
+	return ids, errs
+}
+
+// googleUserUID returns the UID the Google user name is created with according
+// to the [Accounts] uid_policy, ids are the UIDs assigned by metadata. An empty
+// UID lets the accounts backend allocate one. A metadata UID must be within
+// uid_range and not below protected_uid_threshold, metadata can't give a user
+// the UID of a system user.
+func googleUserUID(config *cfg.Accounts, name string, ids map[string]int) (string, error) {
+	switch config.UIDPolicy {
+	case uidPolicyMetadata:
+		id, found := ids[name]
+		if !found {
+			return "", nil
+		}
+		min, max, err := accounts.ParseIDRange(config.UIDRange)
+		if err != nil {
+			return "", fmt.Errorf("invalid uid_range: %w", err)
+		}
+		if id < min || id > max {
+			return "", fmt.Errorf("metadata UID %d of user %s is outside uid_range %s", id, name, config.UIDRange)
+		}
+		if config.ProtectedUIDThreshold > 0 && id < config.ProtectedUIDThreshold {
+			return "", fmt.Errorf("metadata UID %d of user %s is below protected_uid_threshold %d", id, name, config.ProtectedUIDThreshold)
+		}
+		return strconv.Itoa(id), nil
+	case uidPolicyHash:
+		min, max, err := accounts.ParseIDRange(config.UIDRange)
+		if err != nil {
+			return "", fmt.Errorf("invalid uid_range: %w", err)
+		}
+		if config.Backend == accounts.BackendNative {
+			// The native backend checks for collisions while holding its lock.
+			return "", nil
+		}
+		// The GID is matched too, useradd gives the user's own group the same ID
+		// if it's free.
+		used := func(id int) bool {
+			if _, err := user.LookupId(strconv.Itoa(id)); err == nil {
+				return true
+			}
+			_, err := user.LookupGroupId(strconv.Itoa(id))
+			return err == nil
+		}
+		id, err := accounts.HashID(name, min, max, used)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(id), nil
+	}
+	return "", nil
+}
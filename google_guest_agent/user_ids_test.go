@@ -0,0 +1,86 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/accounts"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestGetUserIDs(t *testing.T) {
+	md := &metadata.Descriptor{}
+	md.Project.Attributes.UserIDs = "alice:200001\nbob:200002\ncarol:root\n"
+	md.Instance.Attributes.UserIDs = "alice:200003\n\ndave\n"
+
+	ids, errs := getUserIDs(md)
+	if want := map[string]int{"alice": 200003, "bob": 200002}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("getUserIDs() = %v, want: %v", ids, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("getUserIDs() returned errors %v, want 2 errors", errs)
+	}
+
+	md.Instance.Attributes.BlockProjectKeys = true
+	ids, _ = getUserIDs(md)
+	if want := map[string]int{"alice": 200003}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("getUserIDs() = %v with project keys blocked, want: %v", ids, want)
+	}
+}
+
+func TestGoogleUserUID(t *testing.T) {
+	ids := map[string]int{"alice": 200003, "carol": 500, "dave": 300000}
+	// No user or group exists with an ID in this range.
+	const uidRange = "1900000000-1900000009"
+
+	tests := []struct {
+		desc    string
+		config  *cfg.Accounts
+		user    string
+		want    string
+		wantErr bool
+	}{
+		{desc: "system", config: &cfg.Accounts{UIDPolicy: uidPolicySystem}, user: "alice"},
+		{desc: "metadata", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "200000-299999"}, user: "alice", want: "200003"},
+		{desc: "metadata unassigned", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "200000-299999"}, user: "bob"},
+		{desc: "metadata above range", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "200000-299999"}, user: "dave", wantErr: true},
+		{desc: "metadata below range", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "1000-299999"}, user: "carol", wantErr: true},
+		{desc: "metadata below threshold", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "1-299999", ProtectedUIDThreshold: 1000}, user: "carol", wantErr: true},
+		{desc: "metadata no threshold", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "1-299999"}, user: "carol", want: "500"},
+		{desc: "metadata invalid range", config: &cfg.Accounts{UIDPolicy: uidPolicyMetadata, UIDRange: "1000"}, user: "alice", wantErr: true},
+		{desc: "invalid range", config: &cfg.Accounts{UIDPolicy: uidPolicyHash, UIDRange: "1000"}, user: "bob", wantErr: true},
+		{desc: "native", config: &cfg.Accounts{UIDPolicy: uidPolicyHash, UIDRange: uidRange, Backend: accounts.BackendNative}, user: "bob"},
+	}
+
+	for _, tc := range tests {
+		got, err := googleUserUID(tc.config, tc.user, ids)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("googleUserUID(%s) = %q, %v, want: %q, error: %t", tc.desc, got, err, tc.want, tc.wantErr)
+		}
+	}
+
+	want, err := accounts.HashID("bob", 1900000000, 1900000009, func(int) bool { return false })
+	if err != nil {
+		t.Fatalf("accounts.HashID(bob) = %v, want: nil", err)
+	}
+	config := &cfg.Accounts{UIDPolicy: uidPolicyHash, UIDRange: uidRange}
+	if got, err := googleUserUID(config, "bob", ids); err != nil || got != strconv.Itoa(want) {
+		t.Errorf("googleUserUID(hash) = %q, %v, want: %d, nil", got, err, want)
+	}
+}
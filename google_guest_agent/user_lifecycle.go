@@ -0,0 +1,242 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// googleLockedUsersFile records the state of the locked Google users, one
+// user:state line each, see lockedUser.
+var googleLockedUsersFile = "/var/lib/google/google_users_locked"
+
+// lockedUser is the state, recorded in the google_users_locked file, of a Google
+// user removed from metadata and locked until its removal grace period expires.
+type lockedUser struct {
+	// since is when the user was locked.
+	since time.Time
+	// shell is the user's login shell before it was locked.
+	shell string
+}
+
+// parseLockedUser parses the state recorded in the google_users_locked file for
+// a locked user, it returns false if state isn't a valid one.
+func parseLockedUser(state string) (lockedUser, bool) {
+	since, shell, found := strings.Cut(state, ":")
+	if !found {
+		return lockedUser{}, false
+	}
+	seconds, err := strconv.ParseInt(since, 10, 64)
+	if err != nil {
+		return lockedUser{}, false
+	}
+	return lockedUser{since: time.Unix(seconds, 0), shell: shell}, true
+}
+
+// String returns the state recorded in the google_users_locked file.
+func (l lockedUser) String() string {
+	return fmt.Sprintf("%d:%s", l.since.Unix(), l.shell)
+}
+
+// readLockedUsersFile returns the state of the locked Google users. Lines with
+// an invalid state are ignored.
+func readLockedUsersFile() (map[string]lockedUser, error) {
+	res := make(map[string]lockedUser)
+	data, err := os.ReadFile(googleLockedUsersFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		user, state, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			continue
+		}
+		if l, ok := parseLockedUser(state); ok {
+			res[user] = l
+		}
+	}
+	return res, nil
+}
+
+// writeLockedUsersFile records the state of the locked Google users.
+func writeLockedUsersFile(locked map[string]lockedUser) error {
+	if err := os.MkdirAll(filepath.Dir(googleLockedUsersFile), 0755); err != nil {
+		return err
+	}
+
+	var users []string
+	for user := range locked {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var content strings.Builder
+	for _, user := range users {
+		fmt.Fprintf(&content, "%s:%s\n", user, locked[user])
+	}
+	return os.WriteFile(googleLockedUsersFile, []byte(content.String()), 0600)
+}
+
+// lockGoogleUser removes the keys the agent has added to the authorized keys
+// file of user, keeping the user's own ones, removes it from google-sudoers and locks its password and login shell. members are the groups'
+// members, as returned by readGroupMembers(), nil if unknown. The revoked keys
+// and membership are recorded to audit.
+func lockGoogleUser(ctx context.Context, config *cfg.Sections, user string, members map[string]map[string]bool, audit *accountsAudit, now time.Time) (lockedUser, error) {
+	entry, err := getPasswd(user)
+	if err != nil {
+		return lockedUser{}, err
+	}
+	installed, _ := readGoogleAuthorizedKeys(user)
+	// The user's own keys are kept, the lock is reverted by unlockGoogleUser.
+	if err := stripGoogleAuthorizedKeys(ctx, user); err != nil {
+		return lockedUser{}, err
+	}
+	audit.keyChanges(user, installed, nil)
+
+	backend := accountsBackend(config.Accounts)
+	// The membership is removed anyway if the group database couldn't be read.
+	if members == nil || members["google-sudoers"][user] {
+		if err := backend.RemoveUserFromGroup(ctx, user, "google-sudoers"); err != nil {
+			return lockedUser{}, err
+		}
+		audit.groupEvent(user, "google-sudoers", false)
+		if members != nil {
+			setGroupMember(members, "google-sudoers", user, false)
+		}
+	}
+	if err := backend.LockUser(ctx, user); err != nil {
+		return lockedUser{}, err
+	}
+	return lockedUser{since: now, shell: entry.Shell}, nil
+}
+
+// unlockGoogleUser restores the password and login shell of a locked user, its
+// keys and groups are restored as for any other Google user.
+func unlockGoogleUser(ctx context.Context, config *cfg.Sections, user string, locked lockedUser) error {
+	return accountsBackend(config.Accounts).UnlockUser(ctx, user, locked.shell)
+}
+
+// archiveNameRegexp matches the names of the archives written by archiveHome.
+var archiveNameRegexp = regexp.MustCompile(`^.+-[0-9]{14}\.tar\.gz$`)
+
+// archiveHome writes the home directory of user to a USER-TIMESTAMP.tar.gz
+// archive in dir and returns the archive's path.
+func archiveHome(user, dir string, now time.Time) (string, error) {
+	entry, err := getPasswd(user)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz", user, now.UTC().Format("20060102150405")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := writeTarGz(file, entry.HomeDir, user); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", fmt.Errorf("failed to archive %s: %w", entry.HomeDir, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// writeTarGz writes the gzipped tar archive of the directory src to w, with the
+// entries' names prefixed by prefix.
+func writeTarGz(w io.Writer, src, prefix string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			// Sockets and other special files can't be archived.
+			return nil
+		}
+		header.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// nextUserRemoval returns when the first removal grace period of the locked users
+// expires, the zero time if there's no locked user.
+func nextUserRemoval(locked map[string]lockedUser, grace time.Duration) time.Time {
+	var next time.Time
+	for _, l := range locked {
+		if expiry := l.since.Add(grace); next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	return next
+}
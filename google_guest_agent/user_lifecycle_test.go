@@ -0,0 +1,203 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockedUserState(t *testing.T) {
+	l := lockedUser{since: time.Unix(1700000000, 0), shell: "/bin/bash"}
+	state := l.String()
+	if state != "1700000000:/bin/bash" {
+		t.Errorf("lockedUser.String() = %q, want: %q", state, "1700000000:/bin/bash")
+	}
+	if got, ok := parseLockedUser(state); !ok || !got.since.Equal(l.since) || got.shell != l.shell {
+		t.Errorf("parseLockedUser(%q) = %+v, %t, want: %+v, true", state, got, ok, l)
+	}
+
+	for _, state := range []string{"", "foo", "foo:/bin/bash"} {
+		if _, ok := parseLockedUser(state); ok {
+			t.Errorf("parseLockedUser(%q) = true, want: false", state)
+		}
+	}
+}
+
+func TestGoogleUsersFileLocked(t *testing.T) {
+	dir := t.TempDir()
+	oldFile, oldLockedFile, oldKeys := googleUsersFile, googleLockedUsersFile, sshKeys
+	t.Cleanup(func() { googleUsersFile, googleLockedUsersFile, sshKeys = oldFile, oldLockedFile, oldKeys })
+	googleUsersFile = filepath.Join(dir, "google_users")
+	googleLockedUsersFile = filepath.Join(dir, "google_users_locked")
+	sshKeys = map[string][]string{"alice": {"ssh-rsa AAAA"}}
+
+	locked := map[string]lockedUser{"bob": {since: time.Unix(1700000000, 0), shell: "/bin/sh"}}
+	if err := writeGoogleUsersFile(locked); err != nil {
+		t.Fatalf("writeGoogleUsersFile() = %v, want: nil", err)
+	}
+	if err := writeLockedUsersFile(locked); err != nil {
+		t.Fatalf("writeLockedUsersFile() = %v, want: nil", err)
+	}
+
+	// google_users keeps one username per line.
+	data, err := os.ReadFile(googleUsersFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) = %v, want: nil", googleUsersFile, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	sort.Strings(lines)
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("google_users = %q, want: %q", lines, want)
+	}
+
+	gUsers, err := readGoogleUsersFile()
+	if err != nil {
+		t.Fatalf("readGoogleUsersFile() = %v, want: nil", err)
+	}
+	if want := map[string]string{"alice": "", "bob": ""}; !reflect.DeepEqual(gUsers, want) {
+		t.Errorf("readGoogleUsersFile() = %v, want: %v", gUsers, want)
+	}
+
+	got, err := readLockedUsersFile()
+	if err != nil {
+		t.Fatalf("readLockedUsersFile() = %v, want: nil", err)
+	}
+	if len(got) != 1 || !got["bob"].since.Equal(locked["bob"].since) || got["bob"].shell != "/bin/sh" {
+		t.Errorf("readLockedUsersFile() = %+v, want: %+v", got, locked)
+	}
+
+	os.Remove(googleLockedUsersFile)
+	if got, err := readLockedUsersFile(); err != nil || len(got) != 0 {
+		t.Errorf("readLockedUsersFile() without the file = %+v, %v, want: empty, nil", got, err)
+	}
+}
+
+func TestAuthorizedKeysLines(t *testing.T) {
+	userKey := "ssh-ed25519 AAAAuser alice@laptop"
+	googleKey := "ssh-ed25519 AAAAgoogle alice"
+	contents := []byte(userKey + "\n" + googleKeyComment + "\n" + googleKey + "\n")
+
+	// Locking strips the Google keys only, the user's own key survives.
+	locked := authorizedKeysLines(contents, nil)
+	if want := []string{userKey}; !reflect.DeepEqual(locked, want) {
+		t.Errorf("authorizedKeysLines(lock) = %v, want: %v", locked, want)
+	}
+
+	// Unlocking adds the Google keys back along with it.
+	unlocked := authorizedKeysLines([]byte(strings.Join(locked, "\n")+"\n"), []string{googleKey})
+	if want := []string{userKey, googleKeyComment, googleKey}; !reflect.DeepEqual(unlocked, want) {
+		t.Errorf("authorizedKeysLines(unlock) = %v, want: %v", unlocked, want)
+	}
+
+	if got := authorizedKeysLines([]byte(googleKeyComment+"\n"+googleKey+"\n"), nil); len(got) != 0 {
+		t.Errorf("authorizedKeysLines(only Google keys) = %v, want: nothing", got)
+	}
+}
+
+func TestNextUserRemoval(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	grace := time.Hour
+
+	tests := []struct {
+		desc   string
+		locked map[string]lockedUser
+		want   time.Time
+	}{
+		{desc: "none"},
+		{
+			desc: "earliest",
+			locked: map[string]lockedUser{
+				"alice": {since: now.Add(-10 * time.Minute)},
+				"bob":   {since: now.Add(-30 * time.Minute)},
+			},
+			want: now.Add(30 * time.Minute),
+		},
+		{
+			desc:   "expired",
+			locked: map[string]lockedUser{"alice": {since: now.Add(-2 * time.Hour)}},
+			want:   now.Add(-time.Hour),
+		},
+	}
+
+	for _, tc := range tests {
+		if got := nextUserRemoval(tc.locked, grace); !got.Equal(tc.want) {
+			t.Errorf("nextUserRemoval(%s) = %s, want: %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestWriteTarGz(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("home directories are only archived on linux")
+	}
+
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %+v", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "authorized_keys"), []byte("ssh-rsa AAAA\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+	if err := os.Symlink(".ssh/authorized_keys", filepath.Join(home, "keys")); err != nil {
+		t.Fatalf("Failed to create symlink: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTarGz(&buf, home, "alice"); err != nil {
+		t.Fatalf("writeTarGz(%s) = %+v, want: nil", home, err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %+v, want: nil", err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	contents := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next() = %+v, want: nil", err)
+		}
+		names = append(names, header.Name)
+		data, _ := io.ReadAll(tr)
+		contents[header.Name] = string(data) + header.Linkname
+	}
+	sort.Strings(names)
+
+	if want := []string{"alice/", "alice/.ssh/", "alice/.ssh/authorized_keys", "alice/keys"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("writeTarGz() archived %v, want: %v", names, want)
+	}
+	if got := contents["alice/.ssh/authorized_keys"]; got != "ssh-rsa AAAA\n" {
+		t.Errorf("writeTarGz() archived authorized_keys as %q, want: %q", got, "ssh-rsa AAAA\n")
+	}
+	if got := contents["alice/keys"]; got != ".ssh/authorized_keys" {
+		t.Errorf("writeTarGz() archived the keys symlink to %q, want: %q", got, ".ssh/authorized_keys")
+	}
+}
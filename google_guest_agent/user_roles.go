@@ -0,0 +1,240 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+const (
+	// roleAdmin users are members of google-sudoers, i.e. have passwordless sudo.
+	roleAdmin = "admin"
+	// roleUser users aren't members of google-sudoers.
+	roleUser = "user"
+)
+
+var googleUserGroupsFile = "/var/lib/google/google_users_groups"
+
+// userRole is the privilege level and extra groups of a Google user.
+type userRole struct {
+	admin bool
+	// groups are the groups the user is a member of, on top of the [Accounts]
+	// groups.
+	groups []string
+}
+
+// parseUserRoles parses the guest-agent-user-roles metadata attribute, a newline
+// separated list of USER:ROLE[:GROUP,...] entries where ROLE is admin or user.
+// Invalid entries are returned as errors, the valid ones are applied anyway.
+func parseUserRoles(value string, roles map[string]userRole) []error {
+	var errs []error
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			errs = append(errs, fmt.Errorf("invalid user role entry %q, want USER:ROLE[:GROUP,...]", line))
+			continue
+		}
+		var role userRole
+		switch parts[1] {
+		case roleAdmin:
+			role.admin = true
+		case roleUser:
+		default:
+			errs = append(errs, fmt.Errorf("invalid role %q for user %s, want %s or %s", parts[1], parts[0], roleAdmin, roleUser))
+			continue
+		}
+		if len(parts) == 3 {
+			for _, group := range strings.Split(parts[2], ",") {
+				if group = strings.TrimSpace(group); group != "" && group != "google-sudoers" {
+					role.groups = append(role.groups, group)
+				}
+			}
+		}
+		roles[parts[0]] = role
+	}
+	return errs
+}
+
+// getUserRoles returns the roles of the users assigned one by the instance's or,
+// unless project keys are blocked, the project's guest-agent-user-roles
+// attribute. The instance's roles take precedence.
+func getUserRoles(md *metadata.Descriptor) (map[string]userRole, []error) {
+	roles := make(map[string]userRole)
+	var errs []error
+	if !md.Instance.Attributes.BlockProjectKeys {
+		errs = append(errs, parseUserRoles(md.Project.Attributes.UserRoles, roles)...)
+	}
+	errs = append(errs, parseUserRoles(md.Instance.Attributes.UserRoles, roles)...)
+	return roles, errs
+}
+
+// roleOf returns the role of user, the [Accounts] default_role if it isn't
+// assigned one. Users are only admins by default if default_role is exactly
+// admin, any other value is the user role.
+func roleOf(roles map[string]userRole, user, defaultRole string) userRole {
+	if role, ok := roles[user]; ok {
+		return role
+	}
+	return userRole{admin: defaultRole == roleAdmin}
+}
+
+// groupChange is a change of a user's membership of a group.
+type groupChange struct {
+	group string
+	add   bool
+}
+
+// userGroupChanges returns the changes making user's membership of
+// google-sudoers and of the role's groups match role. members are the groups'
+// current members and granted the role groups the user was previously added to.
+// It also returns the role groups the user is granted once the changes are
+// applied.
+func userGroupChanges(user string, role userRole, members map[string]map[string]bool, granted []string) ([]groupChange, []string) {
+	var changes []groupChange
+	if isMember := members["google-sudoers"][user]; role.admin != isMember {
+		changes = append(changes, groupChange{group: "google-sudoers", add: role.admin})
+	}
+
+	var newGranted []string
+	wanted := make(map[string]bool)
+	for _, group := range role.groups {
+		wanted[group] = true
+		if !members[group][user] {
+			changes = append(changes, groupChange{group: group, add: true})
+			newGranted = append(newGranted, group)
+		} else if utils.ContainsString(group, granted) {
+			newGranted = append(newGranted, group)
+		}
+	}
+	for _, group := range granted {
+		if !wanted[group] && members[group][user] {
+			changes = append(changes, groupChange{group: group})
+		}
+	}
+	sort.Strings(newGranted)
+	return changes, newGranted
+}
+
+// removeString returns list without s.
+func removeString(list []string, s string) []string {
+	var res []string
+	for _, item := range list {
+		if item != s {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// setGroupMember records, in members as returned by readGroupMembers(), whether
+// user is a member of group.
+func setGroupMember(members map[string]map[string]bool, group, user string, member bool) {
+	if members[group] == nil {
+		members[group] = make(map[string]bool)
+	}
+	if member {
+		members[group][user] = true
+	} else {
+		delete(members[group], user)
+	}
+}
+
+// readGroupMembers returns the members of every group of the local group
+// database.
+func readGroupMembers() (map[string]map[string]bool, error) {
+	file, err := os.Open("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	res := make(map[string]map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// google-sudoers:x:1001:alice,bob
+		parts := strings.Split(line, ":")
+		if len(parts) < 4 {
+			continue
+		}
+		members := make(map[string]bool)
+		for _, member := range strings.Split(parts[3], ",") {
+			if member != "" {
+				members[member] = true
+			}
+		}
+		res[parts[0]] = members
+	}
+	return res, scanner.Err()
+}
+
+// readGoogleUserGroupsFile returns the role groups each Google user was added
+// to by the agent.
+func readGoogleUserGroupsFile() (map[string][]string, error) {
+	res := make(map[string][]string)
+	data, err := os.ReadFile(googleUserGroupsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		user, groups, found := strings.Cut(line, ":")
+		if !found || user == "" || groups == "" {
+			continue
+		}
+		res[user] = strings.Split(groups, ",")
+	}
+	return res, nil
+}
+
+// writeGoogleUserGroupsFile records the role groups each Google user was added
+// to by the agent.
+func writeGoogleUserGroupsFile(granted map[string][]string) error {
+	if err := os.MkdirAll(path.Dir(googleUserGroupsFile), 0755); err != nil {
+		return err
+	}
+
+	var users []string
+	for user, groups := range granted {
+		if len(groups) > 0 {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+
+	var content strings.Builder
+	for _, user := range users {
+		fmt.Fprintf(&content, "%s:%s\n", user, strings.Join(granted[user], ","))
+	}
+	return os.WriteFile(googleUserGroupsFile, []byte(content.String()), 0600)
+}
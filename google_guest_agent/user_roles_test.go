@@ -0,0 +1,133 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestGetUserRoles(t *testing.T) {
+	md := &metadata.Descriptor{}
+	md.Project.Attributes.UserRoles = "alice:user\nbob:admin:docker\ncarol:owner\n"
+	md.Instance.Attributes.UserRoles = "alice:admin:adm, video,google-sudoers\n\ndave\n"
+
+	roles, errs := getUserRoles(md)
+	want := map[string]userRole{
+		"alice": {admin: true, groups: []string{"adm", "video"}},
+		"bob":   {admin: true, groups: []string{"docker"}},
+	}
+	if !reflect.DeepEqual(roles, want) {
+		t.Errorf("getUserRoles() = %+v, want: %+v", roles, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("getUserRoles() returned errors %v, want 2 errors", errs)
+	}
+
+	md.Instance.Attributes.BlockProjectKeys = true
+	roles, _ = getUserRoles(md)
+	if _, ok := roles["bob"]; ok {
+		t.Errorf("getUserRoles() = %+v with project keys blocked, want no project role", roles)
+	}
+
+	if role := roleOf(roles, "erin", roleUser); role.admin {
+		t.Errorf("roleOf(erin, %s) = %+v, want non admin", roleUser, role)
+	}
+	if role := roleOf(roles, "erin", roleAdmin); !role.admin {
+		t.Errorf("roleOf(erin, %s) = %+v, want admin", roleAdmin, role)
+	}
+	// Unknown default roles fail closed.
+	for _, defaultRole := range []string{"", "Admin", "admn"} {
+		if role := roleOf(roles, "erin", defaultRole); role.admin {
+			t.Errorf("roleOf(erin, %q) = %+v, want non admin", defaultRole, role)
+		}
+	}
+}
+
+func TestUserGroupChanges(t *testing.T) {
+	members := map[string]map[string]bool{
+		"google-sudoers": {"alice": true},
+		"docker":         {"alice": true},
+		"video":          {"alice": true},
+		"adm":            {},
+	}
+
+	tests := []struct {
+		desc        string
+		role        userRole
+		granted     []string
+		wantChanges []groupChange
+		wantGranted []string
+	}{
+		{
+			desc:        "unchanged",
+			role:        userRole{admin: true, groups: []string{"docker"}},
+			granted:     []string{"docker"},
+			wantGranted: []string{"docker"},
+		},
+		{
+			desc:        "demoted",
+			role:        userRole{groups: []string{"docker", "adm"}},
+			granted:     []string{"docker"},
+			wantChanges: []groupChange{{group: "google-sudoers"}, {group: "adm", add: true}},
+			wantGranted: []string{"adm", "docker"},
+		},
+		{
+			desc:        "group dropped",
+			role:        userRole{admin: true},
+			granted:     []string{"docker"},
+			wantChanges: []groupChange{{group: "docker"}},
+		},
+		{
+			// video membership wasn't granted by the agent, it's left alone.
+			desc: "existing membership",
+			role: userRole{admin: true, groups: []string{"video"}},
+		},
+	}
+
+	for _, tc := range tests {
+		changes, granted := userGroupChanges("alice", tc.role, members, tc.granted)
+		if !reflect.DeepEqual(changes, tc.wantChanges) || !reflect.DeepEqual(granted, tc.wantGranted) {
+			t.Errorf("userGroupChanges(%s) = %+v, %v, want: %+v, %v", tc.desc, changes, granted, tc.wantChanges, tc.wantGranted)
+		}
+	}
+
+	changes, _ := userGroupChanges("bob", userRole{admin: true}, members, nil)
+	if want := []groupChange{{group: "google-sudoers", add: true}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("userGroupChanges(bob) = %+v, want: %+v", changes, want)
+	}
+}
+
+func TestGoogleUserGroupsFile(t *testing.T) {
+	oldFile := googleUserGroupsFile
+	t.Cleanup(func() { googleUserGroupsFile = oldFile })
+	googleUserGroupsFile = filepath.Join(t.TempDir(), "google", "google_users_groups")
+
+	granted, err := readGoogleUserGroupsFile()
+	if err != nil || len(granted) != 0 {
+		t.Fatalf("readGoogleUserGroupsFile() = %v, %v, want: empty, nil", granted, err)
+	}
+
+	want := map[string][]string{"alice": {"adm", "docker"}, "bob": {"video"}}
+	if err := writeGoogleUserGroupsFile(map[string][]string{"alice": {"adm", "docker"}, "bob": {"video"}, "carol": nil}); err != nil {
+		t.Fatalf("writeGoogleUserGroupsFile() = %v, want: nil", err)
+	}
+	if granted, err = readGoogleUserGroupsFile(); err != nil || !reflect.DeepEqual(granted, want) {
+		t.Errorf("readGoogleUserGroupsFile() = %v, %v, want: %v, nil", granted, err, want)
+	}
+}
@@ -29,13 +29,14 @@ import (
 	"math/big"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 var (
@@ -122,7 +123,7 @@ func createOrResetPwd(ctx context.Context, k metadata.WindowsKey) (*credsJSON, e
 		return nil, fmt.Errorf("error creating password: %v", err)
 	}
 	if _, err := userExists(k.UserName); err == nil {
-		logger.Infof("Resetting password for user %s", k.UserName)
+		accountsLog.With(logfields.KeyUser, k.UserName).Infof("Resetting password for user")
 		if err := resetPwd(k.UserName, pwd); err != nil {
 			return nil, fmt.Errorf("error running resetPwd: %v", err)
 		}
@@ -132,10 +133,11 @@ func createOrResetPwd(ctx context.Context, k metadata.WindowsKey) (*credsJSON, e
 			}
 		}
 	} else {
-		logger.Infof("Creating user %s", k.UserName)
+		accountsLog.With(logfields.KeyUser, k.UserName).Infof("Creating user")
 		if err := createUser(ctx, k.UserName, pwd); err != nil {
 			return nil, fmt.Errorf("error running createUser: %v", err)
 		}
+		usersCreated.Inc()
 		if k.AddToAdministrators == nil || *k.AddToAdministrators {
 			if err := addUserToGroup(ctx, k.UserName, "Administrators"); err != nil {
 				return nil, fmt.Errorf("error running addUserToGroup: %v", err)
@@ -154,10 +156,11 @@ func createSSHUser(ctx context.Context, user string) error {
 	if _, err := userExists(user); err == nil {
 		return nil
 	}
-	logger.Infof("Creating user %s", user)
+	accountsLog.With(logfields.KeyUser, user).Infof("Creating user")
 	if err := createUser(ctx, user, pwd); err != nil {
 		return fmt.Errorf("error running createUser: %v", err)
 	}
+	usersCreated.Inc()
 
 	if err := addUserToGroup(ctx, user, "Administrators"); err != nil {
 		return fmt.Errorf("error running addUserToGroup: %v", err)
@@ -222,10 +225,20 @@ func getWinSSHEnabled(md *metadata.Descriptor) bool {
 	return enable
 }
 
+func init() {
+	registerManager(&managerSpec{
+		name:     "windows-accounts",
+		platform: windowsOnly,
+		new:      func() manager { return &winAccountsMgr{} },
+	})
+}
+
 type winAccountsMgr struct {
 	// fakeWindows forces Disabled to run as if it was running in a windows system.
 	// mostly target for unit tests.
 	fakeWindows bool
+	// applied counts the users created and the passwords set by Set().
+	applied int
 }
 
 func (a *winAccountsMgr) Diff(ctx context.Context) (bool, error) {
@@ -343,17 +356,17 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 		if sshEnable != oldSSHEnable {
 			err := verifyWinSSHVersion(ctx)
 			if err != nil {
-				logger.Warningf(err.Error())
+				accountsLog.Warningf(err.Error())
 			}
 
 			if !checkWindowsServiceRunning(ctx, "sshd") {
-				logger.Warningf("The 'enable-windows-ssh' metadata key is set to 'true' " +
+				accountsLog.Warningf("The 'enable-windows-ssh' metadata key is set to 'true' " +
 					"but sshd does not appear to be running.")
 			}
 		}
 
 		if sshKeys == nil {
-			logger.Debugf("initialize sshKeys map")
+			accountsLog.Debugf("initialize sshKeys map")
 			sshKeys = make(map[string][]string)
 		}
 		mdkeys := newMetadata.Instance.Attributes.SSHKeys
@@ -361,11 +374,14 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 			mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
 		}
 
-		mdKeyMap := getUserKeys(mdkeys)
+		mdKeyMap := getUserKeys(mdkeys, keyPolicy(cfg.Get().Accounts))
 
 		for user := range mdKeyMap {
+			exists, _ := userExists(user)
 			if err := createSSHUser(ctx, user); err != nil {
-				logger.Errorf("Error creating user: %s", err)
+				accountsLog.With(logfields.KeyUser, user).WithError(err).Errorf("Error creating user")
+			} else if !exists {
+				a.applied++
 			}
 		}
 	}
@@ -382,9 +398,10 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 		creds, err := createOrResetPwd(ctx, key)
 		if err == nil {
 			printCreds(creds)
+			a.applied++
 			continue
 		}
-		logger.Errorf("error setting password: %s", err)
+		accountsLog.Errorf("error setting password: %s", err)
 		creds = &credsJSON{
 			PasswordFound: false,
 			Exponent:      key.Exponent,
@@ -400,7 +417,7 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 		jsn, err := json.Marshal(key)
 		if err != nil {
 			// This *should* never happen as each key was just Unmarshalled above.
-			logger.Errorf("Failed to marshal windows key to JSON: %s", err)
+			accountsLog.Errorf("Failed to marshal windows key to JSON: %s", err)
 			continue
 		}
 		jsonKeys = append(jsonKeys, string(jsn))
@@ -408,6 +425,47 @@ func (a *winAccountsMgr) Set(ctx context.Context) error {
 	return writeRegMultiString(regKeyBase, accountRegKey, jsonKeys)
 }
 
+// Applied returns the number of users created and passwords set by Set().
+func (a *winAccountsMgr) Applied() int {
+	return a.applied
+}
+
+// Plan returns the SSH users the manager would create and the users whose password
+// it would create or reset.
+func (a *winAccountsMgr) Plan(ctx context.Context) ([]string, error) {
+	var res []string
+
+	if getWinSSHEnabled(newMetadata) {
+		mdkeys := newMetadata.Instance.Attributes.SSHKeys
+		if !newMetadata.Instance.Attributes.BlockProjectKeys {
+			mdkeys = append(mdkeys, newMetadata.Project.Attributes.SSHKeys...)
+		}
+
+		var users []string
+		for user := range getUserKeys(mdkeys, keyPolicy(cfg.Get().Accounts)) {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+
+		for _, user := range users {
+			if exists, _ := userExists(user); !exists {
+				res = append(res, fmt.Sprintf("create SSH user %s", user))
+			}
+		}
+	}
+
+	regKeys, err := readRegMultiString(regKeyBase, accountRegKey)
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+
+	for _, key := range compareAccounts(newMetadata.Instance.Attributes.WindowsKeys, regKeys) {
+		res = append(res, fmt.Sprintf("create or reset password of user %s", key.UserName))
+	}
+
+	return res, nil
+}
+
 var badReg []string
 
 func compareAccounts(newKeys metadata.WindowsKeys, oldStrKeys []string) metadata.WindowsKeys {
@@ -423,7 +481,7 @@ func compareAccounts(newKeys metadata.WindowsKeys, oldStrKeys []string) metadata
 		var key metadata.WindowsKey
 		if err := json.Unmarshal([]byte(s), &key); err != nil {
 			if !utils.ContainsString(s, badReg) {
-				logger.Errorf("Bad windows key from registry: %s", err)
+				accountsLog.Errorf("Bad windows key from registry: %s", err)
 				badReg = append(badReg, s)
 			}
 			continue
@@ -276,7 +276,7 @@ func TestGetUserKeys(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		ret := getUserKeys([]string{tt.key})
+		ret := getUserKeys([]string{tt.key}, utils.KeyPolicy{})
 		if userKeys := ret["user"]; len(userKeys) != tt.expectedValid {
 			t.Errorf("expected %d valid keys from getUserKeys, but %d", tt.expectedValid, len(userKeys))
 		}
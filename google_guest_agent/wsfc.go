@@ -16,13 +16,14 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 )
 
 const wsfcDefaultAgentPort = "59998"
@@ -40,6 +41,17 @@ var (
 	agentInstance *wsfcAgent
 )
 
+func init() {
+	// The address manager must have skipped the cluster addresses before the health
+	// check agent is started.
+	registerManager(&managerSpec{
+		name:         "wsfc",
+		platform:     windowsOnly,
+		new:          func() manager { return newWsfcManager() },
+		dependencies: []string{"address"},
+	})
+}
+
 type wsfcManager struct {
 	agentNewState agentState
 	agentNewPort  string
@@ -130,6 +142,22 @@ func (m *wsfcManager) Set(ctx context.Context) error {
 	return nil
 }
 
+// Plan returns the health check agent state change the manager would make.
+func (m *wsfcManager) Plan(ctx context.Context) ([]string, error) {
+	if m.agentNewState != m.agent.getState() {
+		if m.agentNewState == running {
+			return []string{fmt.Sprintf("start the health check agent on port %s", m.agentNewPort)}, nil
+		}
+		return []string{"stop the health check agent"}, nil
+	}
+
+	if m.agent.getState() == running && m.agentNewPort != m.agent.getPort() {
+		return []string{fmt.Sprintf("restart the health check agent on port %s", m.agentNewPort)}, nil
+	}
+
+	return nil, nil
+}
+
 // interface for agent answering health check ping
 type healthAgent interface {
 	getState() agentState
@@ -149,11 +177,11 @@ type wsfcAgent struct {
 // Start agent and taking tcp request
 func (a *wsfcAgent) run() error {
 	if a.getState() == running {
-		logger.Infof("wsfc agent is already running")
+		logfields.Infof("wsfc agent is already running")
 		return nil
 	}
 
-	logger.Infof("Starting wsfc agent...")
+	logfields.Infof("Starting wsfc agent...")
 	listenerAddr, err := net.ResolveTCPAddr("tcp", ":"+a.port)
 	if err != nil {
 		return err
@@ -171,11 +199,11 @@ func (a *wsfcAgent) run() error {
 			if err != nil {
 				// if err is not due to listener closed, return
 				if opErr, ok := err.(*net.OpError); ok && strings.Contains(opErr.Error(), "closed") {
-					logger.Infof("wsfc agent - tcp listener closed.")
+					logfields.Infof("wsfc agent - tcp listener closed.")
 					return
 				}
 
-				logger.Errorf("wsfc agent - error on accepting request: %s", err)
+				logfields.Errorf("wsfc agent - error on accepting request: %s", err)
 				continue
 			}
 			a.waitGroup.Add(1)
@@ -183,7 +211,7 @@ func (a *wsfcAgent) run() error {
 		}
 	}()
 
-	logger.Infof("wsfc agent started. Listening on port: %s", a.port)
+	logfields.Infof("wsfc agent started. Listening on port: %s", a.port)
 	a.listener = listener
 
 	return nil
@@ -201,14 +229,14 @@ func (a *wsfcAgent) handleHealthCheckRequest(conn net.Conn) {
 	// Read the incoming connection into the buffer.
 	reqLen, err := conn.Read(buf)
 	if err != nil {
-		logger.Errorf("wsfc - error on processing tcp request for network heartbeat health check: %s", err)
+		logfields.Errorf("wsfc - error on processing tcp request for network heartbeat health check: %s", err)
 		return
 	}
 
 	wsfcIP := strings.TrimSpace(string(buf[:reqLen]))
 	reply, err := checkIPExist(wsfcIP)
 	if err != nil {
-		logger.Errorf("wsfc - error on checking local ip: %s", err)
+		logfields.Errorf("wsfc - error on checking local ip: %s", err)
 	}
 	conn.Write([]byte(reply))
 }
@@ -216,17 +244,17 @@ func (a *wsfcAgent) handleHealthCheckRequest(conn net.Conn) {
 // Stop agent. Will wait for all existing request to be completed.
 func (a *wsfcAgent) stop() error {
 	if a.getState() == stopped {
-		logger.Infof("wsfc agent already stopped.")
+		logfields.Infof("wsfc agent already stopped.")
 		return nil
 	}
 
-	logger.Infof("Stopping wsfc agent...")
+	logfields.Infof("Stopping wsfc agent...")
 	// close listener first to avoid taking additional request
 	err := a.listener.Close()
 	// wait for exiting request to finish
 	a.waitGroup.Wait()
 	a.listener = nil
-	logger.Infof("wsfc agent stopped.")
+	logfields.Infof("wsfc agent stopped.")
 	return err
 }
 
@@ -246,7 +274,7 @@ func (a *wsfcAgent) getPort() string {
 
 func (a *wsfcAgent) setPort(newPort string) {
 	if newPort != a.port {
-		logger.Infof("update wsfc agent from port %v to %v", a.port, newPort)
+		logfields.Infof("update wsfc agent from port %v to %v", a.port, newPort)
 		a.port = newPort
 	}
 }
@@ -39,6 +39,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -436,6 +437,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to load instance configuration: %+v", err)
 		os.Exit(1)
 	}
+	opts.FormatFunction = logfields.FormatFunction(cfg.Get().Logging.Format, programName, opts.FormatFunction)
 
 	// The keys to check vary based on the argument and the OS. Also functions to validate arguments.
 	wantedKeys, err := getWantedKeys(os.Args, runtime.GOOS)
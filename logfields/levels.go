@@ -0,0 +1,189 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logfields
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// Level is the minimum severity of the entries logged.
+type Level int
+
+const (
+	// LevelDebug logs all the entries.
+	LevelDebug Level = iota
+	// LevelInfo logs all the entries but the debug ones.
+	LevelInfo
+	// LevelWarning logs the warning and error entries.
+	LevelWarning
+	// LevelError logs the error entries.
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+}
+
+// String returns the level's name.
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the level named name, case insensitively.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for level, n := range levelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q", name)
+}
+
+// Levels are the log levels of the components.
+type Levels struct {
+	// Default is the level of the entries not attributed to a component, or of
+	// the components not in Components.
+	Default Level
+	// Components are the levels of single components, by name.
+	Components map[string]Level
+}
+
+// ParseLevels returns base with the levels of spec applied. spec is a comma
+// separated list of a level, that becomes the default one, and component:level
+// pairs, i.e. info,accounts:debug,network:debug.
+func ParseLevels(base Levels, spec string) (Levels, error) {
+	res := Levels{Default: base.Default}
+	for name, level := range base.Components {
+		if res.Components == nil {
+			res.Components = make(map[string]Level)
+		}
+		res.Components[name] = level
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(entry, ":")
+		if !found {
+			level, err := ParseLevel(entry)
+			if err != nil {
+				return base, err
+			}
+			res.Default = level
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return base, fmt.Errorf("invalid component log level %q, want component:level", entry)
+		}
+		level, err := ParseLevel(value)
+		if err != nil {
+			return base, fmt.Errorf("invalid log level of component %s: %v", name, err)
+		}
+		if res.Components == nil {
+			res.Components = make(map[string]Level)
+		}
+		res.Components[name] = level
+	}
+
+	return res, nil
+}
+
+// String returns the levels in the ParseLevels() format.
+func (l Levels) String() string {
+	var names []string
+	for name := range l.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := []string{l.Default.String()}
+	for _, name := range names {
+		res = append(res, fmt.Sprintf("%s:%s", name, l.Components[name]))
+	}
+	return strings.Join(res, ",")
+}
+
+// minLevel returns the most verbose of the levels.
+func (l Levels) minLevel() Level {
+	res := l.Default
+	for _, level := range l.Components {
+		if level < res {
+			res = level
+		}
+	}
+	return res
+}
+
+var (
+	levelsMu sync.RWMutex
+	levels   = Levels{Default: LevelInfo}
+)
+
+// SetLevels sets the log levels. The logger's debug logging is enabled if any
+// component logs debug entries, the entries logged directly with the logger
+// package bypass the levels, Debugf() and the other package functions must be
+// used instead.
+func SetLevels(l Levels) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	levels = l
+	logger.SetDebugLogging(l.minLevel() == LevelDebug)
+}
+
+// CurrentLevels returns the log levels set with SetLevels().
+func CurrentLevels() Levels {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	return levels
+}
+
+// enabled returns true if entries of severity must be logged for component.
+func enabled(component string, severity logger.Severity) bool {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	level, ok := levels.Components[component]
+	if !ok {
+		level = levels.Default
+	}
+
+	switch severity {
+	case logger.Debug:
+		return level <= LevelDebug
+	case logger.Info:
+		return level <= LevelInfo
+	case logger.Warning:
+		return level <= LevelWarning
+	default:
+		return true
+	}
+}
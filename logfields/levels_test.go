@@ -0,0 +1,88 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logfields
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+func TestParseLevels(t *testing.T) {
+	base := Levels{Default: LevelInfo, Components: map[string]Level{"events": LevelWarning}}
+
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "", want: "info,events:warning"},
+		{spec: "debug", want: "debug,events:warning"},
+		{spec: " Error , accounts:DEBUG,network:debug", want: "error,accounts:debug,events:warning,network:debug"},
+		{spec: "events:info", want: "info,events:info"},
+		{spec: "verbose", wantErr: true},
+		{spec: "accounts:verbose", wantErr: true},
+		{spec: ":debug", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseLevels(base, tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseLevels(%q) returned error: %v, want error: %t", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tc.want {
+			t.Errorf("ParseLevels(%q) = %s, want: %s", tc.spec, got, tc.want)
+		}
+	}
+
+	if base.String() != "info,events:warning" {
+		t.Errorf("ParseLevels() modified the base levels: %s", base)
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	var buf bytes.Buffer
+	opts := logger.LogOpts{
+		LoggerName:          "test",
+		FormatFunction:      func(e logger.LogEntry) string { return e.Message },
+		Writers:             []io.Writer{&buf},
+		DisableLocalLogging: true,
+		DisableCloudLogging: true,
+	}
+	if err := logger.Init(context.Background(), opts); err != nil {
+		t.Fatalf("logger.Init() failed: %+v", err)
+	}
+	defer SetLevels(Levels{Default: LevelInfo})
+
+	SetLevels(Levels{Default: LevelWarning, Components: map[string]Level{ComponentAccounts: LevelDebug}})
+
+	Component(ComponentAccounts).Debugf("accounts debug")
+	Component(ComponentNetwork).Debugf("network debug")
+	Component(ComponentNetwork).Infof("network info")
+	Component(ComponentNetwork).Warningf("network warning")
+	Debugf("default debug")
+	Infof("default info")
+	Warningf("default warning")
+	Errorf("default error")
+
+	want := "accounts debug\nnetwork warning\ndefault warning\ndefault error\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Logged %q, want: %q", got, want)
+	}
+}
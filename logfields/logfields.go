@@ -0,0 +1,248 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logfields attaches structured fields to log entries and formats them
+// as JSON lines. The fields are carried as the log entries' labels, the text
+// formats render them around the message while Cloud Logging records them as
+// labels. Messages therefore shouldn't repeat the fields' values.
+package logfields
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// Field names, they are stable as log pipelines rely on them.
+const (
+	// KeyComponent is the binary, or agent component, logging the entry.
+	KeyComponent = "component"
+	// KeyManager is the guest agent manager the entry relates to.
+	KeyManager = "manager"
+	// KeyEventType is the event type the entry relates to.
+	KeyEventType = "event_type"
+	// KeyUser is the user account the entry relates to.
+	KeyUser = "user"
+	// KeyInterface is the network interface the entry relates to.
+	KeyInterface = "interface"
+	// KeyError is the error the entry reports.
+	KeyError = "error"
+)
+
+const (
+	// FormatText is the free text log format, the default.
+	FormatText = "text"
+	// FormatJSON is the JSON lines log format.
+	FormatJSON = "json"
+)
+
+// Components whose log level can be set on their own, see SetLevels().
+const (
+	// ComponentMetadata is the metadata server client.
+	ComponentMetadata = "metadata"
+	// ComponentEvents is the events manager and its watchers.
+	ComponentEvents = "events"
+	// ComponentAccounts is the users and SSH keys management.
+	ComponentAccounts = "accounts"
+	// ComponentNetwork is the network interfaces and routes management.
+	ComponentNetwork = "network"
+)
+
+// Fields are structured attributes of a log entry.
+type Fields map[string]string
+
+// Component returns fields attributing an entry to the component name, its log
+// level applies.
+func Component(name string) Fields {
+	return Fields{KeyComponent: name}
+}
+
+// Manager returns fields relating an entry to the manager name.
+func Manager(name string) Fields {
+	return Fields{KeyManager: name}
+}
+
+// EventType returns fields relating an entry to the event type evType.
+func EventType(evType string) Fields {
+	return Fields{KeyEventType: evType}
+}
+
+// User returns fields relating an entry to the user account name.
+func User(name string) Fields {
+	return Fields{KeyUser: name}
+}
+
+// Interface returns fields relating an entry to the network interface name.
+func Interface(name string) Fields {
+	return Fields{KeyInterface: name}
+}
+
+// With returns a copy of f with key set to value.
+func (f Fields) With(key, value string) Fields {
+	res := make(Fields, len(f)+1)
+	for k, v := range f {
+		res[k] = v
+	}
+	res[key] = value
+	return res
+}
+
+// WithError returns a copy of f with the error field set to err, if not nil.
+func (f Fields) WithError(err error) Fields {
+	if err == nil {
+		return f
+	}
+	return f.With(KeyError, err.Error())
+}
+
+// Debugf logs debug information with the fields f.
+func (f Fields) Debugf(format string, v ...interface{}) {
+	f.log(logger.Debug, format, v...)
+}
+
+// Infof logs general information with the fields f.
+func (f Fields) Infof(format string, v ...interface{}) {
+	f.log(logger.Info, format, v...)
+}
+
+// Warningf logs warning information with the fields f.
+func (f Fields) Warningf(format string, v ...interface{}) {
+	f.log(logger.Warning, format, v...)
+}
+
+// Errorf logs error information with the fields f.
+func (f Fields) Errorf(format string, v ...interface{}) {
+	f.log(logger.Error, format, v...)
+}
+
+// Debugf logs debug information not attributed to a component, the default
+// level applies.
+func Debugf(format string, v ...interface{}) {
+	Fields(nil).log(logger.Debug, format, v...)
+}
+
+// Infof logs general information not attributed to a component, the default
+// level applies.
+func Infof(format string, v ...interface{}) {
+	Fields(nil).log(logger.Info, format, v...)
+}
+
+// Warningf logs warning information not attributed to a component, the default
+// level applies.
+func Warningf(format string, v ...interface{}) {
+	Fields(nil).log(logger.Warning, format, v...)
+}
+
+// Errorf logs error information not attributed to a component.
+func Errorf(format string, v ...interface{}) {
+	Fields(nil).log(logger.Error, format, v...)
+}
+
+// log logs the entry if the level of its component allows it, the call depth
+// skips log() and its exported caller so the entry's source is the caller's one.
+func (f Fields) log(severity logger.Severity, format string, v ...interface{}) {
+	if !enabled(f[KeyComponent], severity) {
+		return
+	}
+	logger.Log(logger.LogEntry{
+		Message:   fmt.Sprintf(format, v...),
+		Severity:  severity,
+		Labels:    f,
+		CallDepth: 3,
+	})
+}
+
+// jsonEntry is a log entry as formatted by JSONFormat, the order of the fields
+// is stable.
+type jsonEntry struct {
+	Timestamp string `json:"timestamp"`
+	Severity  string `json:"severity"`
+	Component string `json:"component"`
+	Message   string `json:"message"`
+	Manager   string `json:"manager,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	User      string `json:"user,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Source    string `json:"source,omitempty"`
+}
+
+// JSONFormat returns a logger format function producing one JSON object per
+// entry, component is used unless the entry has a component field.
+func JSONFormat(component string) func(logger.LogEntry) string {
+	return func(e logger.LogEntry) string {
+		entry := jsonEntry{
+			Timestamp: e.LocalTimestamp,
+			Severity:  strings.ToUpper(e.Severity.String()),
+			Component: component,
+			Message:   e.Message,
+			Manager:   e.Labels[KeyManager],
+			EventType: e.Labels[KeyEventType],
+			User:      e.Labels[KeyUser],
+			Interface: e.Labels[KeyInterface],
+			Error:     e.Labels[KeyError],
+		}
+		if value := e.Labels[KeyComponent]; value != "" {
+			entry.Component = value
+		}
+		if e.Source != nil {
+			entry.Source = fmt.Sprintf("%s:%d", e.Source.File, e.Source.Line)
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return e.Message
+		}
+		return string(data)
+	}
+}
+
+// textKeys are the fields TextFormat appends to the message, in order.
+var textKeys = []string{KeyEventType, KeyUser, KeyInterface, KeyError}
+
+// TextFormat returns a logger format function rendering the entry's fields in its
+// message, the manager as a "[name]" prefix and the others as key=value suffixes,
+// and formatting the result with text.
+func TextFormat(text func(logger.LogEntry) string) func(logger.LogEntry) string {
+	return func(e logger.LogEntry) string {
+		var msg strings.Builder
+		if name := e.Labels[KeyManager]; name != "" {
+			fmt.Fprintf(&msg, "[%s] ", name)
+		}
+		msg.WriteString(e.Message)
+		for _, key := range textKeys {
+			value, found := e.Labels[key]
+			if !found {
+				continue
+			}
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&msg, " %s=%s", key, value)
+		}
+		e.Message = msg.String()
+		return text(e)
+	}
+}
+
+// FormatFunction returns the logger format function of format: JSONFormat for
+// FormatJSON, TextFormat of text otherwise.
+func FormatFunction(format, component string, text func(logger.LogEntry) string) func(logger.LogEntry) string {
+	if strings.EqualFold(strings.TrimSpace(format), FormatJSON) {
+		return JSONFormat(component)
+	}
+	return TextFormat(text)
+}
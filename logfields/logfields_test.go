@@ -0,0 +1,128 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logfields
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+func TestJSONFormat(t *testing.T) {
+	format := JSONFormat("GCEGuestAgent")
+
+	got := format(logger.LogEntry{
+		Message:        "Creating user foo.",
+		Severity:       logger.Error,
+		Labels:         User("foo").With(KeyManager, "accounts").WithError(fmt.Errorf("useradd failed")),
+		LocalTimestamp: "2023-01-02T03:04:05.0000Z",
+	})
+
+	want := `{"timestamp":"2023-01-02T03:04:05.0000Z","severity":"ERROR","component":"GCEGuestAgent",` +
+		`"message":"Creating user foo.","manager":"accounts","user":"foo","error":"useradd failed"}`
+	if got != want {
+		t.Errorf("JSONFormat() = %s, want: %s", got, want)
+	}
+
+	got = format(logger.LogEntry{Message: "Started.", Severity: logger.Info, Labels: Fields{KeyComponent: "scheduler"}})
+	want = `{"timestamp":"","severity":"INFO","component":"scheduler","message":"Started."}`
+	if got != want {
+		t.Errorf("JSONFormat() = %s, want: %s", got, want)
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	format := TextFormat(func(e logger.LogEntry) string { return e.Message })
+
+	tests := []struct {
+		labels Fields
+		want   string
+	}{
+		{labels: nil, want: "Creating user."},
+		{labels: Component(ComponentAccounts), want: "Creating user."},
+		{labels: Manager("accounts"), want: "[accounts] Creating user."},
+		{
+			labels: User("foo").With(KeyManager, "accounts").WithError(fmt.Errorf("useradd failed")),
+			want:   `[accounts] Creating user. user=foo error="useradd failed"`,
+		},
+		{labels: Interface("eth0").With(KeyEventType, "longpoll"), want: "Creating user. event_type=longpoll interface=eth0"},
+	}
+
+	for _, tc := range tests {
+		if got := format(logger.LogEntry{Message: "Creating user.", Labels: tc.labels}); got != tc.want {
+			t.Errorf("TextFormat() with labels %v = %q, want: %q", tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestFormatFunction(t *testing.T) {
+	text := func(e logger.LogEntry) string { return "text: " + e.Message }
+	entry := logger.LogEntry{Message: "msg", Severity: logger.Info}
+
+	tests := []struct {
+		format   string
+		wantJSON bool
+	}{
+		{format: "json", wantJSON: true},
+		{format: " JSON ", wantJSON: true},
+		{format: "text"},
+		{format: ""},
+		{format: "foo"},
+	}
+
+	for _, tc := range tests {
+		got := FormatFunction(tc.format, "test", text)(entry)
+		if isJSON := json.Valid([]byte(got)); isJSON != tc.wantJSON {
+			t.Errorf("FormatFunction(%q) produced %q, want JSON: %t", tc.format, got, tc.wantJSON)
+		}
+	}
+}
+
+func TestFieldsLog(t *testing.T) {
+	var buf bytes.Buffer
+	opts := logger.LogOpts{
+		LoggerName:          "test",
+		FormatFunction:      JSONFormat("test"),
+		Writers:             []io.Writer{&buf},
+		DisableLocalLogging: true,
+		DisableCloudLogging: true,
+	}
+	if err := logger.Init(context.Background(), opts); err != nil {
+		t.Fatalf("logger.Init() failed: %+v", err)
+	}
+
+	fields := Interface("eth0")
+	fields.Infof("Adding route %s.", "10.0.0.2")
+
+	var entry jsonEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Failed to parse log line %q: %+v", buf.String(), err)
+	}
+	if entry.Interface != "eth0" || entry.Message != "Adding route 10.0.0.2." || entry.Severity != "INFO" {
+		t.Errorf("Infof() logged %+v, want an INFO entry with interface eth0", entry)
+	}
+	if !strings.HasPrefix(entry.Source, "logfields_test.go:") {
+		t.Errorf("Infof() logged source %q, want the caller's source", entry.Source)
+	}
+	if len(fields) != 1 {
+		t.Errorf("Infof() modified the fields: %v", fields)
+	}
+}
@@ -27,7 +27,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"github.com/GoogleCloudPlatform/guest-agent/metrics"
 )
 
 const (
@@ -47,8 +48,28 @@ var (
 	// we backoff until 10s
 	backoffDuration = 100 * time.Millisecond
 	backoffAttempts = 100
+
+	// metadataLog logs the entries of the metadata component.
+	metadataLog = logfields.Component(logfields.ComponentMetadata)
+
+	requestsTotal = metrics.NewCounter("guest_agent_metadata_requests_total",
+		"Number of metadata server requests by type (get, longpoll or guest_attributes) and status code.", "type", "code")
+	requestDuration = metrics.NewHistogram("guest_agent_metadata_request_duration_seconds",
+		"Latency of metadata server requests by type, longpolls last until metadata changes.", metrics.DefaultBuckets, "type")
+	longpollReconnects = metrics.NewCounter("guest_agent_metadata_longpoll_reconnects_total",
+		"Number of times a metadata longpoll was re-established after a failure.")
 )
 
+// observeRequest records a metadata server request of type kind started at start.
+func observeRequest(kind string, start time.Time, resp *http.Response, err error) {
+	code := "error"
+	if err == nil && resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requestsTotal.Inc(kind, code)
+	requestDuration.Observe(time.Since(start).Seconds(), kind)
+}
+
 // MDSClientInterface is the minimum required Metadata Server interface for Guest Agent.
 type MDSClientInterface interface {
 	Get(context.Context) (*Descriptor, error)
@@ -175,6 +196,10 @@ type Attributes struct {
 	WSFCAddresses         string
 	WSFCAgentPort         string
 	DisableTelemetry      bool
+	GuestAgentConfig      string
+	LogLevels             string
+	UserRoles             string
+	UserIDs               string
 }
 
 // UnmarshalJSON unmarshals b into Attribute.
@@ -202,6 +227,10 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 		WSFCAddresses         string      `json:"wsfc-addrs"`
 		WSFCAgentPort         string      `json:"wsfc-agent-port"`
 		DisableTelemetry      string      `json:"disable-guest-telemetry"`
+		GuestAgentConfig      string      `json:"guest-agent-config"`
+		LogLevels             string      `json:"guest-agent-log-levels"`
+		UserRoles             string      `json:"guest-agent-user-roles"`
+		UserIDs               string      `json:"guest-agent-user-ids"`
 	}
 	var temp inner
 	if err := json.Unmarshal(b, &temp); err != nil {
@@ -211,6 +240,10 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 	a.WSFCAddresses = temp.WSFCAddresses
 	a.WSFCAgentPort = temp.WSFCAgentPort
 	a.WindowsKeys = temp.WindowsKeys
+	a.GuestAgentConfig = temp.GuestAgentConfig
+	a.LogLevels = temp.LogLevels
+	a.UserRoles = temp.UserRoles
+	a.UserIDs = temp.UserIDs
 
 	value, err := strconv.ParseBool(temp.BlockProjectKeys)
 	if err == nil {
@@ -298,7 +331,10 @@ func (c *Client) retry(ctx context.Context, cfg requestConfig) (string, error) {
 
 		// Apply the backoff strategy.
 		if err != nil {
-			logger.Debugf("Attempt %d: failed to connect to metadata server: %+v", i, err)
+			if cfg.hang {
+				longpollReconnects.Inc()
+			}
+			metadataLog.Debugf("Attempt %d: failed to connect to metadata server: %+v", i, err)
 			time.Sleep(time.Duration(i) * backoffDuration)
 			continue
 		}
@@ -307,14 +343,14 @@ func (c *Client) retry(ctx context.Context, cfg requestConfig) (string, error) {
 		md, err := io.ReadAll(resp.Body)
 		if err != nil {
 			ferr = err
-			logger.Debugf("Attempt %d: failed to read metadata server response bytes: %+v", i, err)
+			metadataLog.Debugf("Attempt %d: failed to read metadata server response bytes: %+v", i, err)
 			time.Sleep(time.Duration(i) * backoffDuration)
 			continue
 		}
 
 		return string(md), nil
 	}
-	logger.Errorf("Exhausted %d retry attempts to connect to MDS, failed with an error: %+v", backoffAttempts, ferr)
+	metadataLog.Errorf("Exhausted %d retry attempts to connect to MDS, failed with an error: %+v", backoffAttempts, ferr)
 	return "", fmt.Errorf("reached max attempts to connect to metadata")
 }
 
@@ -384,14 +420,14 @@ func (c *Client) get(ctx context.Context, hang bool) (*Descriptor, error) {
 
 // WriteGuestAttributes does a put call to mds changing a guest attribute value.
 func (c *Client) WriteGuestAttributes(ctx context.Context, key, value string) error {
-	logger.Debugf("write guest attribute %q", key)
+	metadataLog.Debugf("write guest attribute %q", key)
 
 	finalURL, err := url.JoinPath(c.metadataURL, "instance/guest-attributes/", key)
 	if err != nil {
 		return fmt.Errorf("failed to form metadata url: %+v", err)
 	}
 
-	logger.Debugf("Requesting(PUT) MDS URL: %s", finalURL)
+	metadataLog.Debugf("Requesting(PUT) MDS URL: %s", finalURL)
 
 	req, err := http.NewRequest("PUT", finalURL, strings.NewReader(value))
 	if err != nil {
@@ -401,7 +437,9 @@ func (c *Client) WriteGuestAttributes(ctx context.Context, key, value string) er
 	req.Header.Add("Metadata-Flavor", "Google")
 	req = req.WithContext(ctx)
 
-	_, err = c.httpClient.Do(req)
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	observeRequest("guest_attributes", start, resp, err)
 	return err
 }
 
@@ -431,7 +469,7 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 	}
 
 	finalURL.RawQuery = values.Encode()
-	logger.Debugf("Requesting(GET) MDS URL: %s", finalURL.String())
+	metadataLog.Debugf("Requesting(GET) MDS URL: %s", finalURL.String())
 
 	req, err := http.NewRequestWithContext(ctx, "GET", finalURL.String(), nil)
 	if err != nil {
@@ -442,7 +480,14 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 	for k, v := range cfg.headers {
 		req.Header.Add(k, v)
 	}
+
+	kind := "get"
+	if cfg.hang {
+		kind = "longpoll"
+	}
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	observeRequest(kind, start, resp, err)
 
 	// If we are canceling httpClient will also wrap the context's error so
 	// check first the context.
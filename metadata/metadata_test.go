@@ -214,3 +214,42 @@ func TestShouldRetry(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestMetrics(t *testing.T) {
+	var req int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req++
+		if req == 1 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	testsrv := httptest.NewServer(handler)
+	defer testsrv.Close()
+
+	client := New()
+	client.metadataURL = testsrv.URL
+
+	okBefore := requestsTotal.Value("longpoll", "200")
+	failedBefore := requestsTotal.Value("longpoll", "412")
+	reconnectsBefore := longpollReconnects.Value()
+	countBefore := requestDuration.Count("longpoll")
+
+	if _, err := client.Watch(context.Background()); err != nil {
+		t.Fatalf("Watch() failed: %+v", err)
+	}
+
+	if got := requestsTotal.Value("longpoll", "412") - failedBefore; got != 1 {
+		t.Errorf("requestsTotal(longpoll, 412) increased by %v, want: 1", got)
+	}
+	if got := longpollReconnects.Value() - reconnectsBefore; got != 1 {
+		t.Errorf("longpollReconnects increased by %v, want: 1", got)
+	}
+	if got := requestsTotal.Value("longpoll", "200") - okBefore; got != 1 {
+		t.Errorf("requestsTotal(longpoll, 200) increased by %v, want: 1", got)
+	}
+	if got := requestDuration.Count("longpoll") - countBefore; got != 2 {
+		t.Errorf("requestDuration(longpoll) count increased by %d, want: 2", got)
+	}
+}
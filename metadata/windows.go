@@ -18,8 +18,8 @@ import (
 	"encoding/json"
 	"strings"
 
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
-	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 // WindowsKey describes the WindowsKey metadata keys.
@@ -47,7 +47,7 @@ func (k *WindowsKeys) UnmarshalJSON(b []byte) error {
 	for _, jskey := range strings.Split(s, "\n") {
 		var wk WindowsKey
 		if err := json.Unmarshal([]byte(jskey), &wk); err != nil {
-			logger.Errorf("failed to unmarshal windows key from metadata: %s", err)
+			logfields.Errorf("failed to unmarshal windows key from metadata: %s", err)
 			continue
 		}
 
@@ -0,0 +1,359 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics implements a minimal registry of counters and histograms
+// exposed in the Prometheus text exposition format. Metrics are always
+// collected in memory, exposing them is up to the caller (see Handler).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultBuckets are the histogram buckets, in seconds, suited to short
+	// operations such as metadata requests.
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+	// LongBuckets are the histogram buckets, in seconds, suited to long running
+	// operations such as manager runs or snapshot hooks.
+	LongBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+	// defaultRegistry is the registry metrics created by NewCounter and
+	// NewHistogram are registered with.
+	defaultRegistry = NewRegistry()
+)
+
+// metric is implemented by the metric types known to the registry.
+type metric interface {
+	// desc returns the metric's description.
+	desc() *desc
+	// write writes the metric's samples in the text format.
+	write(w *bufio.Writer)
+}
+
+// desc describes a metric.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key returns the key of a series given its label values, it panics if the
+// number of values doesn't match the metric's labels as it's a programming error.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the label values, along with the extra pairs, as name="value"
+// pairs in braces. It returns an empty string if there are no labels.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range d.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// header writes the HELP and TYPE lines of the metric.
+func (d *desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes a label value.
+func escape(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// formatFloat formats v as expected by the text format.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds m to the registry, it panics if the name was already registered
+// as it's a programming error.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := m.desc().name
+	if _, found := r.metrics[name]; found {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// WriteText writes all the registered metrics, sorted by name, in the Prometheus
+// text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	var names []string
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var metrics []metric
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, curr := range metrics {
+		curr.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler returns an HTTP handler serving the registry's metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// WriteText writes the default registry's metrics, see Registry.WriteText.
+func WriteText(w io.Writer) error {
+	return defaultRegistry.WriteText(w)
+}
+
+// Handler returns an HTTP handler serving the default registry's metrics.
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+// Counter is a monotonically increasing value, partitioned by label values.
+type Counter struct {
+	d      *desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter creates a counter and registers it with the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := newCounter(name, help, labels)
+	defaultRegistry.register(c)
+	return c
+}
+
+// NewCounter creates a counter and registers it with r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := newCounter(name, help, labels)
+	r.register(c)
+	return c
+}
+
+func newCounter(name, help string, labels []string) *Counter {
+	return &Counter{
+		d:      &desc{name: name, help: help, labels: labels},
+		series: make(map[string]*counterSeries),
+	}
+}
+
+// Inc increments the counter of the series identified by labels.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v, which must not be negative, to the counter of the series identified
+// by labels.
+func (c *Counter) Add(v float64, labels ...string) {
+	key := c.d.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, found := c.series[key]
+	if !found {
+		series = &counterSeries{labels: append([]string{}, labels...)}
+		c.series[key] = series
+	}
+	series.value += v
+}
+
+// Value returns the counter of the series identified by labels.
+func (c *Counter) Value(labels ...string) float64 {
+	key := c.d.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if series, found := c.series[key]; found {
+		return series.value
+	}
+	return 0
+}
+
+func (c *Counter) desc() *desc {
+	return c.d
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.d.header(w, "counter")
+	for _, key := range sortedKeys(c.series) {
+		series := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.d.name, c.d.labelPairs(series.labels), formatFloat(series.value))
+	}
+}
+
+// Histogram samples observations in buckets, partitioned by label values.
+type Histogram struct {
+	d       *desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with buckets, sorted upper bounds, and
+// registers it with the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := newHistogram(name, help, buckets, labels)
+	defaultRegistry.register(h)
+	return h
+}
+
+// NewHistogram creates a histogram with buckets, sorted upper bounds, and
+// registers it with r.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := newHistogram(name, help, buckets, labels)
+	r.register(h)
+	return h
+}
+
+func newHistogram(name, help string, buckets []float64, labels []string) *Histogram {
+	return &Histogram{
+		d:       &desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// Observe adds v to the histogram of the series identified by labels.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.d.key(labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, found := h.series[key]
+	if !found {
+		series = &histogramSeries{
+			labels: append([]string{}, labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += v
+	series.count++
+}
+
+// Count returns the number of observations of the series identified by labels.
+func (h *Histogram) Count(labels ...string) uint64 {
+	key := h.d.key(labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if series, found := h.series[key]; found {
+		return series.count
+	}
+	return 0
+}
+
+func (h *Histogram) desc() *desc {
+	return h.d
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.d.header(w, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.d.name, h.d.labelPairs(series.labels, "le", formatFloat(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.d.name, h.d.labelPairs(series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.d.name, h.d.labelPairs(series.labels), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.d.name, h.d.labelPairs(series.labels), series.count)
+	}
+}
+
+// sortedKeys returns the keys of m in lexical order, so the output is stable.
+func sortedKeys[T any](m map[string]T) []string {
+	var res []string
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
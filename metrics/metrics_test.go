@@ -0,0 +1,106 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("test_requests_total", "Number of requests.", "code")
+	duration := r.NewHistogram("test_duration_seconds", "Duration of requests.", []float64{0.1, 1})
+	r.NewCounter("test_unused_total", "Never incremented.")
+
+	requests.Inc("200")
+	requests.Add(2, "200")
+	requests.Inc("a\"b\\c\nd")
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(5)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %+v", err)
+	}
+
+	want := `# HELP test_duration_seconds Duration of requests.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="a\"b\\c\nd"} 1
+# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteText() wrote:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got := requests.Value("200"); got != 3 {
+		t.Errorf("Value(200) = %v, want: 3", got)
+	}
+	if got := duration.Count(); got != 3 {
+		t.Errorf("Count() = %d, want: 3", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test counter.", "result").Inc("success")
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Handler() returned Content-Type %q, want text/plain; version=0.0.4", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `test_total{result="success"} 1`) {
+		t.Errorf("Handler() returned %q, want the test_total sample", body)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test counter.")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("NewCounter() didn't panic registering test_total twice")
+		}
+	}()
+	r.NewCounter("test_total", "Test counter.")
+}
+
+func TestLabelMismatch(t *testing.T) {
+	c := NewRegistry().NewCounter("test_total", "Test counter.", "a", "b")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Inc() didn't panic with a missing label value")
+		}
+	}()
+	c.Inc("a")
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy restricts the SSH keys accepted from metadata, the zero KeyPolicy
+// accepts any key.
+type KeyPolicy struct {
+	// AllowedTypes are the accepted key types, i.e. ssh-ed25519, any type is
+	// accepted if it's empty.
+	AllowedTypes []string
+	// MinRSABits is the minimum size of the RSA keys.
+	MinRSABits int
+	// RequireSecurityKey only accepts the sk-* keys, i.e. backed by a FIDO
+	// security key.
+	RequireSecurityKey bool
+	// ForbiddenOptions are the authorized keys options, i.e. command, the keys
+	// must not have.
+	ForbiddenOptions []string
+}
+
+// NewKeyPolicy returns the KeyPolicy for the comma separated lists of allowed
+// types and forbidden options.
+func NewKeyPolicy(allowedTypes string, minRSABits int, requireSecurityKey bool, forbiddenOptions string) KeyPolicy {
+	split := func(list string) []string {
+		var res []string
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+				res = append(res, item)
+			}
+		}
+		return res
+	}
+	return KeyPolicy{
+		AllowedTypes:       split(allowedTypes),
+		MinRSABits:         minRSABits,
+		RequireSecurityKey: requireSecurityKey,
+		ForbiddenOptions:   split(forbiddenOptions),
+	}
+}
+
+// Check returns why the authorized keys entry key is rejected by the policy, nil
+// if it's accepted.
+func (p KeyPolicy) Check(key string) error {
+	if len(p.AllowedTypes) == 0 && p.MinRSABits <= 0 && !p.RequireSecurityKey && len(p.ForbiddenOptions) == 0 {
+		return nil
+	}
+
+	pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(key)))
+	if err != nil {
+		return fmt.Errorf("invalid SSH key: %v", err)
+	}
+
+	keyType := pub.Type()
+	if p.RequireSecurityKey && !strings.HasPrefix(keyType, "sk-") {
+		return fmt.Errorf("%s key isn't a security key", keyType)
+	}
+	if len(p.AllowedTypes) > 0 && !ContainsString(keyType, p.AllowedTypes) {
+		return fmt.Errorf("%s keys aren't allowed", keyType)
+	}
+	if keyType == ssh.KeyAlgoRSA && p.MinRSABits > 0 {
+		if cryptoKey, ok := pub.(ssh.CryptoPublicKey); ok {
+			if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+				return fmt.Errorf("%d bits RSA key is smaller than %d bits", rsaKey.N.BitLen(), p.MinRSABits)
+			}
+		}
+	}
+	for _, option := range options {
+		name, _, _ := strings.Cut(option, "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); ContainsString(name, p.ForbiddenOptions) {
+			return fmt.Errorf("%s option isn't allowed", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewKeyPolicy(t *testing.T) {
+	got := NewKeyPolicy("ssh-ed25519, SK-SSH-ED25519@openssh.com,", 2048, true, "command ,")
+	want := KeyPolicy{
+		AllowedTypes:       []string{"ssh-ed25519", "sk-ssh-ed25519@openssh.com"},
+		MinRSABits:         2048,
+		RequireSecurityKey: true,
+		ForbiddenOptions:   []string{"command"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewKeyPolicy() = %+v, want: %+v", got, want)
+	}
+}
+
+func TestKeyPolicyCheck(t *testing.T) {
+	rsaKey := "ssh-rsa " + MakeRandRSAPubKey(t) + " user"
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() = %v, want: nil", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() = %v, want: nil", err)
+	}
+	ed25519Key := "ssh-ed25519 " + base64.StdEncoding.EncodeToString(sshPub.Marshal()) + " user"
+	skKey := "sk-ssh-ed25519@openssh.com " + base64.StdEncoding.EncodeToString(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, "ssh:"})) + " user"
+
+	tests := []struct {
+		desc    string
+		policy  KeyPolicy
+		key     string
+		wantErr bool
+	}{
+		{desc: "no policy", key: "not a key"},
+		{desc: "invalid key", policy: KeyPolicy{MinRSABits: 2048}, key: "not a key", wantErr: true},
+		{desc: "small RSA key", policy: KeyPolicy{MinRSABits: 2048}, key: rsaKey, wantErr: true},
+		{desc: "large enough RSA key", policy: KeyPolicy{MinRSABits: 256}, key: rsaKey},
+		{desc: "other type than RSA", policy: KeyPolicy{MinRSABits: 2048}, key: ed25519Key},
+		{desc: "allowed type", policy: KeyPolicy{AllowedTypes: []string{"ssh-ed25519"}}, key: ed25519Key},
+		{desc: "disallowed type", policy: KeyPolicy{AllowedTypes: []string{"ssh-ed25519"}}, key: rsaKey, wantErr: true},
+		{desc: "security key", policy: KeyPolicy{RequireSecurityKey: true}, key: skKey},
+		{desc: "not a security key", policy: KeyPolicy{RequireSecurityKey: true}, key: ed25519Key, wantErr: true},
+		{desc: "allowed option", policy: KeyPolicy{ForbiddenOptions: []string{"command"}}, key: `from="10.0.0.0/8" ` + ed25519Key},
+		{desc: "forbidden option", policy: KeyPolicy{ForbiddenOptions: []string{"command"}}, key: `no-pty,Command="/bin/true" ` + ed25519Key, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		if err := tc.policy.Check(tc.key); (err != nil) != tc.wantErr {
+			t.Errorf("KeyPolicy.Check(%s) = %v, want error: %t", tc.desc, err, tc.wantErr)
+		}
+	}
+}
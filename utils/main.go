@@ -22,8 +22,10 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,50 +51,79 @@ type sshExpiration struct {
 // CheckExpiredKey validates whether a key has expired.
 // Keys with invalid expiration formats will result in an error.
 func CheckExpiredKey(key string) error {
+	expireOn, expiring, err := KeyExpiration(key)
+	if err != nil {
+		return err
+	}
+	if expiring && expireOn.Before(time.Now()) {
+		return errors.New("invalid ssh key entry - expired key")
+	}
+	return nil
+}
+
+// KeyExpiration returns the expireOn time of a google-ssh key, and false for
+// non-expiring keys. Keys with invalid expiration formats will result in an
+// error.
+func KeyExpiration(key string) (time.Time, bool, error) {
 	trimmedKey := strings.Trim(key, " ")
 	if trimmedKey == "" {
-		return errors.New("invalid ssh key entry - empty key")
+		return time.Time{}, false, errors.New("invalid ssh key entry - empty key")
 	}
 	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(trimmedKey))
 	if err != nil {
-		return err
+		return time.Time{}, false, err
 	}
 	if !strings.HasPrefix(comment, "google-ssh") {
 		// Non-expiring key.
-		return nil
+		return time.Time{}, false, nil
 	}
 	fields := strings.SplitN(comment, " ", 2)
 	if len(fields) < 2 {
 		// expiring key without expiration format.
-		return errors.New("invalid ssh key entry - expiration missing")
+		return time.Time{}, false, errors.New("invalid ssh key entry - expiration missing")
 	}
 	lkey := &sshExpiration{}
 	if err := json.Unmarshal([]byte(fields[1]), lkey); err != nil {
 		// invalid expiration format.
-		return err
+		return time.Time{}, false, err
 	}
-	expired, err := CheckExpired(lkey.ExpireOn)
+	expireOn, err := parseExpireOn(lkey.ExpireOn)
 	if err != nil {
-		return err
+		return time.Time{}, false, err
 	}
-	if expired {
-		return errors.New("invalid ssh key entry - expired key")
+	return expireOn, true, nil
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of an authorized keys entry,
+// like ssh-keygen -l prints it.
+func KeyFingerprint(key string) (string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Trim(key, " ")))
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return ssh.FingerprintSHA256(pubKey), nil
 }
 
 // CheckExpired takes a time string and determines if it represents a time in the past.
 func CheckExpired(expireOn string) (bool, error) {
+	t, err := parseExpireOn(expireOn)
+	if err != nil {
+		return true, err
+	}
+	return t.Before(time.Now()), nil
+}
+
+// parseExpireOn parses the expireOn time of a google-ssh key.
+func parseExpireOn(expireOn string) (time.Time, error) {
 	t, err := time.Parse(time.RFC3339, expireOn)
 	if err != nil {
 		t2, err2 := time.Parse("2006-01-02T15:04:05-0700", expireOn)
 		if err2 != nil {
-			return true, err //Return RFC3339 error
+			return time.Time{}, err //Return RFC3339 error
 		}
 		t = t2
 	}
-	return t.Before(time.Now()), nil
-
+	return t, nil
 }
 
 // ValidateUser checks for the presence of a characters which should not be
@@ -147,6 +178,41 @@ func ValidateUserKey(user, key string) error {
 	return nil
 }
 
+// overflowUIDs are the UIDs of the system users unmapped IDs are mapped to, i.e.
+// nobody and nfsnobody, above any login.defs UID_MIN.
+var overflowUIDs = map[int]bool{65534: true, 4294967294: true}
+
+// ProtectedUser returns why the SSH keys of the user name must be refused, or
+// an empty string if they can be managed. A user is protected if it's listed in
+// protected or if it's an existing user whose UID is below minUID, i.e. a system
+// user, or one of the overflowUIDs. The UIDs are ignored if minUID is 0 and on
+// windows, where users have no UID.
+func ProtectedUser(name string, protected []string, minUID int) string {
+	for _, p := range protected {
+		if strings.TrimSpace(p) == name {
+			return "it is a protected user"
+		}
+	}
+	if minUID <= 0 {
+		return ""
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return ""
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return ""
+	}
+	if uid < minUID {
+		return fmt.Sprintf("its UID %d is below %d", uid, minUID)
+	}
+	if overflowUIDs[uid] {
+		return fmt.Sprintf("its UID %d is the overflow UID of unmapped users", uid)
+	}
+	return ""
+}
+
 // SerialPort is a type for writing to a named serial port.
 type SerialPort struct {
 	Port string
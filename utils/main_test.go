@@ -17,8 +17,12 @@ package utils
 import (
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestContainsString(t *testing.T) {
@@ -123,6 +127,42 @@ func TestCheckExpiredKey(t *testing.T) {
 	}
 }
 
+func TestKeyExpiration(t *testing.T) {
+	pubKey := MakeRandRSAPubKey(t)
+
+	table := []struct {
+		key      string
+		expireOn time.Time
+		expiring bool
+		haserr   bool
+	}{
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56+0000"}`, pubKey), time.Date(2095, 4, 23, 12, 34, 56, 0, time.UTC), true, false},
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"2021-04-23T12:34:56Z"}`, pubKey), time.Date(2021, 4, 23, 12, 34, 56, 0, time.UTC), true, false},
+		{fmt.Sprintf(`ssh-rsa %s google-ssh {"userName":"usera@example.com","expireOn":"Apri 4, 2056"}`, pubKey), time.Time{}, false, true},
+		{fmt.Sprintf("ssh-rsa %s usera", pubKey), time.Time{}, false, false},
+		{"    ", time.Time{}, false, true},
+	}
+
+	for _, tt := range table {
+		expireOn, expiring, err := KeyExpiration(tt.key)
+		if !expireOn.Equal(tt.expireOn) || expiring != tt.expiring || (err != nil) != tt.haserr {
+			t.Errorf("KeyExpiration(%s) = %s, %t, %v, want: %s, %t, error: %t", tt.key, expireOn, expiring, err, tt.expireOn, tt.expiring, tt.haserr)
+		}
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	pubKey := MakeRandRSAPubKey(t)
+
+	fingerprint, err := KeyFingerprint(fmt.Sprintf("ssh-rsa %s usera", pubKey))
+	if err != nil || !strings.HasPrefix(fingerprint, "SHA256:") {
+		t.Errorf("KeyFingerprint() = %q, %v, want: SHA256:..., nil", fingerprint, err)
+	}
+	if _, err := KeyFingerprint("ssh-rsa invalid"); err == nil {
+		t.Errorf("KeyFingerprint(invalid) = nil error, want: error")
+	}
+}
+
 func TestValidateUser(t *testing.T) {
 	table := []struct {
 		user  string
@@ -145,6 +185,35 @@ func TestValidateUser(t *testing.T) {
 	}
 }
 
+func TestProtectedUser(t *testing.T) {
+	table := []struct {
+		user      string
+		protected []string
+		minUID    int
+		want      bool
+	}{
+		{"alice", []string{"root", " alice"}, 0, true},
+		{"alice", []string{"root"}, 1000, false},
+		{"root", nil, 0, false},
+		{"guest-agent-no-such-user", nil, 1000, false},
+		// Windows users have no UID.
+		{"root", nil, 1000, runtime.GOOS != "windows"},
+	}
+
+	for _, tt := range table {
+		if got := ProtectedUser(tt.user, tt.protected, tt.minUID); (got != "") != tt.want {
+			t.Errorf("ProtectedUser(%s, %v, %d) = %q, want protected: %t", tt.user, tt.protected, tt.minUID, got, tt.want)
+		}
+	}
+
+	// nobody's UID is above any UID_MIN, it's protected anyway.
+	if u, err := user.Lookup("nobody"); err == nil && u.Uid == "65534" {
+		if got := ProtectedUser("nobody", nil, 1000); got == "" {
+			t.Errorf("ProtectedUser(nobody, nil, 1000) = %q, want protected", got)
+		}
+	}
+}
+
 func TestSaferWriteFile(t *testing.T) {
 	f := filepath.Join(t.TempDir(), "file")
 	want := "test-data"
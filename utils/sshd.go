@@ -0,0 +1,226 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/logfields"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ExpiryTimeAuto adds expiry-time options if the installed sshd supports them.
+	ExpiryTimeAuto = "auto"
+	// ExpiryTimeAlways always adds expiry-time options.
+	ExpiryTimeAlways = "true"
+	// ExpiryTimeNever never adds expiry-time options.
+	ExpiryTimeNever = "false"
+)
+
+var (
+	openSSHVersionRegexp = regexp.MustCompile(`OpenSSH_(?:for_Windows_)?(\d+)\.(\d+)`)
+
+	// sshdDirs are searched for sshd, in order, instead of the PATH the agent
+	// inherited.
+	sshdDirs = map[string][]string{
+		"windows": {`C:\Windows\System32\OpenSSH`, `C:\Program Files\OpenSSH`},
+		"linux":   {"/usr/sbin", "/usr/local/sbin", "/sbin", "/usr/bin", "/usr/local/bin", "/bin"},
+	}
+
+	// sshdVersionCacheFile caches the detected sshd version across processes,
+	// google_authorized_keys runs for every SSH login.
+	sshdVersionCacheFile = defaultSSHDVersionCacheFile()
+
+	// sshdVersion caches the detected sshd version, it's only detected once per
+	// process.
+	sshdVersion struct {
+		sync.Mutex
+		detected     bool
+		major, minor int
+		err          error
+	}
+)
+
+// sshdVersionCache is the content of the sshdVersionCacheFile, the version of
+// the sshd binary at Path last modified at ModTime.
+type sshdVersionCache struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	Major   int       `json:"major"`
+	Minor   int       `json:"minor"`
+}
+
+// defaultSSHDVersionCacheFile returns the sshdVersionCacheFile of the current
+// OS.
+func defaultSSHDVersionCacheFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "sshd_version")
+	}
+	return "/var/lib/google/sshd_version"
+}
+
+// sshdPath returns the absolute path of the installed sshd, looked up in
+// sshdDirs.
+func sshdPath() (string, error) {
+	dirs, found := sshdDirs[runtime.GOOS]
+	if !found {
+		dirs = sshdDirs["linux"]
+	}
+	name := "sshd"
+	if runtime.GOOS == "windows" {
+		name = "sshd.exe"
+	}
+	for _, dir := range dirs {
+		if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", name, strings.Join(dirs, string(filepath.ListSeparator)))
+}
+
+// parseOpenSSHVersion returns the major and minor version of the OpenSSH
+// version string in output, i.e. OpenSSH_8.9p1.
+func parseOpenSSHVersion(output string) (int, int, error) {
+	match := openSSHVersionRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return 0, 0, fmt.Errorf("no OpenSSH version in %q", output)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return major, minor, nil
+}
+
+// SSHDVersion returns the major and minor version of the installed OpenSSH
+// sshd. It's detected on the first call and cached, in the process and on disk
+// until sshd changes.
+func SSHDVersion(ctx context.Context) (int, int, error) {
+	sshdVersion.Lock()
+	defer sshdVersion.Unlock()
+
+	if !sshdVersion.detected {
+		sshdVersion.major, sshdVersion.minor, sshdVersion.err = detectSSHDVersion(ctx)
+		// A canceled context doesn't tell anything about sshd, it's detected
+		// again on the next call.
+		sshdVersion.detected = ctx.Err() == nil
+		if sshdVersion.err != nil {
+			logfields.Warningf("Failed to detect the sshd version: %v", sshdVersion.err)
+		}
+	}
+	return sshdVersion.major, sshdVersion.minor, sshdVersion.err
+}
+
+// detectSSHDVersion returns the version of sshd recorded in the
+// sshdVersionCacheFile if sshd hasn't changed since, otherwise it runs sshd to
+// get it and records it.
+func detectSSHDVersion(ctx context.Context) (int, int, error) {
+	path, err := sshdPath()
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	current := sshdVersionCache{Path: path, ModTime: info.ModTime().UTC(), Size: info.Size()}
+
+	var cached sshdVersionCache
+	if data, err := os.ReadFile(sshdVersionCacheFile); err == nil && json.Unmarshal(data, &cached) == nil {
+		if cached.Path == current.Path && cached.ModTime.Equal(current.ModTime) && cached.Size == current.Size {
+			return cached.Major, cached.Minor, nil
+		}
+	}
+
+	// Recent sshd print their version with -V, older ones print it along with
+	// their usage on the unknown option, the exit code doesn't matter.
+	out, err := exec.CommandContext(ctx, path, "-V").CombinedOutput()
+	major, minor, parseErr := parseOpenSSHVersion(string(out))
+	if parseErr != nil && err != nil {
+		return 0, 0, fmt.Errorf("failed to run %s: %w", path, err)
+	}
+	if parseErr != nil {
+		return 0, 0, parseErr
+	}
+
+	// The cache is an optimization, i.e. the process may not be allowed to
+	// write it.
+	current.Major, current.Minor = major, minor
+	if data, err := json.Marshal(current); err == nil {
+		if err := os.MkdirAll(filepath.Dir(sshdVersionCacheFile), 0755); err == nil {
+			err = SaferWriteFile(data, sshdVersionCacheFile, 0644)
+		}
+		if err != nil {
+			logfields.Debugf("Failed to cache the sshd version to %s: %v", sshdVersionCacheFile, err)
+		}
+	}
+	return major, minor, nil
+}
+
+// ExpiryTimeEnabled returns true if setting, one of ExpiryTimeAuto,
+// ExpiryTimeAlways and ExpiryTimeNever, enables expiry-time options. sshd
+// supports them since OpenSSH 8.2.
+func ExpiryTimeEnabled(ctx context.Context, setting string) bool {
+	switch setting {
+	case ExpiryTimeAlways:
+		return true
+	case ExpiryTimeNever:
+		return false
+	}
+	major, minor, err := SSHDVersion(ctx)
+	if err != nil {
+		return false
+	}
+	return major > 8 || (major == 8 && minor >= 2)
+}
+
+// AddExpiryTimeOption returns the authorized keys entry key with an OpenSSH
+// expiry-time option matching its google-ssh expireOn time, so that sshd itself
+// enforces the expiration. Keys which don't expire or already have an
+// expiry-time option are returned unchanged. The time is in loc, the time zone
+// sshd interprets it in, and rounded down to the minute.
+func AddExpiryTimeOption(key string, loc *time.Location) string {
+	expireOn, expiring, err := KeyExpiration(key)
+	if err != nil || !expiring {
+		return key
+	}
+	_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(strings.Trim(key, " ")))
+	if err != nil {
+		return key
+	}
+	for _, option := range options {
+		if strings.HasPrefix(strings.ToLower(option), "expiry-time=") {
+			return key
+		}
+	}
+
+	option := fmt.Sprintf(`expiry-time="%s"`, expireOn.In(loc).Format("200601021504"))
+	if len(options) > 0 {
+		// The key's options are comma separated.
+		return option + "," + key
+	}
+	return option + " " + key
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseOpenSSHVersion(t *testing.T) {
+	table := []struct {
+		output       string
+		major, minor int
+		haserr       bool
+	}{
+		{"OpenSSH_9.6p1, OpenSSL 3.0.13 30 Jan 2024", 9, 6, false},
+		{"unknown option -- V\nOpenSSH_7.4p1, OpenSSL 1.0.2k-fips  26 Jan 2017\nusage: sshd [-46DdeiqTt]", 7, 4, false},
+		{"OpenSSH_for_Windows_8.1p1, LibreSSL 3.0.2", 8, 1, false},
+		{"sshd: command not found", 0, 0, true},
+	}
+
+	for _, tt := range table {
+		major, minor, err := parseOpenSSHVersion(tt.output)
+		if major != tt.major || minor != tt.minor || (err != nil) != tt.haserr {
+			t.Errorf("parseOpenSSHVersion(%q) = %d, %d, %v, want: %d, %d, error: %t", tt.output, major, minor, err, tt.major, tt.minor, tt.haserr)
+		}
+	}
+}
+
+func TestSSHDVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sshd is a shell script")
+	}
+	dirs := []string{filepath.Join(t.TempDir(), "sbin"), filepath.Join(t.TempDir(), "bin")}
+	for i, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("os.MkdirAll(%s) failed: %v", dir, err)
+		}
+		script := fmt.Sprintf("#!/bin/sh\necho OpenSSH_9.%dp1 >&2\n", i)
+		if err := os.WriteFile(filepath.Join(dir, "sshd"), []byte(script), 0755); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed: %v", dir, err)
+		}
+	}
+	// Not executable, it's skipped.
+	notExec := t.TempDir()
+	if err := os.WriteFile(filepath.Join(notExec, "sshd"), []byte("#!/bin/sh\necho OpenSSH_1.0\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", notExec, err)
+	}
+
+	oldDirs, oldCacheFile := sshdDirs, sshdVersionCacheFile
+	t.Cleanup(func() {
+		sshdDirs, sshdVersionCacheFile = oldDirs, oldCacheFile
+		sshdVersion.detected = false
+	})
+	sshdDirs = map[string][]string{runtime.GOOS: append([]string{notExec}, dirs...)}
+	sshdVersionCacheFile = filepath.Join(t.TempDir(), "sshd_version")
+	sshdVersion.detected = false
+
+	major, minor, err := SSHDVersion(context.Background())
+	if major != 9 || minor != 0 || err != nil {
+		t.Errorf("SSHDVersion() = %d, %d, %v, want: 9, 0, nil", major, minor, err)
+	}
+
+	// The version is cached, the removed sshd isn't run again.
+	if err := os.Remove(filepath.Join(dirs[0], "sshd")); err != nil {
+		t.Fatalf("os.Remove() failed: %v", err)
+	}
+	if major, minor, err := SSHDVersion(context.Background()); major != 9 || minor != 0 || err != nil {
+		t.Errorf("SSHDVersion() = %d, %d, %v, want the cached 9, 0, nil", major, minor, err)
+	}
+
+	sshdVersion.detected = false
+	if major, minor, err := SSHDVersion(context.Background()); major != 9 || minor != 1 || err != nil {
+		t.Errorf("SSHDVersion() = %d, %d, %v, want: 9, 1, nil", major, minor, err)
+	}
+
+	sshdDirs = map[string][]string{runtime.GOOS: {notExec}}
+	sshdVersion.detected = false
+	if _, _, err := SSHDVersion(context.Background()); err == nil {
+		t.Errorf("SSHDVersion() succeeded without an executable sshd, want error")
+	}
+}
+
+func TestSSHDVersionCacheFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sshd is a shell script")
+	}
+	dir := t.TempDir()
+	sshd := filepath.Join(dir, "sshd")
+	writeSSHD := func(version string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(sshd, []byte("#!/bin/sh\necho OpenSSH_"+version+" >&2\n"), 0755); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed: %v", sshd, err)
+		}
+		if err := os.Chtimes(sshd, mtime, mtime); err != nil {
+			t.Fatalf("os.Chtimes(%s) failed: %v", sshd, err)
+		}
+	}
+
+	oldDirs, oldCacheFile := sshdDirs, sshdVersionCacheFile
+	t.Cleanup(func() {
+		sshdDirs, sshdVersionCacheFile = oldDirs, oldCacheFile
+		sshdVersion.detected = false
+	})
+	sshdDirs = map[string][]string{runtime.GOOS: {dir}}
+	sshdVersionCacheFile = filepath.Join(t.TempDir(), "google", "sshd_version")
+
+	// Each call stands for a new process, i.e. google_authorized_keys.
+	version := func() string {
+		t.Helper()
+		sshdVersion.detected = false
+		major, minor, err := SSHDVersion(context.Background())
+		if err != nil {
+			t.Fatalf("SSHDVersion() failed: %v", err)
+		}
+		return fmt.Sprintf("%d.%d", major, minor)
+	}
+
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeSSHD("8.9", mtime)
+	if got := version(); got != "8.9" {
+		t.Errorf("SSHDVersion() = %s, want: 8.9", got)
+	}
+	if _, err := os.Stat(sshdVersionCacheFile); err != nil {
+		t.Errorf("os.Stat(%s) = %v, want the version cached", sshdVersionCacheFile, err)
+	}
+
+	// Unchanged, sshd isn't run again: the cache answers 8.9.
+	writeSSHD("9.9", mtime)
+	if got := version(); got != "8.9" {
+		t.Errorf("SSHDVersion() = %s with sshd unchanged, want the cached 8.9", got)
+	}
+
+	// An upgraded sshd is detected again.
+	writeSSHD("9.6", mtime.Add(time.Hour))
+	if got := version(); got != "9.6" {
+		t.Errorf("SSHDVersion() = %s with sshd upgraded, want: 9.6", got)
+	}
+}
+
+func TestExpiryTimeEnabled(t *testing.T) {
+	if !ExpiryTimeEnabled(context.Background(), ExpiryTimeAlways) {
+		t.Errorf("ExpiryTimeEnabled(%s) = false, want: true", ExpiryTimeAlways)
+	}
+	if ExpiryTimeEnabled(context.Background(), ExpiryTimeNever) {
+		t.Errorf("ExpiryTimeEnabled(%s) = true, want: false", ExpiryTimeNever)
+	}
+}
+
+func TestAddExpiryTimeOption(t *testing.T) {
+	pubKey := MakeRandRSAPubKey(t)
+	comment := `google-ssh {"userName":"usera@example.com","expireOn":"2095-04-23T12:34:56+0000"}`
+	loc := time.FixedZone("UTC+2", 2*60*60)
+
+	table := []struct {
+		key, want string
+	}{
+		{
+			fmt.Sprintf("ssh-rsa %s %s", pubKey, comment),
+			fmt.Sprintf(`expiry-time="209504231434" ssh-rsa %s %s`, pubKey, comment),
+		},
+		{
+			fmt.Sprintf(`from="10.0.0.0/8" ssh-rsa %s %s`, pubKey, comment),
+			fmt.Sprintf(`expiry-time="209504231434",from="10.0.0.0/8" ssh-rsa %s %s`, pubKey, comment),
+		},
+		{
+			fmt.Sprintf(`expiry-time="20950101" ssh-rsa %s %s`, pubKey, comment),
+			fmt.Sprintf(`expiry-time="20950101" ssh-rsa %s %s`, pubKey, comment),
+		},
+		{
+			fmt.Sprintf("ssh-rsa %s usera", pubKey),
+			fmt.Sprintf("ssh-rsa %s usera", pubKey),
+		},
+	}
+
+	for _, tt := range table {
+		if got := AddExpiryTimeOption(tt.key, loc); got != tt.want {
+			t.Errorf("AddExpiryTimeOption(%q) = %q, want: %q", tt.key, got, tt.want)
+		}
+	}
+}